@@ -0,0 +1,309 @@
+package awsclient
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/NixM0nk3y/dynamodb-clone/faults"
+	"github.com/NixM0nk3y/dynamodb-clone/log"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/aws/aws-sdk-go/service/cloudwatch/cloudwatchiface"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/aws/aws-sdk-go/service/dynamodbstreams"
+	"github.com/aws/aws-sdk-go/service/dynamodbstreams/dynamodbstreamsiface"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+	"github.com/aws/aws-sdk-go/service/secretsmanager/secretsmanageriface"
+	"github.com/aws/aws-sdk-go/service/sts"
+	"github.com/aws/aws-sdk-go/service/sts/stsiface"
+	"github.com/aws/aws-xray-sdk-go/xray"
+	"go.uber.org/zap"
+)
+
+// DefaultMaxRetries made by the SDK's retryer when none is configured
+const DefaultMaxRetries = 5
+
+// Config for the clients of a region and, optionally, an assumed role. An
+// empty endpoint leaves the service on its regional AWS endpoint.
+type Config struct {
+	Region      string
+	RoleArn     string
+	SessionName string // shows up in the role account's cloudtrail
+
+	DynamoDBEndpoint        string
+	DynamoDBStreamsEndpoint string
+	S3Endpoint              string
+	STSEndpoint             string
+	SecretsManagerEndpoint  string
+	CloudWatchEndpoint      string
+	S3ForcePathStyle        bool
+
+	MaxRetries int             // retries made by the SDK's default retryer
+	Retryer    request.Retryer // replaces the default retryer when set
+
+	HTTPTimeout         time.Duration // whole request timeout, none when zero
+	MaxIdleConnsPerHost int           // the transport's default when zero
+
+	XRay bool // trace the clients' calls
+
+	Faults faults.Config // injected into the DynamoDB and S3 clients
+}
+
+// FromEnv builds the configuration of a region from the environment:
+//
+//	AWS_ENDPOINT                   endpoint of every service (localstack)
+//	AWS_<SERVICE>_ENDPOINT         endpoint of a single service, DYNAMODB,
+//	                               DYNAMODBSTREAMS, S3, STS, SECRETSMANAGER or
+//	                               CLOUDWATCH
+//	AWS_S3_FORCEPATHSTYLE          path style S3 addressing when set
+//	AWS_MAX_RETRIES                retries made by the SDK (default 5)
+//	AWS_HTTP_TIMEOUT               request timeout, a Go duration
+//	AWS_MAX_IDLE_CONNS_PER_HOST    idle connections kept to each host
+//	AWS_XRAY_SDK_DISABLED          don't trace the clients when true
+//	FAULT_*                        faults injected, see faults.FromEnv
+func FromEnv(region string) Config {
+
+	config := Config{
+		Region:     region,
+		MaxRetries: DefaultMaxRetries,
+		XRay:       true,
+	}
+
+	endpoint := os.Getenv("AWS_ENDPOINT")
+
+	for _, service := range []struct {
+		name     string
+		endpoint *string
+	}{
+		{"DYNAMODB", &config.DynamoDBEndpoint},
+		{"DYNAMODBSTREAMS", &config.DynamoDBStreamsEndpoint},
+		{"S3", &config.S3Endpoint},
+		{"STS", &config.STSEndpoint},
+		{"SECRETSMANAGER", &config.SecretsManagerEndpoint},
+		{"CLOUDWATCH", &config.CloudWatchEndpoint},
+	} {
+		*service.endpoint = endpoint
+
+		if override := os.Getenv("AWS_" + service.name + "_ENDPOINT"); override != "" {
+			*service.endpoint = override
+		}
+	}
+
+	config.S3ForcePathStyle = os.Getenv("AWS_S3_FORCEPATHSTYLE") != ""
+
+	if retries, err := strconv.Atoi(os.Getenv("AWS_MAX_RETRIES")); err == nil {
+		config.MaxRetries = retries
+	}
+
+	if timeout, err := time.ParseDuration(os.Getenv("AWS_HTTP_TIMEOUT")); err == nil {
+		config.HTTPTimeout = timeout
+	}
+
+	if conns, err := strconv.Atoi(os.Getenv("AWS_MAX_IDLE_CONNS_PER_HOST")); err == nil {
+		config.MaxIdleConnsPerHost = conns
+	}
+
+	if disabled, err := strconv.ParseBool(os.Getenv("AWS_XRAY_SDK_DISABLED")); err == nil && disabled {
+		config.XRay = false
+	}
+
+	config.Faults = faults.FromEnv()
+
+	return config
+}
+
+// Factory builds the clients of a single configuration from a shared session
+type Factory struct {
+	config Config
+	sess   *session.Session
+	faults *faults.Injector
+}
+
+// New returns a factory for the configuration, assuming its role if it has one
+func New(ctx context.Context, config Config) (factory *Factory, err error) {
+
+	logger := log.Logger(ctx)
+
+	awsConfig := &aws.Config{
+		Region:   aws.String(config.Region),
+		Logger:   &log.AWSLogger{},
+		LogLevel: log.AWSLevel(),
+	}
+
+	awsConfig.MaxRetries = aws.Int(config.MaxRetries)
+
+	if config.Retryer != nil {
+		awsConfig = request.WithRetryer(awsConfig, config.Retryer)
+	}
+
+	if config.HTTPTimeout > 0 || config.MaxIdleConnsPerHost > 0 {
+		awsConfig.HTTPClient = httpClient(config)
+	}
+
+	for service, endpoint := range map[string]string{"dynamodb": config.DynamoDBEndpoint, "s3": config.S3Endpoint} {
+		if endpoint != "" {
+			logger.Info(fmt.Sprintf("setting %s endpoint to %s", service, endpoint))
+		}
+	}
+
+	if config.S3ForcePathStyle {
+		logger.Info("setting S3 to pathstyle")
+	}
+
+	sess, err := session.NewSession(awsConfig)
+
+	if err != nil {
+		logger.Error("unable generate new session", zap.Error(err))
+		return nil, err
+	}
+
+	if config.RoleArn != "" {
+
+		logger.Info(fmt.Sprintf("assuming role %s in %s", config.RoleArn, config.Region))
+
+		sessionName := config.SessionName
+
+		if len(sessionName) > 64 {
+			sessionName = sessionName[:64]
+		}
+
+		credentials := stscreds.NewCredentials(sess, config.RoleArn, func(p *stscreds.AssumeRoleProvider) {
+			p.RoleSessionName = sessionName
+			p.Client = sts.New(sess, endpointConfig(config.STSEndpoint))
+		})
+
+		sess, err = session.NewSession(awsConfig.Copy().WithCredentials(credentials))
+
+		if err != nil {
+			logger.Error("unable generate assumed role session", zap.Error(err))
+			return nil, err
+		}
+	}
+
+	if config.Faults.Enabled() {
+		logger.Warn("injecting faults into the dynamodb and s3 clients", zap.Any("faults", config.Faults))
+	}
+
+	return &Factory{config: config, sess: sess, faults: faults.New(config.Faults)}, nil
+}
+
+// httpClient tunes the SDK's HTTP client, keeping the default transport's settings
+func httpClient(config Config) *http.Client {
+
+	transport := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		MaxIdleConns:          100,
+		MaxIdleConnsPerHost:   config.MaxIdleConnsPerHost,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+
+	if transport.MaxIdleConnsPerHost > transport.MaxIdleConns {
+		transport.MaxIdleConns = transport.MaxIdleConnsPerHost
+	}
+
+	return &http.Client{
+		Timeout:   config.HTTPTimeout,
+		Transport: transport,
+	}
+}
+
+func endpointConfig(endpoint string) *aws.Config {
+
+	config := &aws.Config{}
+
+	if endpoint != "" {
+		config.Endpoint = aws.String(endpoint)
+	}
+
+	return config
+}
+
+// trace wraps a client in X-Ray when the configuration asks for it
+func (f *Factory) trace(c *client.Client) {
+	if f.config.XRay {
+		xray.AWS(c)
+	}
+}
+
+// Session returns the factory's session, for clients it doesn't build
+func (f *Factory) Session() *session.Session {
+	return f.sess
+}
+
+// DynamoDB returns a DynamoDB client
+func (f *Factory) DynamoDB() dynamodbiface.DynamoDBAPI {
+
+	svc := dynamodb.New(f.sess, endpointConfig(f.config.DynamoDBEndpoint))
+	f.trace(svc.Client)
+
+	return f.faults.DynamoDB(svc)
+}
+
+// DynamoDBStreams returns a DynamoDB Streams client
+func (f *Factory) DynamoDBStreams() dynamodbstreamsiface.DynamoDBStreamsAPI {
+
+	svc := dynamodbstreams.New(f.sess, endpointConfig(f.config.DynamoDBStreamsEndpoint))
+	f.trace(svc.Client)
+
+	return svc
+}
+
+// S3 returns an S3 client
+func (f *Factory) S3() s3iface.S3API {
+
+	config := endpointConfig(f.config.S3Endpoint)
+
+	if f.config.S3ForcePathStyle {
+		config.S3ForcePathStyle = aws.Bool(true)
+	}
+
+	svc := s3.New(f.sess, config)
+	f.trace(svc.Client)
+
+	return f.faults.S3(svc)
+}
+
+// STS returns an STS client
+func (f *Factory) STS() stsiface.STSAPI {
+
+	svc := sts.New(f.sess, endpointConfig(f.config.STSEndpoint))
+	f.trace(svc.Client)
+
+	return svc
+}
+
+// SecretsManager returns a Secrets Manager client
+func (f *Factory) SecretsManager() secretsmanageriface.SecretsManagerAPI {
+
+	svc := secretsmanager.New(f.sess, endpointConfig(f.config.SecretsManagerEndpoint))
+	f.trace(svc.Client)
+
+	return svc
+}
+
+// CloudWatch returns a CloudWatch client
+func (f *Factory) CloudWatch() cloudwatchiface.CloudWatchAPI {
+
+	svc := cloudwatch.New(f.sess, endpointConfig(f.config.CloudWatchEndpoint))
+	f.trace(svc.Client)
+
+	return svc
+}
@@ -0,0 +1,139 @@
+package clone
+
+import (
+	"context"
+	"time"
+
+	"github.com/NixM0nk3y/dynamodb-clone/clonerr"
+	"github.com/NixM0nk3y/dynamodb-clone/log"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/cenkalti/backoff"
+	"go.uber.org/zap"
+)
+
+// batchWriter puts items into the destination table
+type batchWriter struct {
+	ctx     context.Context
+	svc     dynamodbiface.DynamoDBAPI
+	table   string
+	limiter *capacityLimiter // nil leaves the writes unlimited
+}
+
+func newBatchWriter(ctx context.Context, svc dynamodbiface.DynamoDBAPI, table string, limiter *capacityLimiter) *batchWriter {
+	return &batchWriter{
+		ctx:     ctx,
+		svc:     svc,
+		table:   table,
+		limiter: limiter,
+	}
+}
+
+//
+// Write a batch of items, backing off while throttled and resubmitting any
+// unprocessed items until the whole batch is in. A batch cut short by the
+// timeout isn't counted, it is written again by the next invocation. With a
+// limiter each attempt waits for capacity and pays for what it consumed.
+//
+func (bw *batchWriter) write(records []map[string]*dynamodb.AttributeValue, timeoutChannel <-chan struct{}) (written int64, timedOut bool, err error) {
+
+	logger := log.Logger(bw.ctx)
+
+	expbo := backoff.NewExponentialBackOff()
+	expbo.MaxInterval = 1500 * time.Millisecond
+	boff := backoff.WithContext(expbo, bw.ctx)
+
+	// build our write request
+	writeRequests := make([]*dynamodb.WriteRequest, len(records))
+	for i := 0; i < len(records); i++ {
+		writeRequests[i] = &dynamodb.WriteRequest{
+			PutRequest: &dynamodb.PutRequest{
+				Item: records[i],
+			},
+		}
+	}
+
+	var writeSize int64 = 0
+
+	// write retry loop
+	for {
+		select {
+
+		case <-timeoutChannel:
+
+			return 0, true, nil
+
+		default:
+
+			if timedOut, limitErr := bw.limiter.wait(timeoutChannel); timedOut || limitErr != nil {
+				return 0, timedOut, limitErr
+			}
+
+			writestart := time.Now()
+
+			input := &dynamodb.BatchWriteItemInput{
+				RequestItems: map[string][]*dynamodb.WriteRequest{
+					bw.table: writeRequests,
+				},
+			}
+
+			if bw.limiter != nil {
+				input.ReturnConsumedCapacity = aws.String(dynamodb.ReturnConsumedCapacityTotal)
+			}
+
+			result, writeErr := bw.svc.BatchWriteItemWithContext(bw.ctx, input)
+
+			if writeErr != nil {
+				if clonerr.IsThrottle(writeErr) {
+
+					logger.Warn("thoughput error backing off", zap.Int64("itemcount", writeSize), zap.Error(writeErr))
+
+					// need to sleep when re-requesting, per spec
+					wait := boff.NextBackOff()
+
+					if wait == backoff.Stop {
+						logger.Error("backoff exhausted", zap.Error(writeErr))
+						return 0, false, clonerr.FromDynamoDB(bw.table, writeErr)
+					}
+
+					if sleepErr := aws.SleepWithContext(bw.ctx, wait); sleepErr != nil {
+						logger.Error("timed out", zap.Error(sleepErr))
+						return 0, false, &clonerr.ThroughputExhausted{Table: bw.table, Err: sleepErr}
+					}
+
+					// nothing was written, retry the whole request
+					continue
+				}
+
+				logger.Error("unknown dynamodb error", zap.Error(writeErr))
+				return 0, false, clonerr.FromDynamoDB(bw.table, writeErr)
+			}
+
+			bw.limiter.consumed(result.ConsumedCapacity)
+
+			unprocessedWrites := result.UnprocessedItems[bw.table]
+
+			writeSize += int64(len(writeRequests) - len(unprocessedWrites))
+
+			if len(unprocessedWrites) == 0 {
+
+				logger.Debug("write completed",
+					zap.Int64("writetime", time.Now().Sub(writestart).Milliseconds()),
+					zap.Int("items", len(records)),
+				)
+
+				return writeSize, false, nil
+			}
+
+			logger.Debug("partial write detected",
+				zap.Int64("writetime", time.Now().Sub(writestart).Milliseconds()),
+				zap.Int("items", len(records)),
+				zap.Int("unprocessed", len(unprocessedWrites)))
+
+			// process any remaining writes first
+			// ( will be a short write i.e. less then the 25 items we *could* do)
+			writeRequests = unprocessedWrites
+		}
+	}
+}
@@ -0,0 +1,374 @@
+package clone
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/NixM0nk3y/dynamodb-clone/clonerr"
+	"github.com/NixM0nk3y/dynamodb-clone/log"
+	"github.com/NixM0nk3y/dynamodb-clone/state"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"go.uber.org/zap"
+)
+
+// kinds of capacity a limiter budgets
+const (
+	capacityRead  = "read"
+	capacityWrite = "write"
+)
+
+// budget window counters outlive their second by an hour, for the table's TTL
+const budgetExpiry = time.Hour
+
+// an on demand table's reads are observed over the last day, a minute at a time
+const (
+	observedWindow = 24 * time.Hour
+	observedPeriod = 60 // seconds
+)
+
+// validateCapacity checks a capacity configuration is usable
+func validateCapacity(config state.CapacityConfig) error {
+
+	if config.TargetPercent < 0 || config.TargetPercent > 100 {
+		return &clonerr.SchemaInvalid{Reason: fmt.Sprintf("capacity target of %g%% isn't between 0 and 100", config.TargetPercent)}
+	}
+
+	if config.Units < 0 {
+		return &clonerr.SchemaInvalid{Reason: fmt.Sprintf("capacity of %g units is negative", config.Units)}
+	}
+
+	if config.BudgetTable != "" && !config.Enabled() {
+		return &clonerr.SchemaInvalid{Reason: "a capacity budget table needs a target percentage or units"}
+	}
+
+	return nil
+}
+
+// capacityBudget hands out the capacity units to spend on a table
+type capacityBudget interface {
+	// acquire asks for units, returning those granted and, when none are,
+	// how long to wait before asking again
+	acquire(units float64) (granted float64, wait time.Duration, err error)
+}
+
+// localBudget is a token bucket refilled at rate units a second, holding at
+// most a second's worth. It starts empty so invocations following each other
+// don't each spend a second's worth up front.
+type localBudget struct {
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func (b *localBudget) acquire(units float64) (float64, time.Duration, error) {
+
+	now := time.Now()
+
+	b.tokens = math.Min(b.rate, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+
+	if b.tokens < units {
+		return 0, time.Duration((units - b.tokens) / b.rate * float64(time.Second)), nil
+	}
+
+	b.tokens -= units
+
+	return units, 0, nil
+}
+
+//
+// sharedBudget meters every invocation working on a table through a counter
+// item per second in the budget table. Units are added to the counter before
+// they're spent, an invocation finding the second already spent waits for
+// the next one.
+//
+type sharedBudget struct {
+	ctx   context.Context
+	svc   dynamodbiface.DynamoDBAPI
+	table string
+	id    string // counter items are keyed <id>#<unix second>
+	rate  float64
+}
+
+func (b *sharedBudget) acquire(units float64) (float64, time.Duration, error) {
+
+	logger := log.Logger(b.ctx)
+
+	now := time.Now()
+	window := now.Unix()
+	untilNext := time.Unix(window+1, 0).Sub(now)
+
+	result, err := b.svc.UpdateItemWithContext(b.ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(b.table),
+		Key: map[string]*dynamodb.AttributeValue{
+			"id": {S: aws.String(fmt.Sprintf("%s#%d", b.id, window))},
+		},
+		UpdateExpression: aws.String("ADD consumed :units SET expires = :expires"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":units":   {N: aws.String(strconv.FormatFloat(units, 'f', -1, 64))},
+			":expires": {N: aws.String(strconv.FormatInt(now.Add(budgetExpiry).Unix(), 10))},
+		},
+		ReturnValues: aws.String(dynamodb.ReturnValueUpdatedNew),
+	})
+
+	if err != nil {
+
+		// a throttled budget table holds the writes back too
+		if clonerr.IsThrottle(err) {
+			logger.Warn("capacity budget throttled", zap.Error(err))
+			return 0, untilNext, nil
+		}
+
+		logger.Error(fmt.Sprintf("unable to update capacity budget in %s", b.table), zap.Error(err))
+		return 0, 0, clonerr.FromDynamoDB(b.table, err)
+	}
+
+	consumed, err := strconv.ParseFloat(aws.StringValue(result.Attributes["consumed"].N), 64)
+
+	if err != nil {
+		return 0, 0, &clonerr.SchemaInvalid{Reason: fmt.Sprintf("unreadable capacity budget in %s", b.table), Err: err}
+	}
+
+	// only what fits under the rate is granted, the rest of the window is
+	// counted as spent
+	granted := math.Min(units, b.rate-(consumed-units))
+
+	if granted <= 0 {
+		return 0, untilNext, nil
+	}
+
+	return granted, 0, nil
+}
+
+//
+// capacityLimiter holds calls on a table back to a budget. Each call is paid
+// for with the capacity it reports consuming, so a call running over what was
+// acquired leaves a debt the following calls wait to pay off.
+//
+type capacityLimiter struct {
+	ctx    context.Context
+	table  string
+	rate   float64 // units a second
+	budget capacityBudget
+
+	mu       sync.Mutex
+	balance  float64 // acquired but not yet consumed, negative while in debt
+	estimate float64 // consumed by the last call
+}
+
+//
+// newCapacityLimiter returns a limiter for the kind of capacity spent on the
+// table, nil when the configuration doesn't cap it. A percentage target is
+// taken of the provisioned throughput the table has now or, for the reads of
+// an on demand source, of the most it has served in a minute of the last day.
+//
+func newCapacityLimiter(ctx context.Context, clients Clients, svc dynamodbiface.DynamoDBAPI, table string, kind string, config state.CapacityConfig) (*capacityLimiter, error) {
+
+	logger := log.Logger(ctx)
+
+	if !config.Enabled() {
+		return nil, nil
+	}
+
+	rate := config.Units
+
+	if config.TargetPercent > 0 {
+
+		result, err := svc.DescribeTableWithContext(ctx, &dynamodb.DescribeTableInput{
+			TableName: aws.String(table),
+		})
+
+		if err != nil {
+			logger.Error(fmt.Sprintf("unable to describe table %s", table), zap.Error(err))
+			return nil, clonerr.FromDynamoDB(table, err)
+		}
+
+		provisioned := provisionedCapacity(result.Table, kind)
+
+		if provisioned == 0 && kind == capacityRead {
+			if provisioned, err = observedReadCapacity(ctx, clients, table); err != nil {
+				return nil, err
+			}
+		}
+
+		if provisioned > 0 {
+
+			target := provisioned * config.TargetPercent / 100
+
+			if rate == 0 || target < rate {
+				rate = target
+			}
+		} else if rate == 0 {
+			logger.Warn(fmt.Sprintf("table %s has no provisioned or observed %s capacity to take %g%% of, not limiting", table, kind, config.TargetPercent))
+			return nil, nil
+		}
+	}
+
+	limiter := &capacityLimiter{
+		ctx:    ctx,
+		table:  table,
+		rate:   rate,
+		budget: &localBudget{rate: rate, last: time.Now()},
+	}
+
+	if config.BudgetTable != "" {
+
+		budgetSvc, err := clients.BudgetDynamoDB()
+
+		if err != nil {
+			return nil, err
+		}
+
+		limiter.budget = &sharedBudget{
+			ctx:   ctx,
+			svc:   budgetSvc,
+			table: config.BudgetTable,
+			id:    fmt.Sprintf("%s/%s", table, kind),
+			rate:  rate,
+		}
+	}
+
+	logger.Info(fmt.Sprintf("limiting %s capacity on %s", kind, table), zap.Float64("units", rate),
+		zap.String("budgetTable", config.BudgetTable))
+
+	return limiter, nil
+}
+
+// provisionedCapacity returns the table's provisioned read or write units, zero on demand
+func provisionedCapacity(table *dynamodb.TableDescription, kind string) float64 {
+
+	if table == nil || table.ProvisionedThroughput == nil {
+		return 0
+	}
+
+	if table.BillingModeSummary != nil && aws.StringValue(table.BillingModeSummary.BillingMode) == dynamodb.BillingModePayPerRequest {
+		return 0
+	}
+
+	if kind == capacityRead {
+		return float64(aws.Int64Value(table.ProvisionedThroughput.ReadCapacityUnits))
+	}
+
+	return float64(aws.Int64Value(table.ProvisionedThroughput.WriteCapacityUnits))
+}
+
+//
+// observedReadCapacity returns the peak read units a second the source has
+// consumed over the last day, from the minute sums CloudWatch holds for it.
+// An idle table has none.
+//
+func observedReadCapacity(ctx context.Context, clients Clients, table string) (float64, error) {
+
+	logger := log.Logger(ctx)
+
+	svc, err := clients.SourceCloudWatch()
+
+	if err != nil {
+		return 0, err
+	}
+
+	now := time.Now()
+
+	result, err := svc.GetMetricStatisticsWithContext(ctx, &cloudwatch.GetMetricStatisticsInput{
+		Namespace:  aws.String("AWS/DynamoDB"),
+		MetricName: aws.String("ConsumedReadCapacityUnits"),
+		Dimensions: []*cloudwatch.Dimension{
+			{Name: aws.String("TableName"), Value: aws.String(table)},
+		},
+		StartTime:  aws.Time(now.Add(-observedWindow)),
+		EndTime:    aws.Time(now),
+		Period:     aws.Int64(observedPeriod),
+		Statistics: []*string{aws.String(cloudwatch.StatisticSum)},
+	})
+
+	if err != nil {
+		logger.Error(fmt.Sprintf("unable to read the consumed read capacity of %s", table), zap.Error(err))
+		return 0, clonerr.FromDynamoDB(table, err)
+	}
+
+	var peak float64
+
+	for _, datapoint := range result.Datapoints {
+		peak = math.Max(peak, aws.Float64Value(datapoint.Sum)/observedPeriod)
+	}
+
+	logger.Info(fmt.Sprintf("observed read capacity of %s", table), zap.Float64("units", peak),
+		zap.Int("minutes", len(result.Datapoints)))
+
+	return peak, nil
+}
+
+//
+// wait blocks until there's capacity for the next call, reporting if the
+// timeout fired first. It asks the budget for what the last call consumed
+// plus any debt, never more than a second's worth.
+//
+func (l *capacityLimiter) wait(timeoutChannel <-chan struct{}) (timedOut bool, err error) {
+
+	if l == nil {
+		return false, nil
+	}
+
+	for {
+
+		l.mu.Lock()
+
+		if l.balance > 0 {
+			l.mu.Unlock()
+			return false, nil
+		}
+
+		ask := math.Min(math.Max(l.estimate, 1)-l.balance, l.rate)
+
+		granted, wait, acquireErr := l.budget.acquire(ask)
+
+		l.balance += granted
+
+		l.mu.Unlock()
+
+		if acquireErr != nil {
+			return false, acquireErr
+		}
+
+		if granted > 0 {
+			continue
+		}
+
+		select {
+		case <-timeoutChannel:
+			return true, nil
+		case <-l.ctx.Done():
+			return false, &clonerr.ThroughputExhausted{Table: l.table, Err: l.ctx.Err()}
+		case <-time.After(wait):
+		}
+	}
+}
+
+// consumed pays for a call with the capacity it consumed on the limiter's table
+func (l *capacityLimiter) consumed(capacity []*dynamodb.ConsumedCapacity) {
+
+	if l == nil {
+		return
+	}
+
+	var units float64
+
+	for _, c := range capacity {
+		if c != nil && aws.StringValue(c.TableName) == l.table {
+			units += aws.Float64Value(c.CapacityUnits)
+		}
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.balance -= units
+	l.estimate = units
+}
@@ -0,0 +1,235 @@
+package clone
+
+import (
+	"context"
+	"math/rand"
+	"time"
+
+	"github.com/NixM0nk3y/dynamodb-clone/awsclient"
+	"github.com/NixM0nk3y/dynamodb-clone/log"
+	"github.com/NixM0nk3y/dynamodb-clone/state"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatch/cloudwatchiface"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/aws/aws-sdk-go/service/dynamodbstreams/dynamodbstreamsiface"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/aws/aws-sdk-go/service/secretsmanager/secretsmanageriface"
+	"github.com/aws/aws-sdk-go/service/sts"
+	"github.com/oklog/ulid"
+	"go.uber.org/zap"
+)
+
+// Clients hands out the AWS clients a clone runs with, the source and
+// destination tables may sit in other regions or accounts while the staging
+// bucket is always reached with our own credentials
+type Clients interface {
+	// SourceDynamoDB returns the client for the table being cloned
+	SourceDynamoDB() (dynamodbiface.DynamoDBAPI, error)
+	// SourceCloudWatch returns the client for the metrics of the table being cloned
+	SourceCloudWatch() (cloudwatchiface.CloudWatchAPI, error)
+	// SourceStreams returns the client for the stream of the table being cloned
+	SourceStreams() (dynamodbstreamsiface.DynamoDBStreamsAPI, error)
+	// DestDynamoDB returns the client for the table being created
+	DestDynamoDB() (dynamodbiface.DynamoDBAPI, error)
+	// Bucket returns the client for the staging bucket
+	Bucket() (s3iface.S3API, error)
+	// BucketOwner returns the account owning the staging bucket
+	BucketOwner() (string, error)
+	// BudgetDynamoDB returns the client for the capacity budget table, which
+	// sits beside the staging bucket
+	BudgetDynamoDB() (dynamodbiface.DynamoDBAPI, error)
+	// SecretsManager returns a Secrets Manager client in the region
+	SecretsManager(region string) (secretsmanageriface.SecretsManagerAPI, error)
+}
+
+// Option configures a reader or writer
+type Option func(*options)
+
+type options struct {
+	clients Clients
+}
+
+// WithClients runs with the given clients rather than ones built from the
+// environment, a nil Clients keeps the default
+func WithClients(clients Clients) Option {
+	return func(o *options) {
+		if clients != nil {
+			o.clients = clients
+		}
+	}
+}
+
+func newClients(ctx context.Context, input state.Schema, opts []Option) Clients {
+
+	o := &options{}
+
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	if o.clients == nil {
+		o.clients = &awsClients{ctx: ctx, input: input}
+	}
+
+	return o.clients
+}
+
+// awsClients builds the clients from the environment as they're first asked
+// for, keeping a factory for each side of the clone
+type awsClients struct {
+	ctx    context.Context
+	input  state.Schema
+	source *awsclient.Factory
+	dest   *awsclient.Factory
+	bucket *awsclient.Factory
+}
+
+func (c *awsClients) factory(factory **awsclient.Factory, region string, roleArn string) (*awsclient.Factory, error) {
+
+	if *factory != nil {
+		return *factory, nil
+	}
+
+	config := awsclient.FromEnv(region)
+
+	// the role session name shows up in the other account's cloudtrail
+	config.RoleArn = roleArn
+	config.SessionName = "dynamodb-clone-" + c.input.RunID
+
+	built, err := awsclient.New(c.ctx, config)
+
+	if err != nil {
+		return nil, err
+	}
+
+	*factory = built
+
+	return built, nil
+}
+
+func (c *awsClients) SourceDynamoDB() (dynamodbiface.DynamoDBAPI, error) {
+
+	factory, err := c.factory(&c.source, c.input.SourceTableRegion(), c.input.SourceRoleArn)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return factory.DynamoDB(), nil
+}
+
+func (c *awsClients) SourceStreams() (dynamodbstreamsiface.DynamoDBStreamsAPI, error) {
+
+	factory, err := c.factory(&c.source, c.input.SourceTableRegion(), c.input.SourceRoleArn)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return factory.DynamoDBStreams(), nil
+}
+
+func (c *awsClients) SourceCloudWatch() (cloudwatchiface.CloudWatchAPI, error) {
+
+	factory, err := c.factory(&c.source, c.input.SourceTableRegion(), c.input.SourceRoleArn)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return factory.CloudWatch(), nil
+}
+
+func (c *awsClients) DestDynamoDB() (dynamodbiface.DynamoDBAPI, error) {
+
+	factory, err := c.factory(&c.dest, c.input.DestTableRegion(), c.input.DestRoleArn)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return factory.DynamoDB(), nil
+}
+
+func (c *awsClients) Bucket() (s3iface.S3API, error) {
+
+	factory, err := c.factory(&c.bucket, c.input.StagingRegion(), "")
+
+	if err != nil {
+		return nil, err
+	}
+
+	return factory.S3(), nil
+}
+
+func (c *awsClients) BudgetDynamoDB() (dynamodbiface.DynamoDBAPI, error) {
+
+	factory, err := c.factory(&c.bucket, c.input.StagingRegion(), "")
+
+	if err != nil {
+		return nil, err
+	}
+
+	return factory.DynamoDB(), nil
+}
+
+// BucketOwner returns the account of our own credentials, which own the
+// staging bucket
+func (c *awsClients) BucketOwner() (account string, err error) {
+
+	logger := log.Logger(c.ctx)
+
+	factory, err := c.factory(&c.bucket, c.input.StagingRegion(), "")
+
+	if err != nil {
+		return
+	}
+
+	identity, err := factory.STS().GetCallerIdentityWithContext(c.ctx, &sts.GetCallerIdentityInput{})
+
+	if err != nil {
+		logger.Error("unable to look up the staging bucket's account", zap.Error(err))
+		return "", err
+	}
+
+	return aws.StringValue(identity.Account), nil
+}
+
+func (c *awsClients) SecretsManager(region string) (secretsmanageriface.SecretsManagerAPI, error) {
+
+	factory, err := awsclient.New(c.ctx, awsclient.FromEnv(region))
+
+	if err != nil {
+		return nil, err
+	}
+
+	return factory.SecretsManager(), nil
+}
+
+//
+// The scan and import loops hand back their progress shortly before the
+// context deadline (the lambda timeout), a context without a deadline runs
+// them to completion
+//
+func timeout(ctx context.Context, margin time.Duration) <-chan struct{} {
+
+	deadline, ok := ctx.Deadline()
+
+	if !ok {
+		return nil
+	}
+
+	// closed rather than sent on so every pipeline stage sees it
+	expired := make(chan struct{})
+
+	time.AfterFunc(time.Until(deadline.Add(-margin)), func() { close(expired) })
+
+	return expired
+}
+
+// NewRunID returns a new ULID to scope a clone run's staged objects
+func NewRunID() string {
+	t := time.Now().UTC()
+	entropy := rand.New(rand.NewSource(t.UnixNano()))
+	return ulid.MustNew(ulid.Timestamp(t), entropy).String()
+}
@@ -0,0 +1,976 @@
+package clone_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/NixM0nk3y/dynamodb-clone/clone"
+	"github.com/NixM0nk3y/dynamodb-clone/clonerr"
+	"github.com/NixM0nk3y/dynamodb-clone/clonetest"
+	"github.com/NixM0nk3y/dynamodb-clone/faults"
+	"github.com/NixM0nk3y/dynamodb-clone/manifest"
+	"github.com/NixM0nk3y/dynamodb-clone/state"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+const (
+	testBucket = "test-bucket"
+	sourceDB   = "ddbimport"
+	destDB     = "ddbimport-new"
+)
+
+// loadSource creates the source table and loads test/testdata.json into it,
+// as the Makefile's test/dynamodb targets do against localstack
+func loadSource(t *testing.T, svc *clonetest.DynamoDB) int {
+
+	t.Helper()
+
+	ctx := context.Background()
+
+	_, err := svc.CreateTableWithContext(ctx, &dynamodb.CreateTableInput{
+		TableName: aws.String(sourceDB),
+		AttributeDefinitions: []*dynamodb.AttributeDefinition{
+			{AttributeName: aws.String("Id"), AttributeType: aws.String(dynamodb.ScalarAttributeTypeN)},
+		},
+		KeySchema: []*dynamodb.KeySchemaElement{
+			{AttributeName: aws.String("Id"), KeyType: aws.String(dynamodb.KeyTypeHash)},
+		},
+		BillingMode: aws.String(dynamodb.BillingModePayPerRequest),
+	})
+
+	if err != nil {
+		t.Fatalf("unable to create source table: %v", err)
+	}
+
+	b, err := ioutil.ReadFile("../test/testdata.json")
+
+	if err != nil {
+		t.Fatalf("unable to read test data: %v", err)
+	}
+
+	var requests map[string][]*dynamodb.WriteRequest
+
+	if err = json.Unmarshal(b, &requests); err != nil {
+		t.Fatalf("unable to parse test data: %v", err)
+	}
+
+	if _, err = svc.BatchWriteItemWithContext(ctx, &dynamodb.BatchWriteItemInput{RequestItems: requests}); err != nil {
+		t.Fatalf("unable to load test data: %v", err)
+	}
+
+	return len(requests[sourceDB])
+}
+
+// cloneRun tallies what a cloneTable run did
+type cloneRun struct {
+	invocations map[string]int // of each phase, including retries
+	resumed     map[string]int // invocations handing back before they were complete
+	exported    int64          // items the export reported processing
+	staged      int64          // items listed in the run manifest
+
+	input  state.Schema         // as the schema export handed it on
+	files  []manifest.File      // listed in the run manifest
+	verify []state.VerifyConfig // the verification segments
+}
+
+// retryable are the errors the state machine retries a function on
+func retryable(err error) bool {
+
+	var throughput *clonerr.ThroughputExhausted
+	var storage *clonerr.StorageFailure
+	var unavailable *clonerr.ServiceUnavailable
+
+	return errors.As(err, &throughput) || errors.As(err, &storage) || errors.As(err, &unavailable)
+}
+
+//
+// cloneTable runs the phases as the state machine does, handing each
+// function's result on to the next and invoking the looping ones until they
+// report they're complete. A function failing with a retryable error is
+// invoked again with the same input. The data export, data or table import
+// and verify invocations see an artificial deadline when one is given.
+//
+func cloneTable(t *testing.T, input state.Schema, deadline time.Duration, opts ...clone.Option) (run cloneRun) {
+
+	t.Helper()
+
+	run.invocations = map[string]int{}
+	run.resumed = map[string]int{}
+
+	// invoke retries a phase, more often than the state machine would as
+	// the faults are random
+	invoke := func(phase string, ctx context.Context, fn func(ctx context.Context) error) {
+
+		t.Helper()
+
+		for attempt := 1; ; attempt++ {
+
+			run.invocations[phase]++
+
+			err := fn(ctx)
+
+			if err == nil {
+				return
+			}
+
+			if !retryable(err) || attempt == 20 {
+				t.Fatalf("%s failed after %d attempts: %v", phase, attempt, err)
+			}
+		}
+	}
+
+	dataCtx := func() context.Context {
+		return faults.WithDeadline(context.Background(), deadline)
+	}
+
+	// schema export
+	var schemaResult state.SchemaResult
+
+	invoke("schema export", context.Background(), func(ctx context.Context) (err error) {
+
+		schemaReader, err := clone.NewSchemaReader(ctx, input, opts...)
+
+		if err != nil {
+			t.Fatalf("invalid schema export: %v", err)
+		}
+
+		schemaResult, err = schemaReader.Run()
+
+		return
+	})
+
+	input.RunID = schemaResult.RunID
+	input.Stream = schemaResult.Stream
+
+	run.input = input
+	run.verify = schemaResult.Verify
+
+	// schema import, which ImportTable leaves until the files are staged
+	if !input.SchemaConfig.ImportTable {
+
+		invoke("schema import", context.Background(), func(ctx context.Context) (err error) {
+
+			schemaWriter, err := clone.NewSchemaWriter(ctx, input, opts...)
+
+			if err != nil {
+				t.Fatalf("invalid schema import: %v", err)
+			}
+
+			_, err = schemaWriter.Run()
+
+			return
+		})
+	}
+
+	// data export, one segment at a time
+	var manifests []string
+
+	for _, segment := range schemaResult.Segments {
+
+		exportInput := input
+		exportInput.ExportConfig = segment
+
+		for !exportInput.Export.Complete {
+
+			invoke("data export", dataCtx(), func(ctx context.Context) error {
+
+				dataReader, err := clone.NewDataReader(ctx, exportInput, opts...)
+
+				if err != nil {
+					t.Fatalf("invalid data export of segment %d: %v", segment.Segment, err)
+				}
+
+				output, err := dataReader.Run()
+
+				if err == nil && !output.Complete {
+					run.resumed["data export"]++
+				}
+
+				if err == nil {
+					exportInput.Export = output
+				}
+
+				return err
+			})
+		}
+
+		run.exported += exportInput.Export.Processed
+
+		manifests = append(manifests, exportInput.Export.Manifest)
+	}
+
+	// a direct copy has written the items already
+	if schemaResult.Mode != state.ModeDirect {
+
+		manifestInput := input
+		manifestInput.Export.Manifests = manifests
+
+		var runManifest *manifest.Manifest
+		var mergedKey string
+
+		invoke("manifest merge", context.Background(), func(ctx context.Context) error {
+
+			manifestWriter, err := clone.NewManifestWriter(ctx, manifestInput, opts...)
+
+			if err != nil {
+				t.Fatalf("invalid manifest merge: %v", err)
+			}
+
+			merged, err := manifestWriter.Run()
+
+			if err != nil {
+				return err
+			}
+
+			mergedKey = merged.Manifest
+
+			runManifest, err = clone.ReadManifest(ctx, input, mergedKey, opts...)
+
+			return err
+		})
+
+		run.files = runManifest.Files
+
+		for _, file := range runManifest.Files {
+			run.staged += file.Items
+		}
+
+		// table import, the schema import creating the table from the files
+		if input.SchemaConfig.ImportTable {
+
+			importInput := input
+			importInput.Export.Manifest = mergedKey
+
+			for !importInput.SchemaImport.Complete {
+
+				invoke("table import", dataCtx(), func(ctx context.Context) error {
+
+					schemaWriter, err := clone.NewSchemaWriter(ctx, importInput, opts...)
+
+					if err != nil {
+						t.Fatalf("invalid table import: %v", err)
+					}
+
+					output, err := schemaWriter.Run()
+
+					if err == nil && !output.Complete {
+						run.resumed["table import"]++
+					}
+
+					if err == nil {
+						importInput.SchemaImport = output
+					}
+
+					return err
+				})
+			}
+		} else {
+
+			// data import, one file at a time
+			for _, file := range runManifest.Files {
+
+				importInput := input
+				importInput.Import = state.ImportResult{
+					Records: file.Key,
+					Format:  file.Format,
+					Items:   file.Items,
+					SHA256:  file.SHA256,
+				}
+
+				for !importInput.Import.Complete {
+
+					invoke("data import", dataCtx(), func(ctx context.Context) error {
+
+						dataWriter, err := clone.NewDataWriter(ctx, importInput, opts...)
+
+						if err != nil {
+							t.Fatalf("invalid data import of %s: %v", file.Key, err)
+						}
+
+						output, err := dataWriter.Run()
+
+						if err == nil && !output.Complete {
+							run.resumed["data import"]++
+						}
+
+						if err == nil {
+							importInput.Import = output
+						}
+
+						return err
+					})
+				}
+
+				// an offset or skip gone wrong writes items twice or leaves them out
+				if importInput.Import.Processed != file.Items {
+					t.Fatalf("imported %d items of %s, it holds %d", importInput.Import.Processed, file.Key, file.Items)
+				}
+			}
+		}
+	}
+
+	// verification, which hands back its progress 2s before a scan would
+	verifyCtx := context.Background
+
+	if deadline > 0 {
+		verifyCtx = func() context.Context {
+			return faults.WithDeadline(context.Background(), deadline+2*time.Second)
+		}
+	}
+
+	for _, segment := range schemaResult.Verify {
+
+		verifyInput := input
+		verifyInput.VerifyConfig = segment
+
+		for !verifyInput.Verify.Complete {
+
+			invoke("verify", verifyCtx(), func(ctx context.Context) error {
+
+				verifier, err := clone.NewVerifier(ctx, verifyInput, opts...)
+
+				if err != nil {
+					t.Fatalf("invalid verification: %v", err)
+				}
+
+				output, err := verifier.Run()
+
+				if err == nil && !output.Complete {
+					run.resumed["verify"]++
+				}
+
+				if err == nil {
+					verifyInput.Verify = output
+				}
+
+				return err
+			})
+		}
+	}
+
+	return
+}
+
+func TestClone(t *testing.T) {
+
+	tests := []struct {
+		name   string
+		export state.ExportConfig
+		setup  func(clients *clonetest.Clients)
+		calls  map[string]int // at least, proving the setup was hit
+		check  func(t *testing.T, clients *clonetest.Clients)
+	}{
+		{
+			name:   "staged",
+			export: state.ExportConfig{Mode: state.ModeStaged},
+		},
+		{
+			name:   "direct",
+			export: state.ExportConfig{Mode: state.ModeDirect},
+		},
+		{
+			name:   "auto",
+			export: state.ExportConfig{Mode: state.ModeAuto},
+		},
+		{
+			name:   "paged segments",
+			export: state.ExportConfig{Mode: state.ModeStaged, TotalSegments: 3, Limit: 2},
+		},
+		{
+			name:   "compressed",
+			export: state.ExportConfig{Mode: state.ModeStaged, Compression: "gzip", TotalSegments: 2},
+		},
+		{
+			name:   "unprocessed items",
+			export: state.ExportConfig{Mode: state.ModeStaged},
+			setup: func(clients *clonetest.Clients) {
+				clients.Dest.Unprocessed = func(call int, requests int) int {
+					// the loading call and the first few writes come back short
+					if call > 1 && call < 5 {
+						return requests / 2
+					}
+					return 0
+				}
+			},
+			calls: map[string]int{"BatchWriteItem": 5},
+		},
+		{
+			name:   "throttled",
+			export: state.ExportConfig{Mode: state.ModeDirect, TotalSegments: 2, Limit: 3},
+			setup: func(clients *clonetest.Clients) {
+				clients.Source.Throttle = func(operation string, call int) bool {
+					return (operation == "Scan" && call == 2) || (operation == "BatchWriteItem" && call == 3)
+				}
+			},
+			calls: map[string]int{"Scan": 2, "BatchWriteItem": 3},
+		},
+		{
+			name:   "reserved tags",
+			export: state.ExportConfig{Mode: state.ModeStaged},
+			setup: func(clients *clonetest.Clients) {
+				clients.Source.Tag(sourceDB,
+					&dynamodb.Tag{Key: aws.String("aws:cloudformation:stack-name"), Value: aws.String("tables")},
+					&dynamodb.Tag{Key: aws.String("team"), Value: aws.String("data")})
+			},
+			check: func(t *testing.T, clients *clonetest.Clients) {
+
+				table, err := clients.Dest.DescribeTableWithContext(context.Background(), &dynamodb.DescribeTableInput{
+					TableName: aws.String(destDB),
+				})
+
+				if err != nil {
+					t.Fatalf("unable to describe destination: %v", err)
+				}
+
+				tags, err := clients.Dest.ListTagsOfResourceWithContext(context.Background(), &dynamodb.ListTagsOfResourceInput{
+					ResourceArn: table.Table.TableArn,
+				})
+
+				if err != nil {
+					t.Fatalf("unable to list destination tags: %v", err)
+				}
+
+				expected := []*dynamodb.Tag{{Key: aws.String("team"), Value: aws.String("data")}}
+
+				if !reflect.DeepEqual(tags.Tags, expected) {
+					t.Errorf("destination tagged %v, expected %v", tags.Tags, expected)
+				}
+			},
+		},
+	}
+
+	for _, test := range tests {
+
+		test := test
+
+		t.Run(test.name, func(t *testing.T) {
+
+			clients := clonetest.NewClients()
+
+			items := loadSource(t, clients.Source)
+
+			if test.setup != nil {
+				test.setup(clients)
+			}
+
+			input := state.Schema{
+				Region:        clonetest.Region,
+				Bucket:        testBucket,
+				OrigTableName: sourceDB,
+				NewTableName:  destDB,
+				ExportConfig:  test.export,
+			}
+
+			cloneTable(t, input, 0, clone.WithClients(clients))
+
+			source := clients.Source.Items(sourceDB)
+			dest := clients.Dest.Items(destDB)
+
+			if len(source) != items {
+				t.Fatalf("source has %d items, loaded %d", len(source), items)
+			}
+
+			if !reflect.DeepEqual(source, dest) {
+				t.Fatalf("destination doesn't match the source,\nsource: %v\ndest: %v", source, dest)
+			}
+
+			for operation, minimum := range test.calls {
+				if calls := clients.Source.Calls(operation); calls < minimum {
+					t.Errorf("%s called %d times, expected at least %d", operation, calls, minimum)
+				}
+			}
+
+			if test.check != nil {
+				test.check(t, clients)
+			}
+		})
+	}
+}
+
+func TestCloneTransforms(t *testing.T) {
+
+	tests := []struct {
+		name       string
+		transforms []state.Transform
+		key        string // the destination's key attribute, a hashed string
+	}{
+		{
+			name:       "hashed key",
+			transforms: []state.Transform{{Op: "hash", Attribute: "Id", Salt: "pepper"}},
+			key:        "Id",
+		},
+		{
+			name: "renamed hashed key",
+			transforms: []state.Transform{
+				{Op: "hash", Attribute: "Id", Salt: "pepper"},
+				{Op: "rename", Attribute: "Id", To: "Key"},
+			},
+			key: "Key",
+		},
+		{
+			name: "hashed renamed key",
+			transforms: []state.Transform{
+				{Op: "rename", Attribute: "Id", To: "Key"},
+				{Op: "hash", Attribute: "Key", Salt: "pepper"},
+			},
+			key: "Key",
+		},
+	}
+
+	for _, test := range tests {
+
+		test := test
+
+		t.Run(test.name, func(t *testing.T) {
+
+			clients := clonetest.NewClients()
+
+			items := loadSource(t, clients.Source)
+
+			input := state.Schema{
+				Region:        clonetest.Region,
+				Bucket:        testBucket,
+				OrigTableName: sourceDB,
+				NewTableName:  destDB,
+				ExportConfig:  state.ExportConfig{Mode: state.ModeStaged},
+				ImportConfig:  state.ImportConfig{Transforms: test.transforms},
+			}
+
+			cloneTable(t, input, 0, clone.WithClients(clients))
+
+			table, err := clients.Dest.DescribeTableWithContext(context.Background(), &dynamodb.DescribeTableInput{
+				TableName: aws.String(destDB),
+			})
+
+			if err != nil {
+				t.Fatalf("unable to describe destination: %v", err)
+			}
+
+			expected := []*dynamodb.AttributeDefinition{
+				{AttributeName: aws.String(test.key), AttributeType: aws.String(dynamodb.ScalarAttributeTypeS)},
+			}
+
+			if !reflect.DeepEqual(table.Table.AttributeDefinitions, expected) {
+				t.Errorf("destination defines %v, expected %v", table.Table.AttributeDefinitions, expected)
+			}
+
+			dest := clients.Dest.Items(destDB)
+
+			if len(dest) != items {
+				t.Fatalf("destination has %d items, expected %d", len(dest), items)
+			}
+
+			for _, item := range dest {
+				if item[test.key] == nil || item[test.key].S == nil {
+					t.Fatalf("destination item %v key isn't a hashed string", item)
+				}
+			}
+		})
+	}
+}
+
+// loadItems creates the source table holding count generated items, it is
+// on demand unless given a provisioned throughput
+func loadItems(t *testing.T, svc *clonetest.DynamoDB, count int, throughput *dynamodb.ProvisionedThroughput) {
+
+	t.Helper()
+
+	ctx := context.Background()
+
+	create := &dynamodb.CreateTableInput{
+		TableName: aws.String(sourceDB),
+		AttributeDefinitions: []*dynamodb.AttributeDefinition{
+			{AttributeName: aws.String("Id"), AttributeType: aws.String(dynamodb.ScalarAttributeTypeN)},
+		},
+		KeySchema: []*dynamodb.KeySchemaElement{
+			{AttributeName: aws.String("Id"), KeyType: aws.String(dynamodb.KeyTypeHash)},
+		},
+		BillingMode: aws.String(dynamodb.BillingModePayPerRequest),
+	}
+
+	if throughput != nil {
+		create.BillingMode = aws.String(dynamodb.BillingModeProvisioned)
+		create.ProvisionedThroughput = throughput
+	}
+
+	_, err := svc.CreateTableWithContext(ctx, create)
+
+	if err != nil {
+		t.Fatalf("unable to create source table: %v", err)
+	}
+
+	var requests []*dynamodb.WriteRequest
+
+	for i := 0; i < count; i++ {
+
+		requests = append(requests, &dynamodb.WriteRequest{
+			PutRequest: &dynamodb.PutRequest{
+				Item: map[string]*dynamodb.AttributeValue{
+					"Id":    {N: aws.String(strconv.Itoa(i))},
+					"Title": {S: aws.String(fmt.Sprintf("item %d", i))},
+					"Tags":  {SS: aws.StringSlice([]string{"fault", strconv.Itoa(i % 7)})},
+				},
+			},
+		})
+
+		if len(requests) == 25 || i == count-1 {
+
+			if _, err = svc.BatchWriteItemWithContext(ctx, &dynamodb.BatchWriteItemInput{
+				RequestItems: map[string][]*dynamodb.WriteRequest{sourceDB: requests},
+			}); err != nil {
+				t.Fatalf("unable to load items: %v", err)
+			}
+
+			requests = nil
+		}
+	}
+}
+
+//
+// TestCloneFaults cuts the data export and import invocations short and fails
+// their calls, proving every resume path still ends in an exact clone. The
+// functions hand back their progress 2.5s (writes) to 3s (scans) before their
+// deadline, so a 3.1s deadline leaves an export 100ms and an import 600ms.
+//
+func TestCloneFaults(t *testing.T) {
+
+	const items = 40
+
+	tests := []struct {
+		name     string
+		export   state.ExportConfig
+		batch    int64
+		faults   faults.Config
+		deadline time.Duration
+		pageSize int      // items a scan returns, so verification pages through both tables
+		resumed  []string // phases that must have been cut short at least once
+		injected []faults.Fault
+	}{
+		{
+			name:     "staged deadline",
+			export:   state.ExportConfig{Mode: state.ModeStaged, Limit: 20},
+			faults:   faults.Config{Latency: 40 * time.Millisecond},
+			batch:    1,
+			deadline: 3100 * time.Millisecond,
+			resumed:  []string{"data export", "data import"},
+		},
+		{
+			name:     "compressed deadline",
+			export:   state.ExportConfig{Mode: state.ModeStaged, Limit: 20, Compression: "gzip"},
+			faults:   faults.Config{Latency: 40 * time.Millisecond},
+			batch:    1,
+			deadline: 3100 * time.Millisecond,
+			resumed:  []string{"data export", "data import"},
+		},
+		{
+			name:     "direct deadline",
+			export:   state.ExportConfig{Mode: state.ModeDirect, Limit: 5},
+			faults:   faults.Config{Latency: 40 * time.Millisecond},
+			batch:    1,
+			deadline: 3100 * time.Millisecond,
+			pageSize: 5,
+			resumed:  []string{"data export", "verify"},
+		},
+		{
+			name:   "staged faults",
+			export: state.ExportConfig{Mode: state.ModeStaged, TotalSegments: 2, Limit: 5},
+			batch:  4,
+			faults: faults.Config{
+				Seed:                   1,
+				ThrottleProbability:    0.05,
+				UnprocessedProbability: 0.3,
+				ErrorProbability:       0.1,
+				Latency:                5 * time.Millisecond,
+			},
+			deadline: 3100 * time.Millisecond,
+			injected: []faults.Fault{faults.Throttle, faults.Unprocessed, faults.ServerError},
+		},
+		{
+			name:   "direct faults",
+			export: state.ExportConfig{Mode: state.ModeDirect, TotalSegments: 2, Limit: 5},
+			batch:  4,
+			faults: faults.Config{
+				Seed:                   2,
+				ThrottleProbability:    0.05,
+				UnprocessedProbability: 0.3,
+				ErrorProbability:       0.1,
+				Latency:                5 * time.Millisecond,
+			},
+			deadline: 3100 * time.Millisecond,
+			injected: []faults.Fault{faults.Unprocessed, faults.ServerError},
+		},
+	}
+
+	for _, test := range tests {
+
+		test := test
+
+		t.Run(test.name, func(t *testing.T) {
+
+			t.Parallel()
+
+			clients := clonetest.NewClients()
+
+			loadItems(t, clients.Source, items, nil)
+
+			clients.Source.PageSize = test.pageSize
+
+			injector := faults.New(test.faults)
+			clients.Faults = injector
+
+			input := state.Schema{
+				Region:        clonetest.Region,
+				Bucket:        testBucket,
+				OrigTableName: sourceDB,
+				NewTableName:  destDB,
+				ExportConfig:  test.export,
+				ImportConfig:  state.ImportConfig{BatchSize: test.batch},
+			}
+
+			run := cloneTable(t, input, test.deadline, clone.WithClients(clients))
+
+			source := clients.Source.Items(sourceDB)
+			dest := clients.Dest.Items(destDB)
+
+			if len(source) != items {
+				t.Fatalf("source has %d items, loaded %d", len(source), items)
+			}
+
+			if !reflect.DeepEqual(source, dest) {
+				t.Fatalf("destination doesn't match the source,\nsource: %v\ndest: %v", source, dest)
+			}
+
+			// a page counted twice or skipped shows up in the tallies
+			if run.exported != items {
+				t.Errorf("exported %d items, the source holds %d", run.exported, items)
+			}
+
+			if test.export.Mode == state.ModeStaged && run.staged != items {
+				t.Errorf("the run manifest lists %d items, the source holds %d", run.staged, items)
+			}
+
+			for _, phase := range test.resumed {
+				if run.resumed[phase] == 0 {
+					t.Errorf("%s was never cut short, invoked %d times", phase, run.invocations[phase])
+				}
+			}
+
+			for _, fault := range test.injected {
+				if injector.Injected(fault) == 0 {
+					t.Errorf("no %s fault injected", fault)
+				}
+			}
+
+			t.Logf("invocations %v", run.invocations)
+		})
+	}
+}
+
+//
+// TestCloneCapacity caps the write capacity the import spends on the new
+// table. Every item is a single write unit, so writing them takes at least
+// as long as the cap allows bar the batches in flight and, with a shared
+// budget, the part seconds either end.
+//
+func TestCloneCapacity(t *testing.T) {
+
+	const (
+		items       = 100
+		budgetTable = "clone-budget"
+	)
+
+	tests := []struct {
+		name     string
+		export   state.ExportConfig
+		capacity state.CapacityConfig
+		inFlight float64 // units that may be written ahead of the budget
+		burst    float64 // units the budget may grant at once
+		windows  int     // budget windows the writes must span
+	}{
+		{
+			name:     "staged percent",
+			export:   state.ExportConfig{Mode: state.ModeStaged, Limit: 50},
+			capacity: state.CapacityConfig{TargetPercent: 50},
+			inFlight: 5,
+		},
+		{
+			name:     "direct units",
+			export:   state.ExportConfig{Mode: state.ModeDirect, Limit: 50},
+			capacity: state.CapacityConfig{Units: 40, TargetPercent: 100},
+			inFlight: 4 * 5,
+		},
+		{
+			name:     "staged shared budget",
+			export:   state.ExportConfig{Mode: state.ModeStaged, Limit: 50},
+			capacity: state.CapacityConfig{Units: 40, BudgetTable: budgetTable},
+			inFlight: 5,
+			burst:    80,
+			windows:  3,
+		},
+	}
+
+	for _, test := range tests {
+
+		test := test
+
+		t.Run(test.name, func(t *testing.T) {
+
+			t.Parallel()
+
+			clients := clonetest.NewClients()
+
+			// 80 units provisioned, 50% of which is 40 a second
+			loadItems(t, clients.Source, items, &dynamodb.ProvisionedThroughput{
+				ReadCapacityUnits:  aws.Int64(80),
+				WriteCapacityUnits: aws.Int64(80),
+			})
+
+			if _, err := clients.Budget.CreateTableWithContext(context.Background(), &dynamodb.CreateTableInput{
+				TableName: aws.String(budgetTable),
+				AttributeDefinitions: []*dynamodb.AttributeDefinition{
+					{AttributeName: aws.String("id"), AttributeType: aws.String(dynamodb.ScalarAttributeTypeS)},
+				},
+				KeySchema: []*dynamodb.KeySchemaElement{
+					{AttributeName: aws.String("id"), KeyType: aws.String(dynamodb.KeyTypeHash)},
+				},
+				BillingMode: aws.String(dynamodb.BillingModePayPerRequest),
+			}); err != nil {
+				t.Fatalf("unable to create budget table: %v", err)
+			}
+
+			input := state.Schema{
+				Region:        clonetest.Region,
+				Bucket:        testBucket,
+				OrigTableName: sourceDB,
+				NewTableName:  destDB,
+				ExportConfig:  test.export,
+				ImportConfig:  state.ImportConfig{BatchSize: 5, Capacity: test.capacity},
+			}
+
+			start := time.Now()
+
+			cloneTable(t, input, 0, clone.WithClients(clients))
+
+			elapsed := time.Since(start)
+
+			if !reflect.DeepEqual(clients.Source.Items(sourceDB), clients.Dest.Items(destDB)) {
+				t.Fatalf("destination doesn't match the source")
+			}
+
+			minimum := time.Duration((items - test.burst - test.inFlight) / 40 * float64(time.Second))
+
+			if elapsed < minimum {
+				t.Errorf("wrote %d units in %v, a 40 unit cap takes at least %v", items, elapsed, minimum)
+			}
+
+			if windows := len(clients.Budget.Items(budgetTable)); windows < test.windows {
+				t.Errorf("writes spent %d seconds of the budget, expected at least %d", windows, test.windows)
+			}
+
+			t.Logf("wrote %d units in %v", items, elapsed)
+		})
+	}
+}
+
+func TestCloneReadCapacity(t *testing.T) {
+
+	const items = 100
+
+	//
+	// Verification reads the source within the cap too, in pages of 5: at
+	// least 20 pages over its 4 segments and a consistent lookup of each item
+	// of the new table, bar the last page of each segment which is left unpaid
+	// as the invocation ends.
+	//
+	const verified = 20 + items - 4*5
+
+	tests := []struct {
+		name       string
+		export     state.ExportConfig
+		throughput *dynamodb.ProvisionedThroughput
+		observed   []float64 // on demand read units a second of the last minutes
+		units      float64   // read units of scanning the table
+	}{
+		{
+			name: "staged consistent percent",
+			export: state.ExportConfig{Mode: state.ModeStaged, Limit: 1, ConsistentRead: true,
+				Capacity: state.CapacityConfig{TargetPercent: 50}},
+			throughput: &dynamodb.ProvisionedThroughput{
+				ReadCapacityUnits:  aws.Int64(80),
+				WriteCapacityUnits: aws.Int64(80),
+			},
+			units: items,
+		},
+		{
+			name: "direct observed on demand",
+			export: state.ExportConfig{Mode: state.ModeDirect, Limit: 1,
+				Capacity: state.CapacityConfig{TargetPercent: 25}},
+			observed: []float64{20, 160, 40},
+			units:    items / 2,
+		},
+		{
+			name: "staged units",
+			export: state.ExportConfig{Mode: state.ModeStaged, Limit: 2,
+				Capacity: state.CapacityConfig{Units: 40, TargetPercent: 100}},
+			observed: []float64{200},
+			units:    items / 4,
+		},
+	}
+
+	for _, test := range tests {
+
+		test := test
+
+		t.Run(test.name, func(t *testing.T) {
+
+			t.Parallel()
+
+			clients := clonetest.NewClients()
+
+			// 40 units a second in every case
+			loadItems(t, clients.Source, items, test.throughput)
+
+			clients.Metrics.Consumed(sourceDB, "ConsumedReadCapacityUnits", test.observed...)
+
+			clients.Source.PageSize = 5
+
+			input := state.Schema{
+				Region:        clonetest.Region,
+				Bucket:        testBucket,
+				OrigTableName: sourceDB,
+				NewTableName:  destDB,
+				ExportConfig:  test.export,
+				ImportConfig:  state.ImportConfig{BatchSize: 25},
+			}
+
+			start := time.Now()
+
+			cloneTable(t, input, 0, clone.WithClients(clients))
+
+			elapsed := time.Since(start)
+
+			if !reflect.DeepEqual(clients.Source.Items(sourceDB), clients.Dest.Items(destDB)) {
+				t.Fatalf("destination doesn't match the source")
+			}
+
+			units := test.units + verified
+
+			// the first page is read ahead of the budget
+			minimum := time.Duration((units - 1) / 40 * float64(time.Second))
+
+			if elapsed < minimum {
+				t.Errorf("read %g units in %v, a 40 unit cap takes at least %v", units, elapsed, minimum)
+			}
+
+			t.Logf("read %g units in %v", units, elapsed)
+		})
+	}
+}
@@ -0,0 +1,630 @@
+package clone
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/NixM0nk3y/dynamodb-clone/clonerr"
+	"github.com/NixM0nk3y/dynamodb-clone/datafile"
+	"github.com/NixM0nk3y/dynamodb-clone/log"
+	"github.com/NixM0nk3y/dynamodb-clone/manifest"
+	"github.com/NixM0nk3y/dynamodb-clone/masking"
+	"github.com/NixM0nk3y/dynamodb-clone/state"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/oklog/ulid"
+	"go.uber.org/zap"
+)
+
+// direct copy pipeline sizing
+const (
+	pipelineDepth = 4 // scanned pages queued ahead of the writers
+	directWriters = 4 // batch writes in flight per segment
+)
+
+// DataReader is a
+type DataReader struct {
+	input   state.Schema
+	clients Clients
+	ctx     context.Context
+	err     error
+}
+
+// NewDataReader returns a reader for a single scan segment of the source table
+func NewDataReader(ctx context.Context, input state.Schema, opts ...Option) (*DataReader, error) {
+
+	// every object of the clone is keyed under the run
+	if input.RunID == "" {
+		return nil, &clonerr.SchemaInvalid{Reason: "no run id passed"}
+	}
+
+	// Default to 10000 items in scan
+	if input.ExportConfig.Limit < 1 {
+		input.ExportConfig.Limit = 10000
+	}
+	// default to a single segment scan
+	if input.ExportConfig.TotalSegments < 1 {
+		input.ExportConfig.TotalSegments = 1
+	}
+
+	format, formatErr := datafile.ParseFormat(input.ExportConfig.Format)
+
+	if formatErr != nil {
+		return nil, &clonerr.SchemaInvalid{Reason: "invalid export format", Err: formatErr}
+	}
+
+	input.ExportConfig.Format = string(format)
+
+	compression, compressionErr := datafile.ParseCompression(input.ExportConfig.Compression)
+
+	if compressionErr != nil {
+		return nil, &clonerr.SchemaInvalid{Reason: "invalid export compression", Err: compressionErr}
+	}
+
+	input.ExportConfig.Compression = string(compression)
+
+	switch input.ExportConfig.Mode {
+	case "", state.ModeStaged:
+		input.ExportConfig.Mode = state.ModeStaged
+	case state.ModeDirect:
+
+		if input.NewTableName == "" {
+			return nil, &clonerr.SchemaInvalid{Reason: "no destination table for a direct copy"}
+		}
+
+		// default to a 25 items write (max allowed)
+		if input.ImportConfig.BatchSize < 1 {
+			input.ImportConfig.BatchSize = 25
+		}
+	case state.ModePointInTime:
+
+		if _, err := exportFormat(input.ExportConfig.Format); err != nil {
+			return nil, &clonerr.SchemaInvalid{Reason: "invalid export format", Err: err}
+		}
+
+		// DynamoDB always gzips the files it exports
+		input.ExportConfig.Compression = string(datafile.CompressionGzip)
+	default:
+		// auto is resolved when the segments are planned
+		return nil, &clonerr.SchemaInvalid{Reason: fmt.Sprintf("unknown export mode %s", input.ExportConfig.Mode)}
+	}
+
+	if format == datafile.FormatIon && input.ExportConfig.Mode != state.ModePointInTime {
+		return nil, &clonerr.SchemaInvalid{Reason: "ion data files are only written by a point in time export"}
+	}
+
+	if err := validateCapacity(input.ExportConfig.Capacity); err != nil {
+		return nil, err
+	}
+
+	// a direct copy masks, transforms and limits the writes of items on their
+	// way into the new table, staged items are handled by the import
+	if input.ExportConfig.Mode == state.ModeDirect {
+		if err := validatePipeline(input); err != nil {
+			return nil, err
+		}
+
+		if err := validateCapacity(input.ImportConfig.Capacity); err != nil {
+			return nil, err
+		}
+	}
+
+	return &DataReader{
+		input:   input,
+		clients: newClients(ctx, input, opts),
+		ctx:     ctx,
+	}, nil
+}
+
+// countingWriter tallies the bytes written through it
+type countingWriter struct {
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	cw.n += int64(len(p))
+	return len(p), nil
+}
+
+// encodeItems streams the items, encoded and compressed, into w
+func (dr *DataReader) encodeItems(w io.Writer, items []map[string]*dynamodb.AttributeValue) (err error) {
+
+	logger := log.Logger(dr.ctx)
+
+	compressor, err := datafile.NewCompressor(w, datafile.Compression(dr.input.ExportConfig.Compression))
+
+	if err != nil {
+		return
+	}
+
+	encoder := datafile.NewEncoder(compressor, datafile.Format(dr.input.ExportConfig.Format))
+
+	for _, item := range items {
+
+		if err = encoder.Encode(item); err != nil {
+			logger.Error("unable to encode record", zap.Error(err))
+			return
+		}
+	}
+
+	if err = compressor.Close(); err != nil {
+		logger.Error("unable to compress records", zap.Error(err))
+	}
+
+	return
+}
+
+//
+// Items are encoded straight into a multipart upload so only the parts in
+// flight are held in memory. The sum and size are only known once the upload
+// has finished, so they're added to the object's metadata by copying it over
+// itself.
+//
+func (dr *DataReader) storeItems(items []map[string]*dynamodb.AttributeValue) (file manifest.File, err error) {
+
+	logger := log.Logger(dr.ctx)
+
+	compression := datafile.Compression(dr.input.ExportConfig.Compression)
+
+	// build a ULID
+	t := time.Now().UTC()
+	entropy := rand.New(rand.NewSource(t.UnixNano()))
+	id := ulid.MustNew(ulid.Timestamp(t), entropy)
+
+	fileName := dr.input.Key("data", id.String()+".json"+compression.Extension())
+
+	s3Svc, err := dr.clients.Bucket()
+
+	if err != nil {
+		return
+	}
+
+	logger.Info("storing items", zap.Int("records", len(items)),
+		zap.String("format", dr.input.ExportConfig.Format),
+		zap.String("compression", dr.input.ExportConfig.Compression))
+
+	hash := sha256.New()
+	size := &countingWriter{}
+
+	pipeReader, pipeWriter := io.Pipe()
+	encoded := make(chan error, 1)
+
+	go func() {
+		encodeErr := dr.encodeItems(io.MultiWriter(pipeWriter, hash, size), items)
+		pipeWriter.CloseWithError(encodeErr)
+		encoded <- encodeErr
+	}()
+
+	// Create s3 Client
+	uploader := s3manager.NewUploaderWithClient(s3Svc)
+
+	upload := &s3manager.UploadInput{
+		Bucket: aws.String(dr.input.Bucket),
+		Key:    aws.String(fileName),
+		Body:   pipeReader,
+	}
+
+	if encoding := compression.ContentEncoding(); encoding != "" {
+		upload.ContentEncoding = aws.String(encoding)
+	}
+
+	_, err = uploader.UploadWithContext(dr.ctx, upload)
+
+	// unblock the encoder if the upload gave up part way through
+	pipeReader.CloseWithError(io.ErrClosedPipe)
+
+	// the upload failing closes the pipe under the encoder
+	if encodeErr := <-encoded; encodeErr != nil && !errors.Is(encodeErr, io.ErrClosedPipe) {
+		return file, encodeErr
+	}
+
+	if err != nil {
+		logger.Error(fmt.Sprintf("unable to upload %s to %s", fileName, dr.input.Bucket), zap.Error(err))
+		return file, &clonerr.StorageFailure{Bucket: dr.input.Bucket, Key: fileName, Err: err}
+	}
+
+	file = manifest.File{
+		Key:    fileName,
+		Format: dr.input.ExportConfig.Format,
+		Items:  int64(len(items)),
+		Bytes:  size.n,
+		SHA256: hex.EncodeToString(hash.Sum(nil)),
+	}
+
+	copyInput := &s3.CopyObjectInput{
+		Bucket:            aws.String(dr.input.Bucket),
+		Key:               aws.String(fileName),
+		CopySource:        aws.String(url.PathEscape(dr.input.Bucket + "/" + fileName)),
+		MetadataDirective: aws.String(s3.MetadataDirectiveReplace),
+		ContentEncoding:   upload.ContentEncoding,
+		Metadata: map[string]*string{
+			manifest.MetaSHA256: aws.String(file.SHA256),
+			manifest.MetaItems:  aws.String(strconv.FormatInt(file.Items, 10)),
+		},
+	}
+
+	if _, err = s3Svc.CopyObjectWithContext(dr.ctx, copyInput); err != nil {
+		logger.Error(fmt.Sprintf("unable to record checksum of %s in %s", fileName, dr.input.Bucket), zap.Error(err))
+		return file, &clonerr.StorageFailure{Bucket: dr.input.Bucket, Key: fileName, Err: err}
+	}
+
+	logger.Info(fmt.Sprintf("successfully uploaded %s to %s", fileName, dr.input.Bucket), zap.Int64("bytes", file.Bytes))
+
+	return
+}
+
+//
+// Each segment keeps its own manifest, rewritten at the end of every
+// invocation. Pages stored by a failed invocation never make it into the
+// manifest so a retry doesn't import them twice.
+//
+func (dr *DataReader) loadManifest(key string) (segmentManifest *manifest.Manifest, err error) {
+
+	logger := log.Logger(dr.ctx)
+
+	s3Svc, err := dr.clients.Bucket()
+
+	if err != nil {
+		return
+	}
+
+	segmentManifest, err = manifest.Read(dr.ctx, s3Svc, dr.input.Bucket, key)
+
+	if err != nil {
+		logger.Error(fmt.Sprintf("unable to read manifest %s from %s", key, dr.input.Bucket), zap.Error(err))
+		return nil, &clonerr.StorageFailure{Bucket: dr.input.Bucket, Key: key, Err: err}
+	}
+
+	return
+}
+
+func (dr *DataReader) storeManifest(key string, segmentManifest *manifest.Manifest) (err error) {
+
+	logger := log.Logger(dr.ctx)
+
+	s3Svc, err := dr.clients.Bucket()
+
+	if err != nil {
+		return
+	}
+
+	if err = manifest.Write(dr.ctx, s3Svc, dr.input.Bucket, key, segmentManifest); err != nil {
+		logger.Error(fmt.Sprintf("unable to store manifest %s to %s", key, dr.input.Bucket), zap.Error(err))
+		return &clonerr.StorageFailure{Bucket: dr.input.Bucket, Key: key, Err: err}
+	}
+
+	logger.Info(fmt.Sprintf("stored manifest %s", key), zap.Int("files", len(segmentManifest.Files)))
+
+	return
+}
+
+func (dr *DataReader) dynamodbScan() (output state.ExportResult, err error) {
+
+	logger := log.Logger(dr.ctx)
+
+	// https://docs.aws.amazon.com/lambda/latest/dg/golang-context.html
+	timeoutChannel := timeout(dr.ctx, 3000*time.Millisecond)
+
+	svc, err := dr.clients.SourceDynamoDB()
+
+	if err != nil {
+		return
+	}
+
+	segmentManifest := manifest.New(dr.input.OrigTableName)
+
+	// a filtered clone is a deliberate subset of the source
+	if filter := dr.input.ExportConfig.Filter; filter.Subset() {
+		segmentManifest.Filter = &filter
+	}
+
+	// have we got previous results ?
+	if dr.input.Export.LastKey != nil {
+		output = dr.input.Export
+
+		if segmentManifest, err = dr.loadManifest(output.Manifest); err != nil {
+			return
+		}
+	}
+
+	output.Manifest = dr.input.Key("manifests", fmt.Sprintf("segment-%04d.json", dr.input.ExportConfig.Segment))
+
+	startProcessed := output.Processed
+
+	sc, err := dr.scanner(svc)
+
+	if err != nil {
+		return
+	}
+
+	output.Complete, err = sc.scan(output.LastKey, timeoutChannel, func(items []map[string]*dynamodb.AttributeValue, lastKey map[string]*dynamodb.AttributeValue) error {
+
+		// a filter can leave a page empty
+		if len(items) == 0 {
+			output.LastKey = lastKey
+			return nil
+		}
+
+		// call the handler function with items
+		file, storeError := dr.storeItems(items)
+
+		if storeError != nil {
+			logger.Error("item store failed", zap.Error(storeError))
+			return storeError
+		}
+
+		logger.Info("items stored", zap.Int64("items", int64(len(items))))
+
+		// add data file
+		segmentManifest.Add(file)
+
+		// add to tally
+		output.Processed += int64(len(items))
+
+		output.LastKey = lastKey
+
+		return nil
+	})
+
+	if err != nil {
+		return
+	}
+
+	if !output.Complete {
+		logger.Warn("data export lambda duration expired", zap.Int64("reads", output.Processed-startProcessed))
+	}
+
+	err = dr.storeManifest(output.Manifest, segmentManifest)
+
+	return
+}
+
+// scanner returns a scanner of the segment held to the export's read capacity
+func (dr *DataReader) scanner(svc dynamodbiface.DynamoDBAPI) (*scanner, error) {
+
+	limiter, err := newCapacityLimiter(dr.ctx, dr.clients, svc, dr.input.OrigTableName, capacityRead, dr.input.ExportConfig.Capacity)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &scanner{
+		ctx:           dr.ctx,
+		svc:           svc,
+		table:         dr.input.OrigTableName,
+		segment:       dr.input.ExportConfig.Segment,
+		totalSegments: dr.input.ExportConfig.TotalSegments,
+		limit:         dr.input.ExportConfig.Limit,
+		consistent:    dr.input.ExportConfig.ConsistentRead,
+		filter:        dr.input.ExportConfig.Filter,
+		limiter:       limiter,
+	}, nil
+}
+
+// errPipelineStopped is returned by a page handler once the writes have stopped
+var errPipelineStopped = errors.New("pipeline stopped")
+
+// page is a scanned page waiting to be written
+type page struct {
+	items   []map[string]*dynamodb.AttributeValue
+	lastKey map[string]*dynamodb.AttributeValue
+	report  *masking.Report
+}
+
+//
+// Copy the segment straight into the new table. Scanned pages queue in a
+// bounded channel, so a slow destination holds back the scan, and LastKey
+// only moves on once every item of a page has been written.
+//
+func (dr *DataReader) dynamodbCopy() (output state.ExportResult, err error) {
+
+	logger := log.Logger(dr.ctx)
+
+	// https://docs.aws.amazon.com/lambda/latest/dg/golang-context.html
+	scanTimeout := timeout(dr.ctx, 3000*time.Millisecond)
+	writeTimeout := timeout(dr.ctx, 2500*time.Millisecond) // dynamoDB retries take a while to return
+
+	svc, err := dr.clients.SourceDynamoDB()
+
+	if err != nil {
+		return
+	}
+
+	destSvc, err := dr.clients.DestDynamoDB()
+
+	if err != nil {
+		return
+	}
+
+	sc, err := dr.scanner(svc)
+
+	if err != nil {
+		return
+	}
+
+	limiter, err := newCapacityLimiter(dr.ctx, dr.clients, destSvc, dr.input.NewTableName, capacityWrite, dr.input.ImportConfig.Capacity)
+
+	if err != nil {
+		return
+	}
+
+	writer := newBatchWriter(dr.ctx, destSvc, dr.input.NewTableName, limiter)
+
+	pipeline, err := newItemPipeline(dr.ctx, dr.clients, dr.input)
+
+	if err != nil {
+		return
+	}
+
+	// masking tally of the pages written by this invocation
+	report := pipeline.newReport()
+
+	// have we got previous results ?
+	if dr.input.Export.LastKey != nil {
+		output = dr.input.Export
+	}
+
+	startProcessed := output.Processed
+
+	pages := make(chan page, pipelineDepth)
+	stopped := make(chan struct{})
+
+	var writeErr error
+	var writeTimedOut bool
+
+	go func() {
+		defer close(stopped)
+
+		for p := range pages {
+
+			written, timedOut, pageErr := dr.writePage(writer, p.items, writeTimeout)
+
+			if pageErr != nil {
+				writeErr = pageErr
+				return
+			}
+
+			if timedOut {
+				writeTimedOut = true
+				return
+			}
+
+			output.Processed += written
+			output.LastKey = p.lastKey
+
+			if report != nil {
+				report.Merge(p.report)
+			}
+		}
+	}()
+
+	scanComplete, scanErr := sc.scan(output.LastKey, scanTimeout, func(items []map[string]*dynamodb.AttributeValue, lastKey map[string]*dynamodb.AttributeValue) error {
+
+		pageReport, applyErr := pipeline.apply(items)
+
+		if applyErr != nil {
+			logger.Error("unable to mask or transform records", zap.Error(applyErr))
+			return applyErr
+		}
+
+		select {
+		case pages <- page{items: items, lastKey: lastKey, report: pageReport}:
+			return nil
+		case <-stopped:
+			return errPipelineStopped
+		}
+	})
+
+	close(pages)
+	<-stopped
+
+	if writeErr != nil {
+		logger.Error("item copy failed", zap.Error(writeErr))
+		return output, writeErr
+	}
+
+	if scanErr != nil && scanErr != errPipelineStopped {
+		return output, scanErr
+	}
+
+	output.Complete = scanComplete && !writeTimedOut
+
+	if report != nil {
+
+		key := maskingPartKey(dr.input, fmt.Sprintf("segment-%04d", dr.input.ExportConfig.Segment), startProcessed)
+
+		if err = storeMaskingReport(dr.ctx, dr.clients, dr.input, key, report); err != nil {
+			output.Complete = false
+			return
+		}
+	}
+
+	if output.Complete {
+		output.LastKey = nil
+	} else {
+		logger.Warn("data copy lambda duration expired", zap.Int64("writes", output.Processed-startProcessed))
+	}
+
+	return
+}
+
+// writePage writes a page in parallel batches, only counting it once every batch is in
+func (dr *DataReader) writePage(writer *batchWriter, items []map[string]*dynamodb.AttributeValue, timeoutChannel <-chan struct{}) (written int64, timedOut bool, err error) {
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+
+	batchSize := int(dr.input.ImportConfig.BatchSize)
+	batches := make(chan []map[string]*dynamodb.AttributeValue)
+
+	for i := 0; i < directWriters; i++ {
+
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			for batch := range batches {
+
+				batchWritten, batchTimedOut, batchErr := writer.write(batch, timeoutChannel)
+
+				mu.Lock()
+				written += batchWritten
+				timedOut = timedOut || batchTimedOut
+				if err == nil {
+					err = batchErr
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+	for start := 0; start < len(items); start += batchSize {
+
+		end := start + batchSize
+
+		if end > len(items) {
+			end = len(items)
+		}
+
+		mu.Lock()
+		failed := timedOut || err != nil
+		mu.Unlock()
+
+		if failed {
+			break
+		}
+
+		batches <- items[start:end]
+	}
+
+	close(batches)
+	wg.Wait()
+
+	return
+}
+
+// Run executes a batch batch.
+func (dr *DataReader) Run() (output state.ExportResult, err error) {
+
+	switch dr.input.ExportConfig.Mode {
+	case state.ModeDirect:
+		return dr.dynamodbCopy()
+	case state.ModePointInTime:
+		return dr.dynamodbExport()
+	}
+
+	return dr.dynamodbScan()
+}
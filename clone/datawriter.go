@@ -0,0 +1,485 @@
+package clone
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/NixM0nk3y/dynamodb-clone/clonerr"
+	"github.com/NixM0nk3y/dynamodb-clone/datafile"
+	"github.com/NixM0nk3y/dynamodb-clone/log"
+	"github.com/NixM0nk3y/dynamodb-clone/manifest"
+	"github.com/NixM0nk3y/dynamodb-clone/masking"
+	"github.com/NixM0nk3y/dynamodb-clone/state"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"go.uber.org/zap"
+)
+
+// DataWriter is a
+type DataWriter struct {
+	input   state.Schema
+	clients Clients
+	ctx     context.Context
+	err     error
+}
+
+// NewDataWriter returns a writer importing a single staged data file
+func NewDataWriter(ctx context.Context, input state.Schema, opts ...Option) (*DataWriter, error) {
+
+	// default to a 25 items write (max allowed)
+	// https://docs.aws.amazon.com/amazondynamodb/latest/APIReference/API_BatchWriteItem.html
+	//
+	if input.ImportConfig.BatchSize < 1 {
+		input.ImportConfig.BatchSize = 25
+	}
+
+	// every object of the clone is keyed under the run
+	if input.RunID == "" {
+		return nil, &clonerr.SchemaInvalid{Reason: "no run id passed"}
+	}
+
+	// check for unconfigured state
+	if input.Import.Records == "" {
+		return nil, &clonerr.SchemaInvalid{Reason: "no data record passed to process"}
+	}
+
+	format, formatErr := datafile.ParseFormat(input.Import.Format)
+
+	if formatErr != nil {
+		return nil, &clonerr.SchemaInvalid{Reason: "invalid import format", Err: formatErr}
+	}
+
+	input.Import.Format = string(format)
+
+	if err := validatePipeline(input); err != nil {
+		return nil, err
+	}
+
+	if err := validateCapacity(input.ImportConfig.Capacity); err != nil {
+		return nil, err
+	}
+
+	return &DataWriter{
+		input:   input,
+		clients: newClients(ctx, input, opts),
+		ctx:     ctx,
+	}, nil
+}
+
+// metadataValue looks up user metadata, the SDK hands the keys back in
+// canonical header case
+func metadataValue(metadata map[string]*string, name string) string {
+
+	for key, value := range metadata {
+		if strings.EqualFold(key, name) {
+			return aws.StringValue(value)
+		}
+	}
+
+	return ""
+}
+
+//
+// A data file must match both the sum and count recorded in its object
+// metadata and those the manifest passed in, so a truncated or corrupted
+// object fails the import before a single item is written
+//
+func (dw *DataWriter) checkIntegrity(key string, metadata map[string]*string, sum string, items int64) error {
+
+	logger := log.Logger(dw.ctx)
+
+	expected := []struct {
+		source string
+		sha256 string
+		items  string
+	}{
+		{"object metadata", metadataValue(metadata, manifest.MetaSHA256), metadataValue(metadata, manifest.MetaItems)},
+		{"manifest", dw.input.Import.SHA256, ""},
+	}
+
+	if dw.input.Import.Items > 0 {
+		expected[1].items = strconv.FormatInt(dw.input.Import.Items, 10)
+	}
+
+	checked := false
+
+	for _, e := range expected {
+
+		if e.sha256 != "" {
+
+			checked = true
+
+			if e.sha256 != sum {
+				return &clonerr.IntegrityFailure{Bucket: dw.input.Bucket, Key: key,
+					Reason: fmt.Sprintf("sha256 %s does not match %s in the %s", sum, e.sha256, e.source)}
+			}
+		}
+
+		if e.items != "" && e.items != strconv.FormatInt(items, 10) {
+			return &clonerr.IntegrityFailure{Bucket: dw.input.Bucket, Key: key,
+				Reason: fmt.Sprintf("decoded %d items where the %s records %s", items, e.source, e.items)}
+		}
+	}
+
+	if !checked {
+		logger.Warn(fmt.Sprintf("no checksum recorded for %s, unable to check its integrity", key))
+	}
+
+	return nil
+}
+
+// openData streams a data file from S3, starting offset bytes in
+func (dw *DataWriter) openData(key string, offset int64) (result *s3.GetObjectOutput, err error) {
+
+	logger := log.Logger(dw.ctx)
+
+	s3Svc, err := dw.clients.Bucket()
+
+	if err != nil {
+		return nil, err
+	}
+
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(dw.input.Bucket),
+		Key:    aws.String(key),
+	}
+
+	if offset > 0 {
+		input.Range = aws.String(fmt.Sprintf("bytes=%d-", offset))
+	}
+
+	// ask for the stored bytes, the transport would otherwise gunzip a file
+	// stored with a gzip Content-Encoding and break its checksum
+	result, err = s3Svc.GetObjectWithContext(dw.ctx, input, request.WithSetRequestHeaders(map[string]string{"Accept-Encoding": "identity"}))
+
+	if err != nil {
+		logger.Error(fmt.Sprintf("unable to download records file %s from s3://%s", key, dw.input.Bucket), zap.Error(err))
+		return nil, &clonerr.StorageFailure{Bucket: dw.input.Bucket, Key: key, Err: err}
+	}
+
+	logger.Info(fmt.Sprintf("streaming records file %s from s3://%s", key, dw.input.Bucket), zap.Int64("offset", offset))
+
+	return
+}
+
+// bodyReader remembers a failed read of the object body so a dropped
+// connection isn't mistaken for a corrupted file
+type bodyReader struct {
+	r   io.Reader
+	err error
+}
+
+func (br *bodyReader) Read(p []byte) (n int, err error) {
+
+	n, err = br.r.Read(p)
+
+	if err != nil && err != io.EOF {
+		br.err = err
+	}
+
+	return
+}
+
+//
+// verifyData streams the whole data file once, decoding and counting its
+// items while summing the stored bytes, before the import writes anything
+//
+func (dw *DataWriter) verifyData(key string) (err error) {
+
+	logger := log.Logger(dw.ctx)
+
+	result, err := dw.openData(key, 0)
+
+	if err != nil {
+		return
+	}
+
+	defer result.Body.Close()
+
+	hash := sha256.New()
+	body := &bodyReader{r: io.TeeReader(result.Body, hash)}
+
+	var items int64
+
+	decompressor, decodeErr := datafile.NewDecompressor(body, datafile.DetectCompression(key, aws.StringValue(result.ContentEncoding)))
+
+	if decodeErr == nil {
+
+		decoder := datafile.NewDecoder(decompressor, datafile.Format(dw.input.Import.Format))
+
+		for {
+			if _, decodeErr = decoder.Decode(); decodeErr != nil {
+				break
+			}
+
+			items++
+		}
+
+		decompressor.Close()
+
+		if decodeErr == io.EOF {
+			decodeErr = nil
+		}
+	}
+
+	// sum whatever the decoder left unread
+	if _, copyErr := io.Copy(ioutil.Discard, body); copyErr != nil || body.err != nil {
+
+		if copyErr == nil {
+			copyErr = body.err
+		}
+
+		logger.Error(fmt.Sprintf("unable to read records file %s from s3://%s", key, dw.input.Bucket), zap.Error(copyErr))
+		return &clonerr.StorageFailure{Bucket: dw.input.Bucket, Key: key, Err: copyErr}
+	}
+
+	if err = dw.checkIntegrity(key, result.Metadata, hex.EncodeToString(hash.Sum(nil)), items); err != nil {
+		logger.Error("data file failed integrity check", zap.Error(err))
+		return
+	}
+
+	if decodeErr != nil {
+		logger.Error("unable to decode records from datafile", zap.Error(decodeErr))
+		return &clonerr.StorageFailure{Bucket: dw.input.Bucket, Key: key, Err: decodeErr}
+	}
+
+	logger.Info(fmt.Sprintf("verified %d records in %s", items, key))
+
+	return
+}
+
+//
+// Records are decoded lazily from the object body as they're written, an
+// invocation resumes an uncompressed file from the byte offset reached by the
+// last one while a compressed file is decoded from the start, skipping the
+// items already written
+//
+func (dw *DataWriter) dynamodbImport() (output state.ImportResult, err error) {
+
+	logger := log.Logger(dw.ctx)
+
+	// https://docs.aws.amazon.com/lambda/latest/dg/golang-context.html
+	timeoutChannel := timeout(dw.ctx, 2500*time.Millisecond) // dynamoDB retries take a while to return
+
+	svc, err := dw.clients.DestDynamoDB()
+
+	if err != nil {
+		return
+	}
+
+	limiter, err := newCapacityLimiter(dw.ctx, dw.clients, svc, dw.input.NewTableName, capacityWrite, dw.input.ImportConfig.Capacity)
+
+	if err != nil {
+		return
+	}
+
+	writer := newBatchWriter(dw.ctx, svc, dw.input.NewTableName, limiter)
+
+	pipeline, err := newItemPipeline(dw.ctx, dw.clients, dw.input)
+
+	if err != nil {
+		return
+	}
+
+	// masking tally of the items written by this invocation
+	report := pipeline.newReport()
+
+	logger.Info(fmt.Sprintf("importing data into table %s", dw.input.NewTableName))
+
+	output.Records = dw.input.Import.Records
+	output.Format = dw.input.Import.Format
+	output.Items = dw.input.Import.Items
+	output.SHA256 = dw.input.Import.SHA256
+
+	//
+	output.Processed = dw.input.Import.Processed
+	output.Offset = dw.input.Import.Offset
+
+	// the file is checked in full before its first item is written
+	if output.Processed == 0 {
+		if err = dw.verifyData(output.Records); err != nil {
+			return
+		}
+	}
+
+	result, err := dw.openData(output.Records, output.Offset)
+
+	if err != nil {
+		return
+	}
+
+	defer result.Body.Close()
+
+	compression := datafile.DetectCompression(output.Records, aws.StringValue(result.ContentEncoding))
+
+	decompressor, err := datafile.NewDecompressor(result.Body, compression)
+
+	if err != nil {
+		logger.Error(fmt.Sprintf("unable to decompress %s records file", compression), zap.Error(err))
+		return output, &clonerr.StorageFailure{Bucket: dw.input.Bucket, Key: output.Records, Err: err}
+	}
+
+	defer decompressor.Close()
+
+	decoder := datafile.NewDecoder(decompressor, datafile.Format(output.Format))
+
+	// the offset is relative to the start of the ranged body
+	baseOffset := output.Offset
+
+	// next batch of records to write
+	nextBatch := func(size int64) (batch []map[string]*dynamodb.AttributeValue, err error) {
+
+		for int64(len(batch)) < size {
+
+			item, decodeErr := decoder.Decode()
+
+			if decodeErr == io.EOF {
+				break
+			}
+
+			if decodeErr != nil {
+				logger.Error("unable to decode records from datafile", zap.Error(decodeErr))
+				return nil, &clonerr.StorageFailure{Bucket: dw.input.Bucket, Key: output.Records, Err: decodeErr}
+			}
+
+			batch = append(batch, item)
+		}
+
+		return
+	}
+
+	if baseOffset == 0 && output.Processed > 0 {
+
+		logger.Info(fmt.Sprintf("skipping %d records already written", output.Processed))
+
+		for skipped := int64(0); skipped < output.Processed; skipped += dw.input.ImportConfig.BatchSize {
+
+			size := output.Processed - skipped
+
+			if size > dw.input.ImportConfig.BatchSize {
+				size = dw.input.ImportConfig.BatchSize
+			}
+
+			if _, err = nextBatch(size); err != nil {
+				return
+			}
+		}
+	}
+
+	logger.Info(fmt.Sprintf("starting processing from record %d", output.Processed))
+
+	// write status tracking
+	ticker := time.NewTicker(5000 * time.Millisecond)
+	defer ticker.Stop()
+
+	lastTick := time.Now()
+	lastProcesed := output.Processed
+
+	// batch loop through the data
+	for {
+
+		select {
+
+		case t := <-ticker.C:
+
+			tickPeriod := t.Sub(lastTick).Milliseconds()
+
+			// records processed this tick
+			tickProcessed := output.Processed - lastProcesed
+
+			// round to two decimal places
+			rate := math.Round((float64(tickProcessed)/(float64(tickPeriod)/1000))*100) / 100
+
+			logger.Info("processing writes", zap.Int64("items", output.Processed),
+				zap.Float64("rate", rate),
+				zap.Int64("processed", tickProcessed))
+
+			lastProcesed = output.Processed
+			lastTick = t
+
+		default:
+		}
+
+		batch, batchErr := nextBatch(dw.input.ImportConfig.BatchSize)
+
+		if batchErr != nil {
+			return output, batchErr
+		}
+
+		if len(batch) == 0 {
+			break
+		}
+
+		batchReport, applyErr := pipeline.apply(batch)
+
+		if applyErr != nil {
+			logger.Error("unable to mask or transform records", zap.Error(applyErr))
+			return output, applyErr
+		}
+
+		written, timedOut, writeErr := writer.write(batch, timeoutChannel)
+
+		if writeErr != nil {
+			return output, writeErr
+		}
+
+		if timedOut {
+
+			totalWrites := output.Processed - dw.input.Import.Processed
+
+			logger.Warn("data import lambda duration expired", zap.Int64("writes", totalWrites))
+
+			err = dw.storeReport(report)
+			return
+		}
+
+		// add to tally
+		output.Processed += written
+
+		if report != nil {
+			report.Merge(batchReport)
+		}
+
+		// only an uncompressed file can be picked up part way through
+		if compression == datafile.CompressionNone {
+			output.Offset = baseOffset + decoder.Offset()
+		}
+	}
+
+	logger.Info("record import complete", zap.String("record", output.Records), zap.Int64("count", output.Processed))
+
+	if err = dw.storeReport(report); err != nil {
+		return
+	}
+
+	output.Complete = true
+
+	return
+}
+
+// storeReport saves the masking tally of this invocation as a partial report
+func (dw *DataWriter) storeReport(report *masking.Report) error {
+
+	if report == nil {
+		return nil
+	}
+
+	key := maskingPartKey(dw.input, dw.input.Import.Records, dw.input.Import.Processed)
+
+	return storeMaskingReport(dw.ctx, dw.clients, dw.input, key, report)
+}
+
+// Run executes the import of a data file.
+func (dw *DataWriter) Run() (output state.ImportResult, err error) {
+	return dw.dynamodbImport()
+}
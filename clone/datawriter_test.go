@@ -0,0 +1,206 @@
+package clone_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/NixM0nk3y/dynamodb-clone/clone"
+	"github.com/NixM0nk3y/dynamodb-clone/clonerr"
+	"github.com/NixM0nk3y/dynamodb-clone/clonetest"
+	"github.com/NixM0nk3y/dynamodb-clone/manifest"
+	"github.com/NixM0nk3y/dynamodb-clone/state"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// rewriteObject replaces a staged object's body and metadata, keeping its
+// content encoding
+func rewriteObject(t *testing.T, svc *clonetest.S3, key string, rewrite func(body []byte, metadata map[string]*string) []byte) {
+
+	t.Helper()
+
+	ctx := context.Background()
+
+	result, err := svc.GetObjectWithContext(ctx, &s3.GetObjectInput{Bucket: aws.String(testBucket), Key: aws.String(key)})
+
+	if err != nil {
+		t.Fatalf("unable to read %s: %v", key, err)
+	}
+
+	body, err := ioutil.ReadAll(result.Body)
+
+	if err != nil {
+		t.Fatalf("unable to read %s: %v", key, err)
+	}
+
+	body = rewrite(body, result.Metadata)
+
+	if _, err = svc.PutObjectWithContext(ctx, &s3.PutObjectInput{
+		Bucket:          aws.String(testBucket),
+		Key:             aws.String(key),
+		Body:            bytes.NewReader(body),
+		Metadata:        result.Metadata,
+		ContentEncoding: result.ContentEncoding,
+	}); err != nil {
+		t.Fatalf("unable to rewrite %s: %v", key, err)
+	}
+}
+
+// setMetadata replaces a metadata value, whatever case the key came back in
+func setMetadata(metadata map[string]*string, name string, value *string) {
+
+	for key := range metadata {
+		if strings.EqualFold(key, name) {
+			delete(metadata, key)
+		}
+	}
+
+	if value != nil {
+		metadata[name] = value
+	}
+}
+
+func TestDataWriterIntegrity(t *testing.T) {
+
+	tests := []struct {
+		name     string
+		rewrite  func(body []byte, metadata map[string]*string) []byte
+		manifest func(file *state.ImportResult)
+		reason   string // of the integrity failure, empty for a file that imports
+	}{
+		{
+			name: "corrupted body",
+			rewrite: func(body []byte, metadata map[string]*string) []byte {
+				return bytes.Replace(body, []byte("Title"), []byte("Titel"), 1)
+			},
+			reason: "in the object metadata",
+		},
+		{
+			name: "truncated body",
+			rewrite: func(body []byte, metadata map[string]*string) []byte {
+				return body[:bytes.IndexByte(body, '\n')+1]
+			},
+			reason: "in the object metadata",
+		},
+		{
+			name: "metadata count",
+			rewrite: func(body []byte, metadata map[string]*string) []byte {
+				setMetadata(metadata, manifest.MetaItems, aws.String("1000"))
+				return body
+			},
+			reason: "where the object metadata records 1000",
+		},
+		{
+			name: "manifest checksum",
+			manifest: func(file *state.ImportResult) {
+				file.SHA256 = strings.Repeat("0", 64)
+			},
+			reason: "in the manifest",
+		},
+		{
+			name: "manifest count",
+			manifest: func(file *state.ImportResult) {
+				file.Items++
+			},
+			reason: "where the manifest records",
+		},
+		{
+			// the manifest's sum still has to match
+			name: "metadata stripped",
+			rewrite: func(body []byte, metadata map[string]*string) []byte {
+				setMetadata(metadata, manifest.MetaSHA256, nil)
+				setMetadata(metadata, manifest.MetaItems, nil)
+				return bytes.Replace(body, []byte("Title"), []byte("Titel"), 1)
+			},
+			reason: "in the manifest",
+		},
+		{
+			// a file from before checksums were recorded is imported unchecked
+			name: "unrecorded",
+			rewrite: func(body []byte, metadata map[string]*string) []byte {
+				setMetadata(metadata, manifest.MetaSHA256, nil)
+				setMetadata(metadata, manifest.MetaItems, nil)
+				return body
+			},
+			manifest: func(file *state.ImportResult) {
+				file.SHA256 = ""
+				file.Items = 0
+			},
+		},
+	}
+
+	for _, test := range tests {
+
+		test := test
+
+		t.Run(test.name, func(t *testing.T) {
+
+			clients := clonetest.NewClients()
+
+			loadSource(t, clients.Source)
+
+			run := cloneTable(t, state.Schema{
+				Region:        clonetest.Region,
+				Bucket:        testBucket,
+				OrigTableName: sourceDB,
+				NewTableName:  destDB,
+				ExportConfig:  state.ExportConfig{Mode: state.ModeStaged},
+			}, 0, clone.WithClients(clients))
+
+			if len(run.files) == 0 {
+				t.Fatalf("nothing was staged")
+			}
+
+			file := run.files[0]
+
+			if test.rewrite != nil {
+				rewriteObject(t, clients.Staging, file.Key, test.rewrite)
+			}
+
+			input := run.input
+			input.Import = state.ImportResult{Records: file.Key, Format: file.Format, Items: file.Items, SHA256: file.SHA256}
+
+			if test.manifest != nil {
+				test.manifest(&input.Import)
+			}
+
+			writes := clients.Dest.Calls("BatchWriteItem")
+
+			dataWriter, err := clone.NewDataWriter(context.Background(), input, clone.WithClients(clients))
+
+			if err != nil {
+				t.Fatalf("invalid data import: %v", err)
+			}
+
+			_, err = dataWriter.Run()
+
+			if test.reason == "" {
+
+				if err != nil {
+					t.Fatalf("data import failed: %v", err)
+				}
+
+				return
+			}
+
+			var integrity *clonerr.IntegrityFailure
+
+			if !errors.As(err, &integrity) {
+				t.Fatalf("data import returned %v, expected an integrity failure", err)
+			}
+
+			if integrity.Key != file.Key || !strings.Contains(integrity.Reason, test.reason) {
+				t.Errorf("integrity failure %v, expected one on %s %s", err, file.Key, test.reason)
+			}
+
+			// nothing is written from a bad file
+			if calls := clients.Dest.Calls("BatchWriteItem"); calls != writes {
+				t.Errorf("%d writes made from a bad file", calls-writes)
+			}
+		})
+	}
+}
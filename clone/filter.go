@@ -0,0 +1,109 @@
+package clone
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/NixM0nk3y/dynamodb-clone/state"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// expression attribute name placeholders, i.e. #name
+var namePlaceholder = regexp.MustCompile(`#[A-Za-z0-9_]+`)
+
+//
+// A projection has to carry the key attributes or the items couldn't be
+// written to the new table, any it leaves out are added as placeholders
+//
+func withKeys(filter state.Filter, keySchema []*dynamodb.KeySchemaElement) state.Filter {
+
+	if filter.Projection == "" {
+		return filter
+	}
+
+	projected := map[string]bool{}
+
+	for _, path := range strings.Split(filter.Projection, ",") {
+
+		// only the top level attribute of a document path matters
+		name := strings.TrimSpace(path)
+
+		if end := strings.IndexAny(name, ".["); end >= 0 {
+			name = name[:end]
+		}
+
+		if strings.HasPrefix(name, "#") {
+			name = filter.Names[name]
+		}
+
+		projected[name] = true
+	}
+
+	names := map[string]string{}
+
+	for placeholder, name := range filter.Names {
+		names[placeholder] = name
+	}
+
+	projection := filter.Projection
+
+	for i, element := range keySchema {
+
+		name := aws.StringValue(element.AttributeName)
+
+		if projected[name] {
+			continue
+		}
+
+		placeholder := fmt.Sprintf("#clonekey%d", i)
+
+		names[placeholder] = name
+		projection += ", " + placeholder
+	}
+
+	filter.Projection = projection
+	filter.Names = names
+
+	return filter
+}
+
+// usedNames returns the attribute names referenced by the expressions, the
+// API rejects any which go unused
+func usedNames(names map[string]string, expressions ...string) map[string]*string {
+
+	used := map[string]*string{}
+
+	for _, expression := range expressions {
+		for _, placeholder := range namePlaceholder.FindAllString(expression, -1) {
+			if name, ok := names[placeholder]; ok {
+				used[placeholder] = aws.String(name)
+			}
+		}
+	}
+
+	if len(used) == 0 {
+		return nil
+	}
+
+	return used
+}
+
+// applyFilter narrows a scan to the filtered items and projected attributes
+func applyFilter(params *dynamodb.ScanInput, filter state.Filter) {
+
+	if filter.Expression != "" {
+		params.FilterExpression = aws.String(filter.Expression)
+	}
+
+	if filter.Projection != "" {
+		params.ProjectionExpression = aws.String(filter.Projection)
+	}
+
+	params.ExpressionAttributeNames = usedNames(filter.Names, filter.Expression, filter.Projection)
+
+	if filter.Expression != "" && len(filter.Values) > 0 {
+		params.ExpressionAttributeValues = filter.Values
+	}
+}
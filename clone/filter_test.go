@@ -0,0 +1,177 @@
+package clone
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/NixM0nk3y/dynamodb-clone/clonerr"
+	"github.com/NixM0nk3y/dynamodb-clone/state"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+func TestWithKeys(t *testing.T) {
+
+	keySchema := []*dynamodb.KeySchemaElement{
+		{AttributeName: aws.String("pk"), KeyType: aws.String(dynamodb.KeyTypeHash)},
+		{AttributeName: aws.String("sk"), KeyType: aws.String(dynamodb.KeyTypeRange)},
+	}
+
+	tests := []struct {
+		name     string
+		filter   state.Filter
+		expected state.Filter
+	}{
+		{
+			name:     "no projection",
+			filter:   state.Filter{Expression: "#s = :s", Names: map[string]string{"#s": "status"}},
+			expected: state.Filter{Expression: "#s = :s", Names: map[string]string{"#s": "status"}},
+		},
+		{
+			name:     "keys projected",
+			filter:   state.Filter{Projection: "pk, sk, title"},
+			expected: state.Filter{Projection: "pk, sk, title", Names: map[string]string{}},
+		},
+		{
+			name:   "keys left out",
+			filter: state.Filter{Projection: "title"},
+			expected: state.Filter{
+				Projection: "title, #clonekey0, #clonekey1",
+				Names:      map[string]string{"#clonekey0": "pk", "#clonekey1": "sk"},
+			},
+		},
+		{
+			name:   "key behind a placeholder",
+			filter: state.Filter{Projection: "#p, title", Names: map[string]string{"#p": "pk"}},
+			expected: state.Filter{
+				Projection: "#p, title, #clonekey1",
+				Names:      map[string]string{"#p": "pk", "#clonekey1": "sk"},
+			},
+		},
+		{
+			name:   "document path",
+			filter: state.Filter{Projection: "pk.inner, sk[0], title"},
+			expected: state.Filter{
+				Projection: "pk.inner, sk[0], title",
+				Names:      map[string]string{},
+			},
+		},
+	}
+
+	for _, test := range tests {
+
+		test := test
+
+		t.Run(test.name, func(t *testing.T) {
+			if filter := withKeys(test.filter, keySchema); !reflect.DeepEqual(filter, test.expected) {
+				t.Errorf("projected %+v, expected %+v", filter, test.expected)
+			}
+		})
+	}
+}
+
+func TestApplyFilter(t *testing.T) {
+
+	active := map[string]*dynamodb.AttributeValue{":a": {S: aws.String("active")}}
+
+	tests := []struct {
+		name     string
+		filter   state.Filter
+		expected dynamodb.ScanInput
+	}{
+		{
+			name: "none",
+		},
+		{
+			name:   "expression",
+			filter: state.Filter{Expression: "#s = :a", Names: map[string]string{"#s": "status"}, Values: active},
+			expected: dynamodb.ScanInput{
+				FilterExpression:          aws.String("#s = :a"),
+				ExpressionAttributeNames:  map[string]*string{"#s": aws.String("status")},
+				ExpressionAttributeValues: active,
+			},
+		},
+		{
+			// the API rejects names and values the expressions don't use
+			name: "projection",
+			filter: state.Filter{
+				Projection: "title, #clonekey0",
+				Names:      map[string]string{"#clonekey0": "pk", "#s": "status"},
+				Values:     active,
+			},
+			expected: dynamodb.ScanInput{
+				ProjectionExpression:     aws.String("title, #clonekey0"),
+				ExpressionAttributeNames: map[string]*string{"#clonekey0": aws.String("pk")},
+			},
+		},
+		{
+			name: "both",
+			filter: state.Filter{
+				Expression: "#s = :a",
+				Projection: "#t",
+				Names:      map[string]string{"#s": "status", "#t": "title", "#u": "unused"},
+				Values:     active,
+			},
+			expected: dynamodb.ScanInput{
+				FilterExpression:          aws.String("#s = :a"),
+				ProjectionExpression:      aws.String("#t"),
+				ExpressionAttributeNames:  map[string]*string{"#s": aws.String("status"), "#t": aws.String("title")},
+				ExpressionAttributeValues: active,
+			},
+		},
+	}
+
+	for _, test := range tests {
+
+		test := test
+
+		t.Run(test.name, func(t *testing.T) {
+
+			var params dynamodb.ScanInput
+
+			applyFilter(&params, test.filter)
+
+			if !reflect.DeepEqual(params, test.expected) {
+				t.Errorf("scanned with %v, expected %v", params, test.expected)
+			}
+		})
+	}
+}
+
+func TestFilterInvalid(t *testing.T) {
+
+	filter := state.Filter{Expression: "#s = :a", Names: map[string]string{"#s": "status"}}
+
+	tests := []struct {
+		name  string
+		input state.Schema
+	}{
+		{
+			name:  "point in time",
+			input: state.Schema{ExportConfig: state.ExportConfig{Mode: state.ModePointInTime, Filter: filter}},
+		},
+		{
+			name: "kept in sync",
+			input: state.Schema{
+				ExportConfig: state.ExportConfig{Mode: state.ModeStaged, Filter: filter},
+				SyncConfig:   state.SyncConfig{Enabled: true},
+			},
+		},
+	}
+
+	for _, test := range tests {
+
+		test := test
+
+		t.Run(test.name, func(t *testing.T) {
+
+			var invalid *clonerr.SchemaInvalid
+
+			if _, err := NewSchemaReader(context.Background(), test.input); !errors.As(err, &invalid) {
+				t.Errorf("filtered clone started, %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,111 @@
+package clone
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/NixM0nk3y/dynamodb-clone/clonerr"
+	"github.com/NixM0nk3y/dynamodb-clone/log"
+	"github.com/NixM0nk3y/dynamodb-clone/manifest"
+	"github.com/NixM0nk3y/dynamodb-clone/state"
+	"go.uber.org/zap"
+)
+
+// ManifestWriter is a
+type ManifestWriter struct {
+	input   state.Schema
+	clients Clients
+	ctx     context.Context
+	err     error
+}
+
+// NewManifestWriter returns a writer merging the segment manifests of a run
+func NewManifestWriter(ctx context.Context, input state.Schema, opts ...Option) (*ManifestWriter, error) {
+
+	// every object of the clone is keyed under the run
+	if input.RunID == "" {
+		return nil, &clonerr.SchemaInvalid{Reason: "no run id passed"}
+	}
+
+	if len(input.Export.Manifests) == 0 {
+		return nil, &clonerr.SchemaInvalid{Reason: "no segment manifests passed to merge"}
+	}
+
+	return &ManifestWriter{
+		input:   input,
+		clients: newClients(ctx, input, opts),
+		ctx:     ctx,
+	}, nil
+}
+
+//
+// Combine the per segment manifests into the single run manifest the
+// importers iterate over
+//
+func (mw *ManifestWriter) mergeManifests() (output state.ExportResult, err error) {
+
+	logger := log.Logger(mw.ctx)
+
+	s3Svc, err := mw.clients.Bucket()
+
+	if err != nil {
+		return
+	}
+
+	runManifest := manifest.New(mw.input.OrigTableName)
+
+	for _, key := range mw.input.Export.Manifests {
+
+		segmentManifest, readErr := manifest.Read(mw.ctx, s3Svc, mw.input.Bucket, key)
+
+		if readErr != nil {
+			logger.Error(fmt.Sprintf("unable to read manifest %s from %s", key, mw.input.Bucket), zap.Error(readErr))
+			return output, &clonerr.StorageFailure{Bucket: mw.input.Bucket, Key: key, Err: readErr}
+		}
+
+		logger.Info(fmt.Sprintf("merging manifest %s", key), zap.Int("files", len(segmentManifest.Files)))
+
+		runManifest.Merge(segmentManifest)
+	}
+
+	output.Manifest = mw.input.Key("manifest.json")
+
+	if writeErr := manifest.Write(mw.ctx, s3Svc, mw.input.Bucket, output.Manifest, runManifest); writeErr != nil {
+		logger.Error(fmt.Sprintf("unable to store manifest %s to %s", output.Manifest, mw.input.Bucket), zap.Error(writeErr))
+		return output, &clonerr.StorageFailure{Bucket: mw.input.Bucket, Key: output.Manifest, Err: writeErr}
+	}
+
+	logger.Info(fmt.Sprintf("stored manifest %s", output.Manifest),
+		zap.Int("files", len(runManifest.Files)),
+		zap.Int64("items", runManifest.Items),
+		zap.Int64("bytes", runManifest.Bytes))
+
+	output.Processed = runManifest.Items
+	output.Complete = true
+
+	return
+}
+
+// Run executes a merge of the segment manifests.
+func (mw *ManifestWriter) Run() (output state.ExportResult, err error) {
+	return mw.mergeManifests()
+}
+
+// ReadManifest loads a manifest written by the data export from the staging bucket
+func ReadManifest(ctx context.Context, input state.Schema, key string, opts ...Option) (m *manifest.Manifest, err error) {
+
+	logger := log.Logger(ctx)
+
+	s3Svc, err := newClients(ctx, input, opts).Bucket()
+
+	if err != nil {
+		return
+	}
+
+	if m, err = manifest.Read(ctx, s3Svc, input.Bucket, key); err != nil {
+		logger.Error(fmt.Sprintf("unable to read manifest %s from %s", key, input.Bucket), zap.Error(err))
+		return nil, &clonerr.StorageFailure{Bucket: input.Bucket, Key: key, Err: err}
+	}
+
+	return
+}
@@ -0,0 +1,187 @@
+package clone
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/NixM0nk3y/dynamodb-clone/clonerr"
+	"github.com/NixM0nk3y/dynamodb-clone/log"
+	"github.com/NixM0nk3y/dynamodb-clone/masking"
+	"github.com/NixM0nk3y/dynamodb-clone/state"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"go.uber.org/zap"
+)
+
+// MaskingReporter is a
+type MaskingReporter struct {
+	input   state.Schema
+	clients Clients
+	ctx     context.Context
+	err     error
+}
+
+// NewMaskingReporter returns a reporter merging the masking reports of a run
+func NewMaskingReporter(ctx context.Context, input state.Schema, opts ...Option) (*MaskingReporter, error) {
+
+	// every object of the clone is keyed under the run
+	if input.RunID == "" {
+		return nil, &clonerr.SchemaInvalid{Reason: "no run id passed"}
+	}
+
+	return &MaskingReporter{
+		input:   input,
+		clients: newClients(ctx, input, opts),
+		ctx:     ctx,
+	}, nil
+}
+
+// storeMaskingReport writes a masking report to the staging bucket
+func storeMaskingReport(ctx context.Context, clients Clients, input state.Schema, key string, report *masking.Report) (err error) {
+
+	logger := log.Logger(ctx)
+
+	s3Svc, err := clients.Bucket()
+
+	if err != nil {
+		return
+	}
+
+	b, err := json.Marshal(report)
+
+	if err != nil {
+		return
+	}
+
+	_, err = s3Svc.PutObjectWithContext(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(input.Bucket),
+		Key:         aws.String(key),
+		Body:        bytes.NewReader(b),
+		ContentType: aws.String("application/json"),
+	})
+
+	if err != nil {
+		logger.Error(fmt.Sprintf("unable to store masking report %s to %s", key, input.Bucket), zap.Error(err))
+		return &clonerr.StorageFailure{Bucket: input.Bucket, Key: key, Err: err}
+	}
+
+	return
+}
+
+func (mr *MaskingReporter) readPart(s3Svc s3iface.S3API, key string) (report *masking.Report, err error) {
+
+	result, err := s3Svc.GetObjectWithContext(mr.ctx, &s3.GetObjectInput{
+		Bucket: aws.String(mr.input.Bucket),
+		Key:    aws.String(key),
+	})
+
+	if err != nil {
+		return nil, &clonerr.StorageFailure{Bucket: mr.input.Bucket, Key: key, Err: err}
+	}
+
+	defer result.Body.Close()
+
+	if err = json.NewDecoder(result.Body).Decode(&report); err != nil {
+		return nil, &clonerr.StorageFailure{Bucket: mr.input.Bucket, Key: key, Err: err}
+	}
+
+	return
+}
+
+//
+// Every import invocation leaves a partial report of the items it masked,
+// these are merged into a single report for the run
+//
+func (mr *MaskingReporter) merge() (output state.MaskingResult, err error) {
+
+	logger := log.Logger(mr.ctx)
+
+	config := mr.input.ImportConfig.Masking
+
+	if !config.Enabled() {
+		logger.Info("clone isn't masked")
+		output.Complete = true
+		return
+	}
+
+	s3Svc, err := mr.clients.Bucket()
+
+	if err != nil {
+		return
+	}
+
+	report := &masking.Report{
+		Profile:    config.Profile,
+		Strategies: map[string]string{},
+		Attributes: map[string]int64{},
+	}
+
+	// every rule is listed, even those which matched nothing
+	for _, rule := range config.Rules {
+		report.Strategies[rule.Path] = rule.Strategy
+		report.Attributes[rule.Path] += 0
+	}
+
+	prefix := mr.input.Key("masking", "parts") + "/"
+
+	var keys []string
+
+	err = s3Svc.ListObjectsV2PagesWithContext(mr.ctx, &s3.ListObjectsV2Input{
+		Bucket: aws.String(mr.input.Bucket),
+		Prefix: aws.String(prefix),
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+
+		for _, object := range page.Contents {
+			keys = append(keys, aws.StringValue(object.Key))
+		}
+
+		return true
+	})
+
+	if err != nil {
+		return output, &clonerr.StorageFailure{Bucket: mr.input.Bucket, Key: prefix, Err: err}
+	}
+
+	for _, key := range keys {
+
+		part, readErr := mr.readPart(s3Svc, key)
+
+		if readErr != nil {
+			logger.Error(fmt.Sprintf("unable to read masking report %s", key), zap.Error(readErr))
+			return output, readErr
+		}
+
+		report.Merge(part)
+	}
+
+	output.Report = mr.input.Key("masking", "report.json")
+	output.Profile = report.Profile
+	output.Items = report.Items
+
+	for _, count := range report.Attributes {
+		if count > 0 {
+			output.Attributes++
+		}
+	}
+
+	if err = storeMaskingReport(mr.ctx, mr.clients, mr.input, output.Report, report); err != nil {
+		return
+	}
+
+	logger.Info(fmt.Sprintf("stored masking report %s", output.Report),
+		zap.Int("parts", len(keys)),
+		zap.Int64("items", report.Items),
+		zap.Any("attributes", report.Attributes))
+
+	output.Complete = true
+
+	return
+}
+
+// Run executes a merge of the masking reports.
+func (mr *MaskingReporter) Run() (output state.MaskingResult, err error) {
+	return mr.merge()
+}
@@ -0,0 +1,153 @@
+package clone
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/NixM0nk3y/dynamodb-clone/clonerr"
+	"github.com/NixM0nk3y/dynamodb-clone/log"
+	"github.com/NixM0nk3y/dynamodb-clone/masking"
+	"github.com/NixM0nk3y/dynamodb-clone/state"
+	"github.com/NixM0nk3y/dynamodb-clone/transform"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/arn"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+	"go.uber.org/zap"
+)
+
+// itemPipeline masks and then transforms items on their way into the new table
+type itemPipeline struct {
+	masker     *masking.Masker
+	transforms *transform.Pipeline
+}
+
+//
+// Build the item pipeline from the import configuration, the masking secret
+// is fetched from Secrets Manager with our own credentials in the secret's
+// region
+//
+func newItemPipeline(ctx context.Context, clients Clients, input state.Schema) (pipeline *itemPipeline, err error) {
+
+	pipeline = &itemPipeline{}
+
+	if pipeline.transforms, err = transform.New(input.ImportConfig.Transforms); err != nil {
+		return nil, &clonerr.SchemaInvalid{Reason: "invalid transform", Err: err}
+	}
+
+	config := input.ImportConfig.Masking
+
+	if !config.Enabled() {
+		return
+	}
+
+	var secret []byte
+
+	if masking.NeedsSecret(config) {
+		if secret, err = maskingSecret(ctx, clients, config.SecretArn); err != nil {
+			return nil, err
+		}
+	}
+
+	if pipeline.masker, err = masking.New(config, secret); err != nil {
+		return nil, &clonerr.SchemaInvalid{Reason: "invalid masking profile", Err: err}
+	}
+
+	return
+}
+
+// validatePipeline checks the transforms and masking profile up front, the
+// secret isn't needed to check the profile's rules
+func validatePipeline(input state.Schema) error {
+
+	if _, err := transform.New(input.ImportConfig.Transforms); err != nil {
+		return &clonerr.SchemaInvalid{Reason: "invalid transform", Err: err}
+	}
+
+	if config := input.ImportConfig.Masking; config.Enabled() {
+
+		if masking.NeedsSecret(config) && config.SecretArn == "" {
+			return &clonerr.SchemaInvalid{Reason: fmt.Sprintf("masking profile %s needs a secretarn", config.Profile)}
+		}
+
+		if _, err := masking.New(config, []byte("validate")); err != nil {
+			return &clonerr.SchemaInvalid{Reason: "invalid masking profile", Err: err}
+		}
+	}
+
+	return nil
+}
+
+func maskingSecret(ctx context.Context, clients Clients, secretArn string) (secret []byte, err error) {
+
+	logger := log.Logger(ctx)
+
+	parsed, err := arn.Parse(secretArn)
+
+	if err != nil {
+		return nil, &clonerr.SchemaInvalid{Reason: "invalid masking secret arn", Err: err}
+	}
+
+	svc, err := clients.SecretsManager(parsed.Region)
+
+	if err != nil {
+		return
+	}
+
+	result, err := svc.GetSecretValueWithContext(ctx, &secretsmanager.GetSecretValueInput{
+		SecretId: aws.String(secretArn),
+	})
+
+	if err != nil {
+		logger.Error(fmt.Sprintf("unable to read masking secret %s", secretArn), zap.Error(err))
+		return nil, err
+	}
+
+	if result.SecretString != nil {
+		return []byte(*result.SecretString), nil
+	}
+
+	return result.SecretBinary, nil
+}
+
+// apply masks and transforms a batch in place, the report is nil when the
+// clone isn't masked
+func (p *itemPipeline) apply(items []map[string]*dynamodb.AttributeValue) (report *masking.Report, err error) {
+
+	if p.masker != nil {
+		if report, err = p.masker.Items(items); err != nil {
+			return nil, &clonerr.SchemaInvalid{Reason: "unable to mask item", Err: err}
+		}
+	}
+
+	if err = p.transforms.Items(items); err != nil {
+		return nil, &clonerr.SchemaInvalid{Reason: "unable to transform item", Err: err}
+	}
+
+	return
+}
+
+// newReport returns an empty masking report, nil when the clone isn't masked
+func (p *itemPipeline) newReport() *masking.Report {
+
+	if p.masker == nil {
+		return nil
+	}
+
+	return p.masker.NewReport()
+}
+
+// maskingPartKey names the partial report of an invocation, a retried
+// invocation replaces rather than adds to it
+func maskingPartKey(input state.Schema, source string, start int64) string {
+
+	name := path.Base(source)
+
+	if dot := strings.Index(name, "."); dot > 0 {
+		name = name[:dot]
+	}
+
+	return input.Key("masking", "parts", fmt.Sprintf("%s-%012d.json", name, start))
+}
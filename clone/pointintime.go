@@ -0,0 +1,219 @@
+package clone
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"path"
+	"time"
+
+	"github.com/NixM0nk3y/dynamodb-clone/clonerr"
+	"github.com/NixM0nk3y/dynamodb-clone/datafile"
+	"github.com/NixM0nk3y/dynamodb-clone/log"
+	"github.com/NixM0nk3y/dynamodb-clone/manifest"
+	"github.com/NixM0nk3y/dynamodb-clone/state"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"go.uber.org/zap"
+)
+
+// how often a running point in time export is described
+const exportPollInterval = 10 * time.Second
+
+// exportFormat maps a data file format onto the formats DynamoDB exports
+func exportFormat(format string) (string, error) {
+
+	switch datafile.Format(format) {
+	case datafile.FormatDynamoDB:
+		return dynamodb.ExportFormatDynamodbJson, nil
+	case datafile.FormatIon:
+		return dynamodb.ExportFormatIon, nil
+	}
+
+	return "", fmt.Errorf("a point in time export can't write %q data files", format)
+}
+
+//
+// Start the export of the source table into the run's prefix of the staging
+// bucket, the client token is derived from the run so a retried invocation
+// picks up the export already started rather than starting another
+//
+func (dr *DataReader) startExport(svc dynamodbiface.DynamoDBAPI) (exportArn string, err error) {
+
+	logger := log.Logger(dr.ctx)
+
+	table, err := svc.DescribeTableWithContext(dr.ctx, &dynamodb.DescribeTableInput{
+		TableName: aws.String(dr.input.OrigTableName),
+	})
+
+	if err != nil {
+		logger.Error("unable to describe table", zap.Error(err))
+		return "", clonerr.FromDynamoDB(dr.input.OrigTableName, err)
+	}
+
+	format, _ := exportFormat(dr.input.ExportConfig.Format)
+
+	token := sha256.Sum256([]byte(dr.input.RunID))
+
+	params := &dynamodb.ExportTableToPointInTimeInput{
+		TableArn:     table.Table.TableArn,
+		S3Bucket:     aws.String(dr.input.Bucket),
+		S3Prefix:     aws.String(dr.input.Key("export")),
+		ExportFormat: aws.String(format),
+		ClientToken:  aws.String(hex.EncodeToString(token[:16])),
+	}
+
+	if pointInTime := dr.input.ExportConfig.PointInTime; pointInTime > 0 {
+		params.ExportTime = aws.Time(time.Unix(0, pointInTime*int64(time.Millisecond)))
+	}
+
+	// the export is written with the source's credentials, which have to be
+	// told who owns a bucket in another account
+	if dr.input.SourceRoleArn != "" {
+
+		owner, ownerErr := dr.clients.BucketOwner()
+
+		if ownerErr != nil {
+			return "", ownerErr
+		}
+
+		params.S3BucketOwner = aws.String(owner)
+	}
+
+	result, err := svc.ExportTableToPointInTimeWithContext(dr.ctx, params)
+
+	if err != nil {
+		logger.Error("unable to start point in time export", zap.Error(err))
+		return "", clonerr.FromDynamoDB(dr.input.OrigTableName, err)
+	}
+
+	exportArn = aws.StringValue(result.ExportDescription.ExportArn)
+
+	logger.Info(fmt.Sprintf("started point in time export %s", exportArn),
+		zap.String("format", format),
+		zap.Timep("exporttime", params.ExportTime))
+
+	return
+}
+
+//
+// Export a consistent snapshot of the source table with
+// ExportTableToPointInTime. The export runs for minutes to hours, so each
+// invocation polls it until shortly before its deadline and hands back the
+// export's arn to carry on from. Once it completes its manifest-files.json is
+// recorded as the segment manifest for the import.
+//
+func (dr *DataReader) dynamodbExport() (output state.ExportResult, err error) {
+
+	logger := log.Logger(dr.ctx)
+
+	// https://docs.aws.amazon.com/lambda/latest/dg/golang-context.html
+	timeoutChannel := timeout(dr.ctx, 3000*time.Millisecond)
+
+	svc, err := dr.clients.SourceDynamoDB()
+
+	if err != nil {
+		return
+	}
+
+	// have we got previous results ?
+	if dr.input.Export.ExportArn != "" {
+		output = dr.input.Export
+	}
+
+	if output.ExportArn == "" {
+		if output.ExportArn, err = dr.startExport(svc); err != nil {
+			return
+		}
+	}
+
+	output.Manifest = dr.input.Key("manifests", fmt.Sprintf("segment-%04d.json", dr.input.ExportConfig.Segment))
+
+	for {
+
+		result, describeErr := svc.DescribeExportWithContext(dr.ctx, &dynamodb.DescribeExportInput{
+			ExportArn: aws.String(output.ExportArn),
+		})
+
+		if describeErr != nil {
+			logger.Error("unable to describe point in time export", zap.Error(describeErr))
+			return output, clonerr.FromDynamoDB(dr.input.OrigTableName, describeErr)
+		}
+
+		export := result.ExportDescription
+
+		switch aws.StringValue(export.ExportStatus) {
+
+		case dynamodb.ExportStatusCompleted:
+
+			logger.Info(fmt.Sprintf("point in time export %s completed", output.ExportArn),
+				zap.Int64("items", aws.Int64Value(export.ItemCount)),
+				zap.Int64("bytes", aws.Int64Value(export.BilledSizeBytes)))
+
+			err = dr.storeExportManifest(output.Manifest, aws.StringValue(export.ExportManifest))
+
+			if err != nil {
+				return
+			}
+
+			output.Processed = aws.Int64Value(export.ItemCount)
+			output.Complete = true
+
+			return
+
+		case dynamodb.ExportStatusFailed:
+
+			err = &clonerr.ExportFailed{
+				Table:  dr.input.OrigTableName,
+				Export: output.ExportArn,
+				Code:   aws.StringValue(export.FailureCode),
+				Reason: aws.StringValue(export.FailureMessage),
+			}
+
+			logger.Error("point in time export failed", zap.Error(err))
+
+			return
+		}
+
+		logger.Info(fmt.Sprintf("waiting on point in time export %s", output.ExportArn))
+
+		select {
+		case <-timeoutChannel:
+			logger.Warn("data export lambda duration expired, export still running")
+			return
+		case <-dr.ctx.Done():
+			return output, dr.ctx.Err()
+		case <-time.After(exportPollInterval):
+		}
+	}
+}
+
+//
+// storeExportManifest lists the data files of a completed export in the
+// segment manifest, manifest-files.json sits alongside the summary the
+// export reports
+//
+func (dr *DataReader) storeExportManifest(key string, summaryKey string) (err error) {
+
+	logger := log.Logger(dr.ctx)
+
+	s3Svc, err := dr.clients.Bucket()
+
+	if err != nil {
+		return
+	}
+
+	filesKey := path.Join(path.Dir(summaryKey), "manifest-files.json")
+
+	exportManifest, err := manifest.ReadExport(dr.ctx, s3Svc, dr.input.Bucket, filesKey, dr.input.OrigTableName, dr.input.ExportConfig.Format)
+
+	if err != nil {
+		logger.Error(fmt.Sprintf("unable to read export manifest %s from %s", filesKey, dr.input.Bucket), zap.Error(err))
+		return &clonerr.StorageFailure{Bucket: dr.input.Bucket, Key: filesKey, Err: err}
+	}
+
+	logger.Info(fmt.Sprintf("read export manifest %s", filesKey), zap.Int("files", len(exportManifest.Files)))
+
+	return dr.storeManifest(key, exportManifest)
+}
@@ -0,0 +1,178 @@
+package clone_test
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/NixM0nk3y/dynamodb-clone/clone"
+	"github.com/NixM0nk3y/dynamodb-clone/clonerr"
+	"github.com/NixM0nk3y/dynamodb-clone/clonetest"
+	"github.com/NixM0nk3y/dynamodb-clone/datafile"
+	"github.com/NixM0nk3y/dynamodb-clone/state"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// enablePITR turns on point in time recovery of the source, an export needs it
+func enablePITR(t *testing.T, svc *clonetest.DynamoDB) {
+
+	t.Helper()
+
+	_, err := svc.UpdateContinuousBackupsWithContext(context.Background(), &dynamodb.UpdateContinuousBackupsInput{
+		TableName: aws.String(sourceDB),
+		PointInTimeRecoverySpecification: &dynamodb.PointInTimeRecoverySpecification{
+			PointInTimeRecoveryEnabled: aws.Bool(true),
+		},
+	})
+
+	if err != nil {
+		t.Fatalf("unable to enable point in time recovery: %v", err)
+	}
+}
+
+func TestPointInTimeExport(t *testing.T) {
+
+	tests := []struct {
+		name     string
+		format   string
+		pending  int // times the export is described before it completes
+		deadline time.Duration
+	}{
+		{
+			name: "dynamodb json",
+		},
+		{
+			name:   "ion",
+			format: "ion",
+		},
+		{
+			// each invocation describes the export once before handing back
+			name:     "polled",
+			format:   "ion",
+			pending:  2,
+			deadline: 3500 * time.Millisecond,
+		},
+	}
+
+	for _, test := range tests {
+
+		test := test
+
+		t.Run(test.name, func(t *testing.T) {
+
+			clients := clonetest.NewClients()
+
+			items := loadSource(t, clients.Source)
+
+			enablePITR(t, clients.Source)
+
+			clients.Source.ExportPending = test.pending
+
+			input := state.Schema{
+				Region:        clonetest.Region,
+				Bucket:        testBucket,
+				OrigTableName: sourceDB,
+				NewTableName:  destDB,
+				ExportConfig:  state.ExportConfig{Mode: state.ModePointInTime, Format: test.format},
+			}
+
+			run := cloneTable(t, input, test.deadline, clone.WithClients(clients))
+
+			source := clients.Source.Items(sourceDB)
+			dest := clients.Dest.Items(destDB)
+
+			if !reflect.DeepEqual(source, dest) {
+				t.Fatalf("destination doesn't match the source,\nsource: %v\ndest: %v", source, dest)
+			}
+
+			if run.exported != int64(items) || run.staged != int64(items) {
+				t.Errorf("exported %d items and staged %d, the source holds %d", run.exported, run.staged, items)
+			}
+
+			// the fake writes four items a file
+			if len(run.files) < 2 {
+				t.Errorf("the export was read from %d files", len(run.files))
+			}
+
+			format := string(datafile.DefaultFormat)
+
+			if test.format != "" {
+				format = test.format
+			}
+
+			extension := map[string]string{"dynamodb": ".json.gz", "ion": ".ion.gz"}[format]
+
+			for _, file := range run.files {
+				if file.Format != format || !strings.HasSuffix(file.Key, extension) {
+					t.Errorf("export file %s listed as %s, expected a %s %s file", file.Key, file.Format, format, extension)
+				}
+			}
+
+			if run.resumed["data export"] != test.pending {
+				t.Errorf("the export was handed back %d times while running, expected %d", run.resumed["data export"], test.pending)
+			}
+
+			// the resumed invocations carry on with the export already started
+			if calls := clients.Source.Calls("ExportTableToPointInTime"); calls != 1 {
+				t.Errorf("started %d exports", calls)
+			}
+		})
+	}
+}
+
+func TestPointInTimeExportFailed(t *testing.T) {
+
+	clients := clonetest.NewClients()
+
+	loadSource(t, clients.Source)
+
+	enablePITR(t, clients.Source)
+
+	clients.Source.ExportFailure = "S3AccessDenied"
+
+	input := state.Schema{
+		Region:        clonetest.Region,
+		Bucket:        testBucket,
+		OrigTableName: sourceDB,
+		NewTableName:  destDB,
+		ExportConfig:  state.ExportConfig{Mode: state.ModePointInTime},
+	}
+
+	schemaReader, err := clone.NewSchemaReader(context.Background(), input, clone.WithClients(clients))
+
+	if err != nil {
+		t.Fatalf("invalid schema export: %v", err)
+	}
+
+	schemaResult, err := schemaReader.Run()
+
+	if err != nil {
+		t.Fatalf("schema export failed: %v", err)
+	}
+
+	input.RunID = schemaResult.RunID
+	input.ExportConfig = schemaResult.Segments[0]
+
+	dataReader, err := clone.NewDataReader(context.Background(), input, clone.WithClients(clients))
+
+	if err != nil {
+		t.Fatalf("invalid data export: %v", err)
+	}
+
+	output, err := dataReader.Run()
+
+	var failed *clonerr.ExportFailed
+
+	if !errors.As(err, &failed) || failed.Code != "S3AccessDenied" || failed.Table != sourceDB {
+		t.Fatalf("export failed with %v, expected an S3AccessDenied export failure", err)
+	}
+
+	// the state machine doesn't retry a failed export
+	if retryable(err) || output.Complete {
+		t.Errorf("failed export handed back %+v, retryable %t", output, retryable(err))
+	}
+}
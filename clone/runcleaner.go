@@ -0,0 +1,271 @@
+package clone
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/NixM0nk3y/dynamodb-clone/clonerr"
+	"github.com/NixM0nk3y/dynamodb-clone/log"
+	"github.com/NixM0nk3y/dynamodb-clone/state"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"go.uber.org/zap"
+)
+
+// DeleteObjects takes at most 1000 keys a call
+const deleteBatchSize = 1000
+
+// runGrace is how long since its last object was staged that a run may
+// still be in flight, pruning leaves it alone until then
+const runGrace = 24 * time.Hour
+
+// runMarker is written first by every run, a folder without it wasn't staged by a run
+const runMarker = "schema.json"
+
+// run is the set of staged objects sharing a run id
+type run struct {
+	id       string
+	keys     []string
+	modified time.Time
+	marked   bool
+}
+
+// RunCleaner is a
+type RunCleaner struct {
+	input   state.Schema
+	clients Clients
+	ctx     context.Context
+	err     error
+}
+
+// NewRunCleaner returns a cleaner applying the retention mode to the staged runs
+func NewRunCleaner(ctx context.Context, input state.Schema, opts ...Option) (*RunCleaner, error) {
+
+	// every object of the clone is keyed under the run
+	if input.RunID == "" {
+		return nil, &clonerr.SchemaInvalid{Reason: "no run id passed"}
+	}
+
+	// Default to keeping everything
+	if input.Retention.Mode == "" {
+		input.Retention.Mode = state.RetentionKeep
+	}
+
+	switch input.Retention.Mode {
+	case state.RetentionKeep, state.RetentionPurge, state.RetentionPrune:
+	default:
+		return nil, &clonerr.SchemaInvalid{Reason: fmt.Sprintf("unknown retention mode %s", input.Retention.Mode)}
+	}
+
+	if input.Retention.KeepRuns < 0 {
+		return nil, &clonerr.SchemaInvalid{Reason: "negative number of runs to keep"}
+	}
+
+	return &RunCleaner{
+		input:   input,
+		clients: newClients(ctx, input, opts),
+		ctx:     ctx,
+	}, nil
+}
+
+//
+// Group every staged object of the source table by its run id, objects
+// staged before keys were run scoped sit directly under the table and are
+// left alone, as is any folder without the schema every run stages first as
+// run ids are execution names and can't be told apart by their shape
+//
+func (rc *RunCleaner) listRuns(s3Svc s3iface.S3API) (runs map[string]*run, err error) {
+
+	prefix := rc.input.TablePrefix()
+
+	runs = map[string]*run{}
+
+	err = s3Svc.ListObjectsV2PagesWithContext(rc.ctx, &s3.ListObjectsV2Input{
+		Bucket: aws.String(rc.input.Bucket),
+		Prefix: aws.String(prefix),
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+
+		for _, object := range page.Contents {
+
+			key := aws.StringValue(object.Key)
+
+			parts := strings.SplitN(strings.TrimPrefix(key, prefix), "/", 2)
+
+			if len(parts) < 2 {
+				continue
+			}
+
+			r, ok := runs[parts[0]]
+
+			if !ok {
+				r = &run{id: parts[0]}
+				runs[parts[0]] = r
+			}
+
+			r.keys = append(r.keys, key)
+
+			if parts[1] == runMarker {
+				r.marked = true
+			}
+
+			if modified := aws.TimeValue(object.LastModified); modified.After(r.modified) {
+				r.modified = modified
+			}
+		}
+
+		return true
+	})
+
+	if err != nil {
+		return nil, &clonerr.StorageFailure{Bucket: rc.input.Bucket, Key: prefix, Err: err}
+	}
+
+	for id, r := range runs {
+		if !r.marked && id != rc.input.RunID {
+			delete(runs, id)
+		}
+	}
+
+	return
+}
+
+func (rc *RunCleaner) deleteKeys(s3Svc s3iface.S3API, keys []string) (removed int64, err error) {
+
+	logger := log.Logger(rc.ctx)
+
+	for start := 0; start < len(keys); start += deleteBatchSize {
+
+		end := start + deleteBatchSize
+
+		if end > len(keys) {
+			end = len(keys)
+		}
+
+		objects := make([]*s3.ObjectIdentifier, 0, end-start)
+
+		for _, key := range keys[start:end] {
+			objects = append(objects, &s3.ObjectIdentifier{Key: aws.String(key)})
+		}
+
+		result, deleteErr := s3Svc.DeleteObjectsWithContext(rc.ctx, &s3.DeleteObjectsInput{
+			Bucket: aws.String(rc.input.Bucket),
+			Delete: &s3.Delete{
+				Objects: objects,
+				Quiet:   aws.Bool(true),
+			},
+		})
+
+		if deleteErr != nil {
+			logger.Error(fmt.Sprintf("unable to delete objects from %s", rc.input.Bucket), zap.Error(deleteErr))
+			return removed, &clonerr.StorageFailure{Bucket: rc.input.Bucket, Key: keys[start], Err: deleteErr}
+		}
+
+		if len(result.Errors) > 0 {
+			failed := result.Errors[0]
+			logger.Error(fmt.Sprintf("unable to delete %d objects from %s", len(result.Errors), rc.input.Bucket))
+			return removed, &clonerr.StorageFailure{
+				Bucket: rc.input.Bucket,
+				Key:    aws.StringValue(failed.Key),
+				Err:    fmt.Errorf("%s: %s", aws.StringValue(failed.Code), aws.StringValue(failed.Message)),
+			}
+		}
+
+		removed += int64(len(objects))
+	}
+
+	return
+}
+
+//
+// Remove staged runs as the retention mode asks, purge drops the current
+// run while prune keeps the newest runs and never touches the current one
+// or any staged to recently enough that it may still be running
+//
+func (rc *RunCleaner) cleanup() (output state.CleanupResult, err error) {
+
+	logger := log.Logger(rc.ctx)
+
+	if rc.input.Retention.Mode == state.RetentionKeep {
+		logger.Info("retaining staged objects")
+		output.Complete = true
+		return
+	}
+
+	s3Svc, err := rc.clients.Bucket()
+
+	if err != nil {
+		return
+	}
+
+	runs, err := rc.listRuns(s3Svc)
+
+	if err != nil {
+		return
+	}
+
+	var expired []*run
+
+	switch rc.input.Retention.Mode {
+	case state.RetentionPurge:
+
+		if current, ok := runs[rc.input.RunID]; ok {
+			expired = append(expired, current)
+		}
+
+	case state.RetentionPrune:
+
+		var previous []*run
+
+		for id, r := range runs {
+
+			if id == rc.input.RunID {
+				continue
+			}
+
+			// another clone of the table may be staging it right now
+			if time.Since(r.modified) < runGrace {
+				logger.Info(fmt.Sprintf("keeping run %s, staged to within the last %s", r.id, runGrace))
+				continue
+			}
+
+			previous = append(previous, r)
+		}
+
+		// newest first
+		sort.Slice(previous, func(i, j int) bool {
+			return previous[i].modified.After(previous[j].modified)
+		})
+
+		if keep := int(rc.input.Retention.KeepRuns); len(previous) > keep {
+			expired = previous[keep:]
+		}
+	}
+
+	for _, r := range expired {
+
+		removed, deleteErr := rc.deleteKeys(s3Svc, r.keys)
+
+		output.Removed += removed
+
+		if deleteErr != nil {
+			return output, deleteErr
+		}
+
+		logger.Info(fmt.Sprintf("removed run %s", r.id), zap.Int64("objects", removed))
+
+		output.Runs = append(output.Runs, r.id)
+	}
+
+	output.Complete = true
+
+	return
+}
+
+// Run executes a cleanup of the staged runs.
+func (rc *RunCleaner) Run() (output state.CleanupResult, err error) {
+	return rc.cleanup()
+}
@@ -0,0 +1,152 @@
+package clone_test
+
+import (
+	"bytes"
+	"context"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/NixM0nk3y/dynamodb-clone/clone"
+	"github.com/NixM0nk3y/dynamodb-clone/clonetest"
+	"github.com/NixM0nk3y/dynamodb-clone/state"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+func TestRunCleaner(t *testing.T) {
+
+	// runs of the table by when they last staged an object, the state machine
+	// names them after its execution
+	runs := []struct {
+		name string
+		id   string
+		age  time.Duration
+	}{
+		{"oldest", "5f0c7b8e-6a3d-4c1e-9b2a-7d4e8f1a2c3b", 72 * time.Hour},
+		{"older", "test", 48 * time.Hour},
+		{"in flight", clone.NewRunID(), time.Hour},
+		{"current", clone.NewRunID(), 0},
+	}
+
+	tests := []struct {
+		name      string
+		retention state.RetentionConfig
+		removed   []string
+	}{
+		{
+			name:      "keep",
+			retention: state.RetentionConfig{Mode: state.RetentionKeep},
+		},
+		{
+			name:      "purge",
+			retention: state.RetentionConfig{Mode: state.RetentionPurge},
+			removed:   []string{"current"},
+		},
+		{
+			name:      "prune",
+			retention: state.RetentionConfig{Mode: state.RetentionPrune},
+			removed:   []string{"older", "oldest"},
+		},
+		{
+			name:      "prune keeping one",
+			retention: state.RetentionConfig{Mode: state.RetentionPrune, KeepRuns: 1},
+			removed:   []string{"oldest"},
+		},
+	}
+
+	for _, test := range tests {
+
+		test := test
+
+		t.Run(test.name, func(t *testing.T) {
+
+			clients := clonetest.NewClients()
+
+			input := state.Schema{
+				Region:        clonetest.Region,
+				Bucket:        testBucket,
+				OrigTableName: sourceDB,
+				NewTableName:  destDB,
+				Retention:     test.retention,
+			}
+
+			put := func(key string, age time.Duration) {
+
+				if _, err := clients.Staging.PutObjectWithContext(context.Background(), &s3.PutObjectInput{
+					Bucket: aws.String(testBucket),
+					Key:    aws.String(key),
+					Body:   bytes.NewReader([]byte("{}")),
+				}); err != nil {
+					t.Fatalf("unable to stage %s: %v", key, err)
+				}
+
+				clients.Staging.Modified(testBucket, key, time.Now().Add(-age))
+			}
+
+			ids := map[string]string{}
+
+			for _, r := range runs {
+
+				runInput := input
+				runInput.RunID = r.id
+
+				ids[r.id] = r.name
+
+				put(runInput.Key("schema.json"), r.age)
+				put(runInput.Key("manifest.json"), r.age)
+				put(runInput.Key("data", "segment-0000.json"), r.age)
+
+				if r.name == "current" {
+					input.RunID = r.id
+				}
+			}
+
+			// neither staged before keys were run scoped nor by a run
+			untouched := []string{
+				input.TablePrefix() + "data-0001.json",
+				input.TablePrefix() + "exports/data-0001.json",
+				input.TablePrefix() + "exports/manifest.json",
+			}
+
+			for _, key := range untouched {
+				put(key, 96*time.Hour)
+			}
+
+			cleaner, err := clone.NewRunCleaner(context.Background(), input, clone.WithClients(clients))
+
+			if err != nil {
+				t.Fatalf("invalid cleanup: %v", err)
+			}
+
+			output, err := cleaner.Run()
+
+			if err != nil {
+				t.Fatalf("cleanup failed: %v", err)
+			}
+
+			var removed []string
+
+			for _, id := range output.Runs {
+				removed = append(removed, ids[id])
+			}
+
+			sort.Strings(removed)
+
+			if !reflect.DeepEqual(removed, test.removed) {
+				t.Errorf("removed runs %v, expected %v", removed, test.removed)
+			}
+
+			if output.Removed != int64(3*len(test.removed)) {
+				t.Errorf("removed %d objects, expected %d", output.Removed, 3*len(test.removed))
+			}
+
+			for _, key := range untouched {
+				if _, ok := clients.Staging.Object(testBucket, key); !ok {
+					t.Errorf("%s was removed", key)
+				}
+			}
+		})
+	}
+}
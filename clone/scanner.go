@@ -0,0 +1,133 @@
+package clone
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/NixM0nk3y/dynamodb-clone/clonerr"
+	"github.com/NixM0nk3y/dynamodb-clone/log"
+	"github.com/NixM0nk3y/dynamodb-clone/state"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/cenkalti/backoff"
+	"go.uber.org/zap"
+)
+
+// pageHandler is handed each scanned page with the key to resume after it
+type pageHandler func(items []map[string]*dynamodb.AttributeValue, lastKey map[string]*dynamodb.AttributeValue) error
+
+// scanner pages through one segment of a table
+type scanner struct {
+	ctx           context.Context
+	svc           dynamodbiface.DynamoDBAPI
+	table         string
+	segment       int64
+	totalSegments int64
+	limit         int64
+	consistent    bool
+	filter        state.Filter
+	limiter       *capacityLimiter // nil leaves the reads unlimited
+}
+
+//
+// Page through the segment from startKey until it's exhausted or the timeout
+// fires, complete is only set once the final page has been handled. With a
+// limiter each page waits for read capacity and pays for what it consumed.
+//
+func (sc *scanner) scan(startKey map[string]*dynamodb.AttributeValue, timeoutChannel <-chan struct{}, handle pageHandler) (complete bool, err error) {
+
+	logger := log.Logger(sc.ctx)
+
+	expbo := backoff.NewExponentialBackOff()
+	expbo.MaxInterval = 1500 * time.Millisecond
+	boff := backoff.WithContext(expbo, sc.ctx)
+
+	logger.Info(fmt.Sprintf("scanning table %s", sc.table))
+
+	lastKey := startKey
+
+	for {
+
+		select {
+
+		case <-timeoutChannel:
+
+			return false, nil
+
+		default:
+
+			if timedOut, limitErr := sc.limiter.wait(timeoutChannel); timedOut || limitErr != nil {
+				return false, limitErr
+			}
+
+			// scan params
+			params := &dynamodb.ScanInput{
+				TableName:     aws.String(sc.table),
+				Segment:       aws.Int64(sc.segment),
+				TotalSegments: aws.Int64(sc.totalSegments),
+				Limit:         aws.Int64(sc.limit),
+			}
+
+			if sc.consistent {
+				params.ConsistentRead = aws.Bool(true)
+			}
+
+			if sc.limiter != nil {
+				params.ReturnConsumedCapacity = aws.String(dynamodb.ReturnConsumedCapacityTotal)
+			}
+
+			applyFilter(params, sc.filter)
+
+			// last evaluated key
+			if lastKey != nil {
+				params.ExclusiveStartKey = lastKey
+			}
+
+			// scan, sleep if rate limited
+			resp, scanErr := sc.svc.ScanWithContext(sc.ctx, params)
+
+			if scanErr != nil {
+				if clonerr.IsThrottle(scanErr) {
+
+					logger.Warn("thoughput error backing off", zap.Error(scanErr))
+
+					// need to sleep when re-requesting, per spec
+					wait := boff.NextBackOff()
+
+					if wait == backoff.Stop {
+						logger.Error("backoff exhausted", zap.Error(scanErr))
+						return false, clonerr.FromDynamoDB(sc.table, scanErr)
+					}
+
+					if sleepErr := aws.SleepWithContext(sc.ctx, wait); sleepErr != nil {
+						logger.Error("timed out", zap.Error(sleepErr))
+						return false, &clonerr.ThroughputExhausted{Table: sc.table, Err: sleepErr}
+					}
+					continue
+				}
+
+				logger.Error("unknown dynamodb error", zap.Error(scanErr))
+				return false, clonerr.FromDynamoDB(sc.table, scanErr)
+			}
+
+			// reset backoff
+			boff.Reset()
+
+			sc.limiter.consumed([]*dynamodb.ConsumedCapacity{resp.ConsumedCapacity})
+
+			// set last evaluated key
+			lastKey = resp.LastEvaluatedKey
+
+			if err = handle(resp.Items, lastKey); err != nil {
+				return false, err
+			}
+
+			// exit if last evaluated key empty
+			if lastKey == nil {
+				return true, nil
+			}
+		}
+	}
+}
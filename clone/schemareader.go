@@ -0,0 +1,406 @@
+package clone
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/NixM0nk3y/dynamodb-clone/clonerr"
+	"github.com/NixM0nk3y/dynamodb-clone/log"
+	"github.com/NixM0nk3y/dynamodb-clone/schema"
+	"github.com/NixM0nk3y/dynamodb-clone/state"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"go.uber.org/zap"
+)
+
+// scan segment sizing when the export doesn't configure a segment count
+const (
+	segmentBytes    int64 = 1 << 30 // 1GiB
+	segmentItems    int64 = 1000000
+	maxSegmentCount int64 = 64
+)
+
+// tables auto mode copies directly, anything larger is likely to outlast a
+// single invocation and is staged in S3 instead
+const (
+	directBytes int64 = 128 << 20 // 128MiB
+	directItems int64 = 250000
+)
+
+// SchemaReader is a
+type SchemaReader struct {
+	input   state.Schema
+	clients Clients
+	ctx     context.Context
+	err     error
+}
+
+// NewSchemaReader returns a reader for the source table schema, starting a
+// new run unless the input names one
+func NewSchemaReader(ctx context.Context, input state.Schema, opts ...Option) (*SchemaReader, error) {
+
+	if input.RunID == "" {
+		input.RunID = NewRunID()
+	}
+
+	switch input.ExportConfig.Mode {
+	case "", state.ModeAuto, state.ModeStaged, state.ModeDirect:
+	case state.ModePointInTime:
+
+		// an export takes the whole table
+		if input.ExportConfig.Filter.Subset() {
+			return nil, &clonerr.SchemaInvalid{Reason: "a point in time export can't be filtered"}
+		}
+	default:
+		return nil, &clonerr.SchemaInvalid{Reason: fmt.Sprintf("unknown export mode %s", input.ExportConfig.Mode)}
+	}
+
+	// fail a bad transform or masking profile before any data moves
+	if err := validatePipeline(input); err != nil {
+		return nil, err
+	}
+
+	if err := checkTableImport(input); err != nil {
+		return nil, err
+	}
+
+	// stream records can't be matched against a filter expression
+	if input.SyncConfig.Enabled && input.ExportConfig.Filter.Subset() {
+		return nil, &clonerr.SchemaInvalid{Reason: "a filtered clone can't be kept in sync"}
+	}
+
+	return &SchemaReader{
+		input:   input,
+		clients: newClients(ctx, input, opts),
+		ctx:     ctx,
+	}, nil
+}
+
+func (sr *SchemaReader) storeSchema(document *schema.Document) (result bool, err error) {
+
+	logger := log.Logger(sr.ctx)
+
+	outBuffer := bytes.NewBufferString("")
+
+	b, errJSON := json.Marshal(document)
+
+	if errJSON != nil {
+		logger.Error("unable to marshal record into JSON", zap.Error(errJSON))
+		return false, &clonerr.SchemaInvalid{Reason: "unable to marshal schema", Err: errJSON}
+	}
+
+	outBuffer.Write(b)
+
+	logger.Info(fmt.Sprintf("storing schema for %s", sr.input.OrigTableName))
+
+	fileName := sr.input.Key("schema.json")
+
+	s3Svc, err := sr.clients.Bucket()
+
+	if err != nil {
+		return false, err
+	}
+
+	// Create s3 Client
+	uploader := s3manager.NewUploaderWithClient(s3Svc)
+
+	_, err = uploader.UploadWithContext(sr.ctx, &s3manager.UploadInput{
+		Bucket: aws.String(sr.input.Bucket),
+		Key:    aws.String(fileName),
+		Body:   outBuffer,
+	})
+
+	if err != nil {
+		logger.Error(fmt.Sprintf("unable to upload %s to %s", fileName, sr.input.Bucket), zap.Error(err))
+		return false, &clonerr.StorageFailure{Bucket: sr.input.Bucket, Key: fileName, Err: err}
+	}
+
+	logger.Info(fmt.Sprintf("successfully uploaded %s to %s", fileName, sr.input.Bucket))
+
+	return true, nil
+}
+
+//
+func (sr *SchemaReader) dynamodbSchemaExport() (output state.SchemaResult, err error) {
+
+	logger := log.Logger(sr.ctx)
+
+	// any write from here on may be missed by the scan
+	startedAt := time.Now()
+
+	svc, err := sr.clients.SourceDynamoDB()
+
+	if err != nil {
+		return
+	}
+
+	logger.Info("pulling table schema")
+
+	tableInput := &dynamodb.DescribeTableInput{
+		TableName: aws.String(sr.input.OrigTableName),
+	}
+
+	table, describeError := svc.DescribeTableWithContext(sr.ctx, tableInput)
+	if describeError != nil {
+		logger.Error("unable to describe table", zap.Error(describeError))
+		return output, clonerr.FromDynamoDB(sr.input.OrigTableName, describeError)
+	}
+
+	if output.Stream, err = sr.streamPosition(table.Table, startedAt); err != nil {
+		return
+	}
+
+	document := &schema.Document{
+		Table: table.Table,
+	}
+
+	logger.Info("pulling table settings")
+
+	ttl, ttlError := svc.DescribeTimeToLiveWithContext(sr.ctx, &dynamodb.DescribeTimeToLiveInput{
+		TableName: aws.String(sr.input.OrigTableName),
+	})
+
+	if ttlError != nil {
+		logger.Error("unable to describe time to live", zap.Error(ttlError))
+		return output, clonerr.FromDynamoDB(sr.input.OrigTableName, ttlError)
+	}
+
+	document.TimeToLive = ttl.TimeToLiveDescription
+
+	backups, backupsError := svc.DescribeContinuousBackupsWithContext(sr.ctx, &dynamodb.DescribeContinuousBackupsInput{
+		TableName: aws.String(sr.input.OrigTableName),
+	})
+
+	if backupsError != nil {
+		logger.Error("unable to describe continuous backups", zap.Error(backupsError))
+		return output, clonerr.FromDynamoDB(sr.input.OrigTableName, backupsError)
+	}
+
+	document.ContinuousBackups = backups.ContinuousBackupsDescription
+
+	if sr.input.SchemaConfig.ImportTable && len(table.Table.LocalSecondaryIndexes) > 0 {
+		return output, &clonerr.SchemaInvalid{Reason: fmt.Sprintf("table %s has local secondary indexes ImportTable can't create", sr.input.OrigTableName)}
+	}
+
+	if sr.input.ExportConfig.Mode == state.ModePointInTime && !document.PointInTimeRecoveryEnabled() {
+		return output, &clonerr.SchemaInvalid{Reason: fmt.Sprintf("table %s has no point in time recovery to export from", sr.input.OrigTableName)}
+	}
+
+	tagsInput := &dynamodb.ListTagsOfResourceInput{
+		ResourceArn: table.Table.TableArn,
+	}
+
+	for {
+		tags, tagsError := svc.ListTagsOfResourceWithContext(sr.ctx, tagsInput)
+
+		if tagsError != nil {
+			logger.Error("unable to list table tags", zap.Error(tagsError))
+			return output, clonerr.FromDynamoDB(sr.input.OrigTableName, tagsError)
+		}
+
+		document.Tags = append(document.Tags, tags.Tags...)
+
+		if tags.NextToken == nil {
+			break
+		}
+
+		tagsInput.NextToken = tags.NextToken
+	}
+
+	if output.Complete, err = sr.storeSchema(document); err != nil {
+		return
+	}
+
+	output.Mode = sr.planMode(table.Table)
+
+	sr.input.ExportConfig.Filter = withKeys(sr.input.ExportConfig.Filter, table.Table.KeySchema)
+
+	if filter := sr.input.ExportConfig.Filter; filter.Subset() {
+		logger.Info("cloning a filtered subset", zap.String("filter", filter.Expression), zap.String("projection", filter.Projection))
+	}
+
+	output.Segments = sr.planSegments(table.Table, output.Mode)
+
+	output.Verify = sr.planVerify(int64(len(output.Segments)))
+
+	// a point in time export is a single snapshot of the whole table, taken
+	// as the export started so a stream sync carries on from the same point
+	if output.Mode == state.ModePointInTime {
+
+		config := output.Segments[0]
+
+		config.TotalSegments = 1
+
+		if config.PointInTime == 0 {
+			config.PointInTime = startedAt.UnixNano() / int64(time.Millisecond)
+		}
+
+		if output.Stream.Arn != "" {
+			output.Stream.StartedAt = config.PointInTime
+		}
+
+		output.Segments = []state.ExportConfig{config}
+	}
+
+	return
+}
+
+//
+// Record the source's stream as the export starts so a sync can pick up the
+// writes the scan misses, the stream has to carry new images to replay them
+//
+func (sr *SchemaReader) streamPosition(table *dynamodb.TableDescription, startedAt time.Time) (position state.StreamPosition, err error) {
+
+	logger := log.Logger(sr.ctx)
+
+	if table.LatestStreamArn == nil || table.StreamSpecification == nil || !aws.BoolValue(table.StreamSpecification.StreamEnabled) {
+
+		if sr.input.SyncConfig.Enabled {
+			return position, &clonerr.SchemaInvalid{Reason: fmt.Sprintf("table %s has no stream to sync from", sr.input.OrigTableName)}
+		}
+
+		return
+	}
+
+	switch viewType := aws.StringValue(table.StreamSpecification.StreamViewType); viewType {
+	case dynamodb.StreamViewTypeNewImage, dynamodb.StreamViewTypeNewAndOldImages:
+	default:
+		if sr.input.SyncConfig.Enabled {
+			return position, &clonerr.SchemaInvalid{Reason: fmt.Sprintf("stream of table %s is %s, a sync needs new images", sr.input.OrigTableName, viewType)}
+		}
+	}
+
+	position.Arn = aws.StringValue(table.LatestStreamArn)
+	position.StartedAt = startedAt.UnixNano() / int64(time.Millisecond)
+
+	logger.Info("recorded stream position", zap.String("stream", position.Arn), zap.Int64("startedat", position.StartedAt))
+
+	return
+}
+
+//
+// Split the data export into parallel scan segments, either as configured
+// or sized from the table's (roughly six hourly) item count and size
+//
+func (sr *SchemaReader) planSegments(table *dynamodb.TableDescription, mode string) (segments []state.ExportConfig) {
+
+	logger := log.Logger(sr.ctx)
+
+	totalSegments := sr.input.ExportConfig.TotalSegments
+
+	if totalSegments < 1 {
+
+		bySize := (aws.Int64Value(table.TableSizeBytes) + segmentBytes - 1) / segmentBytes
+		byItems := (aws.Int64Value(table.ItemCount) + segmentItems - 1) / segmentItems
+
+		totalSegments = bySize
+
+		if byItems > totalSegments {
+			totalSegments = byItems
+		}
+
+		if totalSegments > maxSegmentCount {
+			totalSegments = maxSegmentCount
+		}
+
+		if totalSegments < 1 {
+			totalSegments = 1
+		}
+	}
+
+	logger.Info(fmt.Sprintf("exporting with %d segments", totalSegments),
+		zap.Int64("tablesize", aws.Int64Value(table.TableSizeBytes)),
+		zap.Int64("itemcount", aws.Int64Value(table.ItemCount)))
+
+	for segment := int64(0); segment < totalSegments; segment++ {
+
+		config := sr.input.ExportConfig
+
+		config.TotalSegments = totalSegments
+		config.Segment = segment
+		config.Mode = mode
+
+		segments = append(segments, config)
+	}
+
+	return
+}
+
+//
+// Decide between staging the data in S3 or copying it straight into the new
+// table, auto picks a direct copy for tables small enough to finish in one go
+//
+func (sr *SchemaReader) planMode(table *dynamodb.TableDescription) (mode string) {
+
+	logger := log.Logger(sr.ctx)
+
+	mode = sr.input.ExportConfig.Mode
+
+	switch mode {
+	case "":
+		mode = state.ModeStaged
+	case state.ModeAuto:
+
+		mode = state.ModeStaged
+
+		// ImportTable reads the staged files, there's no table to copy into
+		if sr.input.SchemaConfig.ImportTable {
+			break
+		}
+
+		if aws.Int64Value(table.TableSizeBytes) <= directBytes && aws.Int64Value(table.ItemCount) <= directItems {
+			mode = state.ModeDirect
+		}
+	}
+
+	logger.Info(fmt.Sprintf("exporting in %s mode", mode))
+
+	return
+}
+
+//
+// Split the verification into segments, smaller than the export's as each
+// holds both tables' segment in memory
+//
+func (sr *SchemaReader) planVerify(exportSegments int64) (segments []state.VerifyConfig) {
+
+	if sr.input.VerifyConfig.Skip {
+		return []state.VerifyConfig{}
+	}
+
+	totalSegments := sr.input.VerifyConfig.TotalSegments
+
+	if totalSegments < 1 {
+		totalSegments = exportSegments * verifySegmentsPerExport
+	}
+
+	if totalSegments > maxVerifySegments {
+		totalSegments = maxVerifySegments
+	}
+
+	for segment := int64(0); segment < totalSegments; segment++ {
+
+		config := sr.input.VerifyConfig
+
+		config.TotalSegments = totalSegments
+		config.Segment = segment
+		config.Filter = sr.input.ExportConfig.Filter
+
+		segments = append(segments, config)
+	}
+
+	return
+}
+
+// Run executes a export of the schema.
+func (sr *SchemaReader) Run() (output state.SchemaResult, err error) {
+	output, err = sr.dynamodbSchemaExport()
+
+	output.RunID = sr.input.RunID
+
+	return
+}
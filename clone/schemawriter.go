@@ -0,0 +1,450 @@
+package clone
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/NixM0nk3y/dynamodb-clone/clonerr"
+	"github.com/NixM0nk3y/dynamodb-clone/log"
+	"github.com/NixM0nk3y/dynamodb-clone/schema"
+	"github.com/NixM0nk3y/dynamodb-clone/state"
+	"github.com/NixM0nk3y/dynamodb-clone/transform"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"go.uber.org/zap"
+)
+
+// SchemaWriter is a
+type SchemaWriter struct {
+	input   state.Schema
+	clients Clients
+	ctx     context.Context
+	err     error
+}
+
+// NewSchemaWriter returns a writer creating the clone table from the stored schema
+func NewSchemaWriter(ctx context.Context, input state.Schema, opts ...Option) (*SchemaWriter, error) {
+
+	// every object of the clone is keyed under the run
+	if input.RunID == "" {
+		return nil, &clonerr.SchemaInvalid{Reason: "no run id passed"}
+	}
+
+	if err := checkTableImport(input); err != nil {
+		return nil, err
+	}
+
+	// the table is imported from the files the export staged
+	if input.SchemaConfig.ImportTable && input.Export.Manifest == "" {
+		return nil, &clonerr.SchemaInvalid{Reason: "no manifest passed to import the table from"}
+	}
+
+	return &SchemaWriter{
+		input:   input,
+		clients: newClients(ctx, input, opts),
+		ctx:     ctx,
+	}, nil
+}
+
+//
+func (sw *SchemaWriter) retrieveSchema() (tableSchema *schema.Document, err error) {
+
+	logger := log.Logger(sw.ctx)
+
+	logger.Info(fmt.Sprintf("retrieving schema for %s", sw.input.OrigTableName))
+
+	fileName := sw.input.Key("schema.json")
+
+	s3Svc, err := sw.clients.Bucket()
+
+	if err != nil {
+		return nil, err
+	}
+
+	// Create s3 Client
+	downLoader := s3manager.NewDownloaderWithClient(s3Svc)
+
+	w := &aws.WriteAtBuffer{}
+
+	_, downloadErr := downLoader.DownloadWithContext(sw.ctx, w, &s3.GetObjectInput{
+		Bucket: aws.String(sw.input.Bucket),
+		Key:    aws.String(fileName),
+	})
+
+	if downloadErr != nil {
+		logger.Error(fmt.Sprintf("unable to download %s from %s", fileName, sw.input.Bucket), zap.Error(downloadErr))
+		return nil, &clonerr.StorageFailure{Bucket: sw.input.Bucket, Key: fileName, Err: downloadErr}
+	}
+
+	// schema.json is a marshalled schema document
+	errJSON := json.Unmarshal(w.Bytes(), &tableSchema)
+
+	if errJSON != nil {
+		logger.Error("unable to unmarshal record from JSON", zap.Error(errJSON))
+		return nil, &clonerr.SchemaInvalid{Reason: fmt.Sprintf("unable to unmarshal %s", fileName), Err: errJSON}
+	}
+
+	logger.Info(fmt.Sprintf("Successfully retrieved %s from %s", fileName, sw.input.Bucket))
+
+	if tableSchema == nil || tableSchema.Table == nil {
+		return nil, &clonerr.SchemaInvalid{Reason: "unknown table schema"}
+	}
+
+	return
+}
+
+//
+// Rebuild the base schema along with any secondary indexes and the table
+// settings which can be given at creation time
+//
+func (sw *SchemaWriter) buildDynamodbSchema(tableSchema *schema.Document) (ddTable *dynamodb.CreateTableInput) {
+
+	logger := log.Logger(sw.ctx)
+
+	table := tableSchema.Table
+
+	ddTable = &dynamodb.CreateTableInput{
+		TableName:            aws.String(sw.input.NewTableName),
+		KeySchema:            table.KeySchema,
+		AttributeDefinitions: table.AttributeDefinitions,
+	}
+
+	if tags := userTags(tableSchema.Tags); len(tags) > 0 {
+		ddTable.SetTags(tags)
+	}
+
+	if reserved := len(tableSchema.Tags) - len(ddTable.Tags); reserved > 0 {
+		logger.Info(fmt.Sprintf("leaving out %d reserved aws: tags", reserved))
+	}
+
+	if table.TableClassSummary != nil && table.TableClassSummary.TableClass != nil {
+		ddTable.SetTableClass(*table.TableClassSummary.TableClass)
+	}
+
+	if table.StreamSpecification != nil && aws.BoolValue(table.StreamSpecification.StreamEnabled) {
+
+		logger.Info(fmt.Sprintf("enabling %s stream", aws.StringValue(table.StreamSpecification.StreamViewType)))
+
+		ddTable.SetStreamSpecification(&dynamodb.StreamSpecification{
+			StreamEnabled:  aws.Bool(true),
+			StreamViewType: table.StreamSpecification.StreamViewType,
+		})
+	}
+
+	// tables using the AWS owned key don't report a SSE description
+	kmsKeyArn := sw.input.SchemaConfig.KMSKeyArn
+
+	sourceKMS := table.SSEDescription != nil && aws.StringValue(table.SSEDescription.SSEType) == dynamodb.SSETypeKms
+
+	// keys don't cross accounts or regions, fall back to the destination's AWS managed key
+	sameKeys := sw.input.SourceRoleArn == sw.input.DestRoleArn && sw.input.SourceTableRegion() == sw.input.DestTableRegion()
+
+	if kmsKeyArn == "" && sourceKMS && !sameKeys {
+
+		logger.Warn(fmt.Sprintf("source KMS key %s can't be used by the destination, using the AWS managed key",
+			aws.StringValue(table.SSEDescription.KMSMasterKeyArn)))
+
+		ddTable.SetSSESpecification(&dynamodb.SSESpecification{
+			Enabled: aws.Bool(true),
+			SSEType: aws.String(dynamodb.SSETypeKms),
+		})
+	}
+
+	if kmsKeyArn == "" && sourceKMS && sameKeys {
+		kmsKeyArn = aws.StringValue(table.SSEDescription.KMSMasterKeyArn)
+	}
+
+	if kmsKeyArn != "" {
+
+		logger.Info(fmt.Sprintf("encrypting table with KMS key %s", kmsKeyArn))
+
+		ddTable.SetSSESpecification(&dynamodb.SSESpecification{
+			Enabled:        aws.Bool(true),
+			SSEType:        aws.String(dynamodb.SSETypeKms),
+			KMSMasterKeyId: aws.String(kmsKeyArn),
+		})
+	}
+
+	// tables which have never changed billing mode don't report a summary
+	provisionMode := true
+
+	if table.BillingModeSummary != nil {
+		mode := aws.StringValue(table.BillingModeSummary.BillingMode)
+
+		provisionMode = mode == dynamodb.BillingModeProvisioned
+
+		ddTable.SetBillingMode(mode)
+	}
+
+	if provisionMode {
+		logger.Warn("warning provisioned throughput may slow down restore")
+
+		ddTable.SetProvisionedThroughput(provisionedThroughput(table.ProvisionedThroughput))
+	}
+
+	for _, index := range table.GlobalSecondaryIndexes {
+
+		logger.Info(fmt.Sprintf("adding global secondary index %s", aws.StringValue(index.IndexName)))
+
+		gsi := &dynamodb.GlobalSecondaryIndex{
+			IndexName:  index.IndexName,
+			KeySchema:  index.KeySchema,
+			Projection: index.Projection,
+		}
+
+		if provisionMode {
+			gsi.SetProvisionedThroughput(provisionedThroughput(index.ProvisionedThroughput))
+		}
+
+		ddTable.GlobalSecondaryIndexes = append(ddTable.GlobalSecondaryIndexes, gsi)
+	}
+
+	for _, index := range table.LocalSecondaryIndexes {
+
+		logger.Info(fmt.Sprintf("adding local secondary index %s", aws.StringValue(index.IndexName)))
+
+		ddTable.LocalSecondaryIndexes = append(ddTable.LocalSecondaryIndexes, &dynamodb.LocalSecondaryIndex{
+			IndexName:  index.IndexName,
+			KeySchema:  index.KeySchema,
+			Projection: index.Projection,
+		})
+	}
+
+	return
+}
+
+// reservedTagPrefix marks the tags AWS sets itself, like CloudFormation's
+// aws:cloudformation:stack-name, which CreateTable and TagResource reject
+const reservedTagPrefix = "aws:"
+
+// userTags returns the tags a new table can be given
+func userTags(tags []*dynamodb.Tag) (userTags []*dynamodb.Tag) {
+
+	for _, tag := range tags {
+		if !strings.HasPrefix(aws.StringValue(tag.Key), reservedTagPrefix) {
+			userTags = append(userTags, tag)
+		}
+	}
+
+	return
+}
+
+// provisionedThroughput strips the read only fields from a throughput description
+func provisionedThroughput(description *dynamodb.ProvisionedThroughputDescription) *dynamodb.ProvisionedThroughput {
+
+	throughput := &dynamodb.ProvisionedThroughput{
+		ReadCapacityUnits:  aws.Int64(0),
+		WriteCapacityUnits: aws.Int64(0),
+	}
+
+	if description != nil {
+		throughput.ReadCapacityUnits = description.ReadCapacityUnits
+		throughput.WriteCapacityUnits = description.WriteCapacityUnits
+	}
+
+	return throughput
+}
+
+//
+// Global secondary indexes can still be building once the table is ACTIVE
+//
+func (sw *SchemaWriter) waitUntilIndexesActive(svc dynamodbiface.DynamoDBAPI) error {
+
+	w := request.Waiter{
+		Name:        "WaitUntilIndexesActive",
+		MaxAttempts: 60,
+		Delay:       request.ConstantWaiterDelay(10 * time.Second),
+		Acceptors: []request.WaiterAcceptor{
+			{
+				State:    request.SuccessWaiterState,
+				Matcher:  request.PathAllWaiterMatch,
+				Argument: "Table.GlobalSecondaryIndexes[].IndexStatus",
+				Expected: dynamodb.IndexStatusActive,
+			},
+		},
+		Logger: &log.AWSLogger{},
+		NewRequest: func(opts []request.Option) (*request.Request, error) {
+			req, _ := svc.DescribeTableRequest(&dynamodb.DescribeTableInput{
+				TableName: aws.String(sw.input.NewTableName),
+			})
+			req.SetContext(sw.ctx)
+			req.ApplyOptions(opts...)
+			return req, nil
+		},
+	}
+
+	return w.WaitWithContext(sw.ctx)
+}
+
+//
+// Settings which can only be changed once the table exists
+//
+func (sw *SchemaWriter) applyTableSettings(svc dynamodbiface.DynamoDBAPI, tableSchema *schema.Document) (err error) {
+
+	logger := log.Logger(sw.ctx)
+
+	if tableSchema.TimeToLiveEnabled() {
+
+		logger.Info(fmt.Sprintf("enabling time to live on %s", aws.StringValue(tableSchema.TimeToLive.AttributeName)))
+
+		_, err = svc.UpdateTimeToLiveWithContext(sw.ctx, &dynamodb.UpdateTimeToLiveInput{
+			TableName: aws.String(sw.input.NewTableName),
+			TimeToLiveSpecification: &dynamodb.TimeToLiveSpecification{
+				AttributeName: tableSchema.TimeToLive.AttributeName,
+				Enabled:       aws.Bool(true),
+			},
+		})
+
+		if err != nil {
+			return err
+		}
+	}
+
+	if tableSchema.PointInTimeRecoveryEnabled() {
+
+		logger.Info("enabling point in time recovery")
+
+		_, err = svc.UpdateContinuousBackupsWithContext(sw.ctx, &dynamodb.UpdateContinuousBackupsInput{
+			TableName: aws.String(sw.input.NewTableName),
+			PointInTimeRecoverySpecification: &dynamodb.PointInTimeRecoverySpecification{
+				PointInTimeRecoveryEnabled: aws.Bool(true),
+			},
+		})
+
+		if err != nil {
+			return err
+		}
+	}
+
+	// last, so a failure above still leaves a table we can drop
+	if aws.BoolValue(tableSchema.Table.DeletionProtectionEnabled) {
+
+		logger.Info("enabling deletion protection")
+
+		_, err = svc.UpdateTableWithContext(sw.ctx, &dynamodb.UpdateTableInput{
+			TableName:                 aws.String(sw.input.NewTableName),
+			DeletionProtectionEnabled: aws.Bool(true),
+		})
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return
+}
+
+//
+// Wait for the new table and its indexes to become active before applying
+// the settings which need the table in place
+//
+func (sw *SchemaWriter) finishTable(svc dynamodbiface.DynamoDBAPI, tableSchema *schema.Document, tableInput *dynamodb.CreateTableInput, settings ...func(svc dynamodbiface.DynamoDBAPI, tableInput *dynamodb.CreateTableInput) error) error {
+
+	logger := log.Logger(sw.ctx)
+
+	waitErr := svc.WaitUntilTableExistsWithContext(sw.ctx, &dynamodb.DescribeTableInput{
+		TableName: aws.String(sw.input.NewTableName),
+	})
+
+	if waitErr != nil {
+		logger.Error("failed to wait for table to be created", zap.Error(waitErr))
+		return clonerr.FromDynamoDB(sw.input.NewTableName, waitErr)
+	}
+
+	if len(tableInput.GlobalSecondaryIndexes) > 0 {
+
+		logger.Info("waiting for global secondary indexes to become active")
+
+		if indexErr := sw.waitUntilIndexesActive(svc); indexErr != nil {
+			logger.Error("failed to wait for indexes to be created", zap.Error(indexErr))
+			return clonerr.FromDynamoDB(sw.input.NewTableName, indexErr)
+		}
+	}
+
+	for _, apply := range settings {
+		if settingsErr := apply(svc, tableInput); settingsErr != nil {
+			logger.Error("failed to apply table settings", zap.Error(settingsErr))
+			return clonerr.FromDynamoDB(sw.input.NewTableName, settingsErr)
+		}
+	}
+
+	if settingsErr := sw.applyTableSettings(svc, tableSchema); settingsErr != nil {
+		logger.Error("failed to apply table settings", zap.Error(settingsErr))
+		return clonerr.FromDynamoDB(sw.input.NewTableName, settingsErr)
+	}
+
+	return nil
+}
+
+//
+func (sw *SchemaWriter) dynamodbSchemaImport() (result bool, err error) {
+
+	logger := log.Logger(sw.ctx)
+
+	svc, err := sw.clients.DestDynamoDB()
+
+	if err != nil {
+		return false, err
+	}
+
+	logger.Info("pulling table schema from storage")
+
+	tableSchema, retrieveErr := sw.retrieveSchema()
+
+	if retrieveErr != nil {
+		return false, retrieveErr
+	}
+
+	// renamed attributes keep their place in the keys, indexes and TTL, and
+	// hashed ones are defined as the strings they become
+	tableSchema.RenameAttributes(transform.Renames(sw.input.ImportConfig.Transforms))
+	tableSchema.RetypeAttributes(transform.Retypes(sw.input.ImportConfig.Transforms))
+
+	logger.Info(fmt.Sprintf("creating table %s with retrieved schema", sw.input.NewTableName))
+
+	tableInput := sw.buildDynamodbSchema(tableSchema)
+
+	createStart := time.Now()
+
+	_, createError := svc.CreateTableWithContext(sw.ctx, tableInput)
+	if createError != nil {
+		logger.Error("unable to create table", zap.Error(createError))
+
+		if aerr, ok := createError.(awserr.Error); ok && aerr.Code() == "ValidationException" {
+			return false, &clonerr.SchemaInvalid{Reason: "table definition rejected", Err: createError}
+		}
+
+		return false, clonerr.FromDynamoDB(sw.input.NewTableName, createError)
+	}
+
+	if err = sw.finishTable(svc, tableSchema, tableInput); err != nil {
+		return false, err
+	}
+
+	result = true
+
+	logger.Info("create completed",
+		zap.Int64("createtime", time.Now().Sub(createStart).Milliseconds()))
+
+	return
+}
+
+// Run executes a import of the schema.
+func (sw *SchemaWriter) Run() (output state.SchemaImportResult, err error) {
+
+	if sw.input.SchemaConfig.ImportTable {
+		return sw.dynamodbTableImport()
+	}
+
+	output.Complete, err = sw.dynamodbSchemaImport()
+
+	return
+}
@@ -0,0 +1,640 @@
+package clone
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/NixM0nk3y/dynamodb-clone/clonerr"
+	"github.com/NixM0nk3y/dynamodb-clone/log"
+	"github.com/NixM0nk3y/dynamodb-clone/masking"
+	"github.com/NixM0nk3y/dynamodb-clone/state"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/aws/aws-sdk-go/service/dynamodbstreams"
+	"github.com/aws/aws-sdk-go/service/dynamodbstreams/dynamodbstreamsiface"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"go.uber.org/zap"
+)
+
+// stream sync sizing
+const (
+	defaultMaxLag    int64 = 60 // seconds
+	syncWorkers            = 4  // shards read at once
+	streamRecords    int64 = 1000
+	streamRetention        = 24 * time.Hour
+	streamClockSkew        = time.Minute            // records are replayed from this far before the export started
+	streamEmptyPause       = 250 * time.Millisecond // pause before rereading an empty shard
+	streamEmptyPages       = 3                      // empty pages in a row an open shard gives once it has caught up
+)
+
+// StreamSyncer is a
+type StreamSyncer struct {
+	input   state.Schema
+	clients Clients
+	ctx     context.Context
+	err     error
+}
+
+// shardCheckpoint is the last record applied from a shard
+type shardCheckpoint struct {
+	Sequence string `json:"sequence"`
+	Closed   bool   `json:"closed"` // every record of a closed shard has been applied
+}
+
+// syncCheckpoint is the progress through the stream, kept in the staging bucket
+// as it outgrows the state passed between invocations
+type syncCheckpoint struct {
+	Stream string                     `json:"stream"`
+	Shards map[string]shardCheckpoint `json:"shards"`
+}
+
+// shardResult is what a single shard contributed to a pass
+type shardResult struct {
+	checkpoint shardCheckpoint
+	records    int64
+	puts       int64
+	deletes    int64
+	lag        time.Duration
+	report     *masking.Report
+}
+
+// NewStreamSyncer returns a syncer applying the source's stream to the new table
+func NewStreamSyncer(ctx context.Context, input state.Schema, opts ...Option) (*StreamSyncer, error) {
+
+	// every object of the clone is keyed under the run
+	if input.RunID == "" {
+		return nil, &clonerr.SchemaInvalid{Reason: "no run id passed"}
+	}
+
+	if input.Stream.Arn == "" {
+		return nil, &clonerr.SchemaInvalid{Reason: fmt.Sprintf("no stream recorded for table %s", input.OrigTableName)}
+	}
+
+	if input.NewTableName == "" {
+		return nil, &clonerr.SchemaInvalid{Reason: "no destination table to sync"}
+	}
+
+	// stream records can't be matched against a filter expression
+	if input.ExportConfig.Filter.Subset() {
+		return nil, &clonerr.SchemaInvalid{Reason: "a filtered clone can't be kept in sync"}
+	}
+
+	if input.SyncConfig.MaxLagSeconds < 1 {
+		input.SyncConfig.MaxLagSeconds = defaultMaxLag
+	}
+
+	if err := validatePipeline(input); err != nil {
+		return nil, err
+	}
+
+	return &StreamSyncer{
+		input:   input,
+		clients: newClients(ctx, input, opts),
+		ctx:     ctx,
+	}, nil
+}
+
+func (ss *StreamSyncer) loadCheckpoint(s3Svc s3iface.S3API, key string) (checkpoint *syncCheckpoint, err error) {
+
+	logger := log.Logger(ss.ctx)
+
+	checkpoint = &syncCheckpoint{Stream: ss.input.Stream.Arn, Shards: map[string]shardCheckpoint{}}
+
+	result, err := s3Svc.GetObjectWithContext(ss.ctx, &s3.GetObjectInput{
+		Bucket: aws.String(ss.input.Bucket),
+		Key:    aws.String(key),
+	})
+
+	if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == s3.ErrCodeNoSuchKey {
+		logger.Info("starting a new stream sync")
+		return checkpoint, nil
+	}
+
+	if err != nil {
+		logger.Error(fmt.Sprintf("unable to read sync checkpoint %s", key), zap.Error(err))
+		return nil, &clonerr.StorageFailure{Bucket: ss.input.Bucket, Key: key, Err: err}
+	}
+
+	defer result.Body.Close()
+
+	if err = json.NewDecoder(result.Body).Decode(checkpoint); err != nil {
+		return nil, &clonerr.StorageFailure{Bucket: ss.input.Bucket, Key: key, Err: err}
+	}
+
+	if checkpoint.Stream != ss.input.Stream.Arn {
+		return nil, &clonerr.SchemaInvalid{Reason: fmt.Sprintf("sync checkpoint %s is for stream %s", key, checkpoint.Stream)}
+	}
+
+	return
+}
+
+func (ss *StreamSyncer) storeCheckpoint(s3Svc s3iface.S3API, key string, checkpoint *syncCheckpoint) (err error) {
+
+	logger := log.Logger(ss.ctx)
+
+	b, err := json.Marshal(checkpoint)
+
+	if err != nil {
+		return
+	}
+
+	_, err = s3Svc.PutObjectWithContext(ss.ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(ss.input.Bucket),
+		Key:         aws.String(key),
+		Body:        bytes.NewReader(b),
+		ContentType: aws.String("application/json"),
+	})
+
+	if err != nil {
+		logger.Error(fmt.Sprintf("unable to store sync checkpoint %s to %s", key, ss.input.Bucket), zap.Error(err))
+		return &clonerr.StorageFailure{Bucket: ss.input.Bucket, Key: key, Err: err}
+	}
+
+	return
+}
+
+// shards lists every shard the stream still holds
+func (ss *StreamSyncer) shards(svc dynamodbstreamsiface.DynamoDBStreamsAPI) (shards []*dynamodbstreams.Shard, err error) {
+
+	params := &dynamodbstreams.DescribeStreamInput{
+		StreamArn: aws.String(ss.input.Stream.Arn),
+	}
+
+	for {
+
+		result, describeErr := svc.DescribeStreamWithContext(ss.ctx, params)
+
+		if describeErr != nil {
+			return nil, ss.fromStreams(describeErr)
+		}
+
+		shards = append(shards, result.StreamDescription.Shards...)
+
+		if result.StreamDescription.LastEvaluatedShardId == nil {
+			return
+		}
+
+		params.ExclusiveStartShardId = result.StreamDescription.LastEvaluatedShardId
+	}
+}
+
+//
+// A child shard only holds writes made after those of its parent, so it is
+// held back until the parent has been read to its end. A parent the stream
+// has trimmed is either older than the export or lost to the sync.
+//
+func (ss *StreamSyncer) ready(shards []*dynamodbstreams.Shard, checkpoint *syncCheckpoint) (ready []*dynamodbstreams.Shard, err error) {
+
+	listed := map[string]bool{}
+
+	for _, shard := range shards {
+		listed[aws.StringValue(shard.ShardId)] = true
+	}
+
+	for _, shard := range shards {
+
+		if checkpoint.Shards[aws.StringValue(shard.ShardId)].Closed {
+			continue
+		}
+
+		parent := aws.StringValue(shard.ParentShardId)
+
+		if parent != "" && listed[parent] && !checkpoint.Shards[parent].Closed {
+			continue
+		}
+
+		if parent != "" && !listed[parent] {
+			if parentCheckpoint, ok := checkpoint.Shards[parent]; ok && !parentCheckpoint.Closed {
+				return nil, &clonerr.StreamExpired{Stream: ss.input.Stream.Arn, Reason: fmt.Sprintf("shard %s was trimmed before it was read", parent)}
+			}
+		}
+
+		ready = append(ready, shard)
+	}
+
+	return
+}
+
+// fromStreams maps a streams error onto our error types
+func (ss *StreamSyncer) fromStreams(err error) error {
+
+	if awsErr, ok := err.(awserr.Error); ok {
+		switch awsErr.Code() {
+		case dynamodbstreams.ErrCodeTrimmedDataAccessException:
+			return &clonerr.StreamExpired{Stream: ss.input.Stream.Arn, Reason: "records were trimmed before they were read", Err: err}
+		case dynamodbstreams.ErrCodeResourceNotFoundException:
+			return &clonerr.StreamExpired{Stream: ss.input.Stream.Arn, Reason: "stream no longer exists", Err: err}
+		case dynamodbstreams.ErrCodeLimitExceededException:
+			return &clonerr.ThroughputExhausted{Table: ss.input.OrigTableName, Err: err}
+		}
+	}
+
+	return err
+}
+
+func (ss *StreamSyncer) iterator(svc dynamodbstreamsiface.DynamoDBStreamsAPI, shardID string, checkpoint shardCheckpoint) (iterator *string, err error) {
+
+	params := &dynamodbstreams.GetShardIteratorInput{
+		StreamArn:         aws.String(ss.input.Stream.Arn),
+		ShardId:           aws.String(shardID),
+		ShardIteratorType: aws.String(dynamodbstreams.ShardIteratorTypeTrimHorizon),
+	}
+
+	if checkpoint.Sequence != "" {
+		params.ShardIteratorType = aws.String(dynamodbstreams.ShardIteratorTypeAfterSequenceNumber)
+		params.SequenceNumber = aws.String(checkpoint.Sequence)
+	}
+
+	result, err := svc.GetShardIteratorWithContext(ss.ctx, params)
+
+	if err != nil {
+		return nil, ss.fromStreams(err)
+	}
+
+	return result.ShardIterator, nil
+}
+
+//
+// Read a shard from its checkpoint, until an open shard has nothing more to
+// give or a closed one runs out, applying each record in order
+//
+func (ss *StreamSyncer) syncShard(streamsSvc dynamodbstreamsiface.DynamoDBStreamsAPI, destSvc dynamodbiface.DynamoDBAPI, pipeline *itemPipeline, keyNames []string, shard *dynamodbstreams.Shard, checkpoint shardCheckpoint, timeoutChannel <-chan struct{}) (result shardResult, err error) {
+
+	logger := log.Logger(ss.ctx)
+
+	shardID := aws.StringValue(shard.ShardId)
+	closed := shard.SequenceNumberRange != nil && shard.SequenceNumberRange.EndingSequenceNumber != nil
+
+	result.checkpoint = checkpoint
+	result.report = pipeline.newReport()
+
+	// replaying a write the scan already saw leaves the item as the scan found it
+	replayFrom := time.Unix(0, ss.input.Stream.StartedAt*int64(time.Millisecond)).Add(-streamClockSkew)
+
+	iterator, err := ss.iterator(streamsSvc, shardID, checkpoint)
+
+	if err != nil {
+		return
+	}
+
+	// assume the worst until a record says otherwise
+	result.lag = time.Since(replayFrom)
+
+	// empty pages read in a row
+	empty := 0
+
+	for iterator != nil {
+
+		select {
+		case <-timeoutChannel:
+			logger.Warn("stream sync lambda duration expired", zap.String("shard", shardID), zap.Int64("records", result.records))
+			return
+		default:
+		}
+
+		records, recordsErr := streamsSvc.GetRecordsWithContext(ss.ctx, &dynamodbstreams.GetRecordsInput{
+			ShardIterator: iterator,
+			Limit:         aws.Int64(streamRecords),
+		})
+
+		if awsErr, ok := recordsErr.(awserr.Error); ok && awsErr.Code() == dynamodbstreams.ErrCodeExpiredIteratorException {
+
+			// iterators only last a quarter of an hour, pick up from the last record applied
+			if iterator, err = ss.iterator(streamsSvc, shardID, result.checkpoint); err != nil {
+				return
+			}
+
+			continue
+		}
+
+		if recordsErr != nil {
+			return result, ss.fromStreams(recordsErr)
+		}
+
+		for _, record := range records.Records {
+
+			if err = ss.apply(destSvc, pipeline, keyNames, record, replayFrom, &result); err != nil {
+				return
+			}
+
+			result.checkpoint.Sequence = aws.StringValue(record.Dynamodb.SequenceNumber)
+			result.lag = time.Since(aws.TimeValue(record.Dynamodb.ApproximateCreationDateTime))
+		}
+
+		iterator = records.NextShardIterator
+
+		if len(records.Records) > 0 {
+			empty = 0
+			continue
+		}
+
+		empty++
+
+		// an open shard can hand back empty pages ahead of records further
+		// along it, only a run of them means it has caught up
+		if !closed && empty >= streamEmptyPages {
+			result.lag = 0
+			return
+		}
+
+		if err = aws.SleepWithContext(ss.ctx, streamEmptyPause); err != nil {
+			return
+		}
+	}
+
+	// the shard has been read to its end, its children can follow
+	result.checkpoint.Closed = true
+	result.lag = 0
+
+	return
+}
+
+// apply writes a single stream record to the new table
+func (ss *StreamSyncer) apply(svc dynamodbiface.DynamoDBAPI, pipeline *itemPipeline, keyNames []string, record *dynamodbstreams.Record, replayFrom time.Time, result *shardResult) (err error) {
+
+	if aws.TimeValue(record.Dynamodb.ApproximateCreationDateTime).Before(replayFrom) {
+		return
+	}
+
+	result.records++
+
+	switch aws.StringValue(record.EventName) {
+	case dynamodbstreams.OperationTypeInsert, dynamodbstreams.OperationTypeModify:
+
+		item := record.Dynamodb.NewImage
+
+		report, applyErr := pipeline.apply([]map[string]*dynamodb.AttributeValue{item})
+
+		if applyErr != nil {
+			return applyErr
+		}
+
+		_, err = svc.PutItemWithContext(ss.ctx, &dynamodb.PutItemInput{
+			TableName: aws.String(ss.input.NewTableName),
+			Item:      item,
+		})
+
+		if err != nil {
+			return clonerr.FromDynamoDB(ss.input.NewTableName, err)
+		}
+
+		if result.report != nil {
+			result.report.Merge(report)
+		}
+
+		result.puts++
+
+	case dynamodbstreams.OperationTypeRemove:
+
+		// the keys go through the pipeline too, as they did when the item was written
+		keys := map[string]*dynamodb.AttributeValue{}
+
+		for name, value := range record.Dynamodb.Keys {
+			keys[name] = value
+		}
+
+		if _, err = pipeline.apply([]map[string]*dynamodb.AttributeValue{keys}); err != nil {
+			return
+		}
+
+		key := map[string]*dynamodb.AttributeValue{}
+
+		for _, name := range keyNames {
+			key[name] = keys[name]
+		}
+
+		_, err = svc.DeleteItemWithContext(ss.ctx, &dynamodb.DeleteItemInput{
+			TableName: aws.String(ss.input.NewTableName),
+			Key:       key,
+		})
+
+		if err != nil {
+			return clonerr.FromDynamoDB(ss.input.NewTableName, err)
+		}
+
+		result.deletes++
+	}
+
+	return
+}
+
+// keyNames returns the key attributes of the new table
+func (ss *StreamSyncer) keyNames(svc dynamodbiface.DynamoDBAPI) (names []string, err error) {
+
+	table, err := svc.DescribeTableWithContext(ss.ctx, &dynamodb.DescribeTableInput{
+		TableName: aws.String(ss.input.NewTableName),
+	})
+
+	if err != nil {
+		return nil, clonerr.FromDynamoDB(ss.input.NewTableName, err)
+	}
+
+	for _, element := range table.Table.KeySchema {
+		names = append(names, aws.StringValue(element.AttributeName))
+	}
+
+	return
+}
+
+//
+// Apply the stream to the new table, a pass at a time. Shards are read in
+// parallel, and a pass which finishes a shard is followed by another for its
+// children. The sync is complete once the lag behind the source is under
+// the configured limit.
+//
+func (ss *StreamSyncer) sync() (output state.SyncResult, err error) {
+
+	logger := log.Logger(ss.ctx)
+
+	// https://docs.aws.amazon.com/lambda/latest/dg/golang-context.html
+	timeoutChannel := timeout(ss.ctx, 5000*time.Millisecond)
+
+	output = ss.input.Sync
+	output.Complete = false
+	output.Checkpoint = ss.input.Key("sync", "checkpoint.json")
+
+	startRecords := output.Records
+
+	startedAt := time.Unix(0, ss.input.Stream.StartedAt*int64(time.Millisecond))
+
+	if time.Since(startedAt) > streamRetention {
+		return output, &clonerr.StreamExpired{Stream: ss.input.Stream.Arn, Reason: fmt.Sprintf("export started at %s, beyond the stream's retention", startedAt.UTC().Format(time.RFC3339))}
+	}
+
+	streamsSvc, err := ss.clients.SourceStreams()
+
+	if err != nil {
+		return
+	}
+
+	destSvc, err := ss.clients.DestDynamoDB()
+
+	if err != nil {
+		return
+	}
+
+	s3Svc, err := ss.clients.Bucket()
+
+	if err != nil {
+		return
+	}
+
+	pipeline, err := newItemPipeline(ss.ctx, ss.clients, ss.input)
+
+	if err != nil {
+		return
+	}
+
+	keyNames, err := ss.keyNames(destSvc)
+
+	if err != nil {
+		return
+	}
+
+	checkpoint, err := ss.loadCheckpoint(s3Svc, output.Checkpoint)
+
+	if err != nil {
+		return
+	}
+
+	report := pipeline.newReport()
+
+	var lag time.Duration
+
+	// shards left waiting on a parent finished just as time ran out
+	pending := false
+
+	for {
+
+		shards, shardsErr := ss.shards(streamsSvc)
+
+		if shardsErr != nil {
+			return output, shardsErr
+		}
+
+		ready, readyErr := ss.ready(shards, checkpoint)
+
+		if readyErr != nil {
+			return output, readyErr
+		}
+
+		if len(ready) == 0 {
+			break
+		}
+
+		logger.Info(fmt.Sprintf("syncing %d shards", len(ready)), zap.String("stream", ss.input.Stream.Arn))
+
+		var wg sync.WaitGroup
+		var mu sync.Mutex
+		var passErr error
+
+		finished := 0
+		lag = 0
+
+		work := make(chan *dynamodbstreams.Shard)
+
+		for i := 0; i < syncWorkers; i++ {
+
+			wg.Add(1)
+
+			go func() {
+				defer wg.Done()
+
+				for shard := range work {
+
+					shardID := aws.StringValue(shard.ShardId)
+
+					mu.Lock()
+					shardCheckpoint := checkpoint.Shards[shardID]
+					mu.Unlock()
+
+					result, shardErr := ss.syncShard(streamsSvc, destSvc, pipeline, keyNames, shard, shardCheckpoint, timeoutChannel)
+
+					mu.Lock()
+
+					// whatever was applied before a failure still counts
+					checkpoint.Shards[shardID] = result.checkpoint
+					output.Records += result.records
+					output.Puts += result.puts
+					output.Deletes += result.deletes
+
+					if report != nil {
+						report.Merge(result.report)
+					}
+
+					if result.lag > lag {
+						lag = result.lag
+					}
+
+					if result.checkpoint.Closed {
+						finished++
+					}
+
+					if passErr == nil {
+						passErr = shardErr
+					}
+
+					mu.Unlock()
+				}
+			}()
+		}
+
+		for _, shard := range ready {
+			work <- shard
+		}
+
+		close(work)
+		wg.Wait()
+
+		if storeErr := ss.storeCheckpoint(s3Svc, output.Checkpoint, checkpoint); storeErr != nil {
+			return output, storeErr
+		}
+
+		if passErr != nil {
+			logger.Error("stream sync failed", zap.Error(passErr))
+			return output, passErr
+		}
+
+		timedOut := false
+
+		select {
+		case <-timeoutChannel:
+			timedOut = true
+		default:
+		}
+
+		// only a finished shard makes more ready
+		if timedOut || finished == 0 {
+			pending = timedOut && finished > 0
+			break
+		}
+	}
+
+	if report != nil {
+
+		key := maskingPartKey(ss.input, "stream", startRecords)
+
+		if err = storeMaskingReport(ss.ctx, ss.clients, ss.input, key, report); err != nil {
+			return
+		}
+	}
+
+	output.LagMS = lag.Milliseconds()
+	output.Complete = !pending && lag <= time.Duration(ss.input.SyncConfig.MaxLagSeconds)*time.Second
+
+	logger.Info("stream sync pass complete", zap.Int64("records", output.Records-startRecords), zap.Int64("lag", output.LagMS), zap.Bool("complete", output.Complete))
+
+	return
+}
+
+// Run executes a pass over the source's stream.
+func (ss *StreamSyncer) Run() (output state.SyncResult, err error) {
+	return ss.sync()
+}
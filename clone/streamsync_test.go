@@ -0,0 +1,351 @@
+package clone_test
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/NixM0nk3y/dynamodb-clone/clone"
+	"github.com/NixM0nk3y/dynamodb-clone/clonetest"
+	"github.com/NixM0nk3y/dynamodb-clone/state"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodbstreams"
+)
+
+// streamedClone clones the source with its stream enabled, returning the
+// run to sync and the source's items by their Id
+func streamedClone(t *testing.T, clients *clonetest.Clients, transforms []state.Transform) (cloneRun, map[string]map[string]*dynamodb.AttributeValue) {
+
+	t.Helper()
+
+	loadSource(t, clients.Source)
+
+	if _, err := clients.Source.UpdateTableWithContext(context.Background(), &dynamodb.UpdateTableInput{
+		TableName: aws.String(sourceDB),
+		StreamSpecification: &dynamodb.StreamSpecification{
+			StreamEnabled:  aws.Bool(true),
+			StreamViewType: aws.String(dynamodb.StreamViewTypeNewAndOldImages),
+		},
+	}); err != nil {
+		t.Fatalf("unable to enable the source's stream: %v", err)
+	}
+
+	run := cloneTable(t, state.Schema{
+		Region:        clonetest.Region,
+		Bucket:        testBucket,
+		OrigTableName: sourceDB,
+		NewTableName:  destDB,
+		ExportConfig:  state.ExportConfig{Mode: state.ModeStaged},
+		ImportConfig:  state.ImportConfig{Transforms: transforms},
+		SyncConfig:    state.SyncConfig{Enabled: true},
+	}, 0, clone.WithClients(clients))
+
+	if run.input.Stream.Arn == "" {
+		t.Fatalf("no stream position recorded")
+	}
+
+	source := map[string]map[string]*dynamodb.AttributeValue{}
+
+	for _, item := range clients.Source.Items(sourceDB) {
+		source[aws.StringValue(item["Id"].N)] = item
+	}
+
+	return run, source
+}
+
+// syncStream runs stream sync passes until the new table has caught up
+func syncStream(t *testing.T, clients *clonetest.Clients, input state.Schema) state.SyncResult {
+
+	t.Helper()
+
+	for pass := 0; pass < 10; pass++ {
+
+		syncer, err := clone.NewStreamSyncer(context.Background(), input, clone.WithClients(clients))
+
+		if err != nil {
+			t.Fatalf("invalid stream sync: %v", err)
+		}
+
+		if input.Sync, err = syncer.Run(); err != nil {
+			t.Fatalf("stream sync failed: %v", err)
+		}
+
+		if input.Sync.Complete {
+			return input.Sync
+		}
+	}
+
+	t.Fatalf("stream sync didn't catch up, %+v", input.Sync)
+
+	return input.Sync
+}
+
+func TestStreamSync(t *testing.T) {
+
+	n := func(value string) *dynamodb.AttributeValue {
+		return &dynamodb.AttributeValue{N: aws.String(value)}
+	}
+
+	s := func(value string) *dynamodb.AttributeValue {
+		return &dynamodb.AttributeValue{S: aws.String(value)}
+	}
+
+	type write struct {
+		shard string
+		event string
+		at    time.Duration // after the export started
+		id    string
+		image map[string]*dynamodb.AttributeValue // nil for the source's item
+	}
+
+	tests := []struct {
+		name       string
+		transforms []state.Transform
+		key        string // of the new table
+		writes     []write
+		closed     bool // the first shard is closed and the second its child
+		setup      func(streams *clonetest.Streams)
+		expected   map[string]map[string]*dynamodb.AttributeValue
+		result     state.SyncResult
+	}{
+		{
+			name: "replayed writes",
+			key:  "Id",
+			writes: []write{
+				// long before the export, it saw this write
+				{event: dynamodbstreams.OperationTypeInsert, at: -time.Hour, id: "900", image: map[string]*dynamodb.AttributeValue{"Id": n("900")}},
+				// during the export, whether it saw it or not the item ends up the same
+				{event: dynamodbstreams.OperationTypeModify, at: -10 * time.Second, id: "101"},
+				{event: dynamodbstreams.OperationTypeInsert, id: "300", image: map[string]*dynamodb.AttributeValue{"Id": n("300"), "Title": s("new")}},
+				{event: dynamodbstreams.OperationTypeModify, id: "102", image: map[string]*dynamodb.AttributeValue{"Id": n("102"), "Title": s("changed")}},
+			},
+			expected: map[string]map[string]*dynamodb.AttributeValue{
+				"900": nil,
+				"300": {"Id": n("300"), "Title": s("new")},
+				"102": {"Id": n("102"), "Title": s("changed")},
+			},
+			result: state.SyncResult{Records: 3, Puts: 3},
+		},
+		{
+			name: "deletes",
+			key:  "Id",
+			writes: []write{
+				{event: dynamodbstreams.OperationTypeRemove, id: "101"},
+				{event: dynamodbstreams.OperationTypeInsert, id: "301", image: map[string]*dynamodb.AttributeValue{"Id": n("301")}},
+				{event: dynamodbstreams.OperationTypeRemove, id: "301"},
+				// an item the new table never held
+				{event: dynamodbstreams.OperationTypeRemove, id: "999"},
+			},
+			expected: map[string]map[string]*dynamodb.AttributeValue{
+				"101": nil,
+				"301": nil,
+				"999": nil,
+			},
+			result: state.SyncResult{Records: 4, Puts: 1, Deletes: 3},
+		},
+		{
+			// the child's writes come after its parent's, whichever is listed first
+			name:   "child shard",
+			key:    "Id",
+			closed: true,
+			writes: []write{
+				{shard: "shard-1", event: dynamodbstreams.OperationTypeInsert, id: "302", image: map[string]*dynamodb.AttributeValue{"Id": n("302"), "Title": s("first")}},
+				{shard: "shard-1", event: dynamodbstreams.OperationTypeModify, id: "202", image: map[string]*dynamodb.AttributeValue{"Id": n("202"), "Title": s("first")}},
+				{shard: "shard-2", event: dynamodbstreams.OperationTypeModify, id: "302", image: map[string]*dynamodb.AttributeValue{"Id": n("302"), "Title": s("second")}},
+				{shard: "shard-2", event: dynamodbstreams.OperationTypeRemove, id: "202"},
+			},
+			expected: map[string]map[string]*dynamodb.AttributeValue{
+				"302": {"Id": n("302"), "Title": s("second")},
+				"202": nil,
+			},
+			result: state.SyncResult{Records: 4, Puts: 3, Deletes: 1},
+		},
+		{
+			// a shard handing back empty pages ahead of its records hasn't caught up
+			name: "empty pages",
+			key:  "Id",
+			setup: func(streams *clonetest.Streams) {
+				streams.PageSize = 1
+				streams.EmptyPages = 2
+			},
+			writes: []write{
+				{event: dynamodbstreams.OperationTypeInsert, id: "304", image: map[string]*dynamodb.AttributeValue{"Id": n("304")}},
+				{event: dynamodbstreams.OperationTypeRemove, id: "204"},
+			},
+			expected: map[string]map[string]*dynamodb.AttributeValue{
+				"304": {"Id": n("304")},
+				"204": nil,
+			},
+			result: state.SyncResult{Records: 2, Puts: 1, Deletes: 1},
+		},
+		{
+			// keys are transformed as the import did, deletes included
+			name:       "renamed key",
+			transforms: []state.Transform{{Op: "rename", Attribute: "Id", To: "Key"}},
+			key:        "Key",
+			writes: []write{
+				{event: dynamodbstreams.OperationTypeRemove, id: "203"},
+				{event: dynamodbstreams.OperationTypeInsert, id: "303", image: map[string]*dynamodb.AttributeValue{"Id": n("303"), "Title": s("new")}},
+			},
+			expected: map[string]map[string]*dynamodb.AttributeValue{
+				"203": nil,
+				"303": {"Key": n("303"), "Title": s("new")},
+			},
+			result: state.SyncResult{Records: 2, Puts: 1, Deletes: 1},
+		},
+	}
+
+	for _, test := range tests {
+
+		test := test
+
+		t.Run(test.name, func(t *testing.T) {
+
+			clients := clonetest.NewClients()
+
+			run, source := streamedClone(t, clients, test.transforms)
+
+			if test.setup != nil {
+				test.setup(clients.Streams)
+			}
+
+			arn := run.input.Stream.Arn
+			startedAt := time.Unix(0, run.input.Stream.StartedAt*int64(time.Millisecond))
+
+			// a child listed ahead of its parent
+			if test.closed {
+				clients.Streams.Shard(arn, "shard-2", "shard-1")
+			}
+
+			clients.Streams.Shard(arn, "shard-1", "")
+
+			for _, w := range test.writes {
+
+				if w.shard == "" {
+					w.shard = "shard-1"
+				}
+
+				keys := map[string]*dynamodb.AttributeValue{"Id": n(w.id)}
+
+				image := w.image
+
+				if image == nil && w.event != dynamodbstreams.OperationTypeRemove {
+					image = source[w.id]
+				}
+
+				clients.Streams.Write(arn, w.shard, w.event, startedAt.Add(w.at), keys, image)
+			}
+
+			if test.closed {
+				clients.Streams.Close(arn, "shard-1")
+			}
+
+			result := syncStream(t, clients, run.input)
+
+			result.Checkpoint, result.LagMS, result.DurationMS, result.Complete = "", 0, 0, false
+
+			if !reflect.DeepEqual(result, test.result) {
+				t.Errorf("synced %+v, expected %+v", result, test.result)
+			}
+
+			dest := map[string]map[string]*dynamodb.AttributeValue{}
+
+			for _, item := range clients.Dest.Items(destDB) {
+				dest[aws.StringValue(item[test.key].N)] = item
+			}
+
+			for id, item := range test.expected {
+				if !reflect.DeepEqual(dest[id], item) {
+					t.Errorf("item %s is %v, expected %v", id, dest[id], item)
+				}
+			}
+
+			// the rest are as the clone left them
+			for id, item := range source {
+
+				if _, ok := test.expected[id]; ok {
+					continue
+				}
+
+				if _, ok := dest[id]; !ok {
+					t.Errorf("item %s went missing: %v", id, item)
+				}
+			}
+		})
+	}
+}
+
+func TestStreamSyncResume(t *testing.T) {
+
+	clients := clonetest.NewClients()
+
+	run, _ := streamedClone(t, clients, nil)
+
+	arn := run.input.Stream.Arn
+
+	clients.Streams.Shard(arn, "shard-1", "")
+
+	put := func(id string, title string) {
+		clients.Streams.Write(arn, "shard-1", dynamodbstreams.OperationTypeModify, time.Now(),
+			map[string]*dynamodb.AttributeValue{"Id": {N: aws.String(id)}},
+			map[string]*dynamodb.AttributeValue{"Id": {N: aws.String(id)}, "Title": {S: aws.String(title)}})
+	}
+
+	put("101", "first")
+
+	input := run.input
+	input.Sync = syncStream(t, clients, input)
+
+	// a later write to the item is applied, the earlier isn't applied again
+	put("102", "second")
+	put("101", "third")
+
+	result := syncStream(t, clients, input)
+
+	if result.Records != 3 || result.Puts != 3 {
+		t.Errorf("synced %d records with %d puts, expected 3 of each across both syncs", result.Records, result.Puts)
+	}
+
+	if puts := clients.Dest.Calls("PutItem"); puts != 3 {
+		t.Errorf("%d items put, expected 3", puts)
+	}
+
+	titles := map[string]string{}
+
+	for _, item := range clients.Dest.Items(destDB) {
+		titles[aws.StringValue(item["Id"].N)] = aws.StringValue(item["Title"].S)
+	}
+
+	if titles["101"] != "third" || titles["102"] != "second" {
+		t.Errorf("synced titles %v", titles)
+	}
+}
+
+func TestStreamSyncCancelled(t *testing.T) {
+
+	clients := clonetest.NewClients()
+
+	run, _ := streamedClone(t, clients, nil)
+
+	clients.Streams.Shard(run.input.Stream.Arn, "shard-1", "")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	syncer, err := clone.NewStreamSyncer(ctx, run.input, clone.WithClients(clients))
+
+	if err != nil {
+		t.Fatalf("invalid stream sync: %v", err)
+	}
+
+	// an empty shard is paused over, until the invocation is cancelled
+	if _, err = syncer.Run(); err == nil {
+		t.Errorf("stream sync carried on once cancelled")
+	}
+
+	if calls := clients.Streams.Calls("GetRecords"); calls != 1 {
+		t.Errorf("shard read %d times once cancelled", calls)
+	}
+}
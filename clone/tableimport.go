@@ -0,0 +1,465 @@
+package clone
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"path"
+	"time"
+
+	"github.com/NixM0nk3y/dynamodb-clone/clonerr"
+	"github.com/NixM0nk3y/dynamodb-clone/datafile"
+	"github.com/NixM0nk3y/dynamodb-clone/log"
+	"github.com/NixM0nk3y/dynamodb-clone/manifest"
+	"github.com/NixM0nk3y/dynamodb-clone/state"
+	"github.com/NixM0nk3y/dynamodb-clone/transform"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"go.uber.org/zap"
+)
+
+// how often a running table import is described
+const importPollInterval = 10 * time.Second
+
+// importFormat maps a data file format onto the formats ImportTable reads
+func importFormat(format string) (string, error) {
+
+	switch datafile.Format(format) {
+	case datafile.FormatDynamoDB:
+		return dynamodb.InputFormatDynamodbJson, nil
+	case datafile.FormatIon:
+		return dynamodb.InputFormatIon, nil
+	}
+
+	return "", fmt.Errorf("ImportTable can't read %q data files", format)
+}
+
+// importCompression maps a data file compression onto ImportTable's
+func importCompression(compression datafile.Compression) string {
+
+	switch compression {
+	case datafile.CompressionGzip:
+		return dynamodb.InputCompressionTypeGzip
+	case datafile.CompressionZstd:
+		return dynamodb.InputCompressionTypeZstd
+	}
+
+	return dynamodb.InputCompressionTypeNone
+}
+
+// checkTableImport fails a configuration ImportTable can't carry out before any data moves
+func checkTableImport(input state.Schema) error {
+
+	if !input.SchemaConfig.ImportTable {
+		return nil
+	}
+
+	if input.ExportConfig.Mode == state.ModeDirect {
+		return &clonerr.SchemaInvalid{Reason: "a direct copy can't be imported with ImportTable"}
+	}
+
+	format, err := datafile.ParseFormat(input.ExportConfig.Format)
+
+	if err == nil {
+		_, err = importFormat(string(format))
+	}
+
+	if err != nil {
+		return &clonerr.SchemaInvalid{Reason: "invalid export format", Err: err}
+	}
+
+	// ImportTable writes the files as they are
+	if len(input.ImportConfig.Transforms) > 0 || input.ImportConfig.Masking.Enabled() {
+		return &clonerr.SchemaInvalid{Reason: "items can't be masked or transformed by ImportTable"}
+	}
+
+	return nil
+}
+
+//
+// ImportTable reads every object under a prefix in a single format and
+// compression, the files the manifest lists are copied into one folder of
+// their own so they have to share a name with no other
+//
+func importSource(runManifest *manifest.Manifest) (format string, compression datafile.Compression, err error) {
+
+	names := map[string]bool{}
+
+	for i, file := range runManifest.Files {
+
+		name := path.Base(file.Key)
+		fileCompression := datafile.DetectCompression(file.Key, "")
+
+		if names[name] {
+			return "", "", fmt.Errorf("data file %s has the name of another", file.Key)
+		}
+
+		names[name] = true
+
+		if i == 0 {
+			format, compression = file.Format, fileCompression
+			continue
+		}
+
+		if file.Format != format || fileCompression != compression {
+			return "", "", fmt.Errorf("data file %s doesn't match the format and compression of the others", file.Key)
+		}
+	}
+
+	if len(names) == 0 {
+		return "", "", fmt.Errorf("no data files to import")
+	}
+
+	return
+}
+
+// importPrefix is the folder ImportTable reads, holding only the files the run manifest lists
+func importPrefix(input state.Schema) string {
+	return input.Key("import") + "/"
+}
+
+//
+// The run's data folder also holds the files of failed or retried export
+// invocations the manifest leaves out, so ImportTable can't be pointed at
+// it. Each file the manifest lists is checked against its checksum and item
+// count as the data import would, then copied into the import folder,
+// carrying on from the files staged by earlier invocations.
+//
+func (sw *SchemaWriter) stageImportFiles(runManifest *manifest.Manifest, staged int, timeoutChannel <-chan struct{}) (int, error) {
+
+	logger := log.Logger(sw.ctx)
+
+	if _, _, sourceErr := importSource(runManifest); sourceErr != nil {
+		return staged, &clonerr.SchemaInvalid{Reason: "staged files can't be imported", Err: sourceErr}
+	}
+
+	s3Svc, err := sw.clients.Bucket()
+
+	if err != nil {
+		return staged, err
+	}
+
+	for ; staged < len(runManifest.Files); staged++ {
+
+		select {
+		case <-timeoutChannel:
+			logger.Warn("schema import lambda duration expired, files still to be staged for import")
+			return staged, nil
+		default:
+		}
+
+		file := runManifest.Files[staged]
+
+		checkInput := sw.input
+		checkInput.Import = state.ImportResult{
+			Records: file.Key,
+			Format:  file.Format,
+			Items:   file.Items,
+			SHA256:  file.SHA256,
+		}
+
+		checker, checkErr := NewDataWriter(sw.ctx, checkInput, WithClients(sw.clients))
+
+		if checkErr != nil {
+			return staged, checkErr
+		}
+
+		if err = checker.verifyData(file.Key); err != nil {
+			return staged, err
+		}
+
+		key := importPrefix(sw.input) + path.Base(file.Key)
+
+		_, err = s3Svc.CopyObjectWithContext(sw.ctx, &s3.CopyObjectInput{
+			Bucket:     aws.String(sw.input.Bucket),
+			Key:        aws.String(key),
+			CopySource: aws.String(url.PathEscape(sw.input.Bucket + "/" + file.Key)),
+		})
+
+		if err != nil {
+			logger.Error(fmt.Sprintf("unable to copy %s to %s", file.Key, key), zap.Error(err))
+			return staged, &clonerr.StorageFailure{Bucket: sw.input.Bucket, Key: key, Err: err}
+		}
+	}
+
+	logger.Info(fmt.Sprintf("staged %d files for import under %s", staged, importPrefix(sw.input)))
+
+	return staged, nil
+}
+
+//
+// Start the import of the run's data files into a new table, the client
+// token is derived from the run so a retried invocation picks up the import
+// already started rather than starting another
+//
+func (sw *SchemaWriter) startTableImport(svc dynamodbiface.DynamoDBAPI, tableInput *dynamodb.CreateTableInput, runManifest *manifest.Manifest) (importArn string, err error) {
+
+	logger := log.Logger(sw.ctx)
+
+	prefix := importPrefix(sw.input)
+
+	format, compression, sourceErr := importSource(runManifest)
+
+	if sourceErr != nil {
+		return "", &clonerr.SchemaInvalid{Reason: "staged files can't be imported", Err: sourceErr}
+	}
+
+	inputFormat, formatErr := importFormat(format)
+
+	if formatErr != nil {
+		return "", &clonerr.SchemaInvalid{Reason: "staged files can't be imported", Err: formatErr}
+	}
+
+	token := sha256.Sum256([]byte(sw.input.RunID))
+
+	params := &dynamodb.ImportTableInput{
+		ClientToken:          aws.String(hex.EncodeToString(token[:16])),
+		InputFormat:          aws.String(inputFormat),
+		InputCompressionType: aws.String(importCompression(compression)),
+		S3BucketSource: &dynamodb.S3BucketSource{
+			S3Bucket:    aws.String(sw.input.Bucket),
+			S3KeyPrefix: aws.String(prefix),
+		},
+		TableCreationParameters: &dynamodb.TableCreationParameters{
+			TableName:              tableInput.TableName,
+			KeySchema:              tableInput.KeySchema,
+			AttributeDefinitions:   tableInput.AttributeDefinitions,
+			BillingMode:            tableInput.BillingMode,
+			ProvisionedThroughput:  tableInput.ProvisionedThroughput,
+			SSESpecification:       tableInput.SSESpecification,
+			GlobalSecondaryIndexes: tableInput.GlobalSecondaryIndexes,
+		},
+	}
+
+	// the import reads with the destination's credentials, which have to be
+	// told who owns a bucket in another account
+	if sw.input.DestRoleArn != "" {
+
+		owner, ownerErr := sw.clients.BucketOwner()
+
+		if ownerErr != nil {
+			return "", ownerErr
+		}
+
+		params.S3BucketSource.S3BucketOwner = aws.String(owner)
+	}
+
+	result, err := svc.ImportTableWithContext(sw.ctx, params)
+
+	if err != nil {
+		logger.Error("unable to start table import", zap.Error(err))
+		return "", clonerr.FromDynamoDB(sw.input.NewTableName, err)
+	}
+
+	importArn = aws.StringValue(result.ImportTableDescription.ImportArn)
+
+	logger.Info(fmt.Sprintf("started import %s of s3://%s/%s", importArn, sw.input.Bucket, prefix),
+		zap.String("format", inputFormat),
+		zap.String("compression", string(compression)),
+		zap.Int("files", len(runManifest.Files)),
+		zap.Int64("items", runManifest.Items))
+
+	return
+}
+
+//
+// Settings CreateTable would have been given which ImportTable doesn't take
+//
+func (sw *SchemaWriter) applyCreateSettings(svc dynamodbiface.DynamoDBAPI, tableInput *dynamodb.CreateTableInput) (err error) {
+
+	logger := log.Logger(sw.ctx)
+
+	var updates []*dynamodb.UpdateTableInput
+
+	if tableInput.StreamSpecification != nil {
+		updates = append(updates, &dynamodb.UpdateTableInput{StreamSpecification: tableInput.StreamSpecification})
+	}
+
+	if tableInput.TableClass != nil {
+		updates = append(updates, &dynamodb.UpdateTableInput{TableClass: tableInput.TableClass})
+	}
+
+	// one change at a time, each leaves the table updating for a while
+	for _, update := range updates {
+
+		logger.Info("updating table", zap.Stringer("update", update))
+
+		update.TableName = tableInput.TableName
+
+		if _, err = svc.UpdateTableWithContext(sw.ctx, update); err != nil {
+			return err
+		}
+
+		waitErr := svc.WaitUntilTableExistsWithContext(sw.ctx, &dynamodb.DescribeTableInput{
+			TableName: tableInput.TableName,
+		})
+
+		if waitErr != nil {
+			return waitErr
+		}
+	}
+
+	if len(tableInput.Tags) > 0 {
+
+		logger.Info(fmt.Sprintf("tagging table with %d tags", len(tableInput.Tags)))
+
+		table, describeErr := svc.DescribeTableWithContext(sw.ctx, &dynamodb.DescribeTableInput{
+			TableName: tableInput.TableName,
+		})
+
+		if describeErr != nil {
+			return describeErr
+		}
+
+		_, err = svc.TagResourceWithContext(sw.ctx, &dynamodb.TagResourceInput{
+			ResourceArn: table.Table.TableArn,
+			Tags:        tableInput.Tags,
+		})
+	}
+
+	return
+}
+
+//
+// Create the new table with ImportTable from the staged files instead of
+// creating it empty and writing every item. The files are checked and copied
+// into the import folder first, then the import runs for minutes to hours,
+// so each invocation polls it until shortly before its deadline and hands
+// back the import's arn to carry on from.
+//
+func (sw *SchemaWriter) dynamodbTableImport() (output state.SchemaImportResult, err error) {
+
+	logger := log.Logger(sw.ctx)
+
+	// https://docs.aws.amazon.com/lambda/latest/dg/golang-context.html
+	timeoutChannel := timeout(sw.ctx, 3000*time.Millisecond)
+
+	svc, err := sw.clients.DestDynamoDB()
+
+	if err != nil {
+		return
+	}
+
+	logger.Info("pulling table schema from storage")
+
+	tableSchema, err := sw.retrieveSchema()
+
+	if err != nil {
+		return
+	}
+
+	// renamed attributes keep their place in the keys, indexes and TTL, and
+	// hashed ones are defined as the strings they become
+	tableSchema.RenameAttributes(transform.Renames(sw.input.ImportConfig.Transforms))
+	tableSchema.RetypeAttributes(transform.Retypes(sw.input.ImportConfig.Transforms))
+
+	tableInput := sw.buildDynamodbSchema(tableSchema)
+
+	if len(tableInput.LocalSecondaryIndexes) > 0 {
+		return output, &clonerr.SchemaInvalid{Reason: "ImportTable can't create local secondary indexes"}
+	}
+
+	// have we got previous results ?
+	output = sw.input.SchemaImport
+
+	if output.ImportArn == "" {
+
+		runManifest, readErr := ReadManifest(sw.ctx, sw.input, sw.input.Export.Manifest, WithClients(sw.clients))
+
+		if readErr != nil {
+			return output, readErr
+		}
+
+		// ImportTable needs at least one file, an empty table is just created
+		if len(runManifest.Files) == 0 {
+
+			logger.Info("no staged files to import, creating an empty table")
+
+			output.Complete, err = sw.dynamodbSchemaImport()
+
+			return
+		}
+
+		if output.Staged, err = sw.stageImportFiles(runManifest, output.Staged, timeoutChannel); err != nil {
+			return
+		}
+
+		// handed back before the deadline with files still to copy
+		if output.Staged < len(runManifest.Files) {
+			return
+		}
+
+		if output.ImportArn, err = sw.startTableImport(svc, tableInput, runManifest); err != nil {
+			return
+		}
+	}
+
+	for {
+
+		result, describeErr := svc.DescribeImportWithContext(sw.ctx, &dynamodb.DescribeImportInput{
+			ImportArn: aws.String(output.ImportArn),
+		})
+
+		if describeErr != nil {
+			logger.Error("unable to describe table import", zap.Error(describeErr))
+			return output, clonerr.FromDynamoDB(sw.input.NewTableName, describeErr)
+		}
+
+		description := result.ImportTableDescription
+
+		output.Status = aws.StringValue(description.ImportStatus)
+		output.Processed = aws.Int64Value(description.ProcessedItemCount)
+		output.Imported = aws.Int64Value(description.ImportedItemCount)
+		output.Errors = aws.Int64Value(description.ErrorCount)
+
+		switch output.Status {
+
+		case dynamodb.ImportStatusCompleted:
+
+			logger.Info(fmt.Sprintf("table import %s completed", output.ImportArn),
+				zap.Int64("processed", output.Processed),
+				zap.Int64("imported", output.Imported),
+				zap.Int64("errors", output.Errors))
+
+			// items DynamoDB couldn't import are logged rather than failing the import
+			if output.Errors > 0 {
+				logger.Warn(fmt.Sprintf("%d items failed to import, see %s", output.Errors, aws.StringValue(description.CloudWatchLogGroupArn)))
+			}
+
+			if err = sw.finishTable(svc, tableSchema, tableInput, sw.applyCreateSettings); err != nil {
+				return
+			}
+
+			output.Complete = true
+
+			return
+
+		case dynamodb.ImportStatusFailed, dynamodb.ImportStatusCancelling, dynamodb.ImportStatusCancelled:
+
+			err = &clonerr.ImportFailed{
+				Table:  sw.input.NewTableName,
+				Import: output.ImportArn,
+				Code:   output.Status + " " + aws.StringValue(description.FailureCode),
+				Reason: aws.StringValue(description.FailureMessage),
+			}
+
+			logger.Error("table import failed", zap.Error(err))
+
+			return
+		}
+
+		logger.Info(fmt.Sprintf("waiting on table import %s", output.ImportArn), zap.Int64("processed", output.Processed))
+
+		select {
+		case <-timeoutChannel:
+			logger.Warn("schema import lambda duration expired, import still running")
+			return
+		case <-sw.ctx.Done():
+			return output, sw.ctx.Err()
+		case <-time.After(importPollInterval):
+		}
+	}
+}
@@ -0,0 +1,162 @@
+package clone_test
+
+import (
+	"bytes"
+	"context"
+	"path"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/NixM0nk3y/dynamodb-clone/clone"
+	"github.com/NixM0nk3y/dynamodb-clone/clonetest"
+	"github.com/NixM0nk3y/dynamodb-clone/datafile"
+	"github.com/NixM0nk3y/dynamodb-clone/state"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+//
+// stageOrphan leaves a data file in the run's data folder that no manifest
+// lists, as an export invocation that failed after writing it would, holding
+// an item the source doesn't
+//
+func stageOrphan(t *testing.T, clients *clonetest.Clients, input state.Schema) string {
+
+	t.Helper()
+
+	var b bytes.Buffer
+
+	err := datafile.NewEncoder(&b, datafile.FormatDynamoDB).Encode(map[string]*dynamodb.AttributeValue{
+		"Id": {N: aws.String("999999")},
+	})
+
+	if err != nil {
+		t.Fatalf("unable to encode orphaned item: %v", err)
+	}
+
+	key := input.Key("data", clone.NewRunID()+".json")
+
+	if _, err = clients.Staging.PutObjectWithContext(context.Background(), &s3.PutObjectInput{
+		Bucket: aws.String(testBucket),
+		Key:    aws.String(key),
+		Body:   bytes.NewReader(b.Bytes()),
+	}); err != nil {
+		t.Fatalf("unable to stage orphaned file: %v", err)
+	}
+
+	return key
+}
+
+func TestTableImport(t *testing.T) {
+
+	tests := []struct {
+		name     string
+		export   state.ExportConfig
+		pitr     bool
+		pending  int // times the import is described before it completes
+		deadline time.Duration
+	}{
+		{
+			name:   "staged",
+			export: state.ExportConfig{Mode: state.ModeStaged, TotalSegments: 2},
+		},
+		{
+			name:   "compressed",
+			export: state.ExportConfig{Mode: state.ModeStaged, Compression: "gzip"},
+		},
+		{
+			name:   "point in time",
+			export: state.ExportConfig{Mode: state.ModePointInTime, Format: "ion"},
+			pitr:   true,
+		},
+		{
+			// each invocation describes the import once before handing back
+			name:     "polled",
+			export:   state.ExportConfig{Mode: state.ModeStaged},
+			pending:  2,
+			deadline: 3500 * time.Millisecond,
+		},
+	}
+
+	for _, test := range tests {
+
+		test := test
+
+		t.Run(test.name, func(t *testing.T) {
+
+			clients := clonetest.NewClients()
+
+			items := loadSource(t, clients.Source)
+
+			if test.pitr {
+				enablePITR(t, clients.Source)
+			}
+
+			clients.Dest.ImportPending = test.pending
+
+			input := state.Schema{
+				Region:        clonetest.Region,
+				Bucket:        testBucket,
+				OrigTableName: sourceDB,
+				NewTableName:  destDB,
+				RunID:         clone.NewRunID(),
+				ExportConfig:  test.export,
+				SchemaConfig:  state.SchemaImportConfig{ImportTable: true},
+			}
+
+			orphan := stageOrphan(t, clients, input)
+
+			run := cloneTable(t, input, test.deadline, clone.WithClients(clients))
+
+			source := clients.Source.Items(sourceDB)
+			dest := clients.Dest.Items(destDB)
+
+			// the orphaned item would be imported from the data folder
+			if !reflect.DeepEqual(source, dest) {
+				t.Fatalf("destination doesn't match the source,\nsource: %v\ndest: %v", source, dest)
+			}
+
+			if run.staged != int64(items) {
+				t.Errorf("staged %d items, the source holds %d", run.staged, items)
+			}
+
+			if _, ok := clients.Staging.Object(testBucket, orphan); !ok {
+				t.Errorf("orphaned file %s was removed", orphan)
+			}
+
+			// the import folder holds the listed files and nothing else
+			var listed, copied []string
+
+			for _, file := range run.files {
+				listed = append(listed, path.Base(file.Key))
+			}
+
+			for _, key := range clients.Staging.Keys(testBucket, input.Key("import")+"/") {
+				copied = append(copied, path.Base(key))
+			}
+
+			sort.Strings(listed)
+			sort.Strings(copied)
+
+			if !reflect.DeepEqual(listed, copied) {
+				t.Errorf("import folder holds %v, the manifest lists %v", copied, listed)
+			}
+
+			if run.resumed["table import"] != test.pending {
+				t.Errorf("the import was handed back %d times while running, expected %d", run.resumed["table import"], test.pending)
+			}
+
+			// the resumed invocations carry on with the import already started
+			if calls := clients.Dest.Calls("ImportTable"); calls != 1 {
+				t.Errorf("started %d imports", calls)
+			}
+
+			if calls := clients.Dest.Calls("BatchWriteItem"); calls != 1 {
+				t.Errorf("wrote items %d times, only the source should be loaded", calls)
+			}
+		})
+	}
+}
@@ -0,0 +1,555 @@
+package clone
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/NixM0nk3y/dynamodb-clone/clonerr"
+	"github.com/NixM0nk3y/dynamodb-clone/itemhash"
+	"github.com/NixM0nk3y/dynamodb-clone/log"
+	"github.com/NixM0nk3y/dynamodb-clone/state"
+	"github.com/NixM0nk3y/dynamodb-clone/transform"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/cenkalti/backoff"
+	"go.uber.org/zap"
+)
+
+// verification sizing
+const (
+	verifySegmentsPerExport int64 = 4 // every item is looked up in the other table, so verify in smaller segments
+	maxVerifySegments       int64 = 256
+	verifyLimit             int64 = 1000 // items of a page, looked up batchGetSize at a time
+	defaultSamples          int64 = 10
+	batchGetSize                  = 100 // BatchGetItem takes at most 100 keys a call
+)
+
+// a page's lookups take a while, so verification hands back its progress
+// further ahead of the deadline than a scan
+const verifyMargin = 5000 * time.Millisecond
+
+// Verifier is a clone verifier
+type Verifier struct {
+	input   state.Schema
+	clients Clients
+	ctx     context.Context
+	err     error
+}
+
+// NewVerifier returns a verifier comparing one segment of the source and new tables
+func NewVerifier(ctx context.Context, input state.Schema, opts ...Option) (*Verifier, error) {
+
+	// every object of the clone is keyed under the run
+	if input.RunID == "" {
+		return nil, &clonerr.SchemaInvalid{Reason: "no run id passed"}
+	}
+
+	if input.VerifyConfig.TotalSegments < 1 {
+		input.VerifyConfig.TotalSegments = 1
+	}
+
+	if input.VerifyConfig.Segment < 0 || input.VerifyConfig.Segment >= input.VerifyConfig.TotalSegments {
+		return nil, &clonerr.SchemaInvalid{Reason: fmt.Sprintf("verify segment %d out of range", input.VerifyConfig.Segment)}
+	}
+
+	if input.VerifyConfig.Samples < 1 {
+		input.VerifyConfig.Samples = defaultSamples
+	}
+
+	// source items are masked and transformed as the import did before being compared
+	if err := validatePipeline(input); err != nil {
+		return nil, err
+	}
+
+	// the source is read within the export's read capacity
+	if err := validateCapacity(input.ExportConfig.Capacity); err != nil {
+		return nil, err
+	}
+
+	return &Verifier{
+		input:   input,
+		clients: newClients(ctx, input, opts),
+		ctx:     ctx,
+	}, nil
+}
+
+// keyNames returns the key attributes of the source table, partition key first
+func (v *Verifier) keyNames(svc dynamodbiface.DynamoDBAPI) (names []string, err error) {
+
+	table, err := svc.DescribeTableWithContext(v.ctx, &dynamodb.DescribeTableInput{
+		TableName: aws.String(v.input.OrigTableName),
+	})
+
+	if err != nil {
+		return nil, clonerr.FromDynamoDB(v.input.OrigTableName, err)
+	}
+
+	for _, keyType := range []string{dynamodb.KeyTypeHash, dynamodb.KeyTypeRange} {
+		for _, element := range table.Table.KeySchema {
+			if aws.StringValue(element.KeyType) == keyType {
+				names = append(names, aws.StringValue(element.AttributeName))
+			}
+		}
+	}
+
+	return
+}
+
+// scanner returns a consistent scanner of the verify segment of a table
+func (v *Verifier) scanner(svc dynamodbiface.DynamoDBAPI, table string, filter state.Filter, limiter *capacityLimiter) *scanner {
+	return &scanner{
+		ctx:           v.ctx,
+		svc:           svc,
+		table:         table,
+		segment:       v.input.VerifyConfig.Segment,
+		totalSegments: v.input.VerifyConfig.TotalSegments,
+		limit:         verifyLimit,
+		consistent:    true,
+		filter:        filter,
+		limiter:       limiter,
+	}
+}
+
+// pageKeys returns the key attributes of each item of a page
+func pageKeys(items []map[string]*dynamodb.AttributeValue, names []string) []map[string]*dynamodb.AttributeValue {
+
+	keys := make([]map[string]*dynamodb.AttributeValue, len(items))
+
+	for i, item := range items {
+
+		keys[i] = map[string]*dynamodb.AttributeValue{}
+
+		for _, name := range names {
+			keys[i][name] = item[name]
+		}
+	}
+
+	return keys
+}
+
+//
+// compareSource looks each page of the source up in the new table, once it
+// has been masked and transformed as the import did, tallying the items
+// missing from the new table or differing in it
+//
+func (v *Verifier) compareSource(destSvc dynamodbiface.DynamoDBAPI, names []string, pipeline *itemPipeline, output *state.VerifyResult) pageHandler {
+	return func(items []map[string]*dynamodb.AttributeValue, lastKey map[string]*dynamodb.AttributeValue) error {
+
+		if pipeline != nil {
+			if _, applyErr := pipeline.apply(items); applyErr != nil {
+				return applyErr
+			}
+		}
+
+		found, lookupErr := v.lookup(destSvc, v.input.NewTableName, names, pageKeys(items, names), state.Filter{}, nil)
+
+		if lookupErr != nil {
+			return lookupErr
+		}
+
+		var missing, differing []string
+
+		for _, item := range items {
+
+			key := itemhash.Key(item, names)
+
+			sum, ok := found[key]
+
+			switch {
+			case !ok:
+				missing = append(missing, key)
+			case sum != itemhash.Item(item):
+				differing = append(differing, key)
+			}
+		}
+
+		output.SourceItems += int64(len(items))
+		output.Missing += int64(len(missing))
+		output.Differing += int64(len(differing))
+
+		output.MissingKeys = samples(append(output.MissingKeys, missing...), v.input.VerifyConfig.Samples)
+		output.DifferingKeys = samples(append(output.DifferingKeys, differing...), v.input.VerifyConfig.Samples)
+
+		output.LastKey = lastKey
+
+		return nil
+	}
+}
+
+//
+// findExtra looks each page of the new table up in the source, tallying the
+// items the source doesn't hold. Only the keys are compared, the items the
+// source holds were compared while it was scanned. A hashed or masked key
+// can't be mapped back onto the source, the page is then only counted.
+//
+func (v *Verifier) findExtra(sourceSvc dynamodbiface.DynamoDBAPI, sourceNames []string, names []string, reversible bool, limiter *capacityLimiter, output *state.VerifyResult) pageHandler {
+	return func(items []map[string]*dynamodb.AttributeValue, lastKey map[string]*dynamodb.AttributeValue) error {
+
+		output.DestItems += int64(len(items))
+
+		if reversible && len(items) > 0 {
+
+			// map the new table's keys back onto the source's
+			sourceKeys := make([]map[string]*dynamodb.AttributeValue, len(items))
+
+			for i, item := range items {
+
+				sourceKeys[i] = map[string]*dynamodb.AttributeValue{}
+
+				for n, name := range sourceNames {
+					sourceKeys[i][name] = item[names[n]]
+				}
+			}
+
+			found, lookupErr := v.lookup(sourceSvc, v.input.OrigTableName, sourceNames, sourceKeys, v.input.VerifyConfig.Filter, limiter)
+
+			if lookupErr != nil {
+				return lookupErr
+			}
+
+			var extra []string
+
+			for i, item := range items {
+				if _, ok := found[itemhash.Key(sourceKeys[i], sourceNames)]; !ok {
+					extra = append(extra, itemhash.Key(item, names))
+				}
+			}
+
+			output.Extra += int64(len(extra))
+			output.ExtraKeys = samples(append(output.ExtraKeys, extra...), v.input.VerifyConfig.Samples)
+		}
+
+		output.LastKey = lastKey
+
+		return nil
+	}
+}
+
+// lookup reads the items at keys with consistent reads, summing each by its
+// key. With a limiter each call waits for read capacity and pays for it.
+func (v *Verifier) lookup(svc dynamodbiface.DynamoDBAPI, table string, names []string, keys []map[string]*dynamodb.AttributeValue, projection state.Filter, limiter *capacityLimiter) (found map[string]itemhash.Sum, err error) {
+
+	logger := log.Logger(v.ctx)
+
+	found = map[string]itemhash.Sum{}
+
+	expbo := backoff.NewExponentialBackOff()
+	expbo.MaxInterval = 1500 * time.Millisecond
+	boff := backoff.WithContext(expbo, v.ctx)
+
+	// BatchGetItem rejects a call asking for a key twice
+	unique := map[string]bool{}
+	deduped := keys[:0:0]
+
+	for _, key := range keys {
+		if k := itemhash.Key(key, names); !unique[k] {
+			unique[k] = true
+			deduped = append(deduped, key)
+		}
+	}
+
+	keys = deduped
+
+	for start := 0; start < len(keys); start += batchGetSize {
+
+		end := start + batchGetSize
+
+		if end > len(keys) {
+			end = len(keys)
+		}
+
+		request := map[string]*dynamodb.KeysAndAttributes{
+			table: {
+				Keys:           keys[start:end],
+				ConsistentRead: aws.Bool(true),
+			},
+		}
+
+		if projection.Projection != "" {
+			request[table].ProjectionExpression = aws.String(projection.Projection)
+			request[table].ExpressionAttributeNames = usedNames(projection.Names, projection.Projection)
+		}
+
+		for len(request) > 0 {
+
+			if _, limitErr := limiter.wait(nil); limitErr != nil {
+				return nil, limitErr
+			}
+
+			input := &dynamodb.BatchGetItemInput{
+				RequestItems: request,
+			}
+
+			if limiter != nil {
+				input.ReturnConsumedCapacity = aws.String(dynamodb.ReturnConsumedCapacityTotal)
+			}
+
+			result, getErr := svc.BatchGetItemWithContext(v.ctx, input)
+
+			if getErr != nil && !clonerr.IsThrottle(getErr) {
+				logger.Error("unknown dynamodb error", zap.Error(getErr))
+				return nil, clonerr.FromDynamoDB(table, getErr)
+			}
+
+			if getErr == nil {
+
+				limiter.consumed(result.ConsumedCapacity)
+
+				for _, item := range result.Responses[table] {
+					found[itemhash.Key(item, names)] = itemhash.Item(item)
+				}
+
+				request = result.UnprocessedKeys
+
+				if len(request) == 0 {
+					boff.Reset()
+					continue
+				}
+			}
+
+			// need to sleep when re-requesting, per spec
+			wait := boff.NextBackOff()
+
+			if wait == backoff.Stop {
+				logger.Error("backoff exhausted", zap.Error(getErr))
+				return nil, &clonerr.ThroughputExhausted{Table: table, Err: getErr}
+			}
+
+			if sleepErr := aws.SleepWithContext(v.ctx, wait); sleepErr != nil {
+				return nil, &clonerr.ThroughputExhausted{Table: table, Err: sleepErr}
+			}
+		}
+	}
+
+	return
+}
+
+// storeReport writes the segment result next to the rest of the run
+func (v *Verifier) storeReport(output state.VerifyResult) (err error) {
+
+	logger := log.Logger(v.ctx)
+
+	s3Svc, err := v.clients.Bucket()
+
+	if err != nil {
+		return
+	}
+
+	b, err := json.Marshal(output)
+
+	if err != nil {
+		return
+	}
+
+	_, err = s3Svc.PutObjectWithContext(v.ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(v.input.Bucket),
+		Key:         aws.String(output.Report),
+		Body:        bytes.NewReader(b),
+		ContentType: aws.String("application/json"),
+	})
+
+	if err != nil {
+		logger.Error(fmt.Sprintf("unable to store report %s to %s", output.Report, v.input.Bucket), zap.Error(err))
+		return &clonerr.StorageFailure{Bucket: v.input.Bucket, Key: output.Report, Err: err}
+	}
+
+	return
+}
+
+// keysReversible reports if the new table's keys map back onto the source's,
+// only a rename leaves a key attribute's value alone and no key may be masked
+func keysReversible(config state.ImportConfig, names ...[]string) bool {
+
+	keys := map[string]bool{}
+
+	for _, group := range names {
+		for _, name := range group {
+			keys[name] = true
+		}
+	}
+
+	for _, t := range config.Transforms {
+		if t.Op != transform.OpRename && (keys[t.Attribute] || keys[t.To]) {
+			return false
+		}
+	}
+
+	for _, rule := range config.Masking.Rules {
+
+		name := rule.Path
+
+		if end := strings.IndexAny(name, ".["); end >= 0 {
+			name = name[:end]
+		}
+
+		if keys[name] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// samples returns the first few keys in order
+func samples(keys []string, limit int64) []string {
+
+	sort.Strings(keys)
+
+	if int64(len(keys)) > limit {
+		keys = keys[:limit]
+	}
+
+	return keys
+}
+
+//
+// Verify the segment a page at a time, first looking the source's items up in
+// the new table and then the new table's in the source. Progress is handed
+// back shortly before the deadline, LastKey resuming the table being scanned.
+//
+func (v *Verifier) verify() (output state.VerifyResult, err error) {
+
+	logger := log.Logger(v.ctx)
+
+	// https://docs.aws.amazon.com/lambda/latest/dg/golang-context.html
+	timeoutChannel := timeout(v.ctx, verifyMargin)
+
+	sourceSvc, err := v.clients.SourceDynamoDB()
+
+	if err != nil {
+		return
+	}
+
+	destSvc, err := v.clients.DestDynamoDB()
+
+	if err != nil {
+		return
+	}
+
+	pipeline, err := newItemPipeline(v.ctx, v.clients, v.input)
+
+	if err != nil {
+		return
+	}
+
+	sourceNames, err := v.keyNames(sourceSvc)
+
+	if err != nil {
+		logger.Error("unable to describe source table", zap.Error(err))
+		return
+	}
+
+	// the new table's keys carry any renames
+	renames := transform.Renames(v.input.ImportConfig.Transforms)
+
+	names := make([]string, len(sourceNames))
+
+	for i, name := range sourceNames {
+
+		names[i] = name
+
+		if to, ok := renames[name]; ok {
+			names[i] = to
+		}
+	}
+
+	// the live source is held to the export's read capacity
+	limiter, err := newCapacityLimiter(v.ctx, v.clients, sourceSvc, v.input.OrigTableName, capacityRead, v.input.ExportConfig.Capacity)
+
+	if err != nil {
+		return
+	}
+
+	// have we got previous results ?
+	output = v.input.Verify
+
+	// a filtered clone is compared with the same subset of the source
+	output.Subset = v.input.VerifyConfig.Filter.Subset()
+
+	if output.Subset {
+		logger.Info("verifying a filtered subset of the source")
+	}
+
+	if !output.DestScan {
+
+		complete, scanErr := v.scanner(sourceSvc, v.input.OrigTableName, v.input.VerifyConfig.Filter, limiter).
+			scan(output.LastKey, timeoutChannel, v.compareSource(destSvc, names, pipeline, &output))
+
+		if scanErr != nil {
+			return output, scanErr
+		}
+
+		if !complete {
+			logger.Warn("verify lambda duration expired scanning the source", zap.Int64("source", output.SourceItems))
+			return
+		}
+
+		output.DestScan = true
+		output.LastKey = nil
+	}
+
+	reversible := keysReversible(v.input.ImportConfig, sourceNames, names)
+
+	if !reversible {
+		// a hashed or masked key moves the item to another segment and
+		// can't be looked up in the source, only the source side is checked
+		logger.Warn("key attributes are transformed, unable to confirm extra items against the source")
+	}
+
+	complete, err := v.scanner(destSvc, v.input.NewTableName, state.Filter{}, nil).
+		scan(output.LastKey, timeoutChannel, v.findExtra(sourceSvc, sourceNames, names, reversible, limiter, &output))
+
+	if err != nil {
+		return
+	}
+
+	if !complete {
+		logger.Warn("verify lambda duration expired scanning the new table", zap.Int64("dest", output.DestItems))
+		return
+	}
+
+	output.LastKey = nil
+
+	logger.Info("segment scanned", zap.Int64("source", output.SourceItems), zap.Int64("dest", output.DestItems))
+
+	output.Report = v.input.Key("verify", fmt.Sprintf("segment-%04d.json", v.input.VerifyConfig.Segment))
+
+	if err = v.storeReport(output); err != nil {
+		return
+	}
+
+	if output.Diverged() {
+
+		logger.Error("tables diverge",
+			zap.Int64("missing", output.Missing),
+			zap.Int64("extra", output.Extra),
+			zap.Int64("differing", output.Differing),
+			zap.Strings("missingkeys", output.MissingKeys),
+			zap.Strings("extrakeys", output.ExtraKeys),
+			zap.Strings("differingkeys", output.DifferingKeys))
+
+		return output, &clonerr.VerificationFailed{
+			Table:     v.input.NewTableName,
+			Report:    output.Report,
+			Missing:   output.Missing,
+			Extra:     output.Extra,
+			Differing: output.Differing,
+		}
+	}
+
+	output.Complete = true
+
+	return
+}
+
+// Run executes a verification of the segment.
+func (v *Verifier) Run() (output state.VerifyResult, err error) {
+	return v.verify()
+}
@@ -0,0 +1,187 @@
+package clone_test
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/NixM0nk3y/dynamodb-clone/clone"
+	"github.com/NixM0nk3y/dynamodb-clone/clonerr"
+	"github.com/NixM0nk3y/dynamodb-clone/clonetest"
+	"github.com/NixM0nk3y/dynamodb-clone/state"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// verifyTable verifies every segment of a finished clone again, adding up
+// their results and checking a diverging segment fails with its report
+func verifyTable(t *testing.T, clients *clonetest.Clients, run cloneRun) (total state.VerifyResult) {
+
+	t.Helper()
+
+	for _, segment := range run.verify {
+
+		input := run.input
+		input.VerifyConfig = segment
+
+		for !input.Verify.Complete {
+
+			verifier, err := clone.NewVerifier(context.Background(), input, clone.WithClients(clients))
+
+			if err != nil {
+				t.Fatalf("invalid verification: %v", err)
+			}
+
+			output, err := verifier.Run()
+
+			var failed *clonerr.VerificationFailed
+
+			if errors.As(err, &failed) {
+
+				if !output.Diverged() || failed.Missing != output.Missing || failed.Extra != output.Extra || failed.Differing != output.Differing {
+					t.Errorf("segment %d failed with %v, its result was %+v", segment.Segment, err, output)
+				}
+
+				if _, ok := clients.Staging.Object(testBucket, failed.Report); !ok {
+					t.Errorf("segment %d failed without storing its report %s", segment.Segment, failed.Report)
+				}
+
+				output.Complete = true
+			} else if err != nil {
+				t.Fatalf("verification of segment %d failed: %v", segment.Segment, err)
+			}
+
+			input.Verify = output
+		}
+
+		total.SourceItems += input.Verify.SourceItems
+		total.DestItems += input.Verify.DestItems
+		total.Missing += input.Verify.Missing
+		total.Extra += input.Verify.Extra
+		total.Differing += input.Verify.Differing
+		total.MissingKeys = append(total.MissingKeys, input.Verify.MissingKeys...)
+		total.ExtraKeys = append(total.ExtraKeys, input.Verify.ExtraKeys...)
+		total.DifferingKeys = append(total.DifferingKeys, input.Verify.DifferingKeys...)
+	}
+
+	sort.Strings(total.MissingKeys)
+	sort.Strings(total.ExtraKeys)
+	sort.Strings(total.DifferingKeys)
+
+	return
+}
+
+func TestVerifierDivergence(t *testing.T) {
+
+	put := func(item map[string]*dynamodb.AttributeValue) func(t *testing.T, svc *clonetest.DynamoDB) {
+		return func(t *testing.T, svc *clonetest.DynamoDB) {
+			if _, err := svc.PutItemWithContext(context.Background(), &dynamodb.PutItemInput{TableName: aws.String(destDB), Item: item}); err != nil {
+				t.Fatalf("unable to put %v: %v", item, err)
+			}
+		}
+	}
+
+	remove := func(key map[string]*dynamodb.AttributeValue) func(t *testing.T, svc *clonetest.DynamoDB) {
+		return func(t *testing.T, svc *clonetest.DynamoDB) {
+			if _, err := svc.DeleteItemWithContext(context.Background(), &dynamodb.DeleteItemInput{TableName: aws.String(destDB), Key: key}); err != nil {
+				t.Fatalf("unable to delete %v: %v", key, err)
+			}
+		}
+	}
+
+	n := func(value string) *dynamodb.AttributeValue {
+		return &dynamodb.AttributeValue{N: aws.String(value)}
+	}
+
+	tests := []struct {
+		name       string
+		transforms []state.Transform
+		changes    []func(t *testing.T, svc *clonetest.DynamoDB)
+		destItems  int64 // more or less than the source's
+		expected   state.VerifyResult
+	}{
+		{
+			name: "matching",
+		},
+		{
+			name:      "missing",
+			changes:   []func(t *testing.T, svc *clonetest.DynamoDB){remove(map[string]*dynamodb.AttributeValue{"Id": n("101")})},
+			destItems: -1,
+			expected:  state.VerifyResult{Missing: 1, MissingKeys: []string{"Id=N:101"}},
+		},
+		{
+			name: "differing",
+			changes: []func(t *testing.T, svc *clonetest.DynamoDB){
+				put(map[string]*dynamodb.AttributeValue{"Id": n("102"), "Title": {S: aws.String("Book 102 Title")}}),
+				put(map[string]*dynamodb.AttributeValue{"Id": n("201"), "Weight": n("2.5")}),
+			},
+			expected: state.VerifyResult{Differing: 2, DifferingKeys: []string{"Id=N:102", "Id=N:201"}},
+		},
+		{
+			name:      "extra",
+			changes:   []func(t *testing.T, svc *clonetest.DynamoDB){put(map[string]*dynamodb.AttributeValue{"Id": n("999")})},
+			destItems: 1,
+			expected:  state.VerifyResult{Extra: 1, ExtraKeys: []string{"Id=N:999"}},
+		},
+		{
+			name:       "renamed key",
+			transforms: []state.Transform{{Op: "rename", Attribute: "Id", To: "Key"}},
+			changes: []func(t *testing.T, svc *clonetest.DynamoDB){
+				remove(map[string]*dynamodb.AttributeValue{"Key": n("201")}),
+				put(map[string]*dynamodb.AttributeValue{"Key": n("998")}),
+			},
+			expected: state.VerifyResult{
+				Missing:     1,
+				Extra:       1,
+				MissingKeys: []string{"Key=N:201"},
+				ExtraKeys:   []string{"Key=N:998"},
+			},
+		},
+		{
+			// a hashed key can't be looked up in the source, extras are only counted
+			name:       "hashed key",
+			transforms: []state.Transform{{Op: "hash", Attribute: "Id", Salt: "pepper"}},
+			changes: []func(t *testing.T, svc *clonetest.DynamoDB){
+				put(map[string]*dynamodb.AttributeValue{"Id": {S: aws.String("not a hash")}}),
+			},
+			destItems: 1,
+		},
+	}
+
+	for _, test := range tests {
+
+		test := test
+
+		t.Run(test.name, func(t *testing.T) {
+
+			clients := clonetest.NewClients()
+
+			items := int64(loadSource(t, clients.Source))
+
+			run := cloneTable(t, state.Schema{
+				Region:        clonetest.Region,
+				Bucket:        testBucket,
+				OrigTableName: sourceDB,
+				NewTableName:  destDB,
+				ExportConfig:  state.ExportConfig{Mode: state.ModeStaged},
+				ImportConfig:  state.ImportConfig{Transforms: test.transforms},
+			}, 0, clone.WithClients(clients))
+
+			for _, change := range test.changes {
+				change(t, clients.Dest)
+			}
+
+			expected := test.expected
+			expected.SourceItems = items
+			expected.DestItems = items + test.destItems
+
+			total := verifyTable(t, clients, run)
+
+			if !reflect.DeepEqual(total, expected) {
+				t.Errorf("verified %+v, expected %+v", total, expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,205 @@
+package clonerr
+
+import (
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+//
+// The lambda runtime reports the name of the error type back to Step
+// Functions, so the state machine Retry and Catch blocks match on these
+// type names.
+//
+
+// TableNotFound is returned when a table can't be described or read
+type TableNotFound struct {
+	Table string
+	Err   error
+}
+
+func (e *TableNotFound) Error() string {
+	return fmt.Sprintf("table %s not found: %v", e.Table, e.Err)
+}
+
+// Unwrap returns the underlying error
+func (e *TableNotFound) Unwrap() error { return e.Err }
+
+// TableAlreadyExists is returned when the clone destination is already in use
+type TableAlreadyExists struct {
+	Table string
+	Err   error
+}
+
+func (e *TableAlreadyExists) Error() string {
+	return fmt.Sprintf("table %s already exists: %v", e.Table, e.Err)
+}
+
+// Unwrap returns the underlying error
+func (e *TableAlreadyExists) Unwrap() error { return e.Err }
+
+// SchemaInvalid is returned for a bad clone configuration or stored schema
+type SchemaInvalid struct {
+	Reason string
+	Err    error
+}
+
+func (e *SchemaInvalid) Error() string {
+	if e.Err == nil {
+		return fmt.Sprintf("invalid schema: %s", e.Reason)
+	}
+	return fmt.Sprintf("invalid schema: %s: %v", e.Reason, e.Err)
+}
+
+// Unwrap returns the underlying error
+func (e *SchemaInvalid) Unwrap() error { return e.Err }
+
+// ThroughputExhausted is returned when dynamodb throttling outlasts our backoff
+type ThroughputExhausted struct {
+	Table string
+	Err   error
+}
+
+func (e *ThroughputExhausted) Error() string {
+	return fmt.Sprintf("throughput exhausted on table %s: %v", e.Table, e.Err)
+}
+
+// Unwrap returns the underlying error
+func (e *ThroughputExhausted) Unwrap() error { return e.Err }
+
+// ServiceUnavailable is returned when dynamodb fails with a server error the
+// SDK's own retries didn't get past
+type ServiceUnavailable struct {
+	Table string
+	Err   error
+}
+
+func (e *ServiceUnavailable) Error() string {
+	return fmt.Sprintf("dynamodb unavailable for table %s: %v", e.Table, e.Err)
+}
+
+// Unwrap returns the underlying error
+func (e *ServiceUnavailable) Unwrap() error { return e.Err }
+
+// StorageFailure is returned when the staging bucket can't be read or written
+type StorageFailure struct {
+	Bucket string
+	Key    string
+	Err    error
+}
+
+func (e *StorageFailure) Error() string {
+	return fmt.Sprintf("storage failure on s3://%s/%s: %v", e.Bucket, e.Key, e.Err)
+}
+
+// Unwrap returns the underlying error
+func (e *StorageFailure) Unwrap() error { return e.Err }
+
+// IntegrityFailure is returned when a staged data file doesn't match what the
+// export recorded for it, it isn't retried as the object itself is bad
+type IntegrityFailure struct {
+	Bucket string
+	Key    string
+	Reason string
+}
+
+func (e *IntegrityFailure) Error() string {
+	return fmt.Sprintf("integrity check failed on s3://%s/%s: %s", e.Bucket, e.Key, e.Reason)
+}
+
+// ExportFailed is returned when DynamoDB gives up on a point in time export
+type ExportFailed struct {
+	Table  string
+	Export string
+	Code   string
+	Reason string
+}
+
+func (e *ExportFailed) Error() string {
+	return fmt.Sprintf("export %s of table %s failed: %s: %s", e.Export, e.Table, e.Code, e.Reason)
+}
+
+// ImportFailed is returned when DynamoDB gives up on an ImportTable import
+type ImportFailed struct {
+	Table  string
+	Import string
+	Code   string
+	Reason string
+}
+
+func (e *ImportFailed) Error() string {
+	return fmt.Sprintf("import %s into table %s failed: %s: %s", e.Import, e.Table, e.Code, e.Reason)
+}
+
+// StreamExpired is returned when the source stream no longer holds records a sync needs
+type StreamExpired struct {
+	Stream string
+	Reason string
+	Err    error
+}
+
+func (e *StreamExpired) Error() string {
+	if e.Err == nil {
+		return fmt.Sprintf("stream %s expired: %s", e.Stream, e.Reason)
+	}
+	return fmt.Sprintf("stream %s expired: %s: %v", e.Stream, e.Reason, e.Err)
+}
+
+// Unwrap returns the underlying error
+func (e *StreamExpired) Unwrap() error { return e.Err }
+
+// VerificationFailed is returned when the clone doesn't match its source
+type VerificationFailed struct {
+	Table     string
+	Report    string
+	Missing   int64
+	Extra     int64
+	Differing int64
+}
+
+func (e *VerificationFailed) Error() string {
+	return fmt.Sprintf("table %s diverges from its source: %d missing, %d extra, %d differing items, see %s",
+		e.Table, e.Missing, e.Extra, e.Differing, e.Report)
+}
+
+// IsThrottle reports if a dynamodb error should be retried after backing off
+func IsThrottle(err error) bool {
+
+	if awsErr, ok := err.(awserr.Error); ok {
+		switch awsErr.Code() {
+		case dynamodb.ErrCodeProvisionedThroughputExceededException, dynamodb.ErrCodeRequestLimitExceeded, "ThrottlingException":
+			return true
+		}
+	}
+
+	return false
+}
+
+// FromDynamoDB maps a dynamodb error for the given table onto our error types,
+// anything we don't recognise is passed back untouched
+func FromDynamoDB(table string, err error) error {
+
+	if err == nil {
+		return nil
+	}
+
+	if IsThrottle(err) {
+		return &ThroughputExhausted{Table: table, Err: err}
+	}
+
+	if awsErr, ok := err.(awserr.Error); ok {
+		switch awsErr.Code() {
+		case dynamodb.ErrCodeResourceNotFoundException, dynamodb.ErrCodeTableNotFoundException:
+			return &TableNotFound{Table: table, Err: err}
+		case dynamodb.ErrCodeResourceInUseException, dynamodb.ErrCodeTableAlreadyExistsException:
+			return &TableAlreadyExists{Table: table, Err: err}
+		}
+	}
+
+	if reqErr, ok := err.(awserr.RequestFailure); ok && reqErr.StatusCode() >= 500 {
+		return &ServiceUnavailable{Table: table, Err: err}
+	}
+
+	return err
+}
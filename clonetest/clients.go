@@ -0,0 +1,141 @@
+package clonetest
+
+import (
+	"fmt"
+
+	"github.com/NixM0nk3y/dynamodb-clone/clone"
+	"github.com/NixM0nk3y/dynamodb-clone/faults"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/cloudwatch/cloudwatchiface"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/aws/aws-sdk-go/service/dynamodbstreams/dynamodbstreamsiface"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+	"github.com/aws/aws-sdk-go/service/secretsmanager/secretsmanageriface"
+)
+
+//
+// Clients hands the fakes to a clone through clone.WithClients. Source and
+// Dest may be the same fake for a clone within one account and region.
+//
+type Clients struct {
+	Source  *DynamoDB
+	Dest    *DynamoDB
+	Staging *S3
+
+	// Budget holds the capacity budget table
+	Budget *DynamoDB
+
+	// Metrics holds the source's consumed capacity
+	Metrics *CloudWatch
+
+	// Streams holds the source's stream
+	Streams *Streams
+
+	// Secrets maps a Secrets Manager secret arn onto its value, for masking
+	Secrets map[string]string
+
+	// Faults, when set, are injected into the DynamoDB and S3 fakes
+	Faults *faults.Injector
+}
+
+var _ clone.Clients = (*Clients)(nil)
+
+// NewClients returns clients cloning between tables of a single fake, which
+// also holds the budget table
+func NewClients() *Clients {
+
+	tables := NewDynamoDB()
+	staging := NewS3()
+
+	// point in time exports and ImportTable use the staging bucket
+	tables.Bucket = staging
+
+	return &Clients{
+		Source:  tables,
+		Dest:    tables,
+		Staging: staging,
+		Budget:  tables,
+		Metrics: NewCloudWatch(),
+		Streams: NewStreams(),
+		Secrets: map[string]string{},
+	}
+}
+
+// SourceDynamoDB returns the source fake, with any faults
+func (c *Clients) SourceDynamoDB() (dynamodbiface.DynamoDBAPI, error) {
+
+	if c.Faults != nil {
+		return c.Faults.DynamoDB(c.Source), nil
+	}
+
+	return c.Source, nil
+}
+
+// SourceCloudWatch returns the metrics fake
+func (c *Clients) SourceCloudWatch() (cloudwatchiface.CloudWatchAPI, error) {
+	return c.Metrics, nil
+}
+
+// SourceStreams returns the streams fake, faults aren't injected into it
+func (c *Clients) SourceStreams() (dynamodbstreamsiface.DynamoDBStreamsAPI, error) {
+	return c.Streams, nil
+}
+
+// DestDynamoDB returns the destination fake, with any faults
+func (c *Clients) DestDynamoDB() (dynamodbiface.DynamoDBAPI, error) {
+
+	if c.Faults != nil {
+		return c.Faults.DynamoDB(c.Dest), nil
+	}
+
+	return c.Dest, nil
+}
+
+// Bucket returns the staging fake, with any faults
+func (c *Clients) Bucket() (s3iface.S3API, error) {
+
+	if c.Faults != nil {
+		return c.Faults.S3(c.Staging), nil
+	}
+
+	return c.Staging, nil
+}
+
+// BucketOwner returns the fakes' account
+func (c *Clients) BucketOwner() (string, error) {
+	return Account, nil
+}
+
+// BudgetDynamoDB returns the budget fake, faults aren't injected into it
+func (c *Clients) BudgetDynamoDB() (dynamodbiface.DynamoDBAPI, error) {
+	return c.Budget, nil
+}
+
+// SecretsManager returns a fake reading Secrets
+func (c *Clients) SecretsManager(region string) (secretsmanageriface.SecretsManagerAPI, error) {
+	return &secretsManager{secrets: c.Secrets}, nil
+}
+
+type secretsManager struct {
+	secretsmanageriface.SecretsManagerAPI
+
+	secrets map[string]string
+}
+
+func (s *secretsManager) GetSecretValueWithContext(ctx aws.Context, input *secretsmanager.GetSecretValueInput, opts ...request.Option) (*secretsmanager.GetSecretValueOutput, error) {
+
+	value, ok := s.secrets[aws.StringValue(input.SecretId)]
+
+	if !ok {
+		return nil, awserr.New(secretsmanager.ErrCodeResourceNotFoundException,
+			fmt.Sprintf("Secrets Manager can't find the specified secret %s", aws.StringValue(input.SecretId)), nil)
+	}
+
+	return &secretsmanager.GetSecretValueOutput{
+		ARN:          input.SecretId,
+		SecretString: aws.String(value),
+	}, nil
+}
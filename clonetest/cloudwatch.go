@@ -0,0 +1,91 @@
+package clonetest
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/aws/aws-sdk-go/service/cloudwatch/cloudwatchiface"
+)
+
+//
+// CloudWatch is an in-memory cloudwatchiface.CloudWatchAPI holding the
+// DynamoDB table metrics put into it. It only answers GetMetricStatistics
+// sums, anything else panics on the nil embedded interface.
+//
+type CloudWatch struct {
+	cloudwatchiface.CloudWatchAPI
+
+	mu      sync.Mutex
+	metrics map[string][]float64 // units a second of each minute, keyed <table>/<metric>
+}
+
+// NewCloudWatch returns a fake without any metrics
+func NewCloudWatch() *CloudWatch {
+	return &CloudWatch{
+		metrics: map[string][]float64{},
+	}
+}
+
+// Consumed records the units a second a table's metric (e.g.
+// ConsumedReadCapacityUnits) reached in each of the last minutes, oldest first
+func (c *CloudWatch) Consumed(table string, metric string, units ...float64) {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.metrics[table+"/"+metric] = units
+}
+
+// GetMetricStatisticsWithContext returns a datapoint for each recorded
+// minute falling between the start and end time, summed over the period
+func (c *CloudWatch) GetMetricStatisticsWithContext(ctx aws.Context, input *cloudwatch.GetMetricStatisticsInput, opts ...request.Option) (*cloudwatch.GetMetricStatisticsOutput, error) {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if aws.StringValue(input.Namespace) != "AWS/DynamoDB" {
+		return nil, unsupported("GetMetricStatistics", fmt.Sprintf("namespace %s", aws.StringValue(input.Namespace)))
+	}
+
+	if len(input.Statistics) != 1 || aws.StringValue(input.Statistics[0]) != cloudwatch.StatisticSum {
+		return nil, unsupported("GetMetricStatistics", "statistics other than Sum")
+	}
+
+	var table string
+
+	for _, dimension := range input.Dimensions {
+		if aws.StringValue(dimension.Name) == "TableName" {
+			table = aws.StringValue(dimension.Value)
+		}
+	}
+
+	units := c.metrics[table+"/"+aws.StringValue(input.MetricName)]
+
+	output := &cloudwatch.GetMetricStatisticsOutput{
+		Label:      input.MetricName,
+		Datapoints: []*cloudwatch.Datapoint{},
+	}
+
+	now := time.Now().Truncate(time.Minute)
+
+	for i, u := range units {
+
+		timestamp := now.Add(-time.Duration(len(units)-i) * time.Minute)
+
+		if timestamp.Before(aws.TimeValue(input.StartTime)) || !timestamp.Before(aws.TimeValue(input.EndTime)) {
+			continue
+		}
+
+		output.Datapoints = append(output.Datapoints, &cloudwatch.Datapoint{
+			Timestamp: aws.Time(timestamp),
+			Sum:       aws.Float64(u * float64(aws.Int64Value(input.Period))),
+			Unit:      aws.String(cloudwatch.StandardUnitCount),
+		})
+	}
+
+	return output, nil
+}
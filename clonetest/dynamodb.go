@@ -0,0 +1,1344 @@
+package clonetest
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+	"math/big"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+)
+
+// the region and account the fakes put in their arns
+const (
+	Region  = "eu-west-1"
+	Account = "000000000000"
+)
+
+//
+// DynamoDB is an in-memory dynamodbiface.DynamoDBAPI holding the tables of
+// one account and region. It answers the calls the clone makes, anything
+// else panics on the nil embedded interface. Tables are ACTIVE as soon as
+// they're created.
+//
+type DynamoDB struct {
+	dynamodbiface.DynamoDBAPI
+
+	// PageSize caps the items a Scan returns below its Limit, zero leaves
+	// the Limit in charge
+	PageSize int
+
+	// Throttle fails the call'th call (from 1) of an operation with
+	// ProvisionedThroughputExceededException when it returns true
+	Throttle func(operation string, call int) bool
+
+	// Unprocessed returns how many of the requests in the call'th
+	// BatchWriteItem call (from 1) are handed back as UnprocessedItems
+	Unprocessed func(call int, requests int) int
+
+	// Bucket receives the files of point in time exports and holds those
+	// ImportTable reads
+	Bucket *S3
+
+	// ExportPending is how many times an export is described before it
+	// completes
+	ExportPending int
+
+	// ExportFailure, when set, is the FailureCode exports fail with rather
+	// than completing
+	ExportFailure string
+
+	// ImportPending is how many times an ImportTable import is described
+	// before it completes
+	ImportPending int
+
+	mu      sync.Mutex
+	tables  map[string]*table
+	calls   map[string]int
+	exports map[string]*export
+	imports map[string]*tableImport
+}
+
+type table struct {
+	description *dynamodb.TableDescription
+	ttl         *dynamodb.TimeToLiveDescription
+	pitr        bool
+	tags        []*dynamodb.Tag
+	items       map[string]map[string]*dynamodb.AttributeValue
+}
+
+// NewDynamoDB returns a fake without any tables
+func NewDynamoDB() *DynamoDB {
+	return &DynamoDB{
+		tables:  map[string]*table{},
+		calls:   map[string]int{},
+		exports: map[string]*export{},
+		imports: map[string]*tableImport{},
+	}
+}
+
+// Calls returns how many times an operation has been called, throttled calls included
+func (d *DynamoDB) Calls(operation string) int {
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.calls[operation]
+}
+
+// Items returns a copy of a table's items in key order, nil for a missing table
+func (d *DynamoDB) Items(tableName string) (items []map[string]*dynamodb.AttributeValue) {
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	t, ok := d.tables[tableName]
+
+	if !ok {
+		return nil
+	}
+
+	for _, key := range t.keys() {
+		items = append(items, copyItem(t.items[key]))
+	}
+
+	return
+}
+
+// call counts a call to the operation, failing it if it's to be throttled
+func (d *DynamoDB) call(operation string) (int, error) {
+
+	d.calls[operation]++
+
+	call := d.calls[operation]
+
+	if d.Throttle != nil && d.Throttle(operation, call) {
+		return call, awserr.New(dynamodb.ErrCodeProvisionedThroughputExceededException,
+			fmt.Sprintf("%s call %d throttled", operation, call), nil)
+	}
+
+	return call, nil
+}
+
+func (d *DynamoDB) table(name *string) (*table, error) {
+
+	t, ok := d.tables[aws.StringValue(name)]
+
+	if !ok {
+		return nil, awserr.New(dynamodb.ErrCodeResourceNotFoundException,
+			fmt.Sprintf("Requested resource not found: Table: %s not found", aws.StringValue(name)), nil)
+	}
+
+	return t, nil
+}
+
+func (d *DynamoDB) tableByArn(arn *string) (*table, error) {
+
+	for _, t := range d.tables {
+		if aws.StringValue(t.description.TableArn) == aws.StringValue(arn) {
+			return t, nil
+		}
+	}
+
+	return nil, awserr.New(dynamodb.ErrCodeResourceNotFoundException,
+		fmt.Sprintf("Requested resource not found: ResourceArn: %s not found", aws.StringValue(arn)), nil)
+}
+
+func validation(format string, args ...interface{}) error {
+	return awserr.New("ValidationException", fmt.Sprintf(format, args...), nil)
+}
+
+func unsupported(operation string, parameter string) error {
+	return awserr.New("ValidationException", fmt.Sprintf("clonetest: %s doesn't support %s", operation, parameter), nil)
+}
+
+// CreateTableWithContext creates an empty, ACTIVE table
+func (d *DynamoDB) CreateTableWithContext(ctx aws.Context, input *dynamodb.CreateTableInput, opts ...request.Option) (*dynamodb.CreateTableOutput, error) {
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if _, err := d.call("CreateTable"); err != nil {
+		return nil, err
+	}
+
+	t, err := d.createTable(input)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &dynamodb.CreateTableOutput{TableDescription: t.describe()}, nil
+}
+
+// createTable adds a table, with the lock held
+func (d *DynamoDB) createTable(input *dynamodb.CreateTableInput) (*table, error) {
+
+	name := aws.StringValue(input.TableName)
+
+	if _, exists := d.tables[name]; exists {
+		return nil, awserr.New(dynamodb.ErrCodeResourceInUseException, fmt.Sprintf("Table already exists: %s", name), nil)
+	}
+
+	if len(input.KeySchema) == 0 || len(input.AttributeDefinitions) == 0 {
+		return nil, validation("table %s needs a key schema and attribute definitions", name)
+	}
+
+	arn := fmt.Sprintf("arn:aws:dynamodb:%s:%s:table/%s", Region, Account, name)
+
+	description := &dynamodb.TableDescription{
+		TableName:                 input.TableName,
+		TableArn:                  aws.String(arn),
+		TableId:                   aws.String(fmt.Sprintf("%032x", fnvHash(arn))),
+		TableStatus:               aws.String(dynamodb.TableStatusActive),
+		CreationDateTime:          aws.Time(time.Now()),
+		KeySchema:                 input.KeySchema,
+		AttributeDefinitions:      input.AttributeDefinitions,
+		ProvisionedThroughput:     throughputDescription(input.ProvisionedThroughput),
+		DeletionProtectionEnabled: input.DeletionProtectionEnabled,
+	}
+
+	if input.BillingMode != nil {
+		description.BillingModeSummary = &dynamodb.BillingModeSummary{BillingMode: input.BillingMode}
+	}
+
+	if input.TableClass != nil {
+		description.TableClassSummary = &dynamodb.TableClassSummary{TableClass: input.TableClass}
+	}
+
+	if input.SSESpecification != nil && aws.BoolValue(input.SSESpecification.Enabled) {
+		description.SSEDescription = &dynamodb.SSEDescription{
+			Status:          aws.String(dynamodb.SSEStatusEnabled),
+			SSEType:         input.SSESpecification.SSEType,
+			KMSMasterKeyArn: input.SSESpecification.KMSMasterKeyId,
+		}
+	}
+
+	setStream(description, input.StreamSpecification)
+
+	for _, index := range input.GlobalSecondaryIndexes {
+		description.GlobalSecondaryIndexes = append(description.GlobalSecondaryIndexes, &dynamodb.GlobalSecondaryIndexDescription{
+			IndexName:             index.IndexName,
+			IndexArn:              aws.String(arn + "/index/" + aws.StringValue(index.IndexName)),
+			IndexStatus:           aws.String(dynamodb.IndexStatusActive),
+			KeySchema:             index.KeySchema,
+			Projection:            index.Projection,
+			ProvisionedThroughput: throughputDescription(index.ProvisionedThroughput),
+		})
+	}
+
+	for _, index := range input.LocalSecondaryIndexes {
+		description.LocalSecondaryIndexes = append(description.LocalSecondaryIndexes, &dynamodb.LocalSecondaryIndexDescription{
+			IndexName:  index.IndexName,
+			IndexArn:   aws.String(arn + "/index/" + aws.StringValue(index.IndexName)),
+			KeySchema:  index.KeySchema,
+			Projection: index.Projection,
+		})
+	}
+
+	if err := checkTags(input.Tags); err != nil {
+		return nil, err
+	}
+
+	d.tables[name] = &table{
+		description: description,
+		ttl:         &dynamodb.TimeToLiveDescription{TimeToLiveStatus: aws.String(dynamodb.TimeToLiveStatusDisabled)},
+		tags:        input.Tags,
+		items:       map[string]map[string]*dynamodb.AttributeValue{},
+	}
+
+	return d.tables[name], nil
+}
+
+func throughputDescription(throughput *dynamodb.ProvisionedThroughput) *dynamodb.ProvisionedThroughputDescription {
+
+	description := &dynamodb.ProvisionedThroughputDescription{
+		ReadCapacityUnits:      aws.Int64(0),
+		WriteCapacityUnits:     aws.Int64(0),
+		NumberOfDecreasesToday: aws.Int64(0),
+	}
+
+	if throughput != nil {
+		description.ReadCapacityUnits = throughput.ReadCapacityUnits
+		description.WriteCapacityUnits = throughput.WriteCapacityUnits
+	}
+
+	return description
+}
+
+func setStream(description *dynamodb.TableDescription, stream *dynamodb.StreamSpecification) {
+
+	if stream == nil {
+		return
+	}
+
+	if !aws.BoolValue(stream.StreamEnabled) {
+		description.StreamSpecification = nil
+		return
+	}
+
+	label := time.Now().UTC().Format("2006-01-02T15:04:05.000")
+
+	description.StreamSpecification = stream
+	description.LatestStreamLabel = aws.String(label)
+	description.LatestStreamArn = aws.String(aws.StringValue(description.TableArn) + "/stream/" + label)
+}
+
+// describe returns a copy of the description with the live item count and size
+func (t *table) describe() *dynamodb.TableDescription {
+
+	description := *t.description
+
+	var size int64
+
+	for _, item := range t.items {
+		size += itemSize(item)
+	}
+
+	description.ItemCount = aws.Int64(int64(len(t.items)))
+	description.TableSizeBytes = aws.Int64(size)
+
+	return &description
+}
+
+// DescribeTableWithContext describes a table
+func (d *DynamoDB) DescribeTableWithContext(ctx aws.Context, input *dynamodb.DescribeTableInput, opts ...request.Option) (*dynamodb.DescribeTableOutput, error) {
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if _, err := d.call("DescribeTable"); err != nil {
+		return nil, err
+	}
+
+	t, err := d.table(input.TableName)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &dynamodb.DescribeTableOutput{Table: t.describe()}, nil
+}
+
+// DescribeTableRequest is DescribeTableWithContext for the waiters
+func (d *DynamoDB) DescribeTableRequest(input *dynamodb.DescribeTableInput) (*request.Request, *dynamodb.DescribeTableOutput) {
+
+	output := &dynamodb.DescribeTableOutput{}
+
+	return newRequest("DescribeTable", input, output, func(r *request.Request) error {
+
+		result, err := d.DescribeTableWithContext(r.Context(), input)
+
+		if err == nil {
+			*output = *result
+		}
+
+		return err
+	}), output
+}
+
+// WaitUntilTableExistsWithContext returns straight away, the fake's tables are created ACTIVE
+func (d *DynamoDB) WaitUntilTableExistsWithContext(ctx aws.Context, input *dynamodb.DescribeTableInput, opts ...request.WaiterOption) error {
+
+	_, err := d.DescribeTableWithContext(ctx, input)
+
+	return err
+}
+
+// UpdateTableWithContext changes a table's billing, stream, class or deletion protection
+func (d *DynamoDB) UpdateTableWithContext(ctx aws.Context, input *dynamodb.UpdateTableInput, opts ...request.Option) (*dynamodb.UpdateTableOutput, error) {
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if _, err := d.call("UpdateTable"); err != nil {
+		return nil, err
+	}
+
+	t, err := d.table(input.TableName)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(input.GlobalSecondaryIndexUpdates) > 0 || len(input.ReplicaUpdates) > 0 {
+		return nil, unsupported("UpdateTable", "index or replica updates")
+	}
+
+	description := t.description
+
+	if input.BillingMode != nil {
+		description.BillingModeSummary = &dynamodb.BillingModeSummary{BillingMode: input.BillingMode}
+	}
+
+	if input.ProvisionedThroughput != nil {
+		description.ProvisionedThroughput = throughputDescription(input.ProvisionedThroughput)
+	}
+
+	if input.TableClass != nil {
+		description.TableClassSummary = &dynamodb.TableClassSummary{TableClass: input.TableClass}
+	}
+
+	if input.DeletionProtectionEnabled != nil {
+		description.DeletionProtectionEnabled = input.DeletionProtectionEnabled
+	}
+
+	setStream(description, input.StreamSpecification)
+
+	return &dynamodb.UpdateTableOutput{TableDescription: t.describe()}, nil
+}
+
+// DescribeTimeToLiveWithContext describes a table's time to live
+func (d *DynamoDB) DescribeTimeToLiveWithContext(ctx aws.Context, input *dynamodb.DescribeTimeToLiveInput, opts ...request.Option) (*dynamodb.DescribeTimeToLiveOutput, error) {
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if _, err := d.call("DescribeTimeToLive"); err != nil {
+		return nil, err
+	}
+
+	t, err := d.table(input.TableName)
+
+	if err != nil {
+		return nil, err
+	}
+
+	ttl := *t.ttl
+
+	return &dynamodb.DescribeTimeToLiveOutput{TimeToLiveDescription: &ttl}, nil
+}
+
+// UpdateTimeToLiveWithContext turns a table's time to live on or off
+func (d *DynamoDB) UpdateTimeToLiveWithContext(ctx aws.Context, input *dynamodb.UpdateTimeToLiveInput, opts ...request.Option) (*dynamodb.UpdateTimeToLiveOutput, error) {
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if _, err := d.call("UpdateTimeToLive"); err != nil {
+		return nil, err
+	}
+
+	t, err := d.table(input.TableName)
+
+	if err != nil {
+		return nil, err
+	}
+
+	specification := input.TimeToLiveSpecification
+
+	t.ttl = &dynamodb.TimeToLiveDescription{TimeToLiveStatus: aws.String(dynamodb.TimeToLiveStatusDisabled)}
+
+	if aws.BoolValue(specification.Enabled) {
+		t.ttl = &dynamodb.TimeToLiveDescription{
+			AttributeName:    specification.AttributeName,
+			TimeToLiveStatus: aws.String(dynamodb.TimeToLiveStatusEnabled),
+		}
+	}
+
+	return &dynamodb.UpdateTimeToLiveOutput{TimeToLiveSpecification: specification}, nil
+}
+
+func (t *table) continuousBackups() *dynamodb.ContinuousBackupsDescription {
+
+	status := dynamodb.PointInTimeRecoveryStatusDisabled
+
+	if t.pitr {
+		status = dynamodb.PointInTimeRecoveryStatusEnabled
+	}
+
+	return &dynamodb.ContinuousBackupsDescription{
+		ContinuousBackupsStatus: aws.String(dynamodb.ContinuousBackupsStatusEnabled),
+		PointInTimeRecoveryDescription: &dynamodb.PointInTimeRecoveryDescription{
+			PointInTimeRecoveryStatus: aws.String(status),
+		},
+	}
+}
+
+// DescribeContinuousBackupsWithContext describes a table's point in time recovery
+func (d *DynamoDB) DescribeContinuousBackupsWithContext(ctx aws.Context, input *dynamodb.DescribeContinuousBackupsInput, opts ...request.Option) (*dynamodb.DescribeContinuousBackupsOutput, error) {
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if _, err := d.call("DescribeContinuousBackups"); err != nil {
+		return nil, err
+	}
+
+	t, err := d.table(input.TableName)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &dynamodb.DescribeContinuousBackupsOutput{ContinuousBackupsDescription: t.continuousBackups()}, nil
+}
+
+// UpdateContinuousBackupsWithContext turns a table's point in time recovery on or off
+func (d *DynamoDB) UpdateContinuousBackupsWithContext(ctx aws.Context, input *dynamodb.UpdateContinuousBackupsInput, opts ...request.Option) (*dynamodb.UpdateContinuousBackupsOutput, error) {
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if _, err := d.call("UpdateContinuousBackups"); err != nil {
+		return nil, err
+	}
+
+	t, err := d.table(input.TableName)
+
+	if err != nil {
+		return nil, err
+	}
+
+	t.pitr = aws.BoolValue(input.PointInTimeRecoverySpecification.PointInTimeRecoveryEnabled)
+
+	return &dynamodb.UpdateContinuousBackupsOutput{ContinuousBackupsDescription: t.continuousBackups()}, nil
+}
+
+// ListTagsOfResourceWithContext lists a table's tags in a single page
+func (d *DynamoDB) ListTagsOfResourceWithContext(ctx aws.Context, input *dynamodb.ListTagsOfResourceInput, opts ...request.Option) (*dynamodb.ListTagsOfResourceOutput, error) {
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if _, err := d.call("ListTagsOfResource"); err != nil {
+		return nil, err
+	}
+
+	t, err := d.tableByArn(input.ResourceArn)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &dynamodb.ListTagsOfResourceOutput{Tags: append([]*dynamodb.Tag{}, t.tags...)}, nil
+}
+
+// TagResourceWithContext adds or replaces a table's tags
+func (d *DynamoDB) TagResourceWithContext(ctx aws.Context, input *dynamodb.TagResourceInput, opts ...request.Option) (*dynamodb.TagResourceOutput, error) {
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if _, err := d.call("TagResource"); err != nil {
+		return nil, err
+	}
+
+	t, err := d.tableByArn(input.ResourceArn)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkTags(input.Tags); err != nil {
+		return nil, err
+	}
+
+	t.tag(input.Tags)
+
+	return &dynamodb.TagResourceOutput{}, nil
+}
+
+// Tag adds or replaces a table's tags without the checks TagResource makes,
+// as AWS sets its own aws: tags, and panics on a missing table
+func (d *DynamoDB) Tag(tableName string, tags ...*dynamodb.Tag) {
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.tables[tableName].tag(tags)
+}
+
+// checkTags rejects the aws: tags only AWS may set
+func checkTags(tags []*dynamodb.Tag) error {
+
+	for _, tag := range tags {
+		if strings.HasPrefix(aws.StringValue(tag.Key), "aws:") {
+			return validation("tag key %s uses the reserved aws: prefix", aws.StringValue(tag.Key))
+		}
+	}
+
+	return nil
+}
+
+func (t *table) tag(tags []*dynamodb.Tag) {
+
+	for _, tag := range tags {
+
+		replaced := false
+
+		for i, existing := range t.tags {
+			if aws.StringValue(existing.Key) == aws.StringValue(tag.Key) {
+				t.tags[i], replaced = tag, true
+			}
+		}
+
+		if !replaced {
+			t.tags = append(t.tags, tag)
+		}
+	}
+}
+
+//
+// ScanWithContext pages through a segment of the table in key order.
+// Segments split the partition keys by hash as DynamoDB's do. Filter and
+// projection expressions aren't evaluated, a scan passing one fails. The
+// read capacity consumed is that of the page's items.
+//
+func (d *DynamoDB) ScanWithContext(ctx aws.Context, input *dynamodb.ScanInput, opts ...request.Option) (*dynamodb.ScanOutput, error) {
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if _, err := d.call("Scan"); err != nil {
+		return nil, err
+	}
+
+	t, err := d.table(input.TableName)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if input.FilterExpression != nil || input.ProjectionExpression != nil {
+		return nil, unsupported("Scan", "filter or projection expressions")
+	}
+
+	segment, totalSegments := aws.Int64Value(input.Segment), aws.Int64Value(input.TotalSegments)
+
+	if totalSegments < 1 {
+		totalSegments = 1
+	}
+
+	if segment < 0 || segment >= totalSegments {
+		return nil, validation("segment %d isn't in 0 to %d", segment, totalSegments-1)
+	}
+
+	limit := int(aws.Int64Value(input.Limit))
+
+	if d.PageSize > 0 && (limit < 1 || d.PageSize < limit) {
+		limit = d.PageSize
+	}
+
+	var startKey string
+
+	if input.ExclusiveStartKey != nil {
+		if startKey, err = t.key(input.ExclusiveStartKey); err != nil {
+			return nil, err
+		}
+	}
+
+	output := &dynamodb.ScanOutput{Items: []map[string]*dynamodb.AttributeValue{}}
+
+	for _, key := range t.keys() {
+
+		if startKey != "" && key <= startKey {
+			continue
+		}
+
+		item := t.items[key]
+
+		if t.segment(item, totalSegments) != segment {
+			continue
+		}
+
+		if limit > 0 && len(output.Items) == limit {
+			output.LastEvaluatedKey = t.keyOf(output.Items[len(output.Items)-1])
+			break
+		}
+
+		output.Items = append(output.Items, copyItem(item))
+	}
+
+	output.Count = aws.Int64(int64(len(output.Items)))
+	output.ScannedCount = output.Count
+
+	var size int64
+
+	for _, item := range output.Items {
+		size += itemSize(item)
+	}
+
+	name := aws.StringValue(input.TableName)
+
+	if capacity := consumedCapacity(input.ReturnConsumedCapacity, []string{name},
+		map[string]float64{name: readUnits(size, aws.BoolValue(input.ConsistentRead))}); capacity != nil {
+		output.ConsumedCapacity = capacity[0]
+	}
+
+	return output, nil
+}
+
+//
+// BatchWriteItemWithContext puts and deletes items. The whole call is
+// checked before any write is made, then the last requests Unprocessed asks
+// for are handed back untouched.
+//
+func (d *DynamoDB) BatchWriteItemWithContext(ctx aws.Context, input *dynamodb.BatchWriteItemInput, opts ...request.Option) (*dynamodb.BatchWriteItemOutput, error) {
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	call, err := d.call("BatchWriteItem")
+
+	if err != nil {
+		return nil, err
+	}
+
+	type write struct {
+		table   *table
+		name    string
+		key     string
+		request *dynamodb.WriteRequest
+	}
+
+	var names []string
+
+	for name := range input.RequestItems {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	var writes []write
+
+	seen := map[string]bool{}
+
+	for _, name := range names {
+
+		t, tableErr := d.table(aws.String(name))
+
+		if tableErr != nil {
+			return nil, tableErr
+		}
+
+		for _, request := range input.RequestItems[name] {
+
+			item := map[string]*dynamodb.AttributeValue{}
+
+			switch {
+			case request.PutRequest != nil:
+				item = request.PutRequest.Item
+			case request.DeleteRequest != nil:
+				item = request.DeleteRequest.Key
+			default:
+				return nil, validation("write request without a put or delete")
+			}
+
+			key, keyErr := t.key(item)
+
+			if keyErr != nil {
+				return nil, keyErr
+			}
+
+			if seen[name+"\x00"+key] {
+				return nil, validation("Provided list of item keys contains duplicates")
+			}
+
+			seen[name+"\x00"+key] = true
+
+			writes = append(writes, write{table: t, name: name, key: key, request: request})
+		}
+	}
+
+	if len(writes) < 1 || len(writes) > 25 {
+		return nil, validation("BatchWriteItem takes 1 to 25 requests, not %d", len(writes))
+	}
+
+	processed := len(writes)
+
+	if d.Unprocessed != nil {
+		if unprocessed := d.Unprocessed(call, len(writes)); unprocessed > 0 {
+			processed -= unprocessed
+		}
+	}
+
+	if processed < 0 {
+		processed = 0
+	}
+
+	output := &dynamodb.BatchWriteItemOutput{UnprocessedItems: map[string][]*dynamodb.WriteRequest{}}
+
+	consumed := map[string]float64{}
+
+	for i, w := range writes {
+
+		if i >= processed {
+			output.UnprocessedItems[w.name] = append(output.UnprocessedItems[w.name], w.request)
+			continue
+		}
+
+		if w.request.PutRequest != nil {
+			w.table.items[w.key] = copyItem(w.request.PutRequest.Item)
+			consumed[w.name] += writeUnits(w.request.PutRequest.Item)
+		} else {
+			delete(w.table.items, w.key)
+			consumed[w.name]++
+		}
+	}
+
+	output.ConsumedCapacity = consumedCapacity(input.ReturnConsumedCapacity, names, consumed)
+
+	return output, nil
+}
+
+// BatchGetItemWithContext reads items by key, projection expressions aren't evaluated
+func (d *DynamoDB) BatchGetItemWithContext(ctx aws.Context, input *dynamodb.BatchGetItemInput, opts ...request.Option) (*dynamodb.BatchGetItemOutput, error) {
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if _, err := d.call("BatchGetItem"); err != nil {
+		return nil, err
+	}
+
+	output := &dynamodb.BatchGetItemOutput{
+		Responses:       map[string][]map[string]*dynamodb.AttributeValue{},
+		UnprocessedKeys: map[string]*dynamodb.KeysAndAttributes{},
+	}
+
+	var names []string
+	consumed := map[string]float64{}
+
+	for name, request := range input.RequestItems {
+
+		names = append(names, name)
+
+		t, err := d.table(aws.String(name))
+
+		if err != nil {
+			return nil, err
+		}
+
+		if request.ProjectionExpression != nil {
+			return nil, unsupported("BatchGetItem", "projection expressions")
+		}
+
+		output.Responses[name] = []map[string]*dynamodb.AttributeValue{}
+
+		for _, keyItem := range request.Keys {
+
+			key, err := t.key(keyItem)
+
+			if err != nil {
+				return nil, err
+			}
+
+			if item, ok := t.items[key]; ok {
+				output.Responses[name] = append(output.Responses[name], copyItem(item))
+				consumed[name] += readUnits(itemSize(item), aws.BoolValue(request.ConsistentRead))
+			}
+		}
+	}
+
+	sort.Strings(names)
+
+	output.ConsumedCapacity = consumedCapacity(input.ReturnConsumedCapacity, names, consumed)
+
+	return output, nil
+}
+
+// PutItemWithContext puts an item, condition expressions aren't evaluated
+func (d *DynamoDB) PutItemWithContext(ctx aws.Context, input *dynamodb.PutItemInput, opts ...request.Option) (*dynamodb.PutItemOutput, error) {
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if _, err := d.call("PutItem"); err != nil {
+		return nil, err
+	}
+
+	t, err := d.table(input.TableName)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if input.ConditionExpression != nil {
+		return nil, unsupported("PutItem", "condition expressions")
+	}
+
+	key, err := t.key(input.Item)
+
+	if err != nil {
+		return nil, err
+	}
+
+	t.items[key] = copyItem(input.Item)
+
+	return &dynamodb.PutItemOutput{}, nil
+}
+
+//
+// UpdateItemWithContext applies an update expression of ADD and SET actions,
+// SET only assigning values (no arithmetic or functions). Condition
+// expressions aren't evaluated.
+//
+func (d *DynamoDB) UpdateItemWithContext(ctx aws.Context, input *dynamodb.UpdateItemInput, opts ...request.Option) (*dynamodb.UpdateItemOutput, error) {
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if _, err := d.call("UpdateItem"); err != nil {
+		return nil, err
+	}
+
+	t, err := d.table(input.TableName)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if input.ConditionExpression != nil {
+		return nil, unsupported("UpdateItem", "condition expressions")
+	}
+
+	key, err := t.key(input.Key)
+
+	if err != nil {
+		return nil, err
+	}
+
+	item, exists := t.items[key]
+
+	if exists {
+		item = copyItem(item)
+	} else {
+		item = copyItem(input.Key)
+	}
+
+	name := func(token string) string {
+		if alias, ok := input.ExpressionAttributeNames[token]; ok {
+			return aws.StringValue(alias)
+		}
+		return token
+	}
+
+	value := func(token string) (*dynamodb.AttributeValue, error) {
+		v, ok := input.ExpressionAttributeValues[token]
+		if !ok {
+			return nil, validation("An expression attribute value used in expression is not defined: %s", token)
+		}
+		return v, nil
+	}
+
+	updated := map[string]bool{}
+
+	tokens := strings.Fields(strings.Replace(aws.StringValue(input.UpdateExpression), ",", " , ", -1))
+
+	for clause := ""; len(tokens) > 0; {
+
+		switch strings.ToUpper(tokens[0]) {
+		case "ADD", "SET":
+			clause = strings.ToUpper(tokens[0])
+			tokens = tokens[1:]
+			continue
+		case "REMOVE", "DELETE":
+			return nil, unsupported("UpdateItem", tokens[0]+" actions")
+		case ",":
+			tokens = tokens[1:]
+			continue
+		}
+
+		switch clause {
+		case "ADD":
+
+			if len(tokens) < 2 {
+				return nil, validation("Invalid UpdateExpression: incomplete ADD action")
+			}
+
+			attribute := name(tokens[0])
+
+			v, valueErr := value(tokens[1])
+
+			if valueErr != nil {
+				return nil, valueErr
+			}
+
+			if v.N == nil {
+				return nil, unsupported("UpdateItem", "adding anything but numbers")
+			}
+
+			sum, ok := new(big.Float).SetString(aws.StringValue(v.N))
+
+			if !ok {
+				return nil, validation("invalid number %s", aws.StringValue(v.N))
+			}
+
+			if current, found := item[attribute]; found {
+
+				addend, currentOk := new(big.Float).SetString(aws.StringValue(current.N))
+
+				if !currentOk {
+					return nil, validation("An operand in the update expression has an incorrect data type")
+				}
+
+				sum.Add(sum, addend)
+			}
+
+			item[attribute] = &dynamodb.AttributeValue{N: aws.String(sum.Text('g', -1))}
+			updated[attribute] = true
+			tokens = tokens[2:]
+
+		case "SET":
+
+			if len(tokens) < 3 || tokens[1] != "=" {
+				return nil, unsupported("UpdateItem", "SET actions other than path = :value")
+			}
+
+			attribute := name(tokens[0])
+
+			v, valueErr := value(tokens[2])
+
+			if valueErr != nil {
+				return nil, valueErr
+			}
+
+			item[attribute] = copyValue(v)
+			updated[attribute] = true
+			tokens = tokens[3:]
+
+		default:
+			return nil, validation("Invalid UpdateExpression: Syntax error; token: %s", tokens[0])
+		}
+	}
+
+	t.items[key] = item
+
+	output := &dynamodb.UpdateItemOutput{}
+
+	switch aws.StringValue(input.ReturnValues) {
+	case dynamodb.ReturnValueAllNew:
+		output.Attributes = copyItem(item)
+	case dynamodb.ReturnValueUpdatedNew:
+		output.Attributes = map[string]*dynamodb.AttributeValue{}
+		for attribute := range updated {
+			output.Attributes[attribute] = copyValue(item[attribute])
+		}
+	case "", dynamodb.ReturnValueNone:
+	default:
+		return nil, unsupported("UpdateItem", "ReturnValues "+aws.StringValue(input.ReturnValues))
+	}
+
+	return output, nil
+}
+
+// DeleteItemWithContext deletes an item, condition expressions aren't evaluated
+func (d *DynamoDB) DeleteItemWithContext(ctx aws.Context, input *dynamodb.DeleteItemInput, opts ...request.Option) (*dynamodb.DeleteItemOutput, error) {
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if _, err := d.call("DeleteItem"); err != nil {
+		return nil, err
+	}
+
+	t, err := d.table(input.TableName)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if input.ConditionExpression != nil {
+		return nil, unsupported("DeleteItem", "condition expressions")
+	}
+
+	key, err := t.key(input.Key)
+
+	if err != nil {
+		return nil, err
+	}
+
+	delete(t.items, key)
+
+	return &dynamodb.DeleteItemOutput{}, nil
+}
+
+// key encodes the item's key attributes, in key schema order
+func (t *table) key(item map[string]*dynamodb.AttributeValue) (string, error) {
+
+	if err := t.checkTypes(item); err != nil {
+		return "", err
+	}
+
+	var parts []string
+
+	for _, element := range t.description.KeySchema {
+
+		name := aws.StringValue(element.AttributeName)
+
+		value, ok := item[name]
+
+		if !ok {
+			return "", validation("The provided key element does not match the schema, %s is missing", name)
+		}
+
+		encoded, ok := encodeKey(value)
+
+		if !ok {
+			return "", validation("key attribute %s isn't a string, number or binary", name)
+		}
+
+		parts = append(parts, encoded)
+	}
+
+	return strings.Join(parts, "\x00"), nil
+}
+
+// checkTypes rejects key and index attributes whose type differs from their
+// definition, as DynamoDB does
+func (t *table) checkTypes(item map[string]*dynamodb.AttributeValue) error {
+
+	for _, definition := range t.description.AttributeDefinitions {
+
+		name := aws.StringValue(definition.AttributeName)
+
+		value, ok := item[name]
+
+		if !ok {
+			continue
+		}
+
+		if actual := scalarType(value); actual != aws.StringValue(definition.AttributeType) {
+			return validation("One or more parameter values were invalid: Type mismatch for key %s expected: %s actual: %s", name, aws.StringValue(definition.AttributeType), actual)
+		}
+	}
+
+	return nil
+}
+
+func scalarType(value *dynamodb.AttributeValue) string {
+
+	switch {
+	case value == nil:
+		return ""
+	case value.S != nil:
+		return dynamodb.ScalarAttributeTypeS
+	case value.N != nil:
+		return dynamodb.ScalarAttributeTypeN
+	case value.B != nil:
+		return dynamodb.ScalarAttributeTypeB
+	}
+
+	return ""
+}
+
+func encodeKey(value *dynamodb.AttributeValue) (string, bool) {
+
+	switch {
+	case value == nil:
+		return "", false
+	case value.S != nil:
+		return "S" + aws.StringValue(value.S), true
+	case value.N != nil:
+		return "N" + aws.StringValue(value.N), true
+	case value.B != nil:
+		return "B" + string(value.B), true
+	}
+
+	return "", false
+}
+
+// keyOf returns the key attributes of an item
+func (t *table) keyOf(item map[string]*dynamodb.AttributeValue) map[string]*dynamodb.AttributeValue {
+
+	key := map[string]*dynamodb.AttributeValue{}
+
+	for _, element := range t.description.KeySchema {
+		key[aws.StringValue(element.AttributeName)] = copyValue(item[aws.StringValue(element.AttributeName)])
+	}
+
+	return key
+}
+
+// segment returns the scan segment of an item's partition key
+func (t *table) segment(item map[string]*dynamodb.AttributeValue, totalSegments int64) int64 {
+
+	var encoded string
+
+	for _, element := range t.description.KeySchema {
+		if aws.StringValue(element.KeyType) == dynamodb.KeyTypeHash {
+			encoded, _ = encodeKey(item[aws.StringValue(element.AttributeName)])
+		}
+	}
+
+	return int64(fnvHash(encoded) % uint64(totalSegments))
+}
+
+// keys returns the table's item keys in order
+func (t *table) keys() (keys []string) {
+
+	for key := range t.items {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	return
+}
+
+func fnvHash(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	return h.Sum64()
+}
+
+// writeUnits are the write capacity units of putting an item, one per KB
+func writeUnits(item map[string]*dynamodb.AttributeValue) float64 {
+	return math.Max(1, math.Ceil(float64(itemSize(item))/1024))
+}
+
+// readUnits are the read capacity units of reading size bytes, one per 4KB
+// read consistently and half that eventually consistent
+func readUnits(size int64, consistent bool) float64 {
+
+	units := math.Max(1, math.Ceil(float64(size)/4096))
+
+	if !consistent {
+		units /= 2
+	}
+
+	return units
+}
+
+// consumedCapacity reports the units consumed on each table when asked to
+func consumedCapacity(returnCapacity *string, names []string, consumed map[string]float64) (capacity []*dynamodb.ConsumedCapacity) {
+
+	switch aws.StringValue(returnCapacity) {
+	case dynamodb.ReturnConsumedCapacityTotal, dynamodb.ReturnConsumedCapacityIndexes:
+	default:
+		return nil
+	}
+
+	for _, name := range names {
+		capacity = append(capacity, &dynamodb.ConsumedCapacity{
+			TableName:     aws.String(name),
+			CapacityUnits: aws.Float64(consumed[name]),
+		})
+	}
+
+	return
+}
+
+// itemSize roughly follows DynamoDB's sizing, attribute names plus values
+func itemSize(item map[string]*dynamodb.AttributeValue) (size int64) {
+
+	for name, value := range item {
+		size += int64(len(name)) + valueSize(value)
+	}
+
+	return
+}
+
+func valueSize(value *dynamodb.AttributeValue) (size int64) {
+
+	if value == nil {
+		return 0
+	}
+
+	size = int64(len(aws.StringValue(value.S)) + len(aws.StringValue(value.N)) + len(value.B) + 1)
+
+	for _, s := range value.SS {
+		size += int64(len(aws.StringValue(s)))
+	}
+
+	for _, n := range value.NS {
+		size += int64(len(aws.StringValue(n)))
+	}
+
+	for _, b := range value.BS {
+		size += int64(len(b))
+	}
+
+	for _, element := range value.L {
+		size += valueSize(element) + 1
+	}
+
+	for name, element := range value.M {
+		size += int64(len(name)) + valueSize(element) + 1
+	}
+
+	return
+}
+
+func copyItem(item map[string]*dynamodb.AttributeValue) map[string]*dynamodb.AttributeValue {
+
+	if item == nil {
+		return nil
+	}
+
+	copied := make(map[string]*dynamodb.AttributeValue, len(item))
+
+	for name, value := range item {
+		copied[name] = copyValue(value)
+	}
+
+	return copied
+}
+
+func copyValue(value *dynamodb.AttributeValue) *dynamodb.AttributeValue {
+
+	if value == nil {
+		return nil
+	}
+
+	copied := &dynamodb.AttributeValue{
+		BOOL: copyBool(value.BOOL),
+		NULL: copyBool(value.NULL),
+		N:    copyString(value.N),
+		S:    copyString(value.S),
+		M:    copyItem(value.M),
+	}
+
+	if value.B != nil {
+		copied.B = append([]byte{}, value.B...)
+	}
+
+	for _, b := range value.BS {
+		copied.BS = append(copied.BS, append([]byte{}, b...))
+	}
+
+	for _, n := range value.NS {
+		copied.NS = append(copied.NS, copyString(n))
+	}
+
+	for _, s := range value.SS {
+		copied.SS = append(copied.SS, copyString(s))
+	}
+
+	if value.L != nil {
+		copied.L = []*dynamodb.AttributeValue{}
+	}
+
+	for _, element := range value.L {
+		copied.L = append(copied.L, copyValue(element))
+	}
+
+	return copied
+}
+
+func copyString(s *string) *string {
+
+	if s == nil {
+		return nil
+	}
+
+	return aws.String(*s)
+}
+
+func copyBool(b *bool) *bool {
+
+	if b == nil {
+		return nil
+	}
+
+	return aws.Bool(*b)
+}
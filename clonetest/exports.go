@@ -0,0 +1,404 @@
+package clonetest
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/NixM0nk3y/dynamodb-clone/datafile"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// exportFileItems is small so even the test data is exported over several files
+const exportFileItems = 4
+
+// export is a point in time export, its items are taken as it starts
+type export struct {
+	description *dynamodb.ExportDescription
+	items       []map[string]*dynamodb.AttributeValue
+	described   int
+}
+
+//
+// ExportTableToPointInTimeWithContext starts an export of a table with point
+// in time recovery enabled, an export already started with the same client
+// token is handed back instead. The export completes once it has been
+// described ExportPending times, writing its files to Bucket.
+//
+func (d *DynamoDB) ExportTableToPointInTimeWithContext(ctx aws.Context, input *dynamodb.ExportTableToPointInTimeInput, opts ...request.Option) (*dynamodb.ExportTableToPointInTimeOutput, error) {
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if _, err := d.call("ExportTableToPointInTime"); err != nil {
+		return nil, err
+	}
+
+	t, err := d.tableByArn(input.TableArn)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if !t.pitr {
+		return nil, awserr.New(dynamodb.ErrCodePointInTimeRecoveryUnavailableException,
+			fmt.Sprintf("Point in time recovery is not enabled for table '%s'", aws.StringValue(t.description.TableName)), nil)
+	}
+
+	format := aws.StringValue(input.ExportFormat)
+
+	switch format {
+	case "":
+		format = dynamodb.ExportFormatDynamodbJson
+	case dynamodb.ExportFormatDynamodbJson, dynamodb.ExportFormatIon:
+	default:
+		return nil, validation("unknown export format %s", format)
+	}
+
+	if aws.StringValue(input.S3Bucket) == "" {
+		return nil, validation("an export needs an S3 bucket")
+	}
+
+	if input.ClientToken != nil {
+		for _, e := range d.exports {
+			if aws.StringValue(e.description.ClientToken) == aws.StringValue(input.ClientToken) {
+				return &dynamodb.ExportTableToPointInTimeOutput{ExportDescription: e.describe()}, nil
+			}
+		}
+	}
+
+	now := time.Now()
+
+	exportTime := aws.TimeValue(input.ExportTime)
+
+	if exportTime.IsZero() {
+		exportTime = now
+	}
+
+	arn := fmt.Sprintf("%s/export/%013d-%08x", aws.StringValue(t.description.TableArn), now.UnixNano()/int64(time.Millisecond), len(d.exports)+1)
+
+	e := &export{
+		description: &dynamodb.ExportDescription{
+			ExportArn:     aws.String(arn),
+			ExportStatus:  aws.String(dynamodb.ExportStatusInProgress),
+			TableArn:      t.description.TableArn,
+			TableId:       t.description.TableId,
+			ClientToken:   input.ClientToken,
+			S3Bucket:      input.S3Bucket,
+			S3BucketOwner: input.S3BucketOwner,
+			S3Prefix:      input.S3Prefix,
+			ExportFormat:  aws.String(format),
+			ExportTime:    aws.Time(exportTime),
+			StartTime:     aws.Time(now),
+		},
+	}
+
+	for _, key := range t.keys() {
+		e.items = append(e.items, copyItem(t.items[key]))
+	}
+
+	d.exports[arn] = e
+
+	return &dynamodb.ExportTableToPointInTimeOutput{ExportDescription: e.describe()}, nil
+}
+
+// DescribeExportWithContext describes an export, finishing it once it has been pending long enough
+func (d *DynamoDB) DescribeExportWithContext(ctx aws.Context, input *dynamodb.DescribeExportInput, opts ...request.Option) (*dynamodb.DescribeExportOutput, error) {
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if _, err := d.call("DescribeExport"); err != nil {
+		return nil, err
+	}
+
+	e, ok := d.exports[aws.StringValue(input.ExportArn)]
+
+	if !ok {
+		return nil, awserr.New(dynamodb.ErrCodeExportNotFoundException,
+			fmt.Sprintf("Export not found: %s", aws.StringValue(input.ExportArn)), nil)
+	}
+
+	if aws.StringValue(e.description.ExportStatus) == dynamodb.ExportStatusInProgress {
+
+		e.described++
+
+		if e.described > d.ExportPending {
+			d.finish(e)
+		}
+	}
+
+	return &dynamodb.DescribeExportOutput{ExportDescription: e.describe()}, nil
+}
+
+func (e *export) describe() *dynamodb.ExportDescription {
+	description := *e.description
+	return &description
+}
+
+// finish completes an export or fails it with ExportFailure
+func (d *DynamoDB) finish(e *export) {
+
+	e.description.EndTime = aws.Time(time.Now())
+
+	fail := func(code string, message string) {
+		e.description.ExportStatus = aws.String(dynamodb.ExportStatusFailed)
+		e.description.FailureCode = aws.String(code)
+		e.description.FailureMessage = aws.String(message)
+	}
+
+	if d.ExportFailure != "" {
+		fail(d.ExportFailure, "clonetest: export failed")
+		return
+	}
+
+	if d.Bucket == nil {
+		fail("S3NoSuchBucket", "clonetest: no bucket to export to")
+		return
+	}
+
+	summaryKey, size, err := d.writeExport(e)
+
+	if err != nil {
+		fail("S3AccessDenied", err.Error())
+		return
+	}
+
+	e.description.ExportStatus = aws.String(dynamodb.ExportStatusCompleted)
+	e.description.ExportManifest = aws.String(summaryKey)
+	e.description.ItemCount = aws.Int64(int64(len(e.items)))
+	e.description.BilledSizeBytes = aws.Int64(size)
+}
+
+// exportFile is a line of manifest-files.json
+type exportFile struct {
+	ItemCount     int64  `json:"itemCount"`
+	MD5Checksum   string `json:"md5Checksum"`
+	ETag          string `json:"etag"`
+	DataFileS3Key string `json:"dataFileS3Key"`
+}
+
+//
+// writeExport lays the export out as DynamoDB does, gzipped data files under
+// AWSDynamoDB/<export id>/data with manifest-files.json listing them beside
+// the manifest-summary.json the export reports
+//
+func (d *DynamoDB) writeExport(e *export) (summaryKey string, size int64, err error) {
+
+	bucket := e.description.S3Bucket
+	format := aws.StringValue(e.description.ExportFormat)
+	folder := path.Join(aws.StringValue(e.description.S3Prefix), "AWSDynamoDB", path.Base(aws.StringValue(e.description.ExportArn)))
+
+	extension := ".json.gz"
+
+	if format == dynamodb.ExportFormatIon {
+		extension = ".ion.gz"
+	}
+
+	put := func(key string, body []byte) error {
+		_, putErr := d.Bucket.PutObjectWithContext(aws.BackgroundContext(), &s3.PutObjectInput{
+			Bucket: bucket,
+			Key:    aws.String(key),
+			Body:   bytes.NewReader(body),
+		})
+		return putErr
+	}
+
+	var files bytes.Buffer
+
+	for start := 0; start < len(e.items); start += exportFileItems {
+
+		end := start + exportFileItems
+
+		if end > len(e.items) {
+			end = len(e.items)
+		}
+
+		var body bytes.Buffer
+
+		gz := gzip.NewWriter(&body)
+
+		for _, item := range e.items[start:end] {
+
+			var line []byte
+
+			if format == dynamodb.ExportFormatIon {
+				line = []byte("$ion_1_0 " + ionItem(item) + "\n")
+			} else {
+
+				var b bytes.Buffer
+
+				if err = datafile.NewEncoder(&b, datafile.FormatDynamoDB).Encode(item); err != nil {
+					return "", 0, err
+				}
+
+				line = b.Bytes()
+			}
+
+			size += int64(len(line))
+
+			if _, err = gz.Write(line); err != nil {
+				return "", 0, err
+			}
+		}
+
+		if err = gz.Close(); err != nil {
+			return "", 0, err
+		}
+
+		key := path.Join(folder, "data", fmt.Sprintf("%08x%s", fnvHash(fmt.Sprintf("%s-%d", folder, start)), extension))
+
+		if err = put(key, body.Bytes()); err != nil {
+			return "", 0, err
+		}
+
+		sum := md5.Sum(body.Bytes())
+
+		line, _ := json.Marshal(exportFile{
+			ItemCount:     int64(end - start),
+			MD5Checksum:   base64.StdEncoding.EncodeToString(sum[:]),
+			ETag:          strings.Trim(aws.StringValue(etag(body.Bytes())), `"`),
+			DataFileS3Key: key,
+		})
+
+		files.Write(append(line, '\n'))
+	}
+
+	filesKey := path.Join(folder, "manifest-files.json")
+
+	if err = put(filesKey, files.Bytes()); err != nil {
+		return "", 0, err
+	}
+
+	summary, _ := json.Marshal(map[string]interface{}{
+		"version":            "2020-06-30",
+		"exportArn":          e.description.ExportArn,
+		"tableArn":           e.description.TableArn,
+		"exportTime":         e.description.ExportTime,
+		"s3Bucket":           bucket,
+		"s3Prefix":           e.description.S3Prefix,
+		"itemCount":          len(e.items),
+		"outputFormat":       format,
+		"manifestFilesS3Key": filesKey,
+	})
+
+	summaryKey = path.Join(folder, "manifest-summary.json")
+
+	return summaryKey, size, put(summaryKey, summary)
+}
+
+// ionItem writes an item as a line of a DynamoDB ION export does
+func ionItem(item map[string]*dynamodb.AttributeValue) string {
+
+	var b strings.Builder
+
+	b.WriteString("{Item:")
+	writeIonStruct(&b, item)
+	b.WriteString("}")
+
+	return b.String()
+}
+
+func writeIonStruct(b *strings.Builder, m map[string]*dynamodb.AttributeValue) {
+
+	names := make([]string, 0, len(m))
+
+	for name := range m {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	b.WriteString("{")
+
+	for i, name := range names {
+
+		if i > 0 {
+			b.WriteString(",")
+		}
+
+		b.WriteString(strconv.Quote(name))
+		b.WriteString(":")
+		writeIonValue(b, m[name])
+	}
+
+	b.WriteString("}")
+}
+
+// ionDecimal writes a DynamoDB number as an Ion decimal, 12 as 12. and 1.5E+3 as 1.5d+3
+func ionDecimal(n string) string {
+
+	if i := strings.IndexAny(n, "eE"); i >= 0 {
+		return n[:i] + "d" + n[i+1:]
+	}
+
+	if !strings.Contains(n, ".") {
+		return n + "."
+	}
+
+	return n
+}
+
+func writeIonList(b *strings.Builder, annotation string, members []string) {
+
+	b.WriteString(annotation)
+	b.WriteString("::[")
+	b.WriteString(strings.Join(members, ","))
+	b.WriteString("]")
+}
+
+func writeIonValue(b *strings.Builder, value *dynamodb.AttributeValue) {
+
+	var members []string
+
+	switch {
+	case value.S != nil:
+		b.WriteString(strconv.Quote(*value.S))
+	case value.N != nil:
+		b.WriteString(ionDecimal(*value.N))
+	case value.B != nil:
+		b.WriteString("{{" + base64.StdEncoding.EncodeToString(value.B) + "}}")
+	case value.BOOL != nil:
+		b.WriteString(strconv.FormatBool(*value.BOOL))
+	case value.NULL != nil:
+		b.WriteString("null")
+	case value.SS != nil:
+		for _, s := range value.SS {
+			members = append(members, strconv.Quote(aws.StringValue(s)))
+		}
+		writeIonList(b, "$dynamodb_SS", members)
+	case value.NS != nil:
+		for _, n := range value.NS {
+			members = append(members, ionDecimal(aws.StringValue(n)))
+		}
+		writeIonList(b, "$dynamodb_NS", members)
+	case value.BS != nil:
+		for _, member := range value.BS {
+			members = append(members, "{{"+base64.StdEncoding.EncodeToString(member)+"}}")
+		}
+		writeIonList(b, "$dynamodb_BS", members)
+	case value.M != nil:
+		writeIonStruct(b, value.M)
+	case value.L != nil:
+		b.WriteString("[")
+		for i, member := range value.L {
+			if i > 0 {
+				b.WriteString(",")
+			}
+			writeIonValue(b, member)
+		}
+		b.WriteString("]")
+	}
+}
@@ -0,0 +1,239 @@
+package clonetest
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/NixM0nk3y/dynamodb-clone/datafile"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// tableImport is an ImportTable import, its table is created once it completes
+type tableImport struct {
+	description *dynamodb.ImportTableDescription
+	described   int
+}
+
+//
+// ImportTableWithContext starts an import of every object under a prefix of
+// Bucket into a new table, an import already started with the same client
+// token is handed back instead. The import completes once it has been
+// described ImportPending times, creating the table and loading the objects.
+//
+func (d *DynamoDB) ImportTableWithContext(ctx aws.Context, input *dynamodb.ImportTableInput, opts ...request.Option) (*dynamodb.ImportTableOutput, error) {
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if _, err := d.call("ImportTable"); err != nil {
+		return nil, err
+	}
+
+	if input.ClientToken != nil {
+		for _, i := range d.imports {
+			if aws.StringValue(i.description.ClientToken) == aws.StringValue(input.ClientToken) {
+				return &dynamodb.ImportTableOutput{ImportTableDescription: i.describe()}, nil
+			}
+		}
+	}
+
+	params := input.TableCreationParameters
+
+	if params == nil || input.S3BucketSource == nil {
+		return nil, validation("an import needs table creation parameters and an S3 bucket source")
+	}
+
+	name := aws.StringValue(params.TableName)
+
+	if _, exists := d.tables[name]; exists {
+		return nil, awserr.New(dynamodb.ErrCodeResourceInUseException, fmt.Sprintf("Table already exists: %s", name), nil)
+	}
+
+	if _, err := importFormat(input.InputFormat); err != nil {
+		return nil, err
+	}
+
+	if _, err := importCompression(input.InputCompressionType); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+
+	tableArn := fmt.Sprintf("arn:aws:dynamodb:%s:%s:table/%s", Region, Account, name)
+
+	i := &tableImport{
+		description: &dynamodb.ImportTableDescription{
+			ImportArn:               aws.String(fmt.Sprintf("%s/import/%013d-%08x", tableArn, now.UnixNano()/int64(time.Millisecond), len(d.imports)+1)),
+			ImportStatus:            aws.String(dynamodb.ImportStatusInProgress),
+			TableArn:                aws.String(tableArn),
+			ClientToken:             input.ClientToken,
+			S3BucketSource:          input.S3BucketSource,
+			InputFormat:             input.InputFormat,
+			InputCompressionType:    input.InputCompressionType,
+			TableCreationParameters: params,
+			StartTime:               aws.Time(now),
+		},
+	}
+
+	d.imports[aws.StringValue(i.description.ImportArn)] = i
+
+	return &dynamodb.ImportTableOutput{ImportTableDescription: i.describe()}, nil
+}
+
+// DescribeImportWithContext describes an import, finishing it once it has been pending long enough
+func (d *DynamoDB) DescribeImportWithContext(ctx aws.Context, input *dynamodb.DescribeImportInput, opts ...request.Option) (*dynamodb.DescribeImportOutput, error) {
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if _, err := d.call("DescribeImport"); err != nil {
+		return nil, err
+	}
+
+	i, ok := d.imports[aws.StringValue(input.ImportArn)]
+
+	if !ok {
+		return nil, awserr.New(dynamodb.ErrCodeImportNotFoundException,
+			fmt.Sprintf("Import not found: %s", aws.StringValue(input.ImportArn)), nil)
+	}
+
+	if aws.StringValue(i.description.ImportStatus) == dynamodb.ImportStatusInProgress {
+
+		i.described++
+
+		if i.described > d.ImportPending {
+			d.load(i)
+		}
+	}
+
+	return &dynamodb.DescribeImportOutput{ImportTableDescription: i.describe()}, nil
+}
+
+func (i *tableImport) describe() *dynamodb.ImportTableDescription {
+	description := *i.description
+	return &description
+}
+
+func importFormat(format *string) (datafile.Format, error) {
+
+	switch aws.StringValue(format) {
+	case dynamodb.InputFormatDynamodbJson:
+		return datafile.FormatDynamoDB, nil
+	case dynamodb.InputFormatIon:
+		return datafile.FormatIon, nil
+	}
+
+	return "", unsupported("ImportTable", "InputFormat "+aws.StringValue(format))
+}
+
+func importCompression(compression *string) (datafile.Compression, error) {
+
+	switch aws.StringValue(compression) {
+	case "", dynamodb.InputCompressionTypeNone:
+		return datafile.CompressionNone, nil
+	case dynamodb.InputCompressionTypeGzip:
+		return datafile.CompressionGzip, nil
+	case dynamodb.InputCompressionTypeZstd:
+		return datafile.CompressionZstd, nil
+	}
+
+	return "", validation("unknown input compression type %s", aws.StringValue(compression))
+}
+
+//
+// load creates the import's table and writes the items of every object
+// under the prefix, an item without the table's key or an object that can't
+// be read is counted as an error as DynamoDB would log it
+//
+func (d *DynamoDB) load(i *tableImport) {
+
+	description := i.description
+
+	description.EndTime = aws.Time(time.Now())
+
+	params := description.TableCreationParameters
+
+	t, err := d.createTable(&dynamodb.CreateTableInput{
+		TableName:              params.TableName,
+		KeySchema:              params.KeySchema,
+		AttributeDefinitions:   params.AttributeDefinitions,
+		BillingMode:            params.BillingMode,
+		ProvisionedThroughput:  params.ProvisionedThroughput,
+		SSESpecification:       params.SSESpecification,
+		GlobalSecondaryIndexes: params.GlobalSecondaryIndexes,
+	})
+
+	if err == nil && d.Bucket == nil {
+		err = fmt.Errorf("clonetest: no bucket to import from")
+	}
+
+	if err != nil {
+		description.ImportStatus = aws.String(dynamodb.ImportStatusFailed)
+		description.FailureCode = aws.String("ValidationError")
+		description.FailureMessage = aws.String(err.Error())
+		return
+	}
+
+	format, _ := importFormat(description.InputFormat)
+	compression, _ := importCompression(description.InputCompressionType)
+
+	var processed, imported, errors, size int64
+
+	bucket := aws.StringValue(description.S3BucketSource.S3Bucket)
+
+	for _, key := range d.Bucket.Keys(bucket, aws.StringValue(description.S3BucketSource.S3KeyPrefix)) {
+
+		body, _ := d.Bucket.Object(bucket, key)
+
+		size += int64(len(body))
+
+		r, decompressErr := datafile.NewDecompressor(bytes.NewReader(body), compression)
+
+		if decompressErr != nil {
+			errors++
+			continue
+		}
+
+		decoder := datafile.NewDecoder(r, format)
+
+		for {
+			item, decodeErr := decoder.Decode()
+
+			if decodeErr == io.EOF {
+				break
+			}
+
+			// the rest of the object can't be trusted
+			if decodeErr != nil {
+				errors++
+				break
+			}
+
+			processed++
+
+			itemKey, keyErr := t.key(item)
+
+			if keyErr != nil {
+				errors++
+				continue
+			}
+
+			t.items[itemKey] = copyItem(item)
+			imported++
+		}
+
+		r.Close()
+	}
+
+	description.ImportStatus = aws.String(dynamodb.ImportStatusCompleted)
+	description.ProcessedItemCount = aws.Int64(processed)
+	description.ImportedItemCount = aws.Int64(imported)
+	description.ErrorCount = aws.Int64(errors)
+	description.ProcessedSizeBytes = aws.Int64(size)
+	description.CloudWatchLogGroupArn = aws.String(fmt.Sprintf("arn:aws:logs:%s:%s:log-group:/aws-dynamodb/imports:*", Region, Account))
+}
@@ -0,0 +1,24 @@
+package clonetest
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/client/metadata"
+	"github.com/aws/aws-sdk-go/aws/request"
+)
+
+//
+// The SDK helpers (s3manager, the waiters) build their calls with the
+// XxxRequest methods and Send them. newRequest returns a request whose only
+// handler hands it to the fake, which fills in the output in place of the
+// HTTP round trip.
+//
+func newRequest(operation string, input interface{}, output interface{}, send func(r *request.Request) error) *request.Request {
+
+	handlers := request.Handlers{}
+
+	handlers.Send.PushBack(func(r *request.Request) {
+		r.Error = send(r)
+	})
+
+	return request.New(aws.Config{}, metadata.ClientInfo{}, handlers, nil, &request.Operation{Name: operation}, input, output)
+}
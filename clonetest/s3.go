@@ -0,0 +1,598 @@
+package clonetest
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+//
+// S3 is an in-memory s3iface.S3API. Buckets spring into being on their first
+// write, objects keep their body, metadata and content encoding, and the
+// calls s3manager makes for single and multipart uploads are answered.
+// Anything else panics on the nil embedded interface.
+//
+type S3 struct {
+	s3iface.S3API
+
+	mu      sync.Mutex
+	objects map[string]*object
+	uploads map[string]*multipartUpload
+	calls   map[string]int
+}
+
+type object struct {
+	body            []byte
+	metadata        map[string]*string
+	contentEncoding *string
+	modified        time.Time
+}
+
+type multipartUpload struct {
+	bucket          string
+	key             string
+	metadata        map[string]*string
+	contentEncoding *string
+	parts           map[int64][]byte
+}
+
+// NewS3 returns a fake without any objects
+func NewS3() *S3 {
+	return &S3{
+		objects: map[string]*object{},
+		uploads: map[string]*multipartUpload{},
+		calls:   map[string]int{},
+	}
+}
+
+// Calls returns how many times an operation has been called
+func (s *S3) Calls(operation string) int {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.calls[operation]
+}
+
+// Keys returns the keys in a bucket under the prefix, in order
+func (s *S3) Keys(bucket string, prefix string) (keys []string) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.keys(bucket, prefix)
+}
+
+// Object returns a copy of an object's body, false when it doesn't exist
+func (s *S3) Object(bucket string, key string) ([]byte, bool) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	o, ok := s.objects[bucket+"/"+key]
+
+	if !ok {
+		return nil, false
+	}
+
+	return append([]byte{}, o.body...), true
+}
+
+// Modified backdates the objects in a bucket under the prefix
+func (s *S3) Modified(bucket string, prefix string, modified time.Time) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, key := range s.keys(bucket, prefix) {
+		s.objects[bucket+"/"+key].modified = modified
+	}
+}
+
+func (s *S3) keys(bucket string, prefix string) (keys []string) {
+
+	for path := range s.objects {
+		if strings.HasPrefix(path, bucket+"/"+prefix) {
+			keys = append(keys, strings.TrimPrefix(path, bucket+"/"))
+		}
+	}
+
+	sort.Strings(keys)
+
+	return
+}
+
+func noSuchKey(bucket *string, key *string) error {
+	return awserr.New(s3.ErrCodeNoSuchKey, fmt.Sprintf("The specified key does not exist: %s/%s", aws.StringValue(bucket), aws.StringValue(key)), nil)
+}
+
+func etag(body []byte) *string {
+	sum := md5.Sum(body)
+	return aws.String(`"` + hex.EncodeToString(sum[:]) + `"`)
+}
+
+func copyMetadata(metadata map[string]*string) map[string]*string {
+
+	copied := map[string]*string{}
+
+	for name, value := range metadata {
+		copied[name] = copyString(value)
+	}
+
+	return copied
+}
+
+// PutObjectWithContext stores an object
+func (s *S3) PutObjectWithContext(ctx aws.Context, input *s3.PutObjectInput, opts ...request.Option) (*s3.PutObjectOutput, error) {
+
+	var body []byte
+
+	if input.Body != nil {
+
+		read, err := ioutil.ReadAll(input.Body)
+
+		if err != nil {
+			return nil, err
+		}
+
+		body = read
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.calls["PutObject"]++
+
+	s.objects[aws.StringValue(input.Bucket)+"/"+aws.StringValue(input.Key)] = &object{
+		body:            body,
+		metadata:        copyMetadata(input.Metadata),
+		contentEncoding: copyString(input.ContentEncoding),
+		modified:        time.Now(),
+	}
+
+	return &s3.PutObjectOutput{ETag: etag(body)}, nil
+}
+
+// PutObjectRequest is PutObjectWithContext for s3manager
+func (s *S3) PutObjectRequest(input *s3.PutObjectInput) (*request.Request, *s3.PutObjectOutput) {
+
+	output := &s3.PutObjectOutput{}
+
+	return newRequest("PutObject", input, output, func(r *request.Request) error {
+
+		result, err := s.PutObjectWithContext(r.Context(), input)
+
+		if err == nil {
+			*output = *result
+		}
+
+		return err
+	}), output
+}
+
+//
+// GetObjectWithContext reads an object, or the bytes=first-last (or first-)
+// range of it
+//
+func (s *S3) GetObjectWithContext(ctx aws.Context, input *s3.GetObjectInput, opts ...request.Option) (*s3.GetObjectOutput, error) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.calls["GetObject"]++
+
+	o, ok := s.objects[aws.StringValue(input.Bucket)+"/"+aws.StringValue(input.Key)]
+
+	if !ok {
+		return nil, noSuchKey(input.Bucket, input.Key)
+	}
+
+	body := o.body
+
+	output := &s3.GetObjectOutput{
+		ContentEncoding: copyString(o.contentEncoding),
+		Metadata:        copyMetadata(o.metadata),
+		ETag:            etag(o.body),
+		LastModified:    aws.Time(o.modified),
+	}
+
+	if input.Range != nil {
+
+		first, last, err := parseRange(aws.StringValue(input.Range), int64(len(o.body)))
+
+		if err != nil {
+			return nil, err
+		}
+
+		body = o.body[first : last+1]
+
+		output.ContentRange = aws.String(fmt.Sprintf("bytes %d-%d/%d", first, last, len(o.body)))
+	}
+
+	output.ContentLength = aws.Int64(int64(len(body)))
+	output.Body = ioutil.NopCloser(bytes.NewReader(append([]byte{}, body...)))
+
+	return output, nil
+}
+
+func parseRange(header string, size int64) (first int64, last int64, err error) {
+
+	invalid := awserr.New("InvalidRange", fmt.Sprintf("The requested range %s is not satisfiable", header), nil)
+
+	spec := strings.TrimPrefix(header, "bytes=")
+
+	bounds := strings.SplitN(spec, "-", 2)
+
+	if spec == header || len(bounds) != 2 {
+		return 0, 0, invalid
+	}
+
+	if first, err = strconv.ParseInt(bounds[0], 10, 64); err != nil || first >= size {
+		return 0, 0, invalid
+	}
+
+	last = size - 1
+
+	if bounds[1] != "" {
+
+		if last, err = strconv.ParseInt(bounds[1], 10, 64); err != nil || last < first {
+			return 0, 0, invalid
+		}
+
+		if last >= size {
+			last = size - 1
+		}
+	}
+
+	return first, last, nil
+}
+
+// GetObjectRequest is GetObjectWithContext for s3manager
+func (s *S3) GetObjectRequest(input *s3.GetObjectInput) (*request.Request, *s3.GetObjectOutput) {
+
+	output := &s3.GetObjectOutput{}
+
+	return newRequest("GetObject", input, output, func(r *request.Request) error {
+
+		result, err := s.GetObjectWithContext(r.Context(), input)
+
+		if err == nil {
+			*output = *result
+		}
+
+		return err
+	}), output
+}
+
+// CopyObjectWithContext copies an object, replacing its metadata if asked to
+func (s *S3) CopyObjectWithContext(ctx aws.Context, input *s3.CopyObjectInput, opts ...request.Option) (*s3.CopyObjectOutput, error) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.calls["CopyObject"]++
+
+	source, err := url.PathUnescape(aws.StringValue(input.CopySource))
+
+	if err != nil {
+		return nil, err
+	}
+
+	o, ok := s.objects[strings.TrimPrefix(source, "/")]
+
+	if !ok {
+		return nil, awserr.New(s3.ErrCodeNoSuchKey, fmt.Sprintf("The specified key does not exist: %s", source), nil)
+	}
+
+	copied := &object{
+		body:            o.body,
+		metadata:        copyMetadata(o.metadata),
+		contentEncoding: copyString(o.contentEncoding),
+		modified:        time.Now(),
+	}
+
+	if aws.StringValue(input.MetadataDirective) == s3.MetadataDirectiveReplace {
+		copied.metadata = copyMetadata(input.Metadata)
+		copied.contentEncoding = copyString(input.ContentEncoding)
+	}
+
+	s.objects[aws.StringValue(input.Bucket)+"/"+aws.StringValue(input.Key)] = copied
+
+	return &s3.CopyObjectOutput{
+		CopyObjectResult: &s3.CopyObjectResult{ETag: etag(copied.body), LastModified: aws.Time(copied.modified)},
+	}, nil
+}
+
+//
+// ListObjectsV2WithContext lists the keys under a prefix in order, rolling
+// keys up into common prefixes at the delimiter
+//
+func (s *S3) ListObjectsV2WithContext(ctx aws.Context, input *s3.ListObjectsV2Input, opts ...request.Option) (*s3.ListObjectsV2Output, error) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.calls["ListObjectsV2"]++
+
+	prefix := aws.StringValue(input.Prefix)
+	delimiter := aws.StringValue(input.Delimiter)
+
+	maxKeys := int(aws.Int64Value(input.MaxKeys))
+
+	if maxKeys < 1 || maxKeys > 1000 {
+		maxKeys = 1000
+	}
+
+	after := aws.StringValue(input.StartAfter)
+
+	if input.ContinuationToken != nil {
+		after = aws.StringValue(input.ContinuationToken)
+	}
+
+	output := &s3.ListObjectsV2Output{
+		Name:      input.Bucket,
+		Prefix:    input.Prefix,
+		Delimiter: input.Delimiter,
+		MaxKeys:   aws.Int64(int64(maxKeys)),
+	}
+
+	seen := map[string]bool{}
+	count := 0
+	last := ""
+
+	for _, key := range s.keys(aws.StringValue(input.Bucket), prefix) {
+
+		// a token ending in the delimiter carries on past that common prefix
+		if key <= after || (delimiter != "" && strings.HasSuffix(after, delimiter) && strings.HasPrefix(key, after)) {
+			continue
+		}
+
+		entry := key
+
+		if delimiter != "" {
+			if i := strings.Index(key[len(prefix):], delimiter); i >= 0 {
+				entry = key[:len(prefix)+i+len(delimiter)]
+			}
+		}
+
+		if seen[entry] {
+			continue
+		}
+
+		if count == maxKeys {
+			output.IsTruncated = aws.Bool(true)
+			output.NextContinuationToken = aws.String(last)
+			break
+		}
+
+		seen[entry] = true
+		count++
+		last = entry
+
+		if entry != key {
+			output.CommonPrefixes = append(output.CommonPrefixes, &s3.CommonPrefix{Prefix: aws.String(entry)})
+			continue
+		}
+
+		o := s.objects[aws.StringValue(input.Bucket)+"/"+key]
+
+		output.Contents = append(output.Contents, &s3.Object{
+			Key:          aws.String(key),
+			Size:         aws.Int64(int64(len(o.body))),
+			ETag:         etag(o.body),
+			LastModified: aws.Time(o.modified),
+		})
+	}
+
+	if output.IsTruncated == nil {
+		output.IsTruncated = aws.Bool(false)
+	}
+
+	output.KeyCount = aws.Int64(int64(count))
+
+	return output, nil
+}
+
+// ListObjectsV2PagesWithContext hands each page of the listing to fn until it returns false
+func (s *S3) ListObjectsV2PagesWithContext(ctx aws.Context, input *s3.ListObjectsV2Input, fn func(*s3.ListObjectsV2Output, bool) bool, opts ...request.Option) error {
+
+	params := *input
+
+	for {
+
+		page, err := s.ListObjectsV2WithContext(ctx, &params, opts...)
+
+		if err != nil {
+			return err
+		}
+
+		lastPage := !aws.BoolValue(page.IsTruncated)
+
+		if !fn(page, lastPage) || lastPage {
+			return nil
+		}
+
+		params.ContinuationToken = page.NextContinuationToken
+	}
+}
+
+// DeleteObjectWithContext removes an object, a missing object isn't an error
+func (s *S3) DeleteObjectWithContext(ctx aws.Context, input *s3.DeleteObjectInput, opts ...request.Option) (*s3.DeleteObjectOutput, error) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.calls["DeleteObject"]++
+
+	delete(s.objects, aws.StringValue(input.Bucket)+"/"+aws.StringValue(input.Key))
+
+	return &s3.DeleteObjectOutput{}, nil
+}
+
+// DeleteObjectsWithContext removes up to 1000 objects
+func (s *S3) DeleteObjectsWithContext(ctx aws.Context, input *s3.DeleteObjectsInput, opts ...request.Option) (*s3.DeleteObjectsOutput, error) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.calls["DeleteObjects"]++
+
+	if len(input.Delete.Objects) > 1000 {
+		return nil, awserr.New("MalformedXML", "DeleteObjects takes at most 1000 keys", nil)
+	}
+
+	output := &s3.DeleteObjectsOutput{}
+
+	for _, identifier := range input.Delete.Objects {
+
+		delete(s.objects, aws.StringValue(input.Bucket)+"/"+aws.StringValue(identifier.Key))
+
+		output.Deleted = append(output.Deleted, &s3.DeletedObject{Key: identifier.Key})
+	}
+
+	return output, nil
+}
+
+// CreateMultipartUploadWithContext starts a multipart upload
+func (s *S3) CreateMultipartUploadWithContext(ctx aws.Context, input *s3.CreateMultipartUploadInput, opts ...request.Option) (*s3.CreateMultipartUploadOutput, error) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.calls["CreateMultipartUpload"]++
+
+	uploadID := fmt.Sprintf("upload-%d", s.calls["CreateMultipartUpload"])
+
+	s.uploads[uploadID] = &multipartUpload{
+		bucket:          aws.StringValue(input.Bucket),
+		key:             aws.StringValue(input.Key),
+		metadata:        copyMetadata(input.Metadata),
+		contentEncoding: copyString(input.ContentEncoding),
+		parts:           map[int64][]byte{},
+	}
+
+	return &s3.CreateMultipartUploadOutput{
+		Bucket:   input.Bucket,
+		Key:      input.Key,
+		UploadId: aws.String(uploadID),
+	}, nil
+}
+
+func noSuchUpload(uploadID *string) error {
+	return awserr.New(s3.ErrCodeNoSuchUpload, fmt.Sprintf("The specified upload does not exist: %s", aws.StringValue(uploadID)), nil)
+}
+
+// UploadPartWithContext stores a part of a multipart upload
+func (s *S3) UploadPartWithContext(ctx aws.Context, input *s3.UploadPartInput, opts ...request.Option) (*s3.UploadPartOutput, error) {
+
+	var body []byte
+
+	if input.Body != nil {
+
+		read, err := ioutil.ReadAll(input.Body)
+
+		if err != nil {
+			return nil, err
+		}
+
+		body = read
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.calls["UploadPart"]++
+
+	upload, ok := s.uploads[aws.StringValue(input.UploadId)]
+
+	if !ok {
+		return nil, noSuchUpload(input.UploadId)
+	}
+
+	upload.parts[aws.Int64Value(input.PartNumber)] = body
+
+	return &s3.UploadPartOutput{ETag: etag(body)}, nil
+}
+
+// CompleteMultipartUploadWithContext joins the listed parts into the object
+func (s *S3) CompleteMultipartUploadWithContext(ctx aws.Context, input *s3.CompleteMultipartUploadInput, opts ...request.Option) (*s3.CompleteMultipartUploadOutput, error) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.calls["CompleteMultipartUpload"]++
+
+	upload, ok := s.uploads[aws.StringValue(input.UploadId)]
+
+	if !ok {
+		return nil, noSuchUpload(input.UploadId)
+	}
+
+	var body bytes.Buffer
+
+	for _, part := range input.MultipartUpload.Parts {
+
+		data, ok := upload.parts[aws.Int64Value(part.PartNumber)]
+
+		if !ok {
+			return nil, awserr.New("InvalidPart", fmt.Sprintf("part %d wasn't uploaded", aws.Int64Value(part.PartNumber)), nil)
+		}
+
+		body.Write(data)
+	}
+
+	delete(s.uploads, aws.StringValue(input.UploadId))
+
+	s.objects[upload.bucket+"/"+upload.key] = &object{
+		body:            body.Bytes(),
+		metadata:        upload.metadata,
+		contentEncoding: upload.contentEncoding,
+		modified:        time.Now(),
+	}
+
+	return &s3.CompleteMultipartUploadOutput{
+		Bucket: input.Bucket,
+		Key:    input.Key,
+		ETag:   etag(body.Bytes()),
+	}, nil
+}
+
+// AbortMultipartUploadWithContext drops a multipart upload's parts
+func (s *S3) AbortMultipartUploadWithContext(ctx aws.Context, input *s3.AbortMultipartUploadInput, opts ...request.Option) (*s3.AbortMultipartUploadOutput, error) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.calls["AbortMultipartUpload"]++
+
+	if _, ok := s.uploads[aws.StringValue(input.UploadId)]; !ok {
+		return nil, noSuchUpload(input.UploadId)
+	}
+
+	delete(s.uploads, aws.StringValue(input.UploadId))
+
+	return &s3.AbortMultipartUploadOutput{}, nil
+}
+
+// Uploads returns how many multipart uploads are still open
+func (s *S3) Uploads() int {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.uploads)
+}
@@ -0,0 +1,317 @@
+package clonetest
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodbstreams"
+	"github.com/aws/aws-sdk-go/service/dynamodbstreams/dynamodbstreamsiface"
+)
+
+//
+// Streams is an in-memory dynamodbstreamsiface.DynamoDBStreamsAPI holding
+// the shards and records written into it, a write to a table fake isn't
+// streamed. It answers the calls the stream sync makes, anything else
+// panics on the nil embedded interface. Records are never trimmed.
+//
+type Streams struct {
+	dynamodbstreamsiface.DynamoDBStreamsAPI
+
+	// PageSize caps the records a GetRecords returns below its Limit, zero
+	// leaves the Limit in charge
+	PageSize int
+
+	// EmptyPages are handed back by an open shard ahead of each page of
+	// its records, as DynamoDB Streams can
+	EmptyPages int
+
+	mu       sync.Mutex
+	streams  map[string][]*shard // by stream arn, in the order they were added
+	sequence int64
+	calls    map[string]int
+}
+
+type shard struct {
+	id      string
+	parent  string
+	closed  bool
+	records []*dynamodbstreams.Record
+}
+
+// NewStreams returns a fake without any streams
+func NewStreams() *Streams {
+	return &Streams{
+		streams: map[string][]*shard{},
+		calls:   map[string]int{},
+	}
+}
+
+// Calls returns how many times an operation has been called
+func (s *Streams) Calls(operation string) int {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.calls[operation]
+}
+
+// Shard adds an open shard to a stream, creating the stream if need be, its
+// parent is empty for a shard without one
+func (s *Streams) Shard(streamArn string, shardID string, parentID string) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.streams[streamArn] = append(s.streams[streamArn], &shard{id: shardID, parent: parentID})
+}
+
+// Close ends a shard, once its records are read it has no more to give
+func (s *Streams) Close(streamArn string, shardID string) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.shard(streamArn, shardID).closed = true
+}
+
+// Write appends a record of an INSERT, MODIFY or REMOVE made at a time to
+// an open shard, keys are taken from the new image when none are given
+func (s *Streams) Write(streamArn string, shardID string, eventName string, at time.Time, keys map[string]*dynamodb.AttributeValue, newImage map[string]*dynamodb.AttributeValue) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sh := s.shard(streamArn, shardID)
+
+	if sh.closed {
+		panic(fmt.Sprintf("clonetest: write to closed shard %s", shardID))
+	}
+
+	s.sequence++
+
+	sh.records = append(sh.records, &dynamodbstreams.Record{
+		EventName:   aws.String(eventName),
+		EventSource: aws.String("aws:dynamodb"),
+		Dynamodb: &dynamodbstreams.StreamRecord{
+			ApproximateCreationDateTime: aws.Time(at),
+			Keys:                        keys,
+			NewImage:                    newImage,
+			SequenceNumber:              aws.String(fmt.Sprintf("%021d", s.sequence)),
+			StreamViewType:              aws.String(dynamodbstreams.StreamViewTypeNewImage),
+		},
+	})
+}
+
+// shard finds a shard the test has added, a missing one is a broken test
+func (s *Streams) shard(streamArn string, shardID string) *shard {
+
+	for _, sh := range s.streams[streamArn] {
+		if sh.id == shardID {
+			return sh
+		}
+	}
+
+	panic(fmt.Sprintf("clonetest: no shard %s in stream %s", shardID, streamArn))
+}
+
+func (s *Streams) stream(arn *string) ([]*shard, error) {
+
+	shards, ok := s.streams[aws.StringValue(arn)]
+
+	if !ok {
+		return nil, awserr.New(dynamodbstreams.ErrCodeResourceNotFoundException,
+			fmt.Sprintf("Requested resource not found: Stream: %s not found", aws.StringValue(arn)), nil)
+	}
+
+	return shards, nil
+}
+
+// DescribeStreamWithContext lists every shard of the stream in one page
+func (s *Streams) DescribeStreamWithContext(ctx aws.Context, input *dynamodbstreams.DescribeStreamInput, opts ...request.Option) (*dynamodbstreams.DescribeStreamOutput, error) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.calls["DescribeStream"]++
+
+	shards, err := s.stream(input.StreamArn)
+
+	if err != nil {
+		return nil, err
+	}
+
+	description := &dynamodbstreams.StreamDescription{
+		StreamArn:      input.StreamArn,
+		StreamStatus:   aws.String(dynamodbstreams.StreamStatusEnabled),
+		StreamViewType: aws.String(dynamodbstreams.StreamViewTypeNewImage),
+	}
+
+	for _, sh := range shards {
+
+		listed := &dynamodbstreams.Shard{
+			ShardId:             aws.String(sh.id),
+			SequenceNumberRange: &dynamodbstreams.SequenceNumberRange{},
+		}
+
+		if sh.parent != "" {
+			listed.ParentShardId = aws.String(sh.parent)
+		}
+
+		if len(sh.records) > 0 {
+			listed.SequenceNumberRange.StartingSequenceNumber = sh.records[0].Dynamodb.SequenceNumber
+		}
+
+		if sh.closed && len(sh.records) > 0 {
+			listed.SequenceNumberRange.EndingSequenceNumber = sh.records[len(sh.records)-1].Dynamodb.SequenceNumber
+		} else if sh.closed {
+			listed.SequenceNumberRange.EndingSequenceNumber = aws.String(fmt.Sprintf("%021d", 0))
+		}
+
+		description.Shards = append(description.Shards, listed)
+	}
+
+	return &dynamodbstreams.DescribeStreamOutput{StreamDescription: description}, nil
+}
+
+// iterators are the stream arn, shard and position of the next record, and
+// the empty pages handed back at that position
+func shardIterator(streamArn string, shardID string, position int, empty int) *string {
+	return aws.String(fmt.Sprintf("%s|%s|%d|%d", streamArn, shardID, position, empty))
+}
+
+// GetShardIteratorWithContext returns an iterator from the trim horizon, the
+// latest record or a sequence number
+func (s *Streams) GetShardIteratorWithContext(ctx aws.Context, input *dynamodbstreams.GetShardIteratorInput, opts ...request.Option) (*dynamodbstreams.GetShardIteratorOutput, error) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.calls["GetShardIterator"]++
+
+	shards, err := s.stream(input.StreamArn)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var sh *shard
+
+	for _, candidate := range shards {
+		if candidate.id == aws.StringValue(input.ShardId) {
+			sh = candidate
+		}
+	}
+
+	if sh == nil {
+		return nil, awserr.New(dynamodbstreams.ErrCodeResourceNotFoundException,
+			fmt.Sprintf("Requested resource not found: Shard: %s not found", aws.StringValue(input.ShardId)), nil)
+	}
+
+	position := -1
+
+	switch iteratorType := aws.StringValue(input.ShardIteratorType); iteratorType {
+	case dynamodbstreams.ShardIteratorTypeTrimHorizon:
+		position = 0
+	case dynamodbstreams.ShardIteratorTypeLatest:
+		position = len(sh.records)
+	case dynamodbstreams.ShardIteratorTypeAtSequenceNumber, dynamodbstreams.ShardIteratorTypeAfterSequenceNumber:
+
+		for i, record := range sh.records {
+			if aws.StringValue(record.Dynamodb.SequenceNumber) == aws.StringValue(input.SequenceNumber) {
+				position = i
+			}
+		}
+
+		if position < 0 {
+			return nil, validation("sequence number %s isn't in shard %s", aws.StringValue(input.SequenceNumber), sh.id)
+		}
+
+		if iteratorType == dynamodbstreams.ShardIteratorTypeAfterSequenceNumber {
+			position++
+		}
+	default:
+		return nil, validation("unknown shard iterator type %s", iteratorType)
+	}
+
+	return &dynamodbstreams.GetShardIteratorOutput{ShardIterator: shardIterator(aws.StringValue(input.StreamArn), sh.id, position, 0)}, nil
+}
+
+// GetRecordsWithContext returns the records from the iterator on, the next
+// iterator is nil once a closed shard has been read to its end
+func (s *Streams) GetRecordsWithContext(ctx aws.Context, input *dynamodbstreams.GetRecordsInput, opts ...request.Option) (*dynamodbstreams.GetRecordsOutput, error) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.calls["GetRecords"]++
+
+	parts := strings.Split(aws.StringValue(input.ShardIterator), "|")
+
+	if len(parts) != 4 {
+		return nil, validation("invalid shard iterator %s", aws.StringValue(input.ShardIterator))
+	}
+
+	position, positionErr := strconv.Atoi(parts[2])
+	empty, emptyErr := strconv.Atoi(parts[3])
+
+	if positionErr != nil || emptyErr != nil {
+		return nil, validation("invalid shard iterator %s", aws.StringValue(input.ShardIterator))
+	}
+
+	shards, err := s.stream(aws.String(parts[0]))
+
+	if err != nil {
+		return nil, err
+	}
+
+	var sh *shard
+
+	for _, candidate := range shards {
+		if candidate.id == parts[1] {
+			sh = candidate
+		}
+	}
+
+	if sh == nil {
+		return nil, awserr.New(dynamodbstreams.ErrCodeResourceNotFoundException,
+			fmt.Sprintf("Requested resource not found: Shard: %s not found", parts[1]), nil)
+	}
+
+	output := &dynamodbstreams.GetRecordsOutput{Records: []*dynamodbstreams.Record{}}
+
+	if !sh.closed && position < len(sh.records) && empty < s.EmptyPages {
+		output.NextShardIterator = shardIterator(parts[0], sh.id, position, empty+1)
+		return output, nil
+	}
+
+	limit := int(aws.Int64Value(input.Limit))
+
+	if s.PageSize > 0 && (limit < 1 || s.PageSize < limit) {
+		limit = s.PageSize
+	}
+
+	end := len(sh.records)
+
+	if limit > 0 && position+limit < end {
+		end = position + limit
+	}
+
+	if position < end {
+		output.Records = append(output.Records, sh.records[position:end]...)
+	} else {
+		end = position
+	}
+
+	if !sh.closed || end < len(sh.records) {
+		output.NextShardIterator = shardIterator(parts[0], sh.id, end, 0)
+	}
+
+	return output, nil
+}
@@ -0,0 +1,756 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"sync"
+	"time"
+
+	"github.com/NixM0nk3y/dynamodb-clone/clone"
+	"github.com/NixM0nk3y/dynamodb-clone/clonerr"
+	"github.com/NixM0nk3y/dynamodb-clone/log"
+	"github.com/NixM0nk3y/dynamodb-clone/manifest"
+	"github.com/NixM0nk3y/dynamodb-clone/state"
+	"github.com/aws/aws-xray-sdk-go/xray"
+	"go.uber.org/zap"
+)
+
+//
+// Checkpoint is the progress of a clone, rewritten after every step so an
+// interrupted clone picks up where it left off
+//
+type Checkpoint struct {
+	Input          state.Schema                  `json:"input"`
+	SchemaExported bool                          `json:"schemaexported"`
+	Mode           string                        `json:"mode"`
+	Segments       []state.ExportConfig          `json:"segments"`
+	Exports        []state.ExportResult          `json:"exports"`
+	Manifest       string                        `json:"manifest"`
+	SchemaImported bool                          `json:"schemaimported"`
+	TableImport    state.SchemaImportResult      `json:"tableimport"`
+	Imports        map[string]state.ImportResult `json:"imports"`
+	Synced         state.SyncResult              `json:"synced"`
+	Masked         bool                          `json:"masked"`
+	Verify         []state.VerifyConfig          `json:"verifysegments"`
+	Verified       []state.VerifyResult          `json:"verified"`
+
+	path string
+	mu   sync.Mutex
+}
+
+func loadCheckpoint(path string) (cp *Checkpoint, err error) {
+
+	b, err := ioutil.ReadFile(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err = json.Unmarshal(b, &cp); err != nil {
+		return nil, fmt.Errorf("unable to parse checkpoint %s: %w", path, err)
+	}
+
+	cp.path = path
+
+	if cp.Imports == nil {
+		cp.Imports = map[string]state.ImportResult{}
+	}
+
+	return
+}
+
+// update applies a change to the checkpoint and writes it out
+func (cp *Checkpoint) update(change func(cp *Checkpoint)) error {
+
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+
+	change(cp)
+
+	b, err := json.MarshalIndent(cp, "", "    ")
+
+	if err != nil {
+		return err
+	}
+
+	// write then rename so a crash never leaves a torn checkpoint
+	tmp := cp.path + ".tmp"
+
+	if err = ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, cp.path)
+}
+
+//
+// yieldContext reports a deadline without cancelling at it, the readers and
+// writers hand back their progress at the deadline like they do at the end
+// of a lambda invocation while in flight requests are left to finish
+//
+type yieldContext struct {
+	context.Context
+	deadline time.Time
+}
+
+// minInterval leaves room for the margin the phases stop ahead of a deadline
+const minInterval = 10 * time.Second
+
+func (c yieldContext) Deadline() (time.Time, bool) {
+	return c.deadline, true
+}
+
+// ignoreMissingContext stops xray complaining about the untraced calls
+type ignoreMissingContext struct{}
+
+func (ignoreMissingContext) ContextMissing(v interface{}) {}
+
+// Cloner runs the clone phases in process
+type Cloner struct {
+	cp          *Checkpoint
+	ctx         context.Context
+	concurrency int
+	interval    time.Duration
+}
+
+func (c *Cloner) yield() context.Context {
+	return yieldContext{Context: c.ctx, deadline: time.Now().Add(c.interval)}
+}
+
+func (c *Cloner) schemaExport() (err error) {
+
+	if c.cp.SchemaExported {
+		return
+	}
+
+	reader, err := clone.NewSchemaReader(c.ctx, c.cp.Input)
+
+	if err != nil {
+		return
+	}
+
+	output, err := reader.Run()
+
+	if err != nil {
+		return
+	}
+
+	return c.cp.update(func(cp *Checkpoint) {
+		cp.Input.RunID = output.RunID
+		cp.Input.Stream = output.Stream
+		cp.Mode = output.Mode
+		cp.Segments = output.Segments
+		cp.Exports = make([]state.ExportResult, len(output.Segments))
+		cp.Verify = output.Verify
+		cp.Verified = make([]state.VerifyResult, len(output.Verify))
+		cp.SchemaExported = true
+	})
+}
+
+func (c *Cloner) exportSegment(segment int) (err error) {
+
+	logger := log.Logger(c.ctx)
+
+	for !c.cp.Exports[segment].Complete {
+
+		input := c.cp.Input
+		input.ExportConfig = c.cp.Segments[segment]
+		input.Export = c.cp.Exports[segment]
+
+		reader, readerErr := clone.NewDataReader(c.yield(), input)
+
+		if readerErr != nil {
+			return readerErr
+		}
+
+		output, runErr := reader.Run()
+
+		if runErr != nil {
+			return runErr
+		}
+
+		logger.Info(fmt.Sprintf("segment %d exported %d items", segment, output.Processed), zap.Bool("complete", output.Complete))
+
+		if err = c.cp.update(func(cp *Checkpoint) { cp.Exports[segment] = output }); err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+func (c *Cloner) importFile(file manifest.File) (err error) {
+
+	logger := log.Logger(c.ctx)
+
+	key := file.Key
+
+	for !c.imported(key).Complete {
+
+		input := c.cp.Input
+		input.Import = c.imported(key)
+		input.Import.Records = key
+		input.Import.Format = file.Format
+		input.Import.Items = file.Items
+		input.Import.SHA256 = file.SHA256
+
+		writer, writerErr := clone.NewDataWriter(c.yield(), input)
+
+		if writerErr != nil {
+			return writerErr
+		}
+
+		output, runErr := writer.Run()
+
+		if runErr != nil {
+			return runErr
+		}
+
+		logger.Info(fmt.Sprintf("imported %d items from %s", output.Processed, key), zap.Bool("complete", output.Complete))
+
+		if err = c.cp.update(func(cp *Checkpoint) { cp.Imports[key] = output }); err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+func (c *Cloner) imported(key string) state.ImportResult {
+
+	c.cp.mu.Lock()
+	defer c.cp.mu.Unlock()
+
+	return c.cp.Imports[key]
+}
+
+// parallel runs the tasks with at most concurrency running at once, stopping
+// at the first failure
+func (c *Cloner) parallel(tasks []func() error) error {
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var firstErr error
+
+	failed := func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return firstErr != nil
+	}
+
+	sem := make(chan struct{}, c.concurrency)
+
+	for _, task := range tasks {
+
+		sem <- struct{}{}
+
+		if failed() {
+			<-sem
+			break
+		}
+
+		wg.Add(1)
+
+		go func(task func() error) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+
+			if err := task(); err != nil {
+				mu.Lock()
+				if firstErr == nil {
+					firstErr = err
+				}
+				mu.Unlock()
+			}
+		}(task)
+	}
+
+	wg.Wait()
+
+	return firstErr
+}
+
+func (c *Cloner) dataExport() error {
+
+	var tasks []func() error
+
+	for segment := range c.cp.Segments {
+		segment := segment
+		tasks = append(tasks, func() error { return c.exportSegment(segment) })
+	}
+
+	return c.parallel(tasks)
+}
+
+func (c *Cloner) mergeManifests() (err error) {
+
+	if c.cp.Mode == state.ModeDirect || c.cp.Manifest != "" {
+		return
+	}
+
+	input := c.cp.Input
+
+	for _, export := range c.cp.Exports {
+		input.Export.Manifests = append(input.Export.Manifests, export.Manifest)
+	}
+
+	writer, err := clone.NewManifestWriter(c.ctx, input)
+
+	if err != nil {
+		return
+	}
+
+	output, err := writer.Run()
+
+	if err != nil {
+		return
+	}
+
+	return c.cp.update(func(cp *Checkpoint) { cp.Manifest = output.Manifest })
+}
+
+func (c *Cloner) schemaImport() (err error) {
+
+	// ImportTable creates the table once the data is staged
+	if c.cp.SchemaImported || c.cp.Input.SchemaConfig.ImportTable {
+		return
+	}
+
+	writer, err := clone.NewSchemaWriter(c.ctx, c.cp.Input)
+
+	if err != nil {
+		return
+	}
+
+	if _, err = writer.Run(); err != nil {
+		return
+	}
+
+	return c.cp.update(func(cp *Checkpoint) { cp.SchemaImported = true })
+}
+
+// tableImport creates the new table from the staged files with ImportTable
+func (c *Cloner) tableImport() (err error) {
+
+	logger := log.Logger(c.ctx)
+
+	if !c.cp.Input.SchemaConfig.ImportTable {
+		return
+	}
+
+	for !c.cp.TableImport.Complete {
+
+		input := c.cp.Input
+		input.Export.Manifest = c.cp.Manifest
+		input.SchemaImport = c.cp.TableImport
+
+		writer, writerErr := clone.NewSchemaWriter(c.yield(), input)
+
+		if writerErr != nil {
+			return writerErr
+		}
+
+		output, runErr := writer.Run()
+
+		if runErr != nil {
+			return runErr
+		}
+
+		logger.Info(fmt.Sprintf("imported %d items into %s", output.Imported, c.cp.Input.NewTableName),
+			zap.Int64("errors", output.Errors), zap.Bool("complete", output.Complete))
+
+		if err = c.cp.update(func(cp *Checkpoint) { cp.TableImport = output }); err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+func (c *Cloner) dataImport() (err error) {
+
+	// a direct copy has already written the items, ImportTable has loaded them
+	if c.cp.Mode == state.ModeDirect || c.cp.Input.SchemaConfig.ImportTable {
+		return
+	}
+
+	runManifest, err := clone.ReadManifest(c.ctx, c.cp.Input, c.cp.Manifest)
+
+	if err != nil {
+		return
+	}
+
+	var tasks []func() error
+
+	for _, file := range runManifest.Files {
+		file := file
+		tasks = append(tasks, func() error { return c.importFile(file) })
+	}
+
+	return c.parallel(tasks)
+}
+
+// streamSync applies the source's stream until the new table is close enough behind
+func (c *Cloner) streamSync() (err error) {
+
+	logger := log.Logger(c.ctx)
+
+	if !c.cp.Input.SyncConfig.Enabled {
+		return
+	}
+
+	for !c.cp.Synced.Complete {
+
+		input := c.cp.Input
+		input.Sync = c.cp.Synced
+
+		syncer, syncerErr := clone.NewStreamSyncer(c.yield(), input)
+
+		if syncerErr != nil {
+			return syncerErr
+		}
+
+		output, runErr := syncer.Run()
+
+		if runErr != nil {
+			return runErr
+		}
+
+		logger.Info(fmt.Sprintf("applied %d stream records", output.Records), zap.Int64("lag", output.LagMS), zap.Bool("complete", output.Complete))
+
+		if err = c.cp.update(func(cp *Checkpoint) { cp.Synced = output }); err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+func (c *Cloner) maskingReport() (err error) {
+
+	logger := log.Logger(c.ctx)
+
+	if c.cp.Masked {
+		return
+	}
+
+	reporter, err := clone.NewMaskingReporter(c.ctx, c.cp.Input)
+
+	if err != nil {
+		return
+	}
+
+	output, err := reporter.Run()
+
+	if err != nil {
+		return
+	}
+
+	if output.Report != "" {
+		logger.Info(fmt.Sprintf("masked %d items with profile %s", output.Items, output.Profile), zap.String("report", output.Report))
+	}
+
+	return c.cp.update(func(cp *Checkpoint) { cp.Masked = true })
+}
+
+func (c *Cloner) verifySegment(segment int) (err error) {
+
+	logger := log.Logger(c.ctx)
+
+	for !c.verified(segment).Complete {
+
+		input := c.cp.Input
+		input.VerifyConfig = c.cp.Verify[segment]
+		input.Verify = c.verified(segment)
+
+		verifier, verifierErr := clone.NewVerifier(c.yield(), input)
+
+		if verifierErr != nil {
+			return verifierErr
+		}
+
+		output, runErr := verifier.Run()
+
+		if runErr != nil {
+			return runErr
+		}
+
+		if output.Complete {
+			logger.Info(fmt.Sprintf("segment %d verified %d items", segment, output.SourceItems))
+		}
+
+		if err = c.cp.update(func(cp *Checkpoint) { cp.Verified[segment] = output }); err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+func (c *Cloner) verified(segment int) state.VerifyResult {
+
+	c.cp.mu.Lock()
+	defer c.cp.mu.Unlock()
+
+	return c.cp.Verified[segment]
+}
+
+// dataVerify checks every segment, totting up the divergence rather than
+// stopping at the first segment which differs
+func (c *Cloner) dataVerify() error {
+
+	var mu sync.Mutex
+	var failed []*clonerr.VerificationFailed
+	var tasks []func() error
+
+	for segment := range c.cp.Verify {
+		segment := segment
+		tasks = append(tasks, func() error {
+
+			err := c.verifySegment(segment)
+
+			var diverged *clonerr.VerificationFailed
+
+			if errors.As(err, &diverged) {
+				mu.Lock()
+				failed = append(failed, diverged)
+				mu.Unlock()
+				return nil
+			}
+
+			return err
+		})
+	}
+
+	if err := c.parallel(tasks); err != nil {
+		return err
+	}
+
+	if len(failed) == 0 {
+		return nil
+	}
+
+	total := &clonerr.VerificationFailed{Table: c.cp.Input.NewTableName, Report: c.cp.Input.Key("verify")}
+
+	for _, diverged := range failed {
+		total.Missing += diverged.Missing
+		total.Extra += diverged.Extra
+		total.Differing += diverged.Differing
+	}
+
+	return total
+}
+
+func (c *Cloner) cleanup() (err error) {
+
+	cleaner, err := clone.NewRunCleaner(c.ctx, c.cp.Input)
+
+	if err != nil {
+		return
+	}
+
+	_, err = cleaner.Run()
+
+	return
+}
+
+// Run executes the clone phases in order, skipping those already checkpointed
+func (c *Cloner) Run() (err error) {
+
+	logger := log.Logger(c.ctx)
+
+	phases := []struct {
+		name string
+		run  func() error
+	}{
+		{"schema export", c.schemaExport},
+		{"schema import", c.schemaImport},
+		{"data export", c.dataExport},
+		{"manifest merge", c.mergeManifests},
+		{"table import", c.tableImport},
+		{"data import", c.dataImport},
+		{"stream sync", c.streamSync},
+		{"masking report", c.maskingReport},
+		{"verify", c.dataVerify},
+		{"cleanup", c.cleanup},
+	}
+
+	for _, phase := range phases {
+
+		start := time.Now()
+
+		logger.Info(fmt.Sprintf("starting %s", phase.name), zap.String("runid", c.cp.Input.RunID))
+
+		if err = phase.run(); err != nil {
+			return fmt.Errorf("%s failed: %w", phase.name, err)
+		}
+
+		logger.Info(fmt.Sprintf("completed %s", phase.name), zap.Int64("duration", time.Now().Sub(start).Milliseconds()))
+	}
+
+	return
+}
+
+func main() {
+
+	var input state.Schema
+
+	flag.StringVar(&input.Region, "region", os.Getenv("AWS_REGION"), "AWS region of the tables and bucket")
+	flag.StringVar(&input.SourceRegion, "source-region", "", "region of the source table (default -region)")
+	flag.StringVar(&input.DestRegion, "dest-region", "", "region of the destination table (default -region)")
+	flag.StringVar(&input.SourceRoleArn, "source-role", "", "role assumed to read the source table")
+	flag.StringVar(&input.DestRoleArn, "dest-role", "", "role assumed to create and write the destination table")
+	flag.StringVar(&input.Bucket, "bucket", "", "staging bucket")
+	flag.StringVar(&input.BucketRegion, "bucket-region", "", "region of the staging bucket (default -region)")
+	flag.StringVar(&input.Prefix, "prefix", "", "key prefix in the staging bucket")
+	flag.StringVar(&input.RunID, "run", "", "run id (default a new ULID)")
+	flag.StringVar(&input.OrigTableName, "source", "", "table to clone")
+	flag.StringVar(&input.NewTableName, "dest", "", "table to create")
+	flag.Int64Var(&input.ExportConfig.TotalSegments, "segments", 0, "parallel scan segments (default sized from the table)")
+	flag.Int64Var(&input.ExportConfig.Limit, "limit", 0, "items per scan page")
+	flag.StringVar(&input.ExportConfig.Format, "format", "", "staged data file format, ion is only written by a pointintime export")
+	flag.Int64Var(&input.ExportConfig.PointInTime, "export-time", 0, "unix milliseconds a pointintime export is taken at (default the start of the run)")
+	flag.StringVar(&input.ExportConfig.Compression, "compression", "", "staged data file compression: none, gzip or zstd")
+	flag.StringVar(&input.ExportConfig.Filter.Expression, "filter", "", "filter expression selecting the items to clone")
+	flag.StringVar(&input.ExportConfig.Filter.Projection, "projection", "", "projection expression selecting the attributes to clone")
+	flag.StringVar(&input.ExportConfig.Mode, "mode", state.ModeAuto, "export mode: auto, staged, direct or pointintime")
+	flag.Float64Var(&input.ExportConfig.Capacity.TargetPercent, "read-capacity-percent", 0, "percentage of the source's provisioned (or observed on demand) read capacity the scans may use")
+	flag.Float64Var(&input.ExportConfig.Capacity.Units, "read-capacity-units", 0, "read capacity units a second the scans may use")
+	flag.BoolVar(&input.ExportConfig.ConsistentRead, "consistent-read", false, "scan with strongly consistent reads, at twice the read capacity")
+	flag.Int64Var(&input.ImportConfig.BatchSize, "batch", 0, "items per batch write")
+	flag.Float64Var(&input.ImportConfig.Capacity.TargetPercent, "write-capacity-percent", 0, "percentage of the new table's provisioned write capacity the import may use")
+	flag.Float64Var(&input.ImportConfig.Capacity.Units, "write-capacity-units", 0, "write capacity units a second the import may use")
+	budgetTable := flag.String("budget-table", "", "table (string key id) sharing the read and write capacity budgets with other clones")
+	flag.StringVar(&input.SchemaConfig.KMSKeyArn, "kms-key", "", "KMS key to encrypt the new table with")
+	flag.BoolVar(&input.SchemaConfig.ImportTable, "import-table", false, "create the new table from the staged files with ImportTable")
+	flag.BoolVar(&input.SyncConfig.Enabled, "sync", false, "apply the source's stream to the new table once the data is in")
+	flag.Int64Var(&input.SyncConfig.MaxLagSeconds, "max-lag", 0, "seconds the synced table may trail its source by (default 60)")
+	flag.BoolVar(&input.VerifyConfig.Skip, "skip-verify", false, "skip comparing the new table with its source")
+	flag.StringVar(&input.Retention.Mode, "retention", state.RetentionKeep, "staged object retention: keep, purge or prune")
+	flag.Int64Var(&input.Retention.KeepRuns, "keep-runs", 0, "runs kept when pruning")
+
+	names := flag.String("names", "", "expression attribute names as JSON, e.g. {\"#t\":\"tenant\"}")
+	values := flag.String("values", "", "expression attribute values as DynamoDB JSON, e.g. {\":t\":{\"S\":\"acme\"}}")
+
+	transforms := flag.String("transforms", "", "item transforms as a JSON list, e.g. [{\"op\":\"drop\",\"attribute\":\"email\"}]")
+	maskingProfile := flag.String("masking", "", "masking profile as JSON, e.g. {\"profile\":\"pii\",\"secretarn\":\"arn:...\",\"rules\":[{\"path\":\"email\",\"strategy\":\"email\"}]}")
+
+	checkpoint := flag.String("checkpoint", "ddbclone-checkpoint.json", "checkpoint file")
+	concurrency := flag.Int("concurrency", 10, "segments or files processed at once")
+	interval := flag.Duration("checkpoint-interval", time.Minute, "how often export and import progress is checkpointed, at least 10s")
+
+	flag.Parse()
+
+	if *interval < minInterval {
+		fmt.Fprintf(os.Stderr, "invalid -checkpoint-interval: must be at least %s\n", minInterval)
+		os.Exit(2)
+	}
+
+	for _, expression := range []struct {
+		flag  string
+		value string
+		into  interface{}
+	}{
+		{"names", *names, &input.ExportConfig.Filter.Names},
+		{"values", *values, &input.ExportConfig.Filter.Values},
+		{"transforms", *transforms, &input.ImportConfig.Transforms},
+		{"masking", *maskingProfile, &input.ImportConfig.Masking},
+	} {
+		if expression.value == "" {
+			continue
+		}
+
+		if err := json.Unmarshal([]byte(expression.value), expression.into); err != nil {
+			fmt.Fprintf(os.Stderr, "invalid -%s: %v\n", expression.flag, err)
+			os.Exit(2)
+		}
+	}
+
+	for _, capacity := range []*state.CapacityConfig{&input.ExportConfig.Capacity, &input.ImportConfig.Capacity} {
+		if capacity.Enabled() {
+			capacity.BudgetTable = *budgetTable
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// stop at the next checkpoint on ^C
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt)
+
+	go func() {
+		<-signals
+		cancel()
+	}()
+
+	ctx = log.WithRqID(ctx, "ddbclone")
+
+	logger := log.Logger(ctx)
+
+	xray.SetLogger(&log.XrayLogger{})
+
+	xray.Configure(xray.Config{
+		LogLevel:               "info", // default
+		ServiceVersion:         "1.2.3",
+		ContextMissingStrategy: ignoreMissingContext{},
+	})
+
+	cp, err := loadCheckpoint(*checkpoint)
+
+	switch {
+	case err == nil:
+		logger.Info(fmt.Sprintf("resuming run %s from %s", cp.Input.RunID, *checkpoint))
+
+	case errors.Is(err, os.ErrNotExist):
+
+		if input.Region == "" || input.Bucket == "" || input.OrigTableName == "" || input.NewTableName == "" {
+			fmt.Fprintln(os.Stderr, "region, bucket, source and dest are required")
+			flag.Usage()
+			os.Exit(2)
+		}
+
+		if input.RunID == "" {
+			input.RunID = clone.NewRunID()
+		}
+
+		cp = &Checkpoint{
+			Input:   input,
+			Imports: map[string]state.ImportResult{},
+			path:    *checkpoint,
+		}
+
+	default:
+		logger.Fatal("unable to load checkpoint", zap.Error(err))
+	}
+
+	if *concurrency < 1 {
+		*concurrency = 1
+	}
+
+	cloner := &Cloner{
+		cp:          cp,
+		ctx:         ctx,
+		concurrency: *concurrency,
+		interval:    *interval,
+	}
+
+	if err = cloner.Run(); err != nil {
+		logger.Fatal("clone failed", zap.String("checkpoint", *checkpoint), zap.Error(err))
+	}
+
+	// a finished clone has nothing to resume
+	if err = os.Remove(*checkpoint); err != nil && !errors.Is(err, os.ErrNotExist) {
+		logger.Warn("unable to remove checkpoint", zap.Error(err))
+	}
+
+	logger.Info("clone complete", zap.String("runid", cp.Input.RunID))
+}
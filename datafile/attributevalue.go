@@ -0,0 +1,180 @@
+package datafile
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+//
+// AttributeValues are written in DynamoDB's wire form, an object holding a
+// single type descriptor,
+//
+//     {"id":{"S":"1"},"tags":{"SS":["a","b"]},"blob":{"B":"AAE="}}
+//
+// numbers stay strings and binary is base64, so nothing is lost on the way
+// through a data file.
+//
+
+// encodeItem returns the wire form of an item
+func encodeItem(item map[string]*dynamodb.AttributeValue) (map[string]interface{}, error) {
+
+	wire := make(map[string]interface{}, len(item))
+
+	for name, av := range item {
+
+		value, err := encodeValue(av)
+
+		if err != nil {
+			return nil, fmt.Errorf("attribute %s: %w", name, err)
+		}
+
+		wire[name] = value
+	}
+
+	return wire, nil
+}
+
+func encodeValue(av *dynamodb.AttributeValue) (interface{}, error) {
+
+	switch {
+	case av == nil:
+		return nil, errors.New("attribute value is nil")
+	case av.S != nil:
+		return map[string]interface{}{"S": *av.S}, nil
+	case av.N != nil:
+		return map[string]interface{}{"N": *av.N}, nil
+	case av.B != nil:
+		return map[string]interface{}{"B": av.B}, nil
+	case av.BOOL != nil:
+		return map[string]interface{}{"BOOL": *av.BOOL}, nil
+	case av.NULL != nil:
+		return map[string]interface{}{"NULL": *av.NULL}, nil
+	case av.SS != nil:
+		return map[string]interface{}{"SS": aws.StringValueSlice(av.SS)}, nil
+	case av.NS != nil:
+		return map[string]interface{}{"NS": aws.StringValueSlice(av.NS)}, nil
+	case av.BS != nil:
+		return map[string]interface{}{"BS": av.BS}, nil
+	case av.M != nil:
+
+		m, err := encodeItem(av.M)
+
+		if err != nil {
+			return nil, err
+		}
+
+		return map[string]interface{}{"M": m}, nil
+
+	case av.L != nil:
+
+		l := make([]interface{}, len(av.L))
+
+		for i, member := range av.L {
+
+			value, err := encodeValue(member)
+
+			if err != nil {
+				return nil, fmt.Errorf("list element %d: %w", i, err)
+			}
+
+			l[i] = value
+		}
+
+		return map[string]interface{}{"L": l}, nil
+	}
+
+	return nil, errors.New("attribute value has no type")
+}
+
+// decodeItem reads the wire form of an item
+func decodeItem(wire map[string]json.RawMessage) (map[string]*dynamodb.AttributeValue, error) {
+
+	item := make(map[string]*dynamodb.AttributeValue, len(wire))
+
+	for name, raw := range wire {
+
+		av, err := decodeValue(raw)
+
+		if err != nil {
+			return nil, fmt.Errorf("attribute %s: %w", name, err)
+		}
+
+		item[name] = av
+	}
+
+	return item, nil
+}
+
+func decodeValue(raw json.RawMessage) (*dynamodb.AttributeValue, error) {
+
+	var typed map[string]json.RawMessage
+
+	if err := json.Unmarshal(raw, &typed); err != nil {
+		return nil, err
+	}
+
+	if len(typed) != 1 {
+		return nil, fmt.Errorf("attribute value has %d types, expected one: %.64s", len(typed), raw)
+	}
+
+	av := &dynamodb.AttributeValue{}
+
+	for descriptor, field := range typed {
+
+		var err error
+
+		switch descriptor {
+		case "S":
+			err = json.Unmarshal(field, &av.S)
+		case "N":
+			err = json.Unmarshal(field, &av.N)
+		case "B":
+			err = json.Unmarshal(field, &av.B)
+		case "BOOL":
+			err = json.Unmarshal(field, &av.BOOL)
+		case "NULL":
+			err = json.Unmarshal(field, &av.NULL)
+		case "SS":
+			err = json.Unmarshal(field, &av.SS)
+		case "NS":
+			err = json.Unmarshal(field, &av.NS)
+		case "BS":
+			err = json.Unmarshal(field, &av.BS)
+		case "M":
+
+			var m map[string]json.RawMessage
+
+			if err = json.Unmarshal(field, &m); err == nil {
+				av.M, err = decodeItem(m)
+			}
+
+		case "L":
+
+			var l []json.RawMessage
+
+			if err = json.Unmarshal(field, &l); err == nil {
+
+				av.L = make([]*dynamodb.AttributeValue, len(l))
+
+				for i := range l {
+					if av.L[i], err = decodeValue(l[i]); err != nil {
+						return nil, fmt.Errorf("list element %d: %w", i, err)
+					}
+				}
+			}
+
+		default:
+			return nil, fmt.Errorf("unknown attribute type %q", descriptor)
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("%s value: %w", descriptor, err)
+		}
+	}
+
+	return av, nil
+}
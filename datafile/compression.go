@@ -0,0 +1,144 @@
+package datafile
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression applied to a data file as a whole
+type Compression string
+
+const (
+	// CompressionNone stores the records as plain newline delimited JSON
+	CompressionNone Compression = "none"
+
+	// CompressionGzip stores the records gzipped, with a .gz suffix
+	CompressionGzip Compression = "gzip"
+
+	// CompressionZstd stores the records as a zstd frame, with a .zst suffix
+	CompressionZstd Compression = "zstd"
+)
+
+// DefaultCompression used when none is configured
+const DefaultCompression = CompressionNone
+
+// ParseCompression validates a configured compression name, empty means the
+// default.
+func ParseCompression(name string) (Compression, error) {
+
+	switch Compression(name) {
+	case "":
+		return DefaultCompression, nil
+	case CompressionNone, CompressionGzip, CompressionZstd:
+		return Compression(name), nil
+	}
+
+	return "", fmt.Errorf("unknown data file compression %q", name)
+}
+
+// Extension returns the key suffix marking the compression
+func (c Compression) Extension() string {
+
+	switch c {
+	case CompressionGzip:
+		return ".gz"
+	case CompressionZstd:
+		return ".zst"
+	}
+
+	return ""
+}
+
+// ContentEncoding returns the S3 Content-Encoding of the compression
+func (c Compression) ContentEncoding() string {
+
+	switch c {
+	case CompressionGzip, CompressionZstd:
+		return string(c)
+	}
+
+	return ""
+}
+
+//
+// DetectCompression works out how a staged object was compressed, the key
+// suffix is checked first as it survives a copy of the object which the
+// Content-Encoding may not
+//
+func DetectCompression(key string, contentEncoding string) Compression {
+
+	switch {
+	case strings.HasSuffix(key, CompressionGzip.Extension()):
+		return CompressionGzip
+	case strings.HasSuffix(key, CompressionZstd.Extension()):
+		return CompressionZstd
+	}
+
+	switch strings.ToLower(strings.TrimSpace(contentEncoding)) {
+	case "gzip", "x-gzip":
+		return CompressionGzip
+	case "zstd":
+		return CompressionZstd
+	}
+
+	return CompressionNone
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// NewCompressor returns a writer compressing onto w, it must be closed to
+// flush the compressed stream.
+func NewCompressor(w io.Writer, c Compression) (io.WriteCloser, error) {
+
+	switch c {
+	case CompressionNone:
+		return nopWriteCloser{w}, nil
+	case CompressionGzip:
+		return gzip.NewWriter(w), nil
+	case CompressionZstd:
+		return zstd.NewWriter(w)
+	}
+
+	return nil, fmt.Errorf("unknown data file compression %q", c)
+}
+
+// zstdReadCloser releases the decoder's goroutines on close
+type zstdReadCloser struct {
+	*zstd.Decoder
+}
+
+func (z zstdReadCloser) Close() error {
+	z.Decoder.Close()
+	return nil
+}
+
+// NewDecompressor returns a reader decompressing from r.
+func NewDecompressor(r io.Reader, c Compression) (io.ReadCloser, error) {
+
+	switch c {
+	case CompressionNone:
+		return ioutil.NopCloser(r), nil
+	case CompressionGzip:
+		return gzip.NewReader(r)
+	case CompressionZstd:
+
+		decoder, err := zstd.NewReader(r)
+
+		if err != nil {
+			return nil, err
+		}
+
+		return zstdReadCloser{decoder}, nil
+	}
+
+	return nil, fmt.Errorf("unknown data file compression %q", c)
+}
@@ -0,0 +1,185 @@
+package datafile
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+)
+
+// Format of the newline delimited records in a data file
+type Format string
+
+const (
+	// FormatDynamoDB writes each item as native AttributeValue JSON wrapped
+	// in an "Item" object, the same layout DynamoDB uses for its own exports.
+	// Sets, binary values and numbers survive the round trip untouched.
+	FormatDynamoDB Format = "dynamodb"
+
+	// FormatJSON writes each item as plain JSON. Sets collapse into lists,
+	// binary into base64 strings and numbers go through float64.
+	FormatJSON Format = "json"
+
+	// FormatIon reads the Ion text lines of a DynamoDB ION export, it is only
+	// ever written by DynamoDB itself.
+	FormatIon Format = "ion"
+)
+
+// DefaultFormat used when none is configured
+const DefaultFormat = FormatDynamoDB
+
+// ParseFormat validates a configured format name, empty means the default.
+func ParseFormat(name string) (Format, error) {
+
+	switch Format(name) {
+	case "":
+		return DefaultFormat, nil
+	case FormatDynamoDB, FormatJSON, FormatIon:
+		return Format(name), nil
+	}
+
+	return "", fmt.Errorf("unknown data file format %q", name)
+}
+
+// itemLine mirrors a single line of a DynamoDB JSON export
+type itemLine struct {
+	Item map[string]json.RawMessage `json:"Item"`
+}
+
+// Encoder writes items to a data file
+type Encoder struct {
+	w      io.Writer
+	format Format
+}
+
+// NewEncoder returns an encoder writing records in the given format to w.
+func NewEncoder(w io.Writer, format Format) *Encoder {
+	return &Encoder{w: w, format: format}
+}
+
+// Encode writes a single item as one line.
+func (e *Encoder) Encode(item map[string]*dynamodb.AttributeValue) (err error) {
+
+	var b []byte
+
+	switch e.format {
+
+	case FormatDynamoDB:
+
+		var wire map[string]interface{}
+
+		if wire, err = encodeItem(item); err != nil {
+			return err
+		}
+
+		// strings are written as DynamoDB does, without escaping HTML
+		var buf bytes.Buffer
+
+		encoder := json.NewEncoder(&buf)
+		encoder.SetEscapeHTML(false)
+
+		err = encoder.Encode(map[string]interface{}{"Item": wire})
+		b = bytes.TrimSuffix(buf.Bytes(), []byte("\n"))
+
+	case FormatJSON:
+
+		var record map[string]interface{}
+
+		if err = dynamodbattribute.UnmarshalMap(item, &record); err != nil {
+			return err
+		}
+
+		b, err = json.Marshal(record)
+
+	case FormatIon:
+		return fmt.Errorf("%q data files are only written by a point in time export", e.format)
+
+	default:
+		return fmt.Errorf("unknown data file format %q", e.format)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if _, err = e.w.Write(append(b, '\n')); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Decoder reads items from a data file
+type Decoder struct {
+	r      *bufio.Reader
+	format Format
+	offset int64
+}
+
+// NewDecoder returns a decoder reading records in the given format from r.
+func NewDecoder(r io.Reader, format Format) *Decoder {
+	return &Decoder{r: bufio.NewReader(r), format: format}
+}
+
+// Offset returns the bytes read from r up to the end of the last item decoded,
+// decoding picks up again from there on a reader starting at that offset.
+func (d *Decoder) Offset() int64 {
+	return d.offset
+}
+
+// Decode returns the next item, io.EOF once the file is exhausted.
+func (d *Decoder) Decode() (item map[string]*dynamodb.AttributeValue, err error) {
+
+	var line []byte
+
+	// skip blank lines, items can be far larger than a bufio.Scanner token
+	for len(line) == 0 {
+
+		line, err = d.r.ReadBytes('\n')
+
+		if err != nil && (err != io.EOF || len(line) == 0) {
+			return nil, err
+		}
+
+		d.offset += int64(len(line))
+
+		line = bytes.TrimSpace(line)
+	}
+
+	switch d.format {
+
+	case FormatDynamoDB:
+
+		var record itemLine
+
+		if errJSON := json.Unmarshal(line, &record); errJSON != nil {
+			return nil, errJSON
+		}
+
+		if record.Item == nil {
+			return nil, fmt.Errorf("record has no Item: %.64s", line)
+		}
+
+		return decodeItem(record.Item)
+
+	case FormatJSON:
+
+		var record map[string]interface{}
+
+		if errJSON := json.Unmarshal(line, &record); errJSON != nil {
+			return nil, errJSON
+		}
+
+		return dynamodbattribute.MarshalMap(record)
+
+	case FormatIon:
+
+		return decodeIonItem(line)
+	}
+
+	return nil, fmt.Errorf("unknown data file format %q", d.format)
+}
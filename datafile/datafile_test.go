@@ -0,0 +1,272 @@
+package datafile_test
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/NixM0nk3y/dynamodb-clone/datafile"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+func TestDynamoDBFormat(t *testing.T) {
+
+	tests := []struct {
+		name string
+		item map[string]*dynamodb.AttributeValue
+		line string
+	}{
+		{
+			name: "scalars",
+			item: map[string]*dynamodb.AttributeValue{
+				"id":      {S: aws.String("a \"quoted\", <tagged> value")},
+				"price":   {N: aws.String("12345678901234567890123456789012345678")},
+				"tiny":    {N: aws.String("-1.0000000000000000000000000000000000001E-130")},
+				"blob":    {B: []byte{0, 1, 2, 254, 255}},
+				"deleted": {BOOL: aws.Bool(false)},
+				"owner":   {NULL: aws.Bool(true)},
+			},
+			line: `{"Item":{"blob":{"B":"AAEC/v8="},"deleted":{"BOOL":false},"id":{"S":"a \"quoted\", <tagged> value"},"owner":{"NULL":true},"price":{"N":"12345678901234567890123456789012345678"},"tiny":{"N":"-1.0000000000000000000000000000000000001E-130"}}}`,
+		},
+		{
+			name: "sets",
+			item: map[string]*dynamodb.AttributeValue{
+				"tags":   {SS: aws.StringSlice([]string{"b", "a"})},
+				"scores": {NS: aws.StringSlice([]string{"1", "99999999999999999999999999999999999999", "0.5"})},
+				"keys":   {BS: [][]byte{{1}, {2, 3}}},
+			},
+			line: `{"Item":{"keys":{"BS":["AQ==","AgM="]},"scores":{"NS":["1","99999999999999999999999999999999999999","0.5"]},"tags":{"SS":["b","a"]}}}`,
+		},
+		{
+			name: "documents",
+			item: map[string]*dynamodb.AttributeValue{
+				"address": {M: map[string]*dynamodb.AttributeValue{
+					"lines": {L: []*dynamodb.AttributeValue{{S: aws.String("1 High St")}, {N: aws.String("2")}}},
+					"empty": {M: map[string]*dynamodb.AttributeValue{}},
+				}},
+				"history": {L: []*dynamodb.AttributeValue{}},
+			},
+			line: `{"Item":{"address":{"M":{"empty":{"M":{}},"lines":{"L":[{"S":"1 High St"},{"N":"2"}]}}},"history":{"L":[]}}}`,
+		},
+	}
+
+	for _, test := range tests {
+
+		test := test
+
+		t.Run(test.name, func(t *testing.T) {
+
+			var b bytes.Buffer
+
+			if err := datafile.NewEncoder(&b, datafile.FormatDynamoDB).Encode(test.item); err != nil {
+				t.Fatalf("unable to encode: %v", err)
+			}
+
+			if line := strings.TrimSpace(b.String()); line != test.line {
+				t.Errorf("encoded as\n%s\nexpected\n%s", line, test.line)
+			}
+
+			decoder := datafile.NewDecoder(&b, datafile.FormatDynamoDB)
+
+			item, err := decoder.Decode()
+
+			if err != nil {
+				t.Fatalf("unable to decode: %v", err)
+			}
+
+			if !reflect.DeepEqual(item, test.item) {
+				t.Errorf("decoded as %v, expected %v", item, test.item)
+			}
+
+			if _, err = decoder.Decode(); err != io.EOF {
+				t.Errorf("decoded past the item: %v", err)
+			}
+		})
+	}
+}
+
+func TestDynamoDBFormatInvalid(t *testing.T) {
+
+	tests := []struct {
+		name string
+		line string
+	}{
+		{name: "no item", line: `{"Items":{}}`},
+		{name: "untyped value", line: `{"Item":{"id":{}}}`},
+		{name: "two types", line: `{"Item":{"id":{"S":"a","N":"1"}}}`},
+		{name: "unknown type", line: `{"Item":{"id":{"X":"a"}}}`},
+		{name: "number as json number", line: `{"Item":{"id":{"N":1}}}`},
+		{name: "truncated", line: `{"Item":{"id":{"S":"a"`},
+	}
+
+	for _, test := range tests {
+
+		test := test
+
+		t.Run(test.name, func(t *testing.T) {
+			if item, err := datafile.NewDecoder(strings.NewReader(test.line), datafile.FormatDynamoDB).Decode(); err == nil {
+				t.Errorf("decoded %s as %v", test.line, item)
+			}
+		})
+	}
+}
+
+func TestIonFormat(t *testing.T) {
+
+	large := strings.Repeat("0123456789", 20000)
+
+	tests := []struct {
+		name string
+		line string
+		item map[string]*dynamodb.AttributeValue
+	}{
+		{
+			name: "scalars",
+			line: `$ion_1_0 {Item:{id:"1",flag:true,off:false,gone:null,typed:null.string}}`,
+			item: map[string]*dynamodb.AttributeValue{
+				"id":    {S: aws.String("1")},
+				"flag":  {BOOL: aws.Bool(true)},
+				"off":   {BOOL: aws.Bool(false)},
+				"gone":  {NULL: aws.Bool(true)},
+				"typed": {NULL: aws.Bool(true)},
+			},
+		},
+		{
+			name: "numbers",
+			line: `{Item:{price:12345678901234567890123456789012345678.,tiny:-1.0000000000000000000000000000000000001d-130,scaled:12.5d-1,huge:9.9E+125,int:-42,hex:0x1F,half:0.5}}`,
+			item: map[string]*dynamodb.AttributeValue{
+				"price":  {N: aws.String("12345678901234567890123456789012345678")},
+				"tiny":   {N: aws.String("-1.0000000000000000000000000000000000001E-130")},
+				"scaled": {N: aws.String("12.5E-1")},
+				"huge":   {N: aws.String("9.9E+125")},
+				"int":    {N: aws.String("-42")},
+				"hex":    {N: aws.String("31")},
+				"half":   {N: aws.String("0.5")},
+			},
+		},
+		{
+			name: "sets",
+			line: `{Item:{tags:$dynamodb_SS::["b","a"],scores:$dynamodb_NS::[1.,99999999999999999999999999999999999999.,0.5],keys:$dynamodb_BS::[{{AQ==}},{{AgM=}}]}}`,
+			item: map[string]*dynamodb.AttributeValue{
+				"tags":   {SS: aws.StringSlice([]string{"b", "a"})},
+				"scores": {NS: aws.StringSlice([]string{"1", "99999999999999999999999999999999999999", "0.5"})},
+				"keys":   {BS: [][]byte{{1}, {2, 3}}},
+			},
+		},
+		{
+			name: "blobs",
+			line: `{Item:{blob:{{ AAEC /v8= }},empty:{{}}}}`,
+			item: map[string]*dynamodb.AttributeValue{
+				"blob":  {B: []byte{0, 1, 2, 254, 255}},
+				"empty": {B: []byte{}},
+			},
+		},
+		{
+			name: "escapes",
+			line: `{Item:{s:"tab\tquote\"slash\\\/apostrophe\'nul\0.\x41\u00e9\U0001F600\uD83D\uDE00 é😀"}}`,
+			item: map[string]*dynamodb.AttributeValue{
+				"s": {S: aws.String("tab\tquote\"slash\\/apostrophe'nul\x00.Aé😀😀 é😀")},
+			},
+		},
+		{
+			name: "long strings",
+			line: `{Item:{'quoted field':'''one, ''' /* joined */ '''two''',apostrophe:'''it's'''}}`,
+			item: map[string]*dynamodb.AttributeValue{
+				"quoted field": {S: aws.String("one, two")},
+				"apostrophe":   {S: aws.String("it's")},
+			},
+		},
+		{
+			name: "large string",
+			line: `{Item:{s:"` + large + `"}}`,
+			item: map[string]*dynamodb.AttributeValue{
+				"s": {S: aws.String(large)},
+			},
+		},
+		{
+			name: "documents",
+			line: `{Item:{address:{lines:["1 High St",2.],empty:{}},history:[],nested:[[{"a b":$dynamodb_SS::["c"]}]]}}`,
+			item: map[string]*dynamodb.AttributeValue{
+				"address": {M: map[string]*dynamodb.AttributeValue{
+					"lines": {L: []*dynamodb.AttributeValue{{S: aws.String("1 High St")}, {N: aws.String("2")}}},
+					"empty": {M: map[string]*dynamodb.AttributeValue{}},
+				}},
+				"history": {L: []*dynamodb.AttributeValue{}},
+				"nested": {L: []*dynamodb.AttributeValue{{L: []*dynamodb.AttributeValue{{M: map[string]*dynamodb.AttributeValue{
+					"a b": {SS: aws.StringSlice([]string{"c"})},
+				}}}}}},
+			},
+		},
+	}
+
+	for _, test := range tests {
+
+		test := test
+
+		t.Run(test.name, func(t *testing.T) {
+
+			// the line twice, after a blank line
+			decoder := datafile.NewDecoder(strings.NewReader(test.line+"\n\n"+test.line+"\n"), datafile.FormatIon)
+
+			for i := 0; i < 2; i++ {
+
+				item, err := decoder.Decode()
+
+				if err != nil {
+					t.Fatalf("unable to decode: %v", err)
+				}
+
+				if !reflect.DeepEqual(item, test.item) {
+					t.Errorf("decoded as %v, expected %v", item, test.item)
+				}
+			}
+
+			if _, err := decoder.Decode(); err != io.EOF {
+				t.Errorf("decoded past the items: %v", err)
+			}
+		})
+	}
+}
+
+func TestIonFormatInvalid(t *testing.T) {
+
+	tests := []struct {
+		name string
+		line string
+	}{
+		{name: "no item", line: `{Items:{}}`},
+		{name: "not a struct", line: `{Item:["a"]}`},
+		{name: "unknown escape", line: `{Item:{s:"\q"}}`},
+		{name: "truncated escape", line: `{Item:{s:"\u00`},
+		{name: "invalid escape", line: `{Item:{s:"\uZZZZ"}}`},
+		{name: "code point out of range", line: `{Item:{s:"\U00110000"}}`},
+		{name: "unpaired surrogate", line: `{Item:{s:"\uD83D"}}`},
+		{name: "reversed surrogates", line: `{Item:{s:"\uDE00\uD83D"}}`},
+		{name: "unterminated string", line: `{Item:{s:"abc}}`},
+		{name: "unterminated long string", line: `{Item:{s:'''abc}}`},
+		{name: "mixed set", line: `{Item:{tags:$dynamodb_SS::["a",1.]}}`},
+		{name: "invalid blob", line: `{Item:{b:{{!!}}}}`},
+		{name: "unterminated blob", line: `{Item:{b:{{AQ==}}`},
+		{name: "invalid number", line: `{Item:{n:1.2.3}}`},
+		{name: "infinity", line: `{Item:{n:+inf}}`},
+		{name: "symbol value", line: `{Item:{n:nan}}`},
+		{name: "missing colon", line: `{Item:{id "1"}}`},
+		{name: "missing comma", line: `{Item:{id:"1" n:2}}`},
+		{name: "unclosed struct", line: `{Item:{id:"1"`},
+		{name: "trailing data", line: `{Item:{}} {}`},
+	}
+
+	for _, test := range tests {
+
+		test := test
+
+		t.Run(test.name, func(t *testing.T) {
+			if item, err := datafile.NewDecoder(strings.NewReader(test.line), datafile.FormatIon).Decode(); err == nil {
+				t.Errorf("decoded %s as %v", test.line, item)
+			}
+		})
+	}
+}
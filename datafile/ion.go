@@ -0,0 +1,608 @@
+package datafile
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+//
+// DynamoDB's ION exports write each item as a line of Ion text,
+//
+//     $ion_1_0 {Item:{id:"1",tags:$dynamodb_SS::["a","b"],size:12.}}
+//
+// ionParser reads the subset of Ion text they use: structs, lists, strings,
+// decimals, blobs, booleans and nulls, with sets as annotated lists.
+//
+
+// set annotations written by DynamoDB
+const (
+	ionStringSet = "$dynamodb_SS"
+	ionNumberSet = "$dynamodb_NS"
+	ionBinarySet = "$dynamodb_BS"
+)
+
+// ionVersionMarker may precede any top level value
+const ionVersionMarker = "$ion_1_0"
+
+type ionParser struct {
+	s   []byte
+	pos int
+}
+
+// decodeIonItem decodes a single line of a DynamoDB ION export
+func decodeIonItem(line []byte) (map[string]*dynamodb.AttributeValue, error) {
+
+	p := &ionParser{s: line}
+
+	// skip the version marker, a symbol which isn't an annotation
+	for {
+		p.skipSpace()
+
+		start := p.pos
+
+		if symbol, ok := p.identifier(); ok && symbol == ionVersionMarker && !p.annotationFollows() {
+			continue
+		}
+
+		p.pos = start
+		break
+	}
+
+	value, err := p.value()
+
+	if err != nil {
+		return nil, err
+	}
+
+	if value.M == nil || value.M["Item"] == nil || value.M["Item"].M == nil {
+		return nil, fmt.Errorf("record has no Item: %.64s", line)
+	}
+
+	p.skipSpace()
+
+	if p.pos < len(p.s) {
+		return nil, p.errorf("unexpected data after the item")
+	}
+
+	return value.M["Item"].M, nil
+}
+
+func (p *ionParser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("ion offset %d: %s", p.pos, fmt.Sprintf(format, args...))
+}
+
+func (p *ionParser) peek(prefix string) bool {
+	return strings.HasPrefix(string(p.s[p.pos:]), prefix)
+}
+
+// skipSpace steps over whitespace and comments
+func (p *ionParser) skipSpace() {
+
+	for p.pos < len(p.s) {
+
+		switch {
+		case p.s[p.pos] == ' ' || p.s[p.pos] == '\t' || p.s[p.pos] == '\n' || p.s[p.pos] == '\r':
+			p.pos++
+
+		case p.peek("//"):
+			for p.pos < len(p.s) && p.s[p.pos] != '\n' {
+				p.pos++
+			}
+
+		case p.peek("/*"):
+			end := strings.Index(string(p.s[p.pos+2:]), "*/")
+
+			if end < 0 {
+				p.pos = len(p.s)
+				return
+			}
+
+			p.pos += end + 4
+
+		default:
+			return
+		}
+	}
+}
+
+func isIdentifierByte(c byte) bool {
+	return c == '_' || c == '$' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+}
+
+// identifier reads an unquoted symbol
+func (p *ionParser) identifier() (string, bool) {
+
+	start := p.pos
+
+	if start >= len(p.s) || (p.s[start] >= '0' && p.s[start] <= '9') {
+		return "", false
+	}
+
+	for p.pos < len(p.s) && isIdentifierByte(p.s[p.pos]) {
+		p.pos++
+	}
+
+	return string(p.s[start:p.pos]), p.pos > start
+}
+
+// annotationFollows consumes the :: separating an annotation from its value
+func (p *ionParser) annotationFollows() bool {
+
+	start := p.pos
+
+	p.skipSpace()
+
+	if p.peek("::") {
+		p.pos += 2
+		return true
+	}
+
+	p.pos = start
+
+	return false
+}
+
+// symbol reads a field name or annotation, quoted or not
+func (p *ionParser) symbol() (string, error) {
+
+	if p.peek("'''") || (p.pos < len(p.s) && p.s[p.pos] == '"') {
+		return p.text()
+	}
+
+	if p.pos < len(p.s) && p.s[p.pos] == '\'' {
+		return p.quoted('\'')
+	}
+
+	if symbol, ok := p.identifier(); ok {
+		return symbol, nil
+	}
+
+	return "", p.errorf("expected a symbol")
+}
+
+func (p *ionParser) value() (*dynamodb.AttributeValue, error) {
+
+	var annotations []string
+
+	for {
+		p.skipSpace()
+
+		start := p.pos
+
+		if p.pos < len(p.s) && (p.s[p.pos] == '\'' && !p.peek("'''") || isIdentifierByte(p.s[p.pos]) && !(p.s[p.pos] >= '0' && p.s[p.pos] <= '9')) {
+
+			symbol, err := p.symbol()
+
+			if err != nil {
+				return nil, err
+			}
+
+			if p.annotationFollows() {
+				annotations = append(annotations, symbol)
+				continue
+			}
+		}
+
+		p.pos = start
+		break
+	}
+
+	if p.pos >= len(p.s) {
+		return nil, p.errorf("unexpected end of record")
+	}
+
+	switch c := p.s[p.pos]; {
+
+	case p.peek("{{"):
+		return p.blob()
+
+	case c == '{':
+		return p.structure()
+
+	case c == '[':
+		return p.list(annotations)
+
+	case c == '"' || p.peek("'''"):
+
+		text, err := p.text()
+
+		if err != nil {
+			return nil, err
+		}
+
+		return &dynamodb.AttributeValue{S: aws.String(text)}, nil
+
+	case c == '-' || c == '+' || (c >= '0' && c <= '9'):
+		return p.number()
+	}
+
+	symbol, err := p.symbol()
+
+	if err != nil {
+		return nil, err
+	}
+
+	switch symbol {
+	case "true", "false":
+		return &dynamodb.AttributeValue{BOOL: aws.Bool(symbol == "true")}, nil
+	case "null":
+
+		// a typed null, null.string and the like
+		if p.peek(".") {
+			p.pos++
+			p.identifier()
+		}
+
+		return &dynamodb.AttributeValue{NULL: aws.Bool(true)}, nil
+	}
+
+	return nil, p.errorf("unsupported value %q", symbol)
+}
+
+func (p *ionParser) structure() (*dynamodb.AttributeValue, error) {
+
+	m := map[string]*dynamodb.AttributeValue{}
+
+	// opening brace
+	p.pos++
+
+	for {
+		p.skipSpace()
+
+		if p.pos < len(p.s) && p.s[p.pos] == '}' {
+			p.pos++
+			return &dynamodb.AttributeValue{M: m}, nil
+		}
+
+		name, err := p.symbol()
+
+		if err != nil {
+			return nil, err
+		}
+
+		p.skipSpace()
+
+		if p.pos >= len(p.s) || p.s[p.pos] != ':' {
+			return nil, p.errorf("expected : after field %q", name)
+		}
+
+		p.pos++
+
+		if m[name], err = p.value(); err != nil {
+			return nil, err
+		}
+
+		if err = p.separator('}'); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// separator steps over the comma between elements, leaving the closing byte
+func (p *ionParser) separator(closing byte) error {
+
+	p.skipSpace()
+
+	if p.pos >= len(p.s) {
+		return p.errorf("unexpected end of record")
+	}
+
+	switch p.s[p.pos] {
+	case ',':
+		p.pos++
+		return nil
+	case closing:
+		return nil
+	}
+
+	return p.errorf("expected , or %c", closing)
+}
+
+func (p *ionParser) list(annotations []string) (*dynamodb.AttributeValue, error) {
+
+	var values []*dynamodb.AttributeValue
+
+	// opening bracket
+	p.pos++
+
+	for {
+		p.skipSpace()
+
+		if p.pos < len(p.s) && p.s[p.pos] == ']' {
+			p.pos++
+			break
+		}
+
+		value, err := p.value()
+
+		if err != nil {
+			return nil, err
+		}
+
+		values = append(values, value)
+
+		if err = p.separator(']'); err != nil {
+			return nil, err
+		}
+	}
+
+	set := ""
+
+	for _, annotation := range annotations {
+		switch annotation {
+		case ionStringSet, ionNumberSet, ionBinarySet:
+			set = annotation
+		}
+	}
+
+	av := &dynamodb.AttributeValue{}
+
+	for _, value := range values {
+
+		switch {
+		case set == ionStringSet && value.S != nil:
+			av.SS = append(av.SS, value.S)
+		case set == ionNumberSet && value.N != nil:
+			av.NS = append(av.NS, value.N)
+		case set == ionBinarySet && value.B != nil:
+			av.BS = append(av.BS, value.B)
+		case set != "":
+			return nil, p.errorf("unexpected member of %s set", set)
+		}
+	}
+
+	if set == "" {
+		av.L = values
+
+		if av.L == nil {
+			av.L = []*dynamodb.AttributeValue{}
+		}
+	}
+
+	return av, nil
+}
+
+func (p *ionParser) blob() (*dynamodb.AttributeValue, error) {
+
+	end := strings.Index(string(p.s[p.pos+2:]), "}}")
+
+	if end < 0 {
+		return nil, p.errorf("unterminated blob")
+	}
+
+	encoded := strings.Join(strings.Fields(string(p.s[p.pos+2:p.pos+2+end])), "")
+
+	b, err := base64.StdEncoding.DecodeString(encoded)
+
+	if err != nil {
+		return nil, p.errorf("invalid blob: %v", err)
+	}
+
+	p.pos += end + 4
+
+	return &dynamodb.AttributeValue{B: b}, nil
+}
+
+//
+// number converts an Ion decimal or int to a DynamoDB number, 12.5d-1 is
+// written 12.5E-1 as DynamoDB prints it and the trailing point of 103. dropped
+//
+func (p *ionParser) number() (*dynamodb.AttributeValue, error) {
+
+	start := p.pos
+
+	for p.pos < len(p.s) && (isIdentifierByte(p.s[p.pos]) || p.s[p.pos] == '.' || p.s[p.pos] == '-' || p.s[p.pos] == '+') {
+		p.pos++
+	}
+
+	raw := strings.ToLower(strings.Replace(string(p.s[start:p.pos]), "_", "", -1))
+
+	switch raw {
+	case "nan", "+inf", "-inf":
+		return nil, p.errorf("unsupported number %s", raw)
+	}
+
+	// hex and binary ints
+	for _, prefix := range []string{"0x", "-0x", "0b", "-0b"} {
+
+		if !strings.HasPrefix(raw, prefix) {
+			continue
+		}
+
+		n, err := strconv.ParseInt(raw, 0, 64)
+
+		if err != nil {
+			return nil, p.errorf("invalid number %s", raw)
+		}
+
+		return &dynamodb.AttributeValue{N: aws.String(strconv.FormatInt(n, 10))}, nil
+	}
+
+	mantissa, exponent := raw, ""
+
+	if i := strings.IndexAny(raw, "de"); i >= 0 {
+		mantissa, exponent = raw[:i], raw[i+1:]
+	}
+
+	mantissa = strings.TrimSuffix(strings.TrimPrefix(mantissa, "+"), ".")
+
+	if _, err := strconv.ParseFloat(mantissa, 64); err != nil || strings.Contains(mantissa, "e") {
+		return nil, p.errorf("invalid number %s", raw)
+	}
+
+	if exponent != "" {
+
+		if _, err := strconv.Atoi(exponent); err != nil {
+			return nil, p.errorf("invalid number %s", raw)
+		}
+
+		mantissa += "E" + exponent
+	}
+
+	return &dynamodb.AttributeValue{N: aws.String(mantissa)}, nil
+}
+
+// text reads a string, adjacent long strings are joined
+func (p *ionParser) text() (string, error) {
+
+	if !p.peek("'''") {
+		return p.quoted('"')
+	}
+
+	var b strings.Builder
+
+	for p.peek("'''") {
+
+		p.pos += 2
+
+		part, err := p.quoted('\'', "'''")
+
+		if err != nil {
+			return "", err
+		}
+
+		b.WriteString(part)
+
+		start := p.pos
+
+		p.skipSpace()
+
+		if !p.peek("'''") {
+			p.pos = start
+		}
+	}
+
+	return b.String(), nil
+}
+
+// quoted reads an escaped string up to its closing quote
+func (p *ionParser) quoted(quote byte, closing ...string) (string, error) {
+
+	var b strings.Builder
+
+	// opening quote
+	p.pos++
+
+	for p.pos < len(p.s) {
+
+		if len(closing) > 0 && p.peek(closing[0]) {
+			p.pos += len(closing[0])
+			return b.String(), nil
+		}
+
+		c := p.s[p.pos]
+
+		if len(closing) == 0 && c == quote {
+			p.pos++
+			return b.String(), nil
+		}
+
+		if c != '\\' {
+			b.WriteByte(c)
+			p.pos++
+			continue
+		}
+
+		p.pos++
+
+		if p.pos >= len(p.s) {
+			break
+		}
+
+		escape := p.s[p.pos]
+		p.pos++
+
+		switch escape {
+		case 'n':
+			b.WriteByte('\n')
+		case 't':
+			b.WriteByte('\t')
+		case 'r':
+			b.WriteByte('\r')
+		case '0':
+			b.WriteByte(0)
+		case 'a':
+			b.WriteByte('\a')
+		case 'b':
+			b.WriteByte('\b')
+		case 'f':
+			b.WriteByte('\f')
+		case 'v':
+			b.WriteByte('\v')
+		case '\'', '"', '/', '?', '\\':
+			b.WriteByte(escape)
+		case '\n':
+			// escaped line break
+		case '\r':
+			// escaped line break, possibly CR LF
+			if p.pos < len(p.s) && p.s[p.pos] == '\n' {
+				p.pos++
+			}
+		case 'x', 'u', 'U':
+
+			r, err := p.hexEscape(escape)
+
+			if err != nil {
+				return "", err
+			}
+
+			// characters outside the BMP may be escaped as a UTF-16 surrogate pair
+			if utf16.IsSurrogate(r) {
+
+				if !p.peek("\\u") {
+					return "", p.errorf("unpaired surrogate \\u%04X", r)
+				}
+
+				p.pos += 2
+
+				low, err := p.hexEscape('u')
+
+				if err != nil {
+					return "", err
+				}
+
+				if r = utf16.DecodeRune(r, low); r == utf8.RuneError {
+					return "", p.errorf("invalid surrogate pair \\u%04X", low)
+				}
+			} else if !utf8.ValidRune(r) {
+				return "", p.errorf("invalid escape \\%c%s", escape, p.s[p.pos-hexDigits[escape]:p.pos])
+			}
+
+			b.WriteRune(r)
+		default:
+			return "", p.errorf("unknown escape \\%c", escape)
+		}
+	}
+
+	return "", p.errorf("unterminated string")
+}
+
+// hexDigits is the length of each hex escape
+var hexDigits = map[byte]int{'x': 2, 'u': 4, 'U': 8}
+
+// hexEscape reads the digits of a hex escape, leaving surrogates to the caller
+func (p *ionParser) hexEscape(escape byte) (rune, error) {
+
+	digits := hexDigits[escape]
+
+	if p.pos+digits > len(p.s) {
+		return 0, p.errorf("truncated escape")
+	}
+
+	r, err := strconv.ParseUint(string(p.s[p.pos:p.pos+digits]), 16, 32)
+
+	if err != nil {
+		return 0, p.errorf("invalid escape \\%c%s", escape, p.s[p.pos:p.pos+digits])
+	}
+
+	p.pos += digits
+
+	return rune(r), nil
+}
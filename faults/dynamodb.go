@@ -0,0 +1,131 @@
+package faults
+
+import (
+	"fmt"
+
+	"github.com/NixM0nk3y/dynamodb-clone/log"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"go.uber.org/zap"
+)
+
+// dynamoDB injects faults into the item calls of a DynamoDB client
+type dynamoDB struct {
+	dynamodbiface.DynamoDBAPI
+
+	faults *Injector
+}
+
+// DynamoDB wraps a DynamoDB client, it is returned as is when no fault is configured
+func (i *Injector) DynamoDB(svc dynamodbiface.DynamoDBAPI) dynamodbiface.DynamoDBAPI {
+
+	if !i.config.Enabled() {
+		return svc
+	}
+
+	return &dynamoDB{DynamoDBAPI: svc, faults: i}
+}
+
+func (d *dynamoDB) before(ctx aws.Context, operation string) error {
+	return d.faults.before(ctx, "dynamodb", operation,
+		awserr.NewRequestFailure(awserr.New(dynamodb.ErrCodeProvisionedThroughputExceededException,
+			fmt.Sprintf("injected throughput exceeded on %s", operation), nil), 400, requestID),
+		awserr.NewRequestFailure(awserr.New(dynamodb.ErrCodeInternalServerError,
+			fmt.Sprintf("injected server error on %s", operation), nil), 500, requestID))
+}
+
+func (d *dynamoDB) ScanWithContext(ctx aws.Context, input *dynamodb.ScanInput, opts ...request.Option) (*dynamodb.ScanOutput, error) {
+
+	if err := d.before(ctx, "Scan"); err != nil {
+		return nil, err
+	}
+
+	return d.DynamoDBAPI.ScanWithContext(ctx, input, opts...)
+}
+
+func (d *dynamoDB) BatchGetItemWithContext(ctx aws.Context, input *dynamodb.BatchGetItemInput, opts ...request.Option) (*dynamodb.BatchGetItemOutput, error) {
+
+	if err := d.before(ctx, "BatchGetItem"); err != nil {
+		return nil, err
+	}
+
+	return d.DynamoDBAPI.BatchGetItemWithContext(ctx, input, opts...)
+}
+
+func (d *dynamoDB) PutItemWithContext(ctx aws.Context, input *dynamodb.PutItemInput, opts ...request.Option) (*dynamodb.PutItemOutput, error) {
+
+	if err := d.before(ctx, "PutItem"); err != nil {
+		return nil, err
+	}
+
+	return d.DynamoDBAPI.PutItemWithContext(ctx, input, opts...)
+}
+
+func (d *dynamoDB) DeleteItemWithContext(ctx aws.Context, input *dynamodb.DeleteItemInput, opts ...request.Option) (*dynamodb.DeleteItemOutput, error) {
+
+	if err := d.before(ctx, "DeleteItem"); err != nil {
+		return nil, err
+	}
+
+	return d.DynamoDBAPI.DeleteItemWithContext(ctx, input, opts...)
+}
+
+//
+// A short batch write holds back the second half of each table's requests,
+// writing the rest and handing the held back requests over as
+// UnprocessedItems as DynamoDB does when a partition runs out of capacity
+//
+func (d *dynamoDB) BatchWriteItemWithContext(ctx aws.Context, input *dynamodb.BatchWriteItemInput, opts ...request.Option) (*dynamodb.BatchWriteItemOutput, error) {
+
+	if err := d.before(ctx, "BatchWriteItem"); err != nil {
+		return nil, err
+	}
+
+	requests := 0
+
+	for _, tableRequests := range input.RequestItems {
+		requests += len(tableRequests)
+	}
+
+	if requests < 2 || !d.faults.roll(Unprocessed, d.faults.config.UnprocessedProbability) {
+		return d.DynamoDBAPI.BatchWriteItemWithContext(ctx, input, opts...)
+	}
+
+	written := map[string][]*dynamodb.WriteRequest{}
+	held := map[string][]*dynamodb.WriteRequest{}
+
+	for table, tableRequests := range input.RequestItems {
+
+		half := (len(tableRequests) + 1) / 2
+
+		written[table] = tableRequests[:half]
+
+		if half < len(tableRequests) {
+			held[table] = tableRequests[half:]
+		}
+	}
+
+	log.Logger(ctx).Warn("injecting dynamodb unprocessed items", zap.Int("requests", requests))
+
+	shortInput := *input
+	shortInput.RequestItems = written
+
+	output, err := d.DynamoDBAPI.BatchWriteItemWithContext(ctx, &shortInput, opts...)
+
+	if err != nil {
+		return output, err
+	}
+
+	if output.UnprocessedItems == nil {
+		output.UnprocessedItems = map[string][]*dynamodb.WriteRequest{}
+	}
+
+	for table, tableRequests := range held {
+		output.UnprocessedItems[table] = append(output.UnprocessedItems[table], tableRequests...)
+	}
+
+	return output, nil
+}
@@ -0,0 +1,216 @@
+package faults
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/NixM0nk3y/dynamodb-clone/log"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"go.uber.org/zap"
+)
+
+//
+// Faults are injected into the data plane calls a clone makes, the scans,
+// item reads and writes and the staged objects, to prove an invocation
+// failing or cut short part way through resumes into an exact clone. The
+// control plane calls creating and describing tables are passed through
+// untouched.
+//
+
+// Fault is a kind of injected failure
+type Fault string
+
+// the faults injected
+const (
+	Throttle    Fault = "throttle"    // DynamoDB throughput exceeded or S3 SlowDown
+	Unprocessed Fault = "unprocessed" // half a batch write handed back unprocessed
+	ServerError Fault = "servererror" // a 5xx the SDK's retries didn't get past
+)
+
+// requestID marks the injected errors in the logs
+const requestID = "injected-fault"
+
+// Config of the faults injected, each probability is of a single call failing
+type Config struct {
+	Seed int64 // zero seeds from the clock
+
+	ThrottleProbability    float64
+	UnprocessedProbability float64
+	ErrorProbability       float64
+
+	Latency  time.Duration // added to every call
+	Deadline time.Duration // artificial deadline of a function invocation
+}
+
+// FromEnv builds the configuration from the environment:
+//
+//	FAULT_SEED                       seed of the fault sequence
+//	FAULT_THROTTLE_PROBABILITY       calls throttled
+//	FAULT_UNPROCESSED_PROBABILITY    batch writes coming back short
+//	FAULT_ERROR_PROBABILITY          calls failing with a 5xx
+//	FAULT_LATENCY                    delay added to each call, a Go duration
+//	FAULT_DEADLINE                   deadline of each invocation, a Go duration
+func FromEnv() Config {
+
+	config := Config{}
+
+	if seed, err := strconv.ParseInt(os.Getenv("FAULT_SEED"), 10, 64); err == nil {
+		config.Seed = seed
+	}
+
+	for _, probability := range []struct {
+		name  string
+		value *float64
+	}{
+		{"FAULT_THROTTLE_PROBABILITY", &config.ThrottleProbability},
+		{"FAULT_UNPROCESSED_PROBABILITY", &config.UnprocessedProbability},
+		{"FAULT_ERROR_PROBABILITY", &config.ErrorProbability},
+	} {
+		if value, err := strconv.ParseFloat(os.Getenv(probability.name), 64); err == nil {
+			*probability.value = value
+		}
+	}
+
+	if latency, err := time.ParseDuration(os.Getenv("FAULT_LATENCY")); err == nil {
+		config.Latency = latency
+	}
+
+	if deadline, err := time.ParseDuration(os.Getenv("FAULT_DEADLINE")); err == nil {
+		config.Deadline = deadline
+	}
+
+	return config
+}
+
+// Enabled reports if any call would be touched
+func (c Config) Enabled() bool {
+	return c.ThrottleProbability > 0 || c.UnprocessedProbability > 0 || c.ErrorProbability > 0 || c.Latency > 0
+}
+
+//
+// Injector decides which calls fail, it is shared by the clients it wraps.
+// Each fault draws from its own sequence so calls racing each other don't
+// change how often a fault is hit.
+//
+type Injector struct {
+	config Config
+
+	mu       sync.Mutex
+	rands    map[Fault]*rand.Rand
+	injected map[Fault]int
+}
+
+// New returns an injector for the configuration
+func New(config Config) *Injector {
+
+	seed := config.Seed
+
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+
+	rands := map[Fault]*rand.Rand{}
+
+	for i, fault := range []Fault{Throttle, Unprocessed, ServerError} {
+		rands[fault] = rand.New(rand.NewSource(seed*3 + int64(i)))
+	}
+
+	return &Injector{
+		config:   config,
+		rands:    rands,
+		injected: map[Fault]int{},
+	}
+}
+
+// Injected returns the number of times a fault has been injected
+func (i *Injector) Injected(fault Fault) int {
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	return i.injected[fault]
+}
+
+// roll reports if a fault of the given probability hits this call, tallying it
+func (i *Injector) roll(fault Fault, probability float64) bool {
+
+	if probability <= 0 {
+		return false
+	}
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if i.rands[fault].Float64() >= probability {
+		return false
+	}
+
+	i.injected[fault]++
+
+	return true
+}
+
+//
+// before delays a call and then decides if it fails with the service's
+// throttle or server error, a failed call never reaches the service
+//
+func (i *Injector) before(ctx aws.Context, service string, operation string, throttle awserr.RequestFailure, serverError awserr.RequestFailure) error {
+
+	logger := log.Logger(ctx)
+
+	if i.config.Latency > 0 {
+		if err := aws.SleepWithContext(ctx, i.config.Latency); err != nil {
+			return err
+		}
+	}
+
+	if i.roll(Throttle, i.config.ThrottleProbability) {
+		logger.Warn(fmt.Sprintf("injecting %s throttle", service), zap.String("operation", operation))
+		return throttle
+	}
+
+	if i.roll(ServerError, i.config.ErrorProbability) {
+		logger.Warn(fmt.Sprintf("injecting %s server error", service), zap.String("operation", operation))
+		return serverError
+	}
+
+	return nil
+}
+
+// deadlineContext reports a deadline without cancelling at it, like the
+// readers and writers see at the end of a lambda invocation
+type deadlineContext struct {
+	context.Context
+	deadline time.Time
+}
+
+func (c deadlineContext) Deadline() (time.Time, bool) {
+	return c.deadline, true
+}
+
+//
+// WithDeadline brings the deadline of ctx forward to d from now, a zero d
+// leaves it alone. The functions hand back their progress a few seconds
+// before their deadline, so a deadline a little over 3s cuts an invocation
+// down to a few hundred milliseconds.
+//
+func WithDeadline(ctx context.Context, d time.Duration) context.Context {
+
+	if d <= 0 {
+		return ctx
+	}
+
+	deadline := time.Now().Add(d)
+
+	if current, ok := ctx.Deadline(); ok && current.Before(deadline) {
+		return ctx
+	}
+
+	return deadlineContext{Context: ctx, deadline: deadline}
+}
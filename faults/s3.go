@@ -0,0 +1,109 @@
+package faults
+
+import (
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// s3Client injects faults into the object calls of an S3 client
+type s3Client struct {
+	s3iface.S3API
+
+	faults *Injector
+}
+
+// S3 wraps an S3 client, it is returned as is when no fault is configured
+func (i *Injector) S3(svc s3iface.S3API) s3iface.S3API {
+
+	if !i.config.Enabled() {
+		return svc
+	}
+
+	return &s3Client{S3API: svc, faults: i}
+}
+
+func (c *s3Client) before(ctx aws.Context, operation string) error {
+	return c.faults.before(ctx, "s3", operation,
+		awserr.NewRequestFailure(awserr.New("SlowDown",
+			fmt.Sprintf("injected slow down on %s", operation), nil), 503, requestID),
+		awserr.NewRequestFailure(awserr.New("InternalError",
+			fmt.Sprintf("injected server error on %s", operation), nil), 500, requestID))
+}
+
+// inject fails a request built by an XxxRequest method before it's sent,
+// a build error isn't retried by the SDK
+func (c *s3Client) inject(req *request.Request, operation string) {
+	req.Handlers.Build.PushFront(func(r *request.Request) {
+		if err := c.before(r.Context(), operation); err != nil {
+			r.Error = err
+		}
+	})
+}
+
+func (c *s3Client) GetObjectWithContext(ctx aws.Context, input *s3.GetObjectInput, opts ...request.Option) (*s3.GetObjectOutput, error) {
+
+	if err := c.before(ctx, "GetObject"); err != nil {
+		return nil, err
+	}
+
+	return c.S3API.GetObjectWithContext(ctx, input, opts...)
+}
+
+func (c *s3Client) PutObjectWithContext(ctx aws.Context, input *s3.PutObjectInput, opts ...request.Option) (*s3.PutObjectOutput, error) {
+
+	if err := c.before(ctx, "PutObject"); err != nil {
+		return nil, err
+	}
+
+	return c.S3API.PutObjectWithContext(ctx, input, opts...)
+}
+
+// PutObjectRequest is how s3manager uploads a single part object
+func (c *s3Client) PutObjectRequest(input *s3.PutObjectInput) (*request.Request, *s3.PutObjectOutput) {
+
+	req, output := c.S3API.PutObjectRequest(input)
+	c.inject(req, "PutObject")
+
+	return req, output
+}
+
+func (c *s3Client) CopyObjectWithContext(ctx aws.Context, input *s3.CopyObjectInput, opts ...request.Option) (*s3.CopyObjectOutput, error) {
+
+	if err := c.before(ctx, "CopyObject"); err != nil {
+		return nil, err
+	}
+
+	return c.S3API.CopyObjectWithContext(ctx, input, opts...)
+}
+
+func (c *s3Client) CreateMultipartUploadWithContext(ctx aws.Context, input *s3.CreateMultipartUploadInput, opts ...request.Option) (*s3.CreateMultipartUploadOutput, error) {
+
+	if err := c.before(ctx, "CreateMultipartUpload"); err != nil {
+		return nil, err
+	}
+
+	return c.S3API.CreateMultipartUploadWithContext(ctx, input, opts...)
+}
+
+func (c *s3Client) UploadPartWithContext(ctx aws.Context, input *s3.UploadPartInput, opts ...request.Option) (*s3.UploadPartOutput, error) {
+
+	if err := c.before(ctx, "UploadPart"); err != nil {
+		return nil, err
+	}
+
+	return c.S3API.UploadPartWithContext(ctx, input, opts...)
+}
+
+func (c *s3Client) CompleteMultipartUploadWithContext(ctx aws.Context, input *s3.CompleteMultipartUploadInput, opts ...request.Option) (*s3.CompleteMultipartUploadOutput, error) {
+
+	if err := c.before(ctx, "CompleteMultipartUpload"); err != nil {
+		return nil, err
+	}
+
+	return c.S3API.CompleteMultipartUploadWithContext(ctx, input, opts...)
+}
@@ -4,9 +4,13 @@ go 1.14
 
 require (
 	github.com/aws/aws-lambda-go v1.17.0
-	github.com/aws/aws-sdk-go v1.31.3
+	github.com/aws/aws-sdk-go v1.55.8
 	github.com/aws/aws-xray-sdk-go v1.0.1
 	github.com/cenkalti/backoff v2.2.1+incompatible
+	github.com/klauspost/compress v1.11.13
 	github.com/oklog/ulid v1.3.1
+	github.com/pkg/errors v0.9.1 // indirect
+	github.com/stretchr/testify v1.5.1 // indirect
 	go.uber.org/zap v1.15.0
+	golang.org/x/net v0.0.0-20200202094626-16171245cfb2 // indirect
 )
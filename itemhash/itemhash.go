@@ -0,0 +1,158 @@
+package itemhash
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+//
+// Items are hashed in a canonical form so two tables holding the same data
+// produce the same sums, map keys and the members of sets are sorted and
+// every value is length prefixed so no two shapes encode alike
+//
+
+// Sum is the SHA-256 of an item's canonical form
+type Sum [sha256.Size]byte
+
+// Item returns the sum of an item
+func Item(item map[string]*dynamodb.AttributeValue) (sum Sum) {
+
+	h := sha256.New()
+
+	writeMap(h, item)
+
+	copy(sum[:], h.Sum(nil))
+
+	return
+}
+
+func writeString(h hash.Hash, s string) {
+	writeBytes(h, []byte(s))
+}
+
+func writeBytes(h hash.Hash, b []byte) {
+	var length [8]byte
+	binary.BigEndian.PutUint64(length[:], uint64(len(b)))
+	h.Write(length[:])
+	h.Write(b)
+}
+
+func writeMap(h hash.Hash, m map[string]*dynamodb.AttributeValue) {
+
+	names := make([]string, 0, len(m))
+
+	for name := range m {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	writeString(h, fmt.Sprintf("M%d", len(names)))
+
+	for _, name := range names {
+		writeString(h, name)
+		writeValue(h, m[name])
+	}
+}
+
+func writeSet(h hash.Hash, tag string, members []string) {
+
+	sorted := append([]string(nil), members...)
+
+	sort.Strings(sorted)
+
+	writeString(h, fmt.Sprintf("%s%d", tag, len(sorted)))
+
+	for _, member := range sorted {
+		writeString(h, member)
+	}
+}
+
+func writeValue(h hash.Hash, av *dynamodb.AttributeValue) {
+
+	switch {
+	case av == nil:
+		writeString(h, "_")
+	case av.S != nil:
+		writeString(h, "S")
+		writeString(h, *av.S)
+	case av.N != nil:
+		writeString(h, "N")
+		writeString(h, *av.N)
+	case av.B != nil:
+		writeString(h, "B")
+		writeBytes(h, av.B)
+	case av.BOOL != nil:
+		writeString(h, fmt.Sprintf("BOOL%t", *av.BOOL))
+	case av.NULL != nil:
+		writeString(h, "NULL")
+	case av.M != nil:
+		writeMap(h, av.M)
+	case av.L != nil:
+		writeString(h, fmt.Sprintf("L%d", len(av.L)))
+		for _, member := range av.L {
+			writeValue(h, member)
+		}
+	case av.SS != nil:
+		writeSet(h, "SS", stringValues(av.SS))
+	case av.NS != nil:
+		writeSet(h, "NS", stringValues(av.NS))
+	case av.BS != nil:
+		members := make([]string, len(av.BS))
+		for i, member := range av.BS {
+			members[i] = string(member)
+		}
+		writeSet(h, "BS", members)
+	default:
+		writeString(h, "_")
+	}
+}
+
+func stringValues(values []*string) []string {
+
+	members := make([]string, len(values))
+
+	for i, value := range values {
+		if value != nil {
+			members[i] = *value
+		}
+	}
+
+	return members
+}
+
+// Key returns a printable, comparable form of an item's key attributes.
+// Strings are quoted, so a separator inside a value can't make two keys
+// print alike.
+func Key(item map[string]*dynamodb.AttributeValue, names []string) string {
+
+	parts := make([]string, 0, len(names))
+
+	for _, name := range names {
+
+		value := "?"
+
+		if av := item[name]; av != nil {
+			switch {
+			case av.S != nil:
+				value = "S:" + strconv.Quote(*av.S)
+			case av.N != nil:
+				value = "N:" + *av.N
+			case av.B != nil:
+				value = "B:" + base64.StdEncoding.EncodeToString(av.B)
+			}
+		}
+
+		parts = append(parts, name+"="+value)
+	}
+
+	return strings.Join(parts, ",")
+}
@@ -0,0 +1,106 @@
+package itemhash_test
+
+import (
+	"testing"
+
+	"github.com/NixM0nk3y/dynamodb-clone/itemhash"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+func TestKey(t *testing.T) {
+
+	names := []string{"pk", "sk"}
+
+	tests := []struct {
+		name string
+		a, b map[string]*dynamodb.AttributeValue
+	}{
+		{
+			name: "separator in a value",
+			a:    map[string]*dynamodb.AttributeValue{"pk": {S: aws.String("a,sk=S:b")}, "sk": {S: aws.String("c")}},
+			b:    map[string]*dynamodb.AttributeValue{"pk": {S: aws.String("a")}, "sk": {S: aws.String("b,sk=S:c")}},
+		},
+		{
+			name: "string and number",
+			a:    map[string]*dynamodb.AttributeValue{"pk": {S: aws.String("1")}, "sk": {S: aws.String("x")}},
+			b:    map[string]*dynamodb.AttributeValue{"pk": {N: aws.String("1")}, "sk": {S: aws.String("x")}},
+		},
+		{
+			name: "missing and placeholder",
+			a:    map[string]*dynamodb.AttributeValue{"pk": {S: aws.String("?")}},
+			b:    map[string]*dynamodb.AttributeValue{"pk": {S: aws.String("?")}, "sk": {S: aws.String("?")}},
+		},
+		{
+			name: "string and binary",
+			a:    map[string]*dynamodb.AttributeValue{"pk": {S: aws.String("YQ==")}, "sk": {N: aws.String("1")}},
+			b:    map[string]*dynamodb.AttributeValue{"pk": {B: []byte("a")}, "sk": {N: aws.String("1")}},
+		},
+	}
+
+	for _, test := range tests {
+
+		test := test
+
+		t.Run(test.name, func(t *testing.T) {
+
+			a, b := itemhash.Key(test.a, names), itemhash.Key(test.b, names)
+
+			if a == b {
+				t.Errorf("different keys both print as %s", a)
+			}
+
+			if again := itemhash.Key(test.a, names); again != a {
+				t.Errorf("key printed as %s then %s", a, again)
+			}
+		})
+	}
+}
+
+func TestItem(t *testing.T) {
+
+	tests := []struct {
+		name  string
+		a, b  map[string]*dynamodb.AttributeValue
+		equal bool
+	}{
+		{
+			name:  "set order",
+			a:     map[string]*dynamodb.AttributeValue{"s": {SS: aws.StringSlice([]string{"a", "b"})}},
+			b:     map[string]*dynamodb.AttributeValue{"s": {SS: aws.StringSlice([]string{"b", "a"})}},
+			equal: true,
+		},
+		{
+			name:  "binary set order",
+			a:     map[string]*dynamodb.AttributeValue{"s": {BS: [][]byte{{1}, {2, 3}}}},
+			b:     map[string]*dynamodb.AttributeValue{"s": {BS: [][]byte{{2, 3}, {1}}}},
+			equal: true,
+		},
+		{
+			name: "string and number",
+			a:    map[string]*dynamodb.AttributeValue{"v": {S: aws.String("1")}},
+			b:    map[string]*dynamodb.AttributeValue{"v": {N: aws.String("1")}},
+		},
+		{
+			name: "list and set",
+			a:    map[string]*dynamodb.AttributeValue{"v": {L: []*dynamodb.AttributeValue{{S: aws.String("a")}}}},
+			b:    map[string]*dynamodb.AttributeValue{"v": {SS: aws.StringSlice([]string{"a"})}},
+		},
+		{
+			name: "value moved between attributes",
+			a:    map[string]*dynamodb.AttributeValue{"ab": {S: aws.String("c")}},
+			b:    map[string]*dynamodb.AttributeValue{"a": {S: aws.String("bc")}},
+		},
+	}
+
+	for _, test := range tests {
+
+		test := test
+
+		t.Run(test.name, func(t *testing.T) {
+			if equal := itemhash.Item(test.a) == itemhash.Item(test.b); equal != test.equal {
+				t.Errorf("items summed equal %t, expected %t", equal, test.equal)
+			}
+		})
+	}
+}
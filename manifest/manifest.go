@@ -0,0 +1,156 @@
+package manifest
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+
+	"github.com/NixM0nk3y/dynamodb-clone/state"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// S3 object metadata written alongside each data file
+const (
+	MetaSHA256 = "sha256"
+	MetaItems  = "items"
+)
+
+// File is a single staged data file
+type File struct {
+	Key    string `json:"key"`
+	Format string `json:"format"`
+	Items  int64  `json:"items"`
+	Bytes  int64  `json:"bytes"`
+	SHA256 string `json:"sha256"`
+}
+
+//
+// Manifest lists the data files staged by an export, the importers iterate
+// over Files rather than carrying the list through the execution state
+//
+type Manifest struct {
+	Table  string        `json:"table"`
+	Items  int64         `json:"items"`
+	Bytes  int64         `json:"bytes"`
+	Filter *state.Filter `json:"filter,omitempty"`
+	Files  []File        `json:"files"`
+}
+
+// New returns an empty manifest for a table
+func New(table string) *Manifest {
+	return &Manifest{
+		Table: table,
+		Files: []File{},
+	}
+}
+
+// Add records a staged data file
+func (m *Manifest) Add(file File) {
+	m.Files = append(m.Files, file)
+	m.Items += file.Items
+	m.Bytes += file.Bytes
+}
+
+// Merge appends the files of another manifest
+func (m *Manifest) Merge(other *Manifest) {
+
+	if m.Filter == nil {
+		m.Filter = other.Filter
+	}
+
+	for _, file := range other.Files {
+		m.Add(file)
+	}
+}
+
+// Read loads a manifest from the staging bucket
+func Read(ctx context.Context, svc s3iface.S3API, bucket string, key string) (m *Manifest, err error) {
+
+	result, err := svc.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer result.Body.Close()
+
+	if err = json.NewDecoder(result.Body).Decode(&m); err != nil {
+		return nil, err
+	}
+
+	return
+}
+
+// Write stores a manifest in the staging bucket
+func Write(ctx context.Context, svc s3iface.S3API, bucket string, key string, m *Manifest) (err error) {
+
+	b, err := json.Marshal(m)
+
+	if err != nil {
+		return err
+	}
+
+	_, err = svc.PutObjectWithContext(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(bucket),
+		Key:         aws.String(key),
+		Body:        bytes.NewReader(b),
+		ContentType: aws.String("application/json"),
+	})
+
+	return
+}
+
+// exportFile is a line of the manifest-files.json written by a DynamoDB export
+type exportFile struct {
+	ItemCount     int64  `json:"itemCount"`
+	MD5Checksum   string `json:"md5Checksum"`
+	ETag          string `json:"etag"`
+	DataFileS3Key string `json:"dataFileS3Key"`
+}
+
+//
+// ReadExport loads the manifest-files.json of an ExportTableToPointInTime
+// export as a manifest of its data files, which are all in the given format
+//
+func ReadExport(ctx context.Context, svc s3iface.S3API, bucket string, key string, table string, format string) (m *Manifest, err error) {
+
+	result, err := svc.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer result.Body.Close()
+
+	m = New(table)
+
+	// one JSON object per line
+	decoder := json.NewDecoder(result.Body)
+
+	for {
+		var file exportFile
+
+		if err = decoder.Decode(&file); err == io.EOF {
+			return m, nil
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		m.Add(File{
+			Key:    file.DataFileS3Key,
+			Format: format,
+			Items:  file.ItemCount,
+		})
+	}
+}
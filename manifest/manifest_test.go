@@ -0,0 +1,109 @@
+package manifest_test
+
+import (
+	"bytes"
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/NixM0nk3y/dynamodb-clone/clonetest"
+	"github.com/NixM0nk3y/dynamodb-clone/manifest"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+const (
+	bucket   = "test-bucket"
+	filesKey = "ddbimport/run/export/AWSDynamoDB/01700000000000-0000abcd/manifest-files.json"
+)
+
+func TestReadExport(t *testing.T) {
+
+	tests := []struct {
+		name     string
+		files    string
+		expected *manifest.Manifest // nil when the read fails
+	}{
+		{
+			name: "files",
+			files: `{"itemCount":3,"md5Checksum":"bXk=","etag":"6d79","dataFileS3Key":"export/data/a.ion.gz"}
+{"itemCount":0,"md5Checksum":"bXk=","etag":"6d79","dataFileS3Key":"export/data/b.ion.gz"}
+{"itemCount":2,"md5Checksum":"bXk=","etag":"6d79","dataFileS3Key":"export/data/c.ion.gz"}
+`,
+			expected: &manifest.Manifest{
+				Table: "ddbimport",
+				Items: 5,
+				Files: []manifest.File{
+					{Key: "export/data/a.ion.gz", Format: "ion", Items: 3},
+					{Key: "export/data/b.ion.gz", Format: "ion", Items: 0},
+					{Key: "export/data/c.ion.gz", Format: "ion", Items: 2},
+				},
+			},
+		},
+		{
+			name:  "no trailing line break",
+			files: `{"itemCount":1,"dataFileS3Key":"export/data/a.ion.gz"}`,
+			expected: &manifest.Manifest{
+				Table: "ddbimport",
+				Items: 1,
+				Files: []manifest.File{{Key: "export/data/a.ion.gz", Format: "ion", Items: 1}},
+			},
+		},
+		{
+			name:     "empty table",
+			files:    "",
+			expected: &manifest.Manifest{Table: "ddbimport", Files: []manifest.File{}},
+		},
+		{
+			name:  "truncated",
+			files: `{"itemCount":3,"dataFileS3Key":"export/da`,
+		},
+		{
+			name:  "count as a string",
+			files: `{"itemCount":"3","dataFileS3Key":"export/data/a.ion.gz"}`,
+		},
+	}
+
+	for _, test := range tests {
+
+		test := test
+
+		t.Run(test.name, func(t *testing.T) {
+
+			svc := clonetest.NewS3()
+
+			if _, err := svc.PutObjectWithContext(context.Background(), &s3.PutObjectInput{
+				Bucket: aws.String(bucket),
+				Key:    aws.String(filesKey),
+				Body:   bytes.NewReader([]byte(test.files)),
+			}); err != nil {
+				t.Fatalf("unable to store manifest-files.json: %v", err)
+			}
+
+			m, err := manifest.ReadExport(context.Background(), svc, bucket, filesKey, "ddbimport", "ion")
+
+			if test.expected == nil {
+
+				if err == nil {
+					t.Errorf("read %s as %+v", test.files, m)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unable to read export manifest: %v", err)
+			}
+
+			if !reflect.DeepEqual(m, test.expected) {
+				t.Errorf("read as %+v, expected %+v", m, test.expected)
+			}
+		})
+	}
+}
+
+func TestReadExportMissing(t *testing.T) {
+	if m, err := manifest.ReadExport(context.Background(), clonetest.NewS3(), bucket, filesKey, "ddbimport", "ion"); err == nil {
+		t.Errorf("read a missing manifest as %+v", m)
+	}
+}
@@ -0,0 +1,340 @@
+package masking
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/NixM0nk3y/dynamodb-clone/itemhash"
+	"github.com/NixM0nk3y/dynamodb-clone/state"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+//
+// A masking profile maps attribute paths onto strategies. Tokens are an HMAC
+// of the value keyed by the profile's secret, so a value masks to the same
+// token in every table cloned with that secret and joins still line up.
+//
+
+// masking strategies
+const (
+	StrategyEmail     = "email"     // deterministic fake address in the same format
+	StrategyHMAC      = "hmac"      // deterministic token of the same type
+	StrategyNull      = "null"      // replaced with NULL
+	StrategyDateShift = "dateshift" // dates moved by a fixed number of days
+)
+
+// date layouts a shifted string may be in, the first to parse is kept
+var dateLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05",
+	"2006-01-02",
+}
+
+// epoch numbers above this are taken to be in milliseconds
+const epochMillis = 100000000000
+
+// rule is a parsed rule of the profile
+type rule struct {
+	path     string
+	strategy string
+	steps    []step
+	mask     maskFunc
+}
+
+// Masker applies a masking profile to items
+type Masker struct {
+	profile string
+	rules   []rule
+}
+
+// NeedsSecret reports if the profile uses a strategy keyed by the secret
+func NeedsSecret(config state.MaskingConfig) bool {
+
+	for _, r := range config.Rules {
+		switch r.Strategy {
+		case StrategyEmail, StrategyHMAC:
+			return true
+		}
+	}
+
+	return false
+}
+
+// New returns a masker for the profile, secret keys the tokens
+func New(config state.MaskingConfig, secret []byte) (*Masker, error) {
+
+	if config.Profile == "" {
+		return nil, errors.New("masking profile has no name")
+	}
+
+	if NeedsSecret(config) && len(secret) == 0 {
+		return nil, fmt.Errorf("masking profile %s needs a secret", config.Profile)
+	}
+
+	masker := &Masker{profile: config.Profile}
+
+	for i, r := range config.Rules {
+
+		steps, err := parsePath(r.Path)
+
+		if err != nil {
+			return nil, fmt.Errorf("masking rule %d: %w", i, err)
+		}
+
+		var mask maskFunc
+
+		switch r.Strategy {
+		case StrategyEmail:
+			mask = emailMask(secret)
+		case StrategyHMAC:
+			mask = hmacMask(secret)
+		case StrategyNull:
+			mask = nullMask
+		case StrategyDateShift:
+
+			if r.Days == 0 {
+				return nil, fmt.Errorf("masking rule %d: dateshift needs a number of days", i)
+			}
+
+			mask = dateShiftMask(r.Days)
+		default:
+			return nil, fmt.Errorf("masking rule %d: unknown strategy %q", i, r.Strategy)
+		}
+
+		masker.rules = append(masker.rules, rule{path: r.Path, strategy: r.Strategy, steps: steps, mask: mask})
+	}
+
+	return masker, nil
+}
+
+// Profile returns the name of the masking profile
+func (m *Masker) Profile() string {
+	return m.profile
+}
+
+// Mask masks an item in place, returning the paths of the rules which
+// touched it
+func (m *Masker) Mask(item map[string]*dynamodb.AttributeValue) (touched []string, err error) {
+
+	root := &dynamodb.AttributeValue{M: item}
+
+	for _, r := range m.rules {
+
+		_, ruleTouched, ruleErr := walk(root, r.steps, r.mask)
+
+		if ruleErr != nil {
+			return nil, fmt.Errorf("masking %s: %w", r.path, ruleErr)
+		}
+
+		if ruleTouched {
+			touched = append(touched, r.path)
+		}
+	}
+
+	return
+}
+
+// NewReport returns an empty report for the masker's profile
+func (m *Masker) NewReport() *Report {
+
+	report := &Report{
+		Profile:    m.profile,
+		Strategies: map[string]string{},
+		Attributes: map[string]int64{},
+	}
+
+	for _, r := range m.rules {
+		report.Strategies[r.path] = r.strategy
+	}
+
+	return report
+}
+
+func mac(secret []byte, value *dynamodb.AttributeValue) []byte {
+
+	h := hmac.New(sha256.New, secret)
+
+	// scalars by their text, so an id stored as a string or a number in
+	// different tables tokenises alike
+	switch {
+	case value.S != nil:
+		h.Write([]byte(*value.S))
+	case value.N != nil:
+		h.Write([]byte(*value.N))
+	case value.B != nil:
+		h.Write(value.B)
+	default:
+		sum := itemhash.Item(map[string]*dynamodb.AttributeValue{"": value})
+		h.Write(sum[:])
+	}
+
+	return h.Sum(nil)
+}
+
+func stringToken(secret []byte, s string) string {
+	return hex.EncodeToString(mac(secret, &dynamodb.AttributeValue{S: aws.String(s)})[:16])
+}
+
+// numberTokenLimit keeps number tokens within the 38 significant digits a
+// DynamoDB number holds
+var numberTokenLimit = new(big.Int).Exp(big.NewInt(10), big.NewInt(38), nil)
+
+// numberToken takes 128 bits of the MAC down to 38 digits, wide enough that
+// masked numeric keys don't collide
+func numberToken(secret []byte, n string) string {
+	sum := mac(secret, &dynamodb.AttributeValue{N: aws.String(n)})
+	return new(big.Int).Mod(new(big.Int).SetBytes(sum[:16]), numberTokenLimit).String()
+}
+
+func hmacMask(secret []byte) maskFunc {
+	return func(value *dynamodb.AttributeValue) (*dynamodb.AttributeValue, error) {
+
+		// tokens keep the type so key attributes stay valid
+		switch {
+		case value.S != nil:
+			return &dynamodb.AttributeValue{S: aws.String(stringToken(secret, *value.S))}, nil
+		case value.N != nil:
+			return &dynamodb.AttributeValue{N: aws.String(numberToken(secret, *value.N))}, nil
+		case value.B != nil:
+			return &dynamodb.AttributeValue{B: mac(secret, value)}, nil
+		case value.SS != nil:
+			return &dynamodb.AttributeValue{SS: mapMembers(value.SS, func(s string) string { return stringToken(secret, s) })}, nil
+		case value.NS != nil:
+			return &dynamodb.AttributeValue{NS: mapMembers(value.NS, func(n string) string { return numberToken(secret, n) })}, nil
+		case value.NULL != nil:
+			return value, nil
+		}
+
+		return &dynamodb.AttributeValue{S: aws.String(hex.EncodeToString(mac(secret, value)[:16]))}, nil
+	}
+}
+
+func fakeEmail(secret []byte, address string) string {
+
+	at := strings.LastIndex(address, "@")
+
+	if at < 0 {
+		return "user-" + stringToken(secret, address)[:12] + "@example.com"
+	}
+
+	// the local part and domain are tokenised apart so addresses at the same
+	// domain still share one
+	local := stringToken(secret, strings.ToLower(address[:at]))[:12]
+	domain := stringToken(secret, strings.ToLower(address[at+1:]))[:8]
+
+	return "user-" + local + "@" + domain + ".example.com"
+}
+
+func emailMask(secret []byte) maskFunc {
+	return func(value *dynamodb.AttributeValue) (*dynamodb.AttributeValue, error) {
+
+		switch {
+		case value.S != nil:
+			return &dynamodb.AttributeValue{S: aws.String(fakeEmail(secret, *value.S))}, nil
+		case value.SS != nil:
+			return &dynamodb.AttributeValue{SS: mapMembers(value.SS, func(s string) string { return fakeEmail(secret, s) })}, nil
+		case value.NULL != nil:
+			return value, nil
+		}
+
+		return nil, errors.New("email masking applies to strings")
+	}
+}
+
+func nullMask(value *dynamodb.AttributeValue) (*dynamodb.AttributeValue, error) {
+	return &dynamodb.AttributeValue{NULL: aws.Bool(true)}, nil
+}
+
+func shiftDate(s string, days int64) (string, error) {
+
+	for _, layout := range dateLayouts {
+
+		t, err := time.Parse(layout, s)
+
+		if err == nil {
+			return t.AddDate(0, 0, int(days)).Format(layout), nil
+		}
+	}
+
+	return "", fmt.Errorf("unable to parse date %q", s)
+}
+
+func shiftEpoch(n string, days int64) (string, error) {
+
+	epoch, err := strconv.ParseInt(n, 10, 64)
+
+	if err != nil {
+		return "", fmt.Errorf("unable to parse epoch %q", n)
+	}
+
+	shift := days * 86400
+
+	if epoch > epochMillis || epoch < -epochMillis {
+		shift *= 1000
+	}
+
+	return strconv.FormatInt(epoch+shift, 10), nil
+}
+
+// dateShiftMask moves dates, as strings or epoch numbers, by a fixed number
+// of days so intervals between them survive. A value that isn't a date fails
+// the import rather than leaking through unmasked.
+func dateShiftMask(days int64) maskFunc {
+	return func(value *dynamodb.AttributeValue) (*dynamodb.AttributeValue, error) {
+
+		switch {
+		case value.S != nil:
+
+			shifted, err := shiftDate(*value.S, days)
+
+			if err != nil {
+				return nil, err
+			}
+
+			return &dynamodb.AttributeValue{S: aws.String(shifted)}, nil
+
+		case value.N != nil:
+
+			shifted, err := shiftEpoch(*value.N, days)
+
+			if err != nil {
+				return nil, err
+			}
+
+			return &dynamodb.AttributeValue{N: aws.String(shifted)}, nil
+
+		case value.NULL != nil:
+			return value, nil
+		}
+
+		return nil, errors.New("date shifting applies to strings and numbers")
+	}
+}
+
+// mapMembers maps the members of a set, dropping duplicates a set can't hold
+func mapMembers(members []*string, f func(string) string) (mapped []*string) {
+
+	seen := map[string]bool{}
+
+	for _, member := range members {
+
+		m := f(aws.StringValue(member))
+
+		if seen[m] {
+			continue
+		}
+
+		seen[m] = true
+		mapped = append(mapped, aws.String(m))
+	}
+
+	return
+}
@@ -0,0 +1,375 @@
+package masking_test
+
+import (
+	"encoding/hex"
+	"reflect"
+	"strconv"
+	"testing"
+
+	"github.com/NixM0nk3y/dynamodb-clone/masking"
+	"github.com/NixM0nk3y/dynamodb-clone/state"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+var secret = []byte("test-secret")
+
+func s(value string) *dynamodb.AttributeValue {
+	return &dynamodb.AttributeValue{S: aws.String(value)}
+}
+
+func n(value string) *dynamodb.AttributeValue {
+	return &dynamodb.AttributeValue{N: aws.String(value)}
+}
+
+func unhex(t *testing.T, value string) []byte {
+
+	t.Helper()
+
+	b, err := hex.DecodeString(value)
+
+	if err != nil {
+		t.Fatalf("invalid hex %s: %v", value, err)
+	}
+
+	return b
+}
+
+//
+// Tokens are fixed by the secret, a change to them breaks joins between a
+// table cloned before it and one cloned after
+//
+func TestMask(t *testing.T) {
+
+	null := &dynamodb.AttributeValue{NULL: aws.Bool(true)}
+
+	tests := []struct {
+		name     string
+		rules    []state.MaskRule
+		item     map[string]*dynamodb.AttributeValue
+		expected map[string]*dynamodb.AttributeValue
+		touched  []string
+	}{
+		{
+			name: "hmac keeps the type",
+			rules: []state.MaskRule{
+				{Path: "s", Strategy: masking.StrategyHMAC},
+				{Path: "n", Strategy: masking.StrategyHMAC},
+				{Path: "ss", Strategy: masking.StrategyHMAC},
+				{Path: "ns", Strategy: masking.StrategyHMAC},
+				{Path: "m", Strategy: masking.StrategyHMAC},
+				{Path: "none", Strategy: masking.StrategyHMAC},
+			},
+			item: map[string]*dynamodb.AttributeValue{
+				"s":    s("42"),
+				"n":    n("42"),
+				"ss":   {SS: aws.StringSlice([]string{"a", "42"})},
+				"ns":   {NS: aws.StringSlice([]string{"1", "42"})},
+				"m":    {M: map[string]*dynamodb.AttributeValue{"k": s("v")}},
+				"none": null,
+			},
+			expected: map[string]*dynamodb.AttributeValue{
+				"s":    s("0c448d9ba9697edc6e65d581ad07fba7"),
+				"n":    n("16306684288349166305370251574475488167"),
+				"ss":   {SS: aws.StringSlice([]string{"07e1820bffbe7d4d25aa44853d57043d", "0c448d9ba9697edc6e65d581ad07fba7"})},
+				"ns":   {NS: aws.StringSlice([]string{"79205692941541382867509324493483716929", "16306684288349166305370251574475488167"})},
+				"m":    s("e039c3acbe4c6362414314dcae77dc6d"),
+				"none": null,
+			},
+			touched: []string{"s", "n", "ss", "ns", "m", "none"},
+		},
+		{
+			name:  "email",
+			rules: []state.MaskRule{{Path: "email", Strategy: masking.StrategyEmail}, {Path: "aliases", Strategy: masking.StrategyEmail}},
+			item: map[string]*dynamodb.AttributeValue{
+				"email":   s("Jane.Doe@Example.com"),
+				"aliases": {SS: aws.StringSlice([]string{"jane.doe@example.com", "john@example.com", "not-an-address"})},
+			},
+			// addresses at one domain share its token, and case doesn't matter
+			expected: map[string]*dynamodb.AttributeValue{
+				"email": s("user-950a4b221a74@d56831e4.example.com"),
+				"aliases": {SS: aws.StringSlice([]string{
+					"user-950a4b221a74@d56831e4.example.com",
+					"user-d76273a70627@d56831e4.example.com",
+					"user-7cd9ae55e4d6@example.com",
+				})},
+			},
+			touched: []string{"email", "aliases"},
+		},
+		{
+			name:  "null",
+			rules: []state.MaskRule{{Path: "contacts.*.phone", Strategy: masking.StrategyNull}},
+			item: map[string]*dynamodb.AttributeValue{
+				"contacts": {M: map[string]*dynamodb.AttributeValue{
+					"home": {M: map[string]*dynamodb.AttributeValue{"phone": s("555-0100"), "name": s("Jane")}},
+					"work": {M: map[string]*dynamodb.AttributeValue{"email": s("jane@example.com")}},
+				}},
+			},
+			expected: map[string]*dynamodb.AttributeValue{
+				"contacts": {M: map[string]*dynamodb.AttributeValue{
+					"home": {M: map[string]*dynamodb.AttributeValue{"phone": null, "name": s("Jane")}},
+					"work": {M: map[string]*dynamodb.AttributeValue{"email": s("jane@example.com")}},
+				}},
+			},
+			touched: []string{"contacts.*.phone"},
+		},
+		{
+			name: "dateshift",
+			rules: []state.MaskRule{
+				{Path: "dob", Strategy: masking.StrategyDateShift, Days: 90},
+				{Path: "created", Strategy: masking.StrategyDateShift, Days: -1},
+				{Path: "seconds", Strategy: masking.StrategyDateShift, Days: 1},
+				{Path: "millis", Strategy: masking.StrategyDateShift, Days: 1},
+				{Path: "expires", Strategy: masking.StrategyDateShift, Days: 1},
+			},
+			item: map[string]*dynamodb.AttributeValue{
+				"dob":     s("1980-01-01"),
+				"created": s("2021-03-01T12:30:00Z"),
+				"seconds": n("1600000000"),
+				"millis":  n("1600000000000"),
+				"expires": null,
+			},
+			expected: map[string]*dynamodb.AttributeValue{
+				"dob":     s("1980-03-31"),
+				"created": s("2021-02-28T12:30:00Z"),
+				"seconds": n("1600086400"),
+				"millis":  n("1600086400000"),
+				"expires": null,
+			},
+			touched: []string{"dob", "created", "seconds", "millis", "expires"},
+		},
+		{
+			name: "list elements",
+			rules: []state.MaskRule{
+				{Path: "addresses[1].postcode", Strategy: masking.StrategyNull},
+				{Path: "phones[*]", Strategy: masking.StrategyNull},
+			},
+			item: map[string]*dynamodb.AttributeValue{
+				"addresses": {L: []*dynamodb.AttributeValue{
+					{M: map[string]*dynamodb.AttributeValue{"postcode": s("AB1 2CD")}},
+					{M: map[string]*dynamodb.AttributeValue{"postcode": s("EF3 4GH")}},
+				}},
+				"phones": {L: []*dynamodb.AttributeValue{s("555-0100"), s("555-0101")}},
+			},
+			expected: map[string]*dynamodb.AttributeValue{
+				"addresses": {L: []*dynamodb.AttributeValue{
+					{M: map[string]*dynamodb.AttributeValue{"postcode": s("AB1 2CD")}},
+					{M: map[string]*dynamodb.AttributeValue{"postcode": null}},
+				}},
+				"phones": {L: []*dynamodb.AttributeValue{null, null}},
+			},
+			touched: []string{"addresses[1].postcode", "phones[*]"},
+		},
+		{
+			name:     "missing paths",
+			rules:    []state.MaskRule{{Path: "email", Strategy: masking.StrategyEmail}, {Path: "contacts.*.phone", Strategy: masking.StrategyNull}},
+			item:     map[string]*dynamodb.AttributeValue{"id": n("1"), "contacts": {M: map[string]*dynamodb.AttributeValue{}}},
+			expected: map[string]*dynamodb.AttributeValue{"id": n("1"), "contacts": {M: map[string]*dynamodb.AttributeValue{}}},
+		},
+	}
+
+	for _, test := range tests {
+
+		test := test
+
+		t.Run(test.name, func(t *testing.T) {
+
+			masker, err := masking.New(state.MaskingConfig{Profile: "pii", Rules: test.rules}, secret)
+
+			if err != nil {
+				t.Fatalf("invalid profile: %v", err)
+			}
+
+			touched, err := masker.Mask(test.item)
+
+			if err != nil {
+				t.Fatalf("unable to mask: %v", err)
+			}
+
+			if !reflect.DeepEqual(test.item, test.expected) {
+				t.Errorf("masked to %v, expected %v", test.item, test.expected)
+			}
+
+			if !reflect.DeepEqual(touched, test.touched) {
+				t.Errorf("touched %v, expected %v", touched, test.touched)
+			}
+		})
+	}
+}
+
+func TestMaskBinary(t *testing.T) {
+
+	masker, err := masking.New(state.MaskingConfig{
+		Profile: "blobs",
+		Rules:   []state.MaskRule{{Path: "b", Strategy: masking.StrategyHMAC}},
+	}, secret)
+
+	if err != nil {
+		t.Fatalf("invalid profile: %v", err)
+	}
+
+	item := map[string]*dynamodb.AttributeValue{"b": {B: []byte("42")}}
+
+	if _, err = masker.Mask(item); err != nil {
+		t.Fatalf("unable to mask: %v", err)
+	}
+
+	// binary is keyed by its bytes, alike the string holding them
+	expected := unhex(t, "0c448d9ba9697edc6e65d581ad07fba78e907baad3c1e452d3ead109363f97bf")
+
+	if !reflect.DeepEqual(item["b"].B, expected) {
+		t.Errorf("masked to %x, expected %x", item["b"].B, expected)
+	}
+}
+
+func TestMaskInvalid(t *testing.T) {
+
+	tests := []struct {
+		name   string
+		config state.MaskingConfig
+		secret []byte
+		item   map[string]*dynamodb.AttributeValue // fails to mask, when the profile is valid
+	}{
+		{name: "no profile", config: state.MaskingConfig{Rules: []state.MaskRule{{Path: "a", Strategy: masking.StrategyNull}}}},
+		{name: "no secret", config: state.MaskingConfig{Profile: "p", Rules: []state.MaskRule{{Path: "a", Strategy: masking.StrategyHMAC}}}},
+		{name: "unknown strategy", config: state.MaskingConfig{Profile: "p", Rules: []state.MaskRule{{Path: "a", Strategy: "redact"}}}, secret: secret},
+		{name: "dateshift without days", config: state.MaskingConfig{Profile: "p", Rules: []state.MaskRule{{Path: "a", Strategy: masking.StrategyDateShift}}}},
+		{name: "leading dot", config: state.MaskingConfig{Profile: "p", Rules: []state.MaskRule{{Path: ".a", Strategy: masking.StrategyNull}}}},
+		{name: "leading index", config: state.MaskingConfig{Profile: "p", Rules: []state.MaskRule{{Path: "[0]", Strategy: masking.StrategyNull}}}},
+		{name: "unclosed index", config: state.MaskingConfig{Profile: "p", Rules: []state.MaskRule{{Path: "a[0", Strategy: masking.StrategyNull}}}},
+		{name: "invalid index", config: state.MaskingConfig{Profile: "p", Rules: []state.MaskRule{{Path: "a[-1]", Strategy: masking.StrategyNull}}}},
+		{
+			name:   "email of a number",
+			config: state.MaskingConfig{Profile: "p", Rules: []state.MaskRule{{Path: "a", Strategy: masking.StrategyEmail}}},
+			secret: secret,
+			item:   map[string]*dynamodb.AttributeValue{"a": n("1")},
+		},
+		{
+			name:   "dateshift of a non date",
+			config: state.MaskingConfig{Profile: "p", Rules: []state.MaskRule{{Path: "a", Strategy: masking.StrategyDateShift, Days: 1}}},
+			item:   map[string]*dynamodb.AttributeValue{"a": s("yesterday")},
+		},
+		{
+			name:   "dateshift of a fractional epoch",
+			config: state.MaskingConfig{Profile: "p", Rules: []state.MaskRule{{Path: "a", Strategy: masking.StrategyDateShift, Days: 1}}},
+			item:   map[string]*dynamodb.AttributeValue{"a": n("1600000000.5")},
+		},
+	}
+
+	for _, test := range tests {
+
+		test := test
+
+		t.Run(test.name, func(t *testing.T) {
+
+			masker, err := masking.New(test.config, test.secret)
+
+			if test.item == nil {
+				if err == nil {
+					t.Errorf("built a masker from %+v", test.config)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("invalid profile: %v", err)
+			}
+
+			// a value that can't be masked mustn't leak through
+			if _, err = masker.Mask(test.item); err == nil {
+				t.Errorf("masked %v", test.item)
+			}
+		})
+	}
+}
+
+func TestReport(t *testing.T) {
+
+	masker, err := masking.New(state.MaskingConfig{
+		Profile: "pii",
+		Rules: []state.MaskRule{
+			{Path: "email", Strategy: masking.StrategyEmail},
+			{Path: "phone", Strategy: masking.StrategyNull},
+		},
+	}, secret)
+
+	if err != nil {
+		t.Fatalf("invalid profile: %v", err)
+	}
+
+	batches := [][]map[string]*dynamodb.AttributeValue{
+		{
+			{"id": n("1"), "email": s("a@example.com"), "phone": s("555-0100")},
+			{"id": n("2"), "email": s("b@example.com")},
+			{"id": n("3")},
+		},
+		{
+			{"id": n("4"), "phone": s("555-0101")},
+		},
+	}
+
+	merged := &masking.Report{Strategies: map[string]string{}, Attributes: map[string]int64{}}
+
+	for _, batch := range batches {
+
+		report, err := masker.Items(batch)
+
+		if err != nil {
+			t.Fatalf("unable to mask: %v", err)
+		}
+
+		merged.Merge(report)
+	}
+
+	merged.Merge(nil)
+
+	// items untouched by the profile aren't counted
+	expected := &masking.Report{
+		Profile:    "pii",
+		Items:      3,
+		Strategies: map[string]string{"email": masking.StrategyEmail, "phone": masking.StrategyNull},
+		Attributes: map[string]int64{"email": 2, "phone": 2},
+	}
+
+	if !reflect.DeepEqual(merged, expected) {
+		t.Errorf("reported %+v, expected %+v", merged, expected)
+	}
+}
+
+func TestNumberTokens(t *testing.T) {
+
+	masker, err := masking.New(state.MaskingConfig{
+		Profile: "ids",
+		Rules:   []state.MaskRule{{Path: "Id", Strategy: masking.StrategyHMAC}},
+	}, secret)
+
+	if err != nil {
+		t.Fatalf("invalid profile: %v", err)
+	}
+
+	seen := map[string]string{}
+
+	for i := 0; i < 20000; i++ {
+
+		id := strconv.Itoa(i)
+
+		item := map[string]*dynamodb.AttributeValue{"Id": {N: aws.String(id)}}
+
+		if _, err = masker.Mask(item); err != nil {
+			t.Fatalf("unable to mask %s: %v", id, err)
+		}
+
+		token := aws.StringValue(item["Id"].N)
+
+		// wide enough not to collide, narrow enough for a DynamoDB number
+		if len(token) < 30 || len(token) > 38 {
+			t.Fatalf("%s masked to %s, %d digits", id, token, len(token))
+		}
+
+		if other, ok := seen[token]; ok {
+			t.Fatalf("%s and %s both masked to %s", other, id, token)
+		}
+
+		seen[token] = id
+	}
+}
@@ -0,0 +1,162 @@
+package masking
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+//
+// Paths follow the document path syntax of DynamoDB expressions, map keys
+// separated by dots and list elements by index, with * standing for every
+// key or element, i.e. addresses[*].email or contact.*.phone
+//
+
+const allElements = -1
+
+// step is a single map key or list index of a path
+type step struct {
+	name  string
+	list  bool
+	index int
+}
+
+func parsePath(path string) (steps []step, err error) {
+
+	rest := path
+
+	for rest != "" {
+
+		switch {
+		case strings.HasPrefix(rest, "["):
+
+			end := strings.Index(rest, "]")
+
+			if end < 0 {
+				return nil, fmt.Errorf("unclosed [ in path %q", path)
+			}
+
+			index := rest[1:end]
+
+			if index == "*" {
+				steps = append(steps, step{list: true, index: allElements})
+			} else {
+
+				i, convErr := strconv.Atoi(index)
+
+				if convErr != nil || i < 0 {
+					return nil, fmt.Errorf("invalid index %q in path %q", index, path)
+				}
+
+				steps = append(steps, step{list: true, index: i})
+			}
+
+			rest = rest[end+1:]
+
+		case strings.HasPrefix(rest, "."):
+
+			if len(steps) == 0 {
+				return nil, fmt.Errorf("path %q starts with a dot", path)
+			}
+
+			rest = rest[1:]
+
+			fallthrough
+
+		default:
+
+			end := strings.IndexAny(rest, ".[")
+
+			if end < 0 {
+				end = len(rest)
+			}
+
+			if end == 0 {
+				return nil, fmt.Errorf("empty attribute name in path %q", path)
+			}
+
+			steps = append(steps, step{name: rest[:end]})
+
+			rest = rest[end:]
+		}
+	}
+
+	if len(steps) == 0 || steps[0].list {
+		return nil, fmt.Errorf("path %q must start with an attribute name", path)
+	}
+
+	return
+}
+
+// maskFunc replaces a single value
+type maskFunc func(value *dynamodb.AttributeValue) (*dynamodb.AttributeValue, error)
+
+// walk applies mask to every value the steps lead to, reporting if any did
+func walk(value *dynamodb.AttributeValue, steps []step, mask maskFunc) (masked *dynamodb.AttributeValue, touched bool, err error) {
+
+	if value == nil {
+		return value, false, nil
+	}
+
+	if len(steps) == 0 {
+		masked, err = mask(value)
+		return masked, err == nil, err
+	}
+
+	s := steps[0]
+
+	if s.list {
+
+		for i := range value.L {
+
+			if s.index != allElements && s.index != i {
+				continue
+			}
+
+			var elementTouched bool
+
+			if value.L[i], elementTouched, err = walk(value.L[i], steps[1:], mask); err != nil {
+				return value, false, err
+			}
+
+			touched = touched || elementTouched
+		}
+
+		return value, touched, nil
+	}
+
+	names := []string{s.name}
+
+	if s.name == "*" {
+
+		names = names[:0]
+
+		for name := range value.M {
+			names = append(names, name)
+		}
+
+		sort.Strings(names)
+	}
+
+	for _, name := range names {
+
+		member, ok := value.M[name]
+
+		if !ok {
+			continue
+		}
+
+		var memberTouched bool
+
+		if value.M[name], memberTouched, err = walk(member, steps[1:], mask); err != nil {
+			return value, false, err
+		}
+
+		touched = touched || memberTouched
+	}
+
+	return value, touched, nil
+}
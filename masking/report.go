@@ -0,0 +1,66 @@
+package masking
+
+import "github.com/aws/aws-sdk-go/service/dynamodb"
+
+// Report lists the attributes a masking profile touched during a clone
+type Report struct {
+	Profile    string            `json:"profile"`
+	Items      int64             `json:"items"`
+	Strategies map[string]string `json:"strategies"`
+	Attributes map[string]int64  `json:"attributes"`
+}
+
+// Add records the paths masked in a single item
+func (r *Report) Add(touched []string) {
+
+	if len(touched) == 0 {
+		return
+	}
+
+	r.Items++
+
+	for _, path := range touched {
+		r.Attributes[path]++
+	}
+}
+
+// Merge adds the counts of another report
+func (r *Report) Merge(other *Report) {
+
+	if other == nil {
+		return
+	}
+
+	if r.Profile == "" {
+		r.Profile = other.Profile
+	}
+
+	r.Items += other.Items
+
+	for path, strategy := range other.Strategies {
+		r.Strategies[path] = strategy
+	}
+
+	for path, count := range other.Attributes {
+		r.Attributes[path] += count
+	}
+}
+
+// Items masks a batch of items in place, returning a report of the batch
+func (m *Masker) Items(items []map[string]*dynamodb.AttributeValue) (report *Report, err error) {
+
+	report = m.NewReport()
+
+	for _, item := range items {
+
+		touched, maskErr := m.Mask(item)
+
+		if maskErr != nil {
+			return nil, maskErr
+		}
+
+		report.Add(touched)
+	}
+
+	return
+}
@@ -0,0 +1,112 @@
+package schema
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// Document is the table definition stored by the schema exporter.
+//
+// It is a superset of dynamodb.DescribeTableOutput so schema files written
+// before the extra settings were captured still load.
+type Document struct {
+	Table             *dynamodb.TableDescription
+	TimeToLive        *dynamodb.TimeToLiveDescription
+	ContinuousBackups *dynamodb.ContinuousBackupsDescription
+	Tags              []*dynamodb.Tag
+}
+
+// TimeToLiveEnabled reports if the source table expires items
+func (d *Document) TimeToLiveEnabled() bool {
+
+	if d.TimeToLive == nil {
+		return false
+	}
+
+	switch aws.StringValue(d.TimeToLive.TimeToLiveStatus) {
+	case dynamodb.TimeToLiveStatusEnabled, dynamodb.TimeToLiveStatusEnabling:
+		return d.TimeToLive.AttributeName != nil
+	}
+
+	return false
+}
+
+// PointInTimeRecoveryEnabled reports if the source table has continuous backups
+func (d *Document) PointInTimeRecoveryEnabled() bool {
+
+	if d.ContinuousBackups == nil || d.ContinuousBackups.PointInTimeRecoveryDescription == nil {
+		return false
+	}
+
+	status := d.ContinuousBackups.PointInTimeRecoveryDescription.PointInTimeRecoveryStatus
+
+	return aws.StringValue(status) == dynamodb.PointInTimeRecoveryStatusEnabled
+}
+
+// RenameAttributes renames attributes throughout the table definition, for a
+// clone whose items have their key or TTL attributes renamed on the way in
+func (d *Document) RenameAttributes(renames map[string]string) {
+
+	if len(renames) == 0 {
+		return
+	}
+
+	rename := func(name *string) *string {
+		if to, ok := renames[aws.StringValue(name)]; ok {
+			return aws.String(to)
+		}
+		return name
+	}
+
+	renameKeys := func(keys []*dynamodb.KeySchemaElement) {
+		for _, key := range keys {
+			key.AttributeName = rename(key.AttributeName)
+		}
+	}
+
+	renameProjection := func(projection *dynamodb.Projection) {
+		if projection != nil {
+			for i, name := range projection.NonKeyAttributes {
+				projection.NonKeyAttributes[i] = rename(name)
+			}
+		}
+	}
+
+	if d.Table != nil {
+
+		for _, definition := range d.Table.AttributeDefinitions {
+			definition.AttributeName = rename(definition.AttributeName)
+		}
+
+		renameKeys(d.Table.KeySchema)
+
+		for _, index := range d.Table.GlobalSecondaryIndexes {
+			renameKeys(index.KeySchema)
+			renameProjection(index.Projection)
+		}
+
+		for _, index := range d.Table.LocalSecondaryIndexes {
+			renameKeys(index.KeySchema)
+			renameProjection(index.Projection)
+		}
+	}
+
+	if d.TimeToLive != nil {
+		d.TimeToLive.AttributeName = rename(d.TimeToLive.AttributeName)
+	}
+}
+
+// RetypeAttributes changes the type of attribute definitions, for a clone
+// whose key or index attributes are transformed into another scalar type
+func (d *Document) RetypeAttributes(types map[string]string) {
+
+	if d.Table == nil {
+		return
+	}
+
+	for _, definition := range d.Table.AttributeDefinitions {
+		if to, ok := types[aws.StringValue(definition.AttributeName)]; ok {
+			definition.AttributeType = aws.String(to)
+		}
+	}
+}
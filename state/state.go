@@ -1,18 +1,130 @@
 package state
 
-import "github.com/aws/aws-sdk-go/service/dynamodb"
+import (
+	"path"
+
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
 
 // SchemaResult from the Lambda.
 type SchemaResult struct {
-	DurationMS int64 `json:"durationms"`
-	Complete   bool  `json:"complete"`
+	DurationMS int64          `json:"durationms"`
+	Complete   bool           `json:"complete"`
+	RunID      string         `json:"runid"`
+	Mode       string         `json:"mode"`
+	Segments   []ExportConfig `json:"segments"`
+	Verify     []VerifyConfig `json:"verifysegments"`
+	Stream     StreamPosition `json:"stream"`
+}
+
+//
+// StreamPosition is the source table's stream as it stood when the export
+// started, a stream sync applies the writes made from then on
+//
+type StreamPosition struct {
+	Arn       string `json:"arn"`
+	StartedAt int64  `json:"startedat"` // unix milliseconds
+}
+
+//
+// SchemaImportConfig for the table schema import
+//
+type SchemaImportConfig struct {
+	KMSKeyArn   string `json:"kmskeyarn"`
+	ImportTable bool   `json:"importtable"` // create the table with ImportTable from the staged files
+}
+
+//
+// SchemaImportResult from the table creation, an ImportTable import is
+// carried across invocations by the files staged for it and then its arn
+//
+type SchemaImportResult struct {
+	Staged     int    `json:"staged"` // manifest files checked and copied into the import folder
+	ImportArn  string `json:"importarn"`
+	Status     string `json:"status"`
+	Processed  int64  `json:"processed"`
+	Imported   int64  `json:"imported"`
+	Errors     int64  `json:"errors"`
+	DurationMS int64  `json:"durationms"`
+	Complete   bool   `json:"complete"`
 }
 
 //
 // ImportConfig from the batch data import
 //
 type ImportConfig struct {
-	BatchSize int64 `json:"batchsize"`
+	BatchSize  int64          `json:"batchsize"`
+	Transforms []Transform    `json:"transforms"`
+	Masking    MaskingConfig  `json:"masking"`
+	Capacity   CapacityConfig `json:"capacity"` // write capacity spent on the new table
+}
+
+//
+// CapacityConfig caps the capacity units a second spent on a table, as a
+// percentage of its provisioned throughput, outright or the lower of the two.
+// The percentage of an on demand table's reads is taken of the peak it has
+// served over the last day. With a BudgetTable the cap is shared by every
+// invocation working on the table rather than applying to each one.
+//
+type CapacityConfig struct {
+	TargetPercent float64 `json:"targetpercent"`
+	Units         float64 `json:"units"`
+	BudgetTable   string  `json:"budgettable"`
+}
+
+// Enabled reports if the capacity spent is capped
+func (c CapacityConfig) Enabled() bool {
+	return c.TargetPercent > 0 || c.Units > 0
+}
+
+//
+// MaskingConfig is a named masking profile, items are masked before any
+// transforms run. Tokens are keyed by the secret held in SecretArn.
+//
+type MaskingConfig struct {
+	Profile   string     `json:"profile"`
+	SecretArn string     `json:"secretarn"`
+	Rules     []MaskRule `json:"rules"`
+}
+
+// MaskRule masks the values at an attribute path with a strategy
+type MaskRule struct {
+	Path     string `json:"path"`
+	Strategy string `json:"strategy"`
+	Days     int64  `json:"days"`
+}
+
+// Enabled reports if the profile masks anything
+func (c MaskingConfig) Enabled() bool {
+	return len(c.Rules) > 0
+}
+
+//
+// MaskingResult from merging the masking reports of a run
+//
+type MaskingResult struct {
+	Report     string `json:"report"`
+	Profile    string `json:"profile"`
+	Items      int64  `json:"items"`
+	Attributes int64  `json:"attributes"`
+	DurationMS int64  `json:"durationms"`
+	Complete   bool   `json:"complete"`
+}
+
+//
+// Transform is a single step of the item transform pipeline, the fields
+// used depend on the op, Params carries the settings of registered
+// transformers
+//
+type Transform struct {
+	Op          string                   `json:"op"`
+	Attribute   string                   `json:"attribute"`
+	To          string                   `json:"to"`
+	Value       *dynamodb.AttributeValue `json:"value"`
+	Pattern     string                   `json:"pattern"`
+	Replacement string                   `json:"replacement"`
+	Salt        string                   `json:"salt"`
+	Params      map[string]string        `json:"params"`
 }
 
 //
@@ -20,18 +132,58 @@ type ImportConfig struct {
 //
 type ImportResult struct {
 	Processed  int64  `json:"processed"`
+	Offset     int64  `json:"offset"`
 	Records    string `json:"records"`
+	Format     string `json:"format"`
+	Items      int64  `json:"items"`
+	SHA256     string `json:"sha256"`
 	DurationMS int64  `json:"durationms"`
 	Complete   bool   `json:"complete"`
 }
 
+// Export modes, auto is resolved to staged or direct from the table size
+const (
+	ModeAuto   = "auto"   // direct for small tables, staged otherwise
+	ModeStaged = "staged" // pages are staged as data files in S3 and imported
+	ModeDirect = "direct" // pages are written straight into the new table
+
+	// ModePointInTime exports a consistent snapshot of a table with PITR
+	// enabled through ExportTableToPointInTime, the export's files are
+	// imported like staged ones
+	ModePointInTime = "pointintime"
+)
+
 //
 // ExportConfig from the batch data export
 //
 type ExportConfig struct {
-	TotalSegments int64 `json:"totalsegments"`
-	Segment       int64 `json:"segment"`
-	Limit         int64 `json:"limit"`
+	TotalSegments int64  `json:"totalsegments"`
+	Segment       int64  `json:"segment"`
+	Limit         int64  `json:"limit"`
+	Format        string `json:"format"`
+	Compression   string `json:"compression"`
+	Mode          string `json:"mode"`
+	PointInTime   int64  `json:"pointintime"` // unix milliseconds, a point in time export's snapshot
+	Filter        Filter `json:"filter"`
+
+	Capacity       CapacityConfig `json:"capacity"`       // read capacity spent on the source
+	ConsistentRead bool           `json:"consistentread"` // strongly consistent scans, at twice the read capacity
+}
+
+//
+// Filter narrows a clone to the source items matching Expression and the
+// attributes listed in Projection, as passed to the scan
+//
+type Filter struct {
+	Expression string                              `json:"expression"`
+	Projection string                              `json:"projection"`
+	Names      map[string]string                   `json:"names"`
+	Values     map[string]*dynamodb.AttributeValue `json:"values"`
+}
+
+// Subset reports if the filter leaves out any items or attributes
+func (f Filter) Subset() bool {
+	return f.Expression != "" || f.Projection != ""
 }
 
 //
@@ -39,22 +191,156 @@ type ExportConfig struct {
 //
 type ExportResult struct {
 	Processed  int64                               `json:"processed"`
-	Records    []string                            `json:"records"`
+	Manifest   string                              `json:"manifest"`
+	Manifests  []string                            `json:"manifests"`
 	LastKey    map[string]*dynamodb.AttributeValue `json:"lastkey"`
+	ExportArn  string                              `json:"exportarn"`
 	DurationMS int64                               `json:"durationms"`
 	Complete   bool                                `json:"complete"`
 }
 
+//
+// VerifyConfig for the post clone verification
+//
+type VerifyConfig struct {
+	Skip          bool   `json:"skip"`
+	TotalSegments int64  `json:"totalsegments"`
+	Segment       int64  `json:"segment"`
+	Samples       int64  `json:"samples"`
+	Filter        Filter `json:"filter"`
+}
+
+//
+// VerifyResult from the verification of a segment
+//
+type VerifyResult struct {
+	SourceItems   int64    `json:"sourceitems"`
+	DestItems     int64    `json:"destitems"`
+	Missing       int64    `json:"missing"`
+	Extra         int64    `json:"extra"`
+	Differing     int64    `json:"differing"`
+	MissingKeys   []string `json:"missingkeys"`
+	ExtraKeys     []string `json:"extrakeys"`
+	DifferingKeys []string `json:"differingkeys"`
+	Subset        bool     `json:"subset"`
+	Report        string   `json:"report"`
+	DurationMS    int64    `json:"durationms"`
+	Complete      bool     `json:"complete"`
+
+	// resumes the segment, the source is scanned before the new table
+	LastKey  map[string]*dynamodb.AttributeValue `json:"lastkey"`
+	DestScan bool                                `json:"destscan"`
+}
+
+// Diverged reports if the segments of the two tables don't match
+func (r VerifyResult) Diverged() bool {
+	return r.Missing > 0 || r.Extra > 0 || r.Differing > 0
+}
+
+//
+// SyncConfig for keeping the new table in step with its source's stream once
+// the data is in
+//
+type SyncConfig struct {
+	Enabled       bool  `json:"enabled"`
+	MaxLagSeconds int64 `json:"maxlagseconds"`
+}
+
+//
+// SyncResult from a stream sync pass, the counts run across passes
+//
+type SyncResult struct {
+	Checkpoint string `json:"checkpoint"`
+	Records    int64  `json:"records"`
+	Puts       int64  `json:"puts"`
+	Deletes    int64  `json:"deletes"`
+	LagMS      int64  `json:"lagms"`
+	DurationMS int64  `json:"durationms"`
+	Complete   bool   `json:"complete"`
+}
+
+// Retention modes for the staged objects of a run
+const (
+	RetentionKeep  = "keep"  // leave everything in place
+	RetentionPurge = "purge" // remove this run once the clone completes
+	RetentionPrune = "prune" // keep only the newest KeepRuns runs of the table
+)
+
+//
+// RetentionConfig for the staged objects
+//
+type RetentionConfig struct {
+	Mode     string `json:"mode"`
+	KeepRuns int64  `json:"keepruns"`
+}
+
+//
+// CleanupResult from the staged object cleanup
+//
+type CleanupResult struct {
+	Removed    int64    `json:"removed"`
+	Runs       []string `json:"runs"`
+	DurationMS int64    `json:"durationms"`
+	Complete   bool     `json:"complete"`
+}
+
 //
 // Schema for the Exporters
 //
 type Schema struct {
-	Region        string       `json:"region"`
-	Bucket        string       `json:"bucket"`
-	OrigTableName string       `json:"origtable"`
-	NewTableName  string       `json:"newtable"`
-	Import        ImportResult `json:"dataimporter"`
-	Export        ExportResult `json:"dataexporter"`
-	ImportConfig  ImportConfig `json:"dataimporterconfig"`
-	ExportConfig  ExportConfig `json:"dataexporterconfig"`
+	Region        string             `json:"region"`
+	SourceRegion  string             `json:"sourceregion"`
+	DestRegion    string             `json:"destregion"`
+	SourceRoleArn string             `json:"sourcerolearn"`
+	DestRoleArn   string             `json:"destrolearn"`
+	Bucket        string             `json:"bucket"`
+	BucketRegion  string             `json:"bucketregion"`
+	Prefix        string             `json:"prefix"`
+	RunID         string             `json:"runid"`
+	OrigTableName string             `json:"origtable"`
+	NewTableName  string             `json:"newtable"`
+	Import        ImportResult       `json:"dataimporter"`
+	Export        ExportResult       `json:"dataexporter"`
+	ImportConfig  ImportConfig       `json:"dataimporterconfig"`
+	ExportConfig  ExportConfig       `json:"dataexporterconfig"`
+	SchemaConfig  SchemaImportConfig `json:"schemaimporterconfig"`
+	SchemaImport  SchemaImportResult `json:"schemaimporter"`
+	VerifyConfig  VerifyConfig       `json:"verifierconfig"`
+	Verify        VerifyResult       `json:"verifier"`
+	Retention     RetentionConfig    `json:"retention"`
+	Stream        StreamPosition     `json:"stream"`
+	SyncConfig    SyncConfig         `json:"syncconfig"`
+	Sync          SyncResult         `json:"streamsync"`
+}
+
+// SourceTableRegion is the region of the table being cloned, Region unless overridden
+func (s Schema) SourceTableRegion() string {
+	return regionOr(s.SourceRegion, s.Region)
+}
+
+// DestTableRegion is the region of the table being created, Region unless overridden
+func (s Schema) DestTableRegion() string {
+	return regionOr(s.DestRegion, s.Region)
+}
+
+// StagingRegion is the region of the staging bucket, Region unless overridden
+func (s Schema) StagingRegion() string {
+	return regionOr(s.BucketRegion, s.Region)
+}
+
+func regionOr(region string, fallback string) string {
+	if region != "" {
+		return region
+	}
+	return fallback
+}
+
+// TablePrefix is the key prefix holding every run of the source table
+func (s Schema) TablePrefix() string {
+	return path.Join(s.Prefix, s.OrigTableName) + "/"
+}
+
+// Key builds a run scoped object key, <prefix>/<table>/<runid>/<parts>
+func (s Schema) Key(parts ...string) string {
+	return path.Join(append([]string{s.Prefix, s.OrigTableName, s.RunID}, parts...)...)
 }
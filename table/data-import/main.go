@@ -1,313 +1,27 @@
 package main
 
 import (
-	"bufio"
-	"bytes"
 	"context"
-	"encoding/json"
-	"fmt"
-	"math"
 	"os"
 	"time"
 
+	"github.com/NixM0nk3y/dynamodb-clone/clone"
+	"github.com/NixM0nk3y/dynamodb-clone/faults"
 	"github.com/NixM0nk3y/dynamodb-clone/log"
 	"github.com/NixM0nk3y/dynamodb-clone/state"
 	"github.com/aws/aws-lambda-go/lambda"
 	"github.com/aws/aws-lambda-go/lambdacontext"
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/awserr"
-	"github.com/aws/aws-sdk-go/aws/client"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/dynamodb"
-	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
-	"github.com/aws/aws-sdk-go/service/s3"
-	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 	"github.com/aws/aws-xray-sdk-go/xray"
-	"github.com/cenkalti/backoff"
 	"go.uber.org/zap"
 )
 
-// DataWriter is a
-type DataWriter struct {
-	input state.Schema
-	sess  client.ConfigProvider
-	ctx   context.Context
-	err   error
-}
-
-func (dw *DataWriter) getSession() (sess client.ConfigProvider) {
-	logger := log.Logger(dw.ctx)
-
-	if dw.sess != nil {
-		return dw.sess
-	}
-
-	config := &aws.Config{
-		Region:     aws.String(dw.input.Region),
-		MaxRetries: aws.Int(5),
-		Logger:     &log.AWSLogger{},
-		LogLevel:   log.AWSLevel(),
-	}
-
-	// override endpoint supplied
-	if awsEndpoint := os.Getenv("AWS_ENDPOINT"); awsEndpoint != "" {
-		logger.Info(fmt.Sprintf("setting endpoint to %s", awsEndpoint))
-		config.Endpoint = aws.String(awsEndpoint)
-	}
-
-	// override endpoint supplied
-	if awsS3pathstyle := os.Getenv("AWS_S3_FORCEPATHSTYLE"); awsS3pathstyle != "" {
-		logger.Info("setting S3 to pathstyle")
-		config.S3ForcePathStyle = aws.Bool(true)
-	}
-
-	sess, err := session.NewSession(config)
-
-	if err != nil {
-		logger.Panic("unable generate new session", zap.Error(err))
-	}
-
-	// stash the session
-	dw.sess = sess
-
-	return
-}
-
-func (dw *DataWriter) retrieveData(key string) (records []map[string]*dynamodb.AttributeValue, err error) {
-
-	logger := log.Logger(dw.ctx)
-
-	logger.Info(fmt.Sprintf("retrieving data key %s for %s", dw.input.OrigTableName, key))
-
-	fileName := fmt.Sprintf("%s/%s.json", dw.input.OrigTableName, key)
-
-	s3Svc := s3.New(dw.getSession())
-	xray.AWS(s3Svc.Client)
-
-	// Create s3 Client
-	downLoader := s3manager.NewDownloaderWithClient(s3Svc)
-
-	w := &aws.WriteAtBuffer{}
-
-	_, downloadErr := downLoader.DownloadWithContext(dw.ctx, w, &s3.GetObjectInput{
-		Bucket: aws.String(dw.input.Bucket),
-		Key:    aws.String(fileName),
-	})
-
-	if downloadErr != nil {
-		logger.Panic(fmt.Sprintf("unable to download records file %s from s3://%s", fileName, dw.input.Bucket), zap.Error(downloadErr))
-	}
-
-	logger.Info(fmt.Sprintf("successfully retrieved records file %s from s3://%s", fileName, dw.input.Bucket))
-
-	s := bufio.NewScanner(bytes.NewReader(w.Bytes()))
-
-	for s.Scan() {
-		var item map[string]interface{}
-		if errJSON := json.Unmarshal(s.Bytes(), &item); errJSON != nil {
-			logger.Panic("unable unmarshal record from JSON", zap.Error(errJSON))
-		}
-		av, attributeErr := dynamodbattribute.MarshalMap(item)
-		if attributeErr != nil {
-			logger.Panic("failed to dynamodb marshal record", zap.Error(attributeErr))
-		}
-
-		records = append(records, av)
-	}
-
-	if scanErr := s.Err(); scanErr != nil {
-		logger.Panic("unable unmarshal JSON records from datafile", zap.Error(scanErr))
-	}
-
-	return
-}
-
-// dynamodbScan
-func (dw *DataWriter) dynamodbImport() (output state.ImportResult, err error) {
-
-	logger := log.Logger(dw.ctx)
-
-	// https://docs.aws.amazon.com/lambda/latest/dg/golang-context.html
-	deadline, _ := dw.ctx.Deadline()
-	deadline = deadline.Add(-2500 * time.Millisecond) // dynamoDB retries take a while to return
-	timeoutChannel := time.After(time.Until(deadline))
-
-	// Create DynamoDB client
-	svc := dynamodb.New(dw.getSession())
-
-	xray.AWS(svc.Client)
-
-	expbo := backoff.NewExponentialBackOff()
-	expbo.MaxInterval = 1500 * time.Millisecond
-	boff := backoff.WithContext(expbo, dw.ctx)
-
-	logger.Info(fmt.Sprintf("importing data into table %s", dw.input.NewTableName))
-
-	output.Records = dw.input.Import.Records
-
-	data, retrieveErr := dw.retrieveData(output.Records)
-
-	if retrieveErr != nil {
-		logger.Panic("error retrieving data", zap.Error(retrieveErr))
-	}
-
-	logger.Info(fmt.Sprintf("successfully retrieved %d records from %s", len(data), output.Records))
-
-	//
-	output.Processed = dw.input.Import.Processed
-
-	logger.Info(fmt.Sprintf("starting processing from record %d", dw.input.Import.Processed))
-
-	// write status tracking
-	ticker := time.NewTicker(5000 * time.Millisecond)
-	lastTick := time.Now()
-	lastProcesed := output.Processed
-
-	// batch loop through the data
-nextbatch:
-	for start := output.Processed; start < int64(len(data)); start += dw.input.ImportConfig.BatchSize {
-
-		// end of current batch
-		end := start + int64(dw.input.ImportConfig.BatchSize)
-
-		// end of slice
-		if end > int64(len(data)) {
-			end = int64(len(data))
-		}
-
-		records := data[start:end]
-
-		// build our write request
-		writeRequests := make([]*dynamodb.WriteRequest, len(records))
-		for i := 0; i < len(records); i++ {
-			writeRequests[i] = &dynamodb.WriteRequest{
-				PutRequest: &dynamodb.PutRequest{
-					Item: records[i],
-				},
-			}
-		}
-
-		var writeSize int64 = 0
-
-		// write retry loop
-		for {
-			select {
-
-			case t := <-ticker.C:
-
-				tickPeriod := t.Sub(lastTick).Milliseconds()
-
-				// records processed this tick
-				tickProcessed := output.Processed - lastProcesed
-
-				// round to two decimal places
-				rate := math.Round((float64(tickProcessed)/(float64(tickPeriod)/1000))*100) / 100
-
-				logger.Info("processing writes", zap.Int64("items", output.Processed),
-					zap.Float64("rate", rate),
-					zap.Int64("processed", tickProcessed))
-
-				lastProcesed = output.Processed
-				lastTick = t
-
-			case <-timeoutChannel:
-
-				totalWrites := output.Processed - dw.input.Import.Processed
-
-				logger.Warn("data import lambda duration expired", zap.Int64("writes", totalWrites))
-				// close down ticker and exit
-				ticker.Stop()
-				return
-
-			default:
-
-				writestart := time.Now()
-
-				result, writeErr := svc.BatchWriteItemWithContext(dw.ctx, &dynamodb.BatchWriteItemInput{
-					RequestItems: map[string][]*dynamodb.WriteRequest{
-						dw.input.NewTableName: writeRequests,
-					},
-				})
-
-				if writeErr != nil {
-					if awsErr, ok := writeErr.(awserr.Error); ok {
-						// process SDK error
-						switch awsErr.Code() {
-						case dynamodb.ErrCodeProvisionedThroughputExceededException, dynamodb.ErrCodeRequestLimitExceeded, "ThrottlingException":
-
-							logger.Warn("thoughput error backing off", zap.Int64("itemcount", output.Processed), zap.Error(writeErr))
-
-							// need to sleep when re-requesting, per spec
-							if err := aws.SleepWithContext(dw.ctx, boff.NextBackOff()); err != nil {
-								logger.Panic("timed out", zap.Error(err))
-							}
-						default:
-							logger.Panic("unknown dynamodb error", zap.Error(writeErr))
-						}
-
-					} else {
-						logger.Panic("unknown error", zap.Error(writeErr))
-					}
-				}
-
-				unprocessedWrites := result.UnprocessedItems[dw.input.NewTableName]
-
-				writeSize += int64(len(writeRequests) - len(unprocessedWrites))
-
-				if len(unprocessedWrites) == 0 {
-
-					logger.Debug("write completed",
-						zap.Int64("writetime", time.Now().Sub(writestart).Milliseconds()),
-						zap.Int("items", len(records)),
-					)
-
-					// reset backoff
-					boff.Reset()
-
-					// add to tally
-					output.Processed += writeSize
-
-					// onto next batch
-					continue nextbatch
-
-				} else {
-
-					logger.Debug("partial write detected",
-						zap.Int64("writetime", time.Now().Sub(writestart).Milliseconds()),
-						zap.Int("items", len(records)),
-						zap.Int("unprocessed", len(unprocessedWrites)))
-
-					// process any remaining writes first
-					// ( will be a short write i.e. less then the 25 items we *could* do)
-					writeRequests = unprocessedWrites
-
-				}
-
-			}
-
-		}
-	}
-
-	ticker.Stop()
-
-	logger.Info("record import complete", zap.String("record", output.Records), zap.Int64("count", output.Processed))
-
-	output.Complete = true
-
-	return
-}
-
-// Run executes a batch batch.
-func (dw *DataWriter) Run() (output state.ImportResult, err error) {
-	return dw.dynamodbImport()
-}
-
 // Handler is foo
 func Handler(ctx context.Context, input state.Schema) (output state.ImportResult, err error) {
 
 	lc, _ := lambdacontext.FromContext(ctx)
 
-	rqCtx := log.WithRqID(ctx, lc.AwsRequestID)
+	// FAULT_DEADLINE cuts the invocation short to exercise its resume
+	rqCtx := faults.WithDeadline(log.WithRqID(ctx, lc.AwsRequestID), faults.FromEnv().Deadline)
 
 	logger := log.Logger(rqCtx).With(zap.String("sourceRegion", input.Region),
 		zap.String("sourceBucket", input.Bucket),
@@ -323,29 +37,25 @@ func Handler(ctx context.Context, input state.Schema) (output state.ImportResult
 
 	logger.Info("dyanmodb data export handler")
 
-	// default to a 25 items write (max allowed)
-	// https://docs.aws.amazon.com/amazondynamodb/latest/APIReference/API_BatchWriteItem.html
-	//
-	if input.ImportConfig.BatchSize < 1 {
-		input.ImportConfig.BatchSize = 25
+	// capped imports share the stack's budget unless the input names another
+	if capacity := &input.ImportConfig.Capacity; capacity.Enabled() && capacity.BudgetTable == "" {
+		capacity.BudgetTable = os.Getenv("CAPACITY_BUDGET_TABLE")
 	}
 
-	// check for unconfigured state
-	if input.Import.Records == "" {
-		logger.Panic("no data record passed to process")
+	writer, err := clone.NewDataWriter(rqCtx, input)
+
+	if err != nil {
+		logger.Error("invalid configuration", zap.Error(err))
+		return
 	}
 
 	start := time.Now()
 
-	writer := DataWriter{
-		input: input,
-		ctx:   rqCtx,
-	}
-
 	output, err = writer.Run()
 
 	if err != nil {
-		logger.Panic("full scan failed", zap.Error(err))
+		logger.Error("data import failed", zap.Error(err))
+		return
 	}
 
 	output.DurationMS = time.Now().Sub(start).Milliseconds()
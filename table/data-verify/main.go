@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"os"
+	"time"
+
+	"github.com/NixM0nk3y/dynamodb-clone/clone"
+	"github.com/NixM0nk3y/dynamodb-clone/log"
+	"github.com/NixM0nk3y/dynamodb-clone/state"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-lambda-go/lambdacontext"
+	"github.com/aws/aws-xray-sdk-go/xray"
+	"go.uber.org/zap"
+)
+
+// Handler is foo
+func Handler(ctx context.Context, input state.Schema) (output state.VerifyResult, err error) {
+
+	lc, _ := lambdacontext.FromContext(ctx)
+
+	rqCtx := log.WithRqID(ctx, lc.AwsRequestID)
+
+	logger := log.Logger(rqCtx).With(zap.String("region", input.Region),
+		zap.String("bucket", input.Bucket),
+		zap.String("stable", input.OrigTableName),
+		zap.String("dtable", input.NewTableName),
+	)
+
+	xray.SetLogger(&log.XrayLogger{})
+
+	xray.Configure(xray.Config{
+		LogLevel:       "info", // default
+		ServiceVersion: "1.2.3",
+	})
+
+	logger.Info("dynamodb data verify")
+
+	// capped reads of the source share the stack's budget unless the input names another
+	if capacity := &input.ExportConfig.Capacity; capacity.Enabled() && capacity.BudgetTable == "" {
+		capacity.BudgetTable = os.Getenv("CAPACITY_BUDGET_TABLE")
+	}
+
+	verifier, err := clone.NewVerifier(rqCtx, input)
+
+	if err != nil {
+		logger.Error("invalid configuration", zap.Error(err))
+		return
+	}
+
+	start := time.Now()
+
+	output, err = verifier.Run()
+
+	if err != nil {
+		logger.Error("verification failed", zap.Error(err))
+		return
+	}
+
+	output.DurationMS = time.Now().Sub(start).Milliseconds()
+
+	logger.Info("complete", zap.Int64("duration", output.DurationMS), zap.Int64("source", output.SourceItems), zap.Int64("dest", output.DestItems))
+
+	return
+
+}
+
+func main() {
+	lambda.Start(Handler)
+}
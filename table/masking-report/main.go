@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/NixM0nk3y/dynamodb-clone/clone"
+	"github.com/NixM0nk3y/dynamodb-clone/log"
+	"github.com/NixM0nk3y/dynamodb-clone/state"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-lambda-go/lambdacontext"
+	"github.com/aws/aws-xray-sdk-go/xray"
+	"go.uber.org/zap"
+)
+
+// Handler is foo
+func Handler(ctx context.Context, input state.Schema) (output state.MaskingResult, err error) {
+
+	lc, _ := lambdacontext.FromContext(ctx)
+
+	rqCtx := log.WithRqID(ctx, lc.AwsRequestID)
+
+	logger := log.Logger(rqCtx).With(zap.String("region", input.Region),
+		zap.String("bucket", input.Bucket),
+		zap.String("table", input.OrigTableName),
+		zap.String("runid", input.RunID),
+	)
+
+	xray.SetLogger(&log.XrayLogger{})
+
+	xray.Configure(xray.Config{
+		LogLevel:       "info", // default
+		ServiceVersion: "1.2.3",
+	})
+
+	logger.Info("dynamodb masking report")
+
+	reporter, err := clone.NewMaskingReporter(rqCtx, input)
+
+	if err != nil {
+		logger.Error("invalid configuration", zap.Error(err))
+		return
+	}
+
+	start := time.Now()
+
+	output, err = reporter.Run()
+
+	if err != nil {
+		logger.Error("masking report failed", zap.Error(err))
+		return
+	}
+
+	output.DurationMS = time.Now().Sub(start).Milliseconds()
+
+	logger.Info("complete", zap.Int64("duration", output.DurationMS), zap.Int64("items", output.Items), zap.Int64("attributes", output.Attributes))
+
+	return
+
+}
+
+func main() {
+	lambda.Start(Handler)
+}
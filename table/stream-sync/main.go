@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/NixM0nk3y/dynamodb-clone/clone"
+	"github.com/NixM0nk3y/dynamodb-clone/log"
+	"github.com/NixM0nk3y/dynamodb-clone/state"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-lambda-go/lambdacontext"
+	"github.com/aws/aws-xray-sdk-go/xray"
+	"go.uber.org/zap"
+)
+
+// Handler is foo
+func Handler(ctx context.Context, input state.Schema) (output state.SyncResult, err error) {
+
+	lc, _ := lambdacontext.FromContext(ctx)
+
+	rqCtx := log.WithRqID(ctx, lc.AwsRequestID)
+
+	logger := log.Logger(rqCtx).With(zap.String("region", input.Region),
+		zap.String("bucket", input.Bucket),
+		zap.String("stable", input.OrigTableName),
+		zap.String("stream", input.Stream.Arn),
+		zap.String("dtable", input.NewTableName),
+	)
+
+	xray.SetLogger(&log.XrayLogger{})
+
+	xray.Configure(xray.Config{
+		LogLevel:       "info", // default
+		ServiceVersion: "1.2.3",
+	})
+
+	logger.Info("dynamodb stream sync")
+
+	syncer, err := clone.NewStreamSyncer(rqCtx, input)
+
+	if err != nil {
+		logger.Error("invalid configuration", zap.Error(err))
+		return
+	}
+
+	start := time.Now()
+
+	output, err = syncer.Run()
+
+	if err != nil {
+		logger.Error("stream sync failed", zap.Error(err))
+		return
+	}
+
+	output.DurationMS = time.Now().Sub(start).Milliseconds()
+
+	logger.Info("complete", zap.Int64("duration", output.DurationMS), zap.Int64("records", output.Records), zap.Int64("lag", output.LagMS))
+
+	return
+
+}
+
+func main() {
+	lambda.Start(Handler)
+}
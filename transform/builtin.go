@@ -0,0 +1,205 @@
+package transform
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"regexp"
+
+	"github.com/NixM0nk3y/dynamodb-clone/itemhash"
+	"github.com/NixM0nk3y/dynamodb-clone/state"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// built in ops
+const (
+	OpDrop   = "drop"   // remove attribute
+	OpRename = "rename" // move attribute to to
+	OpSet    = "set"    // set attribute to the constant value
+	OpHash   = "hash"   // replace attribute with the salted SHA-256 of its value
+	OpMask   = "mask"   // replace matches of pattern in a string attribute with replacement
+	OpCopy   = "copy"   // copy attribute to to
+)
+
+func init() {
+	Register(OpDrop, newDrop)
+	Register(OpRename, newRename)
+	Register(OpSet, newSet)
+	Register(OpHash, newHash)
+	Register(OpMask, newMask)
+	Register(OpCopy, newCopy)
+}
+
+var (
+	errNoAttribute = errors.New("no attribute")
+	errNoTarget    = errors.New("no target attribute")
+)
+
+func newDrop(config state.Transform) (Transformer, error) {
+
+	if config.Attribute == "" {
+		return nil, errNoAttribute
+	}
+
+	return Func(func(item map[string]*dynamodb.AttributeValue) (map[string]*dynamodb.AttributeValue, error) {
+		delete(item, config.Attribute)
+		return item, nil
+	}), nil
+}
+
+func newRename(config state.Transform) (Transformer, error) {
+
+	if config.Attribute == "" {
+		return nil, errNoAttribute
+	}
+
+	if config.To == "" {
+		return nil, errNoTarget
+	}
+
+	return Func(func(item map[string]*dynamodb.AttributeValue) (map[string]*dynamodb.AttributeValue, error) {
+
+		if value, ok := item[config.Attribute]; ok {
+			delete(item, config.Attribute)
+			item[config.To] = value
+		}
+
+		return item, nil
+	}), nil
+}
+
+func newSet(config state.Transform) (Transformer, error) {
+
+	if config.Attribute == "" {
+		return nil, errNoAttribute
+	}
+
+	if config.Value == nil {
+		return nil, errors.New("no value")
+	}
+
+	return Func(func(item map[string]*dynamodb.AttributeValue) (map[string]*dynamodb.AttributeValue, error) {
+		item[config.Attribute] = config.Value
+		return item, nil
+	}), nil
+}
+
+func newHash(config state.Transform) (Transformer, error) {
+
+	if config.Attribute == "" {
+		return nil, errNoAttribute
+	}
+
+	return Func(func(item map[string]*dynamodb.AttributeValue) (map[string]*dynamodb.AttributeValue, error) {
+
+		if value, ok := item[config.Attribute]; ok {
+			item[config.Attribute] = &dynamodb.AttributeValue{S: aws.String(hashValue(config.Salt, value))}
+		}
+
+		return item, nil
+	}), nil
+}
+
+// hashValue sums a scalar's text, so the same id hashes alike whether it's
+// stored as a string or a number, and anything else in its canonical form
+func hashValue(salt string, value *dynamodb.AttributeValue) string {
+
+	h := sha256.New()
+
+	h.Write([]byte(salt))
+
+	switch {
+	case value.S != nil:
+		h.Write([]byte(*value.S))
+	case value.N != nil:
+		h.Write([]byte(*value.N))
+	case value.B != nil:
+		h.Write(value.B)
+	default:
+		sum := itemhash.Item(map[string]*dynamodb.AttributeValue{"": value})
+		h.Write(sum[:])
+	}
+
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func newMask(config state.Transform) (Transformer, error) {
+
+	if config.Attribute == "" {
+		return nil, errNoAttribute
+	}
+
+	if config.Pattern == "" {
+		return nil, errors.New("no pattern")
+	}
+
+	pattern, err := regexp.Compile(config.Pattern)
+
+	if err != nil {
+		return nil, fmt.Errorf("invalid pattern: %w", err)
+	}
+
+	return Func(func(item map[string]*dynamodb.AttributeValue) (map[string]*dynamodb.AttributeValue, error) {
+
+		value, ok := item[config.Attribute]
+
+		// only strings and string sets are masked
+		switch {
+		case !ok:
+		case value.S != nil:
+			item[config.Attribute] = &dynamodb.AttributeValue{S: aws.String(pattern.ReplaceAllString(*value.S, config.Replacement))}
+		case value.SS != nil:
+
+			members := make([]*string, len(value.SS))
+
+			for i, member := range value.SS {
+				members[i] = aws.String(pattern.ReplaceAllString(aws.StringValue(member), config.Replacement))
+			}
+
+			item[config.Attribute] = &dynamodb.AttributeValue{SS: dedupe(members)}
+		}
+
+		return item, nil
+	}), nil
+}
+
+// dedupe drops repeated members, masking can map two members onto one and a
+// set can't hold both
+func dedupe(members []*string) (unique []*string) {
+
+	seen := map[string]bool{}
+
+	for _, member := range members {
+
+		if seen[*member] {
+			continue
+		}
+
+		seen[*member] = true
+		unique = append(unique, member)
+	}
+
+	return
+}
+
+func newCopy(config state.Transform) (Transformer, error) {
+
+	if config.Attribute == "" {
+		return nil, errNoAttribute
+	}
+
+	if config.To == "" {
+		return nil, errNoTarget
+	}
+
+	return Func(func(item map[string]*dynamodb.AttributeValue) (map[string]*dynamodb.AttributeValue, error) {
+
+		if value, ok := item[config.Attribute]; ok {
+			item[config.To] = value
+		}
+
+		return item, nil
+	}), nil
+}
@@ -0,0 +1,206 @@
+package transform
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/NixM0nk3y/dynamodb-clone/state"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+//
+// Transformers rewrite each item on its way into the new table, the built in
+// operations are registered below and teams can register their own under a
+// new op name before the clone runs
+//
+
+// Transformer rewrites a single item, it may change the item in place and
+// must always return an item
+type Transformer interface {
+	Transform(item map[string]*dynamodb.AttributeValue) (map[string]*dynamodb.AttributeValue, error)
+}
+
+// Func adapts a plain function to a Transformer
+type Func func(item map[string]*dynamodb.AttributeValue) (map[string]*dynamodb.AttributeValue, error)
+
+// Transform calls f
+func (f Func) Transform(item map[string]*dynamodb.AttributeValue) (map[string]*dynamodb.AttributeValue, error) {
+	return f(item)
+}
+
+// Factory builds a transformer from its configuration in the state input
+type Factory func(config state.Transform) (Transformer, error)
+
+var (
+	registryMu sync.RWMutex
+	registry   = map[string]Factory{}
+)
+
+// Register makes a transformer available under an op name, registering the
+// same name twice panics
+func Register(op string, factory Factory) {
+
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	if factory == nil {
+		panic("transform: register of nil factory for " + op)
+	}
+
+	if _, exists := registry[op]; exists {
+		panic("transform: register called twice for " + op)
+	}
+
+	registry[op] = factory
+}
+
+// Ops returns the registered op names
+func Ops() (ops []string) {
+
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+
+	for op := range registry {
+		ops = append(ops, op)
+	}
+
+	sort.Strings(ops)
+
+	return
+}
+
+// Pipeline applies transformers in the order they were configured
+type Pipeline struct {
+	steps []Transformer
+}
+
+// New builds a pipeline from its configuration, an empty configuration leaves
+// items untouched
+func New(configs []state.Transform) (*Pipeline, error) {
+
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+
+	pipeline := &Pipeline{}
+
+	for i, config := range configs {
+
+		factory, ok := registry[config.Op]
+
+		if !ok {
+			return nil, fmt.Errorf("transform %d: unknown op %q", i, config.Op)
+		}
+
+		step, err := factory(config)
+
+		if err != nil {
+			return nil, fmt.Errorf("transform %d (%s): %w", i, config.Op, err)
+		}
+
+		pipeline.steps = append(pipeline.steps, step)
+	}
+
+	return pipeline, nil
+}
+
+// Empty reports if the pipeline has nothing to do
+func (p *Pipeline) Empty() bool {
+	return p == nil || len(p.steps) == 0
+}
+
+// Transform runs an item through every step of the pipeline
+func (p *Pipeline) Transform(item map[string]*dynamodb.AttributeValue) (map[string]*dynamodb.AttributeValue, error) {
+
+	if p == nil {
+		return item, nil
+	}
+
+	for _, step := range p.steps {
+
+		var err error
+
+		if item, err = step.Transform(item); err != nil {
+			return nil, err
+		}
+
+		if item == nil {
+			return nil, fmt.Errorf("transformer %T returned no item", step)
+		}
+	}
+
+	return item, nil
+}
+
+// Items transforms a batch of items in place
+func (p *Pipeline) Items(items []map[string]*dynamodb.AttributeValue) (err error) {
+
+	if p.Empty() {
+		return
+	}
+
+	for i := range items {
+		if items[i], err = p.Transform(items[i]); err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+// Renames returns the attributes renamed by the configuration, mapping the
+// source name onto the name it ends up with
+func Renames(configs []state.Transform) map[string]string {
+
+	renames := map[string]string{}
+
+	for _, config := range configs {
+
+		if config.Op != OpRename {
+			continue
+		}
+
+		// follow a chain of renames back to the source attribute
+		from := config.Attribute
+
+		for source, to := range renames {
+			if to == from {
+				from = source
+			}
+		}
+
+		renames[from] = config.To
+	}
+
+	return renames
+}
+
+// Retypes returns the scalar type the configuration leaves attributes with
+// where it differs from the source, keyed by the name they end up with; a
+// hashed key or index attribute needs its definition to follow
+func Retypes(configs []state.Transform) map[string]string {
+
+	types := map[string]string{}
+
+	for _, config := range configs {
+
+		switch config.Op {
+		case OpHash:
+			types[config.Attribute] = dynamodb.ScalarAttributeTypeS
+		case OpDrop:
+			delete(types, config.Attribute)
+		case OpRename, OpCopy:
+			if t, ok := types[config.Attribute]; ok {
+				types[config.To] = t
+			} else {
+				delete(types, config.To)
+			}
+
+			if config.Op == OpRename {
+				delete(types, config.Attribute)
+			}
+		}
+	}
+
+	return types
+}
@@ -0,0 +1,246 @@
+package transform_test
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"reflect"
+	"testing"
+
+	"github.com/NixM0nk3y/dynamodb-clone/state"
+	"github.com/NixM0nk3y/dynamodb-clone/transform"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// hashed is the hash op's output for a scalar's text
+func hashed(salt string, text string) *dynamodb.AttributeValue {
+	sum := sha256.Sum256([]byte(salt + text))
+	return &dynamodb.AttributeValue{S: aws.String(hex.EncodeToString(sum[:]))}
+}
+
+func s(value string) *dynamodb.AttributeValue {
+	return &dynamodb.AttributeValue{S: aws.String(value)}
+}
+
+func n(value string) *dynamodb.AttributeValue {
+	return &dynamodb.AttributeValue{N: aws.String(value)}
+}
+
+func TestPipeline(t *testing.T) {
+
+	tests := []struct {
+		name       string
+		transforms []state.Transform
+		item       map[string]*dynamodb.AttributeValue
+		expected   map[string]*dynamodb.AttributeValue
+	}{
+		{
+			name:     "empty",
+			item:     map[string]*dynamodb.AttributeValue{"id": n("1")},
+			expected: map[string]*dynamodb.AttributeValue{"id": n("1")},
+		},
+		{
+			name:       "drop",
+			transforms: []state.Transform{{Op: "drop", Attribute: "ssn"}, {Op: "drop", Attribute: "missing"}},
+			item:       map[string]*dynamodb.AttributeValue{"id": n("1"), "ssn": s("123-45-6789")},
+			expected:   map[string]*dynamodb.AttributeValue{"id": n("1")},
+		},
+		{
+			name:       "rename",
+			transforms: []state.Transform{{Op: "rename", Attribute: "pk", To: "id"}, {Op: "rename", Attribute: "missing", To: "other"}},
+			item:       map[string]*dynamodb.AttributeValue{"pk": n("1")},
+			expected:   map[string]*dynamodb.AttributeValue{"id": n("1")},
+		},
+		{
+			name:       "set",
+			transforms: []state.Transform{{Op: "set", Attribute: "env", Value: s("test")}},
+			item:       map[string]*dynamodb.AttributeValue{"id": n("1"), "env": s("prod")},
+			expected:   map[string]*dynamodb.AttributeValue{"id": n("1"), "env": s("test")},
+		},
+		{
+			name: "hash",
+			transforms: []state.Transform{
+				{Op: "hash", Attribute: "user", Salt: "pepper"},
+				{Op: "hash", Attribute: "account", Salt: "pepper"},
+				{Op: "hash", Attribute: "blob", Salt: "pepper"},
+			},
+			item: map[string]*dynamodb.AttributeValue{
+				"user":    s("42"),
+				"account": n("42"),
+				"blob":    {B: []byte("42")},
+			},
+			// the same id hashes alike whatever its type
+			expected: map[string]*dynamodb.AttributeValue{
+				"user":    hashed("pepper", "42"),
+				"account": hashed("pepper", "42"),
+				"blob":    hashed("pepper", "42"),
+			},
+		},
+		{
+			name:       "salted hash",
+			transforms: []state.Transform{{Op: "hash", Attribute: "user", Salt: "salt"}},
+			item:       map[string]*dynamodb.AttributeValue{"user": s("42")},
+			expected:   map[string]*dynamodb.AttributeValue{"user": hashed("salt", "42")},
+		},
+		{
+			name: "mask",
+			transforms: []state.Transform{
+				{Op: "mask", Attribute: "email", Pattern: "^[^@]+", Replacement: "user"},
+				{Op: "mask", Attribute: "aliases", Pattern: "^[^@]+", Replacement: "user"},
+				{Op: "mask", Attribute: "age", Pattern: "[0-9]", Replacement: "0"},
+			},
+			item: map[string]*dynamodb.AttributeValue{
+				"email":   s("jane@example.com"),
+				"aliases": {SS: aws.StringSlice([]string{"jane@example.com", "j.doe@example.com", "jd@example.org"})},
+				"age":     n("42"),
+			},
+			// set members masked alike collapse into one, numbers are left alone
+			expected: map[string]*dynamodb.AttributeValue{
+				"email":   s("user@example.com"),
+				"aliases": {SS: aws.StringSlice([]string{"user@example.com", "user@example.org"})},
+				"age":     n("42"),
+			},
+		},
+		{
+			name:       "copy",
+			transforms: []state.Transform{{Op: "copy", Attribute: "id", To: "legacyid"}},
+			item:       map[string]*dynamodb.AttributeValue{"id": n("1")},
+			expected:   map[string]*dynamodb.AttributeValue{"id": n("1"), "legacyid": n("1")},
+		},
+		{
+			name: "in order",
+			transforms: []state.Transform{
+				{Op: "copy", Attribute: "id", To: "legacyid"},
+				{Op: "hash", Attribute: "id", Salt: "pepper"},
+				{Op: "rename", Attribute: "id", To: "pk"},
+			},
+			item:     map[string]*dynamodb.AttributeValue{"id": n("7")},
+			expected: map[string]*dynamodb.AttributeValue{"pk": hashed("pepper", "7"), "legacyid": n("7")},
+		},
+	}
+
+	for _, test := range tests {
+
+		test := test
+
+		t.Run(test.name, func(t *testing.T) {
+
+			pipeline, err := transform.New(test.transforms)
+
+			if err != nil {
+				t.Fatalf("invalid pipeline: %v", err)
+			}
+
+			if pipeline.Empty() != (len(test.transforms) == 0) {
+				t.Errorf("pipeline of %d transforms reports empty %t", len(test.transforms), pipeline.Empty())
+			}
+
+			item, err := pipeline.Transform(test.item)
+
+			if err != nil {
+				t.Fatalf("unable to transform: %v", err)
+			}
+
+			if !reflect.DeepEqual(item, test.expected) {
+				t.Errorf("transformed to %v, expected %v", item, test.expected)
+			}
+		})
+	}
+}
+
+func TestNewInvalid(t *testing.T) {
+
+	tests := []struct {
+		name      string
+		transform state.Transform
+	}{
+		{name: "unknown op", transform: state.Transform{Op: "encrypt", Attribute: "id"}},
+		{name: "drop without attribute", transform: state.Transform{Op: "drop"}},
+		{name: "rename without target", transform: state.Transform{Op: "rename", Attribute: "id"}},
+		{name: "copy without target", transform: state.Transform{Op: "copy", Attribute: "id"}},
+		{name: "set without value", transform: state.Transform{Op: "set", Attribute: "env"}},
+		{name: "hash without attribute", transform: state.Transform{Op: "hash", Salt: "pepper"}},
+		{name: "mask without pattern", transform: state.Transform{Op: "mask", Attribute: "email"}},
+		{name: "mask with invalid pattern", transform: state.Transform{Op: "mask", Attribute: "email", Pattern: "("}},
+	}
+
+	for _, test := range tests {
+
+		test := test
+
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := transform.New([]state.Transform{test.transform}); err == nil {
+				t.Errorf("built a pipeline from %+v", test.transform)
+			}
+		})
+	}
+}
+
+func TestSchemaChanges(t *testing.T) {
+
+	tests := []struct {
+		name       string
+		transforms []state.Transform
+		renames    map[string]string
+		retypes    map[string]string
+	}{
+		{
+			name:       "none",
+			transforms: []state.Transform{{Op: "drop", Attribute: "ssn"}},
+			renames:    map[string]string{},
+			retypes:    map[string]string{},
+		},
+		{
+			name:       "chained renames",
+			transforms: []state.Transform{{Op: "rename", Attribute: "a", To: "b"}, {Op: "rename", Attribute: "b", To: "c"}},
+			renames:    map[string]string{"a": "c"},
+			retypes:    map[string]string{},
+		},
+		{
+			name:       "hash then rename",
+			transforms: []state.Transform{{Op: "hash", Attribute: "pk"}, {Op: "rename", Attribute: "pk", To: "id"}},
+			renames:    map[string]string{"pk": "id"},
+			retypes:    map[string]string{"id": dynamodb.ScalarAttributeTypeS},
+		},
+		{
+			name:       "rename then hash",
+			transforms: []state.Transform{{Op: "rename", Attribute: "pk", To: "id"}, {Op: "hash", Attribute: "id"}},
+			renames:    map[string]string{"pk": "id"},
+			retypes:    map[string]string{"id": dynamodb.ScalarAttributeTypeS},
+		},
+		{
+			name:       "hash copied",
+			transforms: []state.Transform{{Op: "hash", Attribute: "pk"}, {Op: "copy", Attribute: "pk", To: "gsi"}},
+			renames:    map[string]string{},
+			retypes:    map[string]string{"pk": dynamodb.ScalarAttributeTypeS, "gsi": dynamodb.ScalarAttributeTypeS},
+		},
+		{
+			name:       "hash dropped",
+			transforms: []state.Transform{{Op: "hash", Attribute: "pk"}, {Op: "drop", Attribute: "pk"}},
+			renames:    map[string]string{},
+			retypes:    map[string]string{},
+		},
+		{
+			name:       "hash overwritten",
+			transforms: []state.Transform{{Op: "hash", Attribute: "gsi"}, {Op: "copy", Attribute: "pk", To: "gsi"}},
+			renames:    map[string]string{},
+			retypes:    map[string]string{},
+		},
+	}
+
+	for _, test := range tests {
+
+		test := test
+
+		t.Run(test.name, func(t *testing.T) {
+
+			if renames := transform.Renames(test.transforms); !reflect.DeepEqual(renames, test.renames) {
+				t.Errorf("renames %v, expected %v", renames, test.renames)
+			}
+
+			if retypes := transform.Retypes(test.transforms); !reflect.DeepEqual(retypes, test.retypes) {
+				t.Errorf("retypes %v, expected %v", retypes, test.retypes)
+			}
+		})
+	}
+}